@@ -60,16 +60,29 @@ pub fn build(b: *std.Build) void {
         "src/utils/logging.c",
         "src/utils/memory.c",
         "src/utils/colors.c",
+        "src/utils/sha256.c",
+        "src/utils/state.c",
         "src/io/input.c",
         "src/io/output.c",
+        "src/io/spool.c",
+        "src/io/exec.c",
+        "src/io/sandbox.c",
+        "src/io/sideeffect.c",
         "src/cli/help.c",
         "src/cli/args.c",
         "src/cli/init.c",
+        "src/cli/install.c",
         "src/protocol/json.c",
         "src/protocol/cloudevents.c",
         "src/protocol/validation.c",
+        "src/protocol/identity.c",
         "src/network/http.c",
         "src/network/retry.c",
+        "src/network/budget.c",
+        "src/network/safestart.c",
+        "src/network/failcache.c",
+        "src/network/fanout.c",
+        "src/network/srv.c",
     };
 
     for (c_sources) |src| {
@@ -92,6 +105,8 @@ pub fn build(b: *std.Build) void {
 
     exe.linkLibrary(yyjson);
     exe.linkSystemLibrary("curl");
+    exe.linkSystemLibrary("z");
+    exe.linkSystemLibrary("resolv");
     exe.linkLibC();
     b.installArtifact(exe);
 
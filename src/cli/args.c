@@ -12,16 +12,21 @@
 #include "../utils/logging.h"
 #include "help.h"
 #include "init.h"
+#include "install.h"
 
 cchd_error cchd_parse_args(int argc, char *argv[], cchd_config_t *config) {
   CHECK_NULL(argv, CCHD_ERROR_INVALID_ARG);
   CHECK_NULL(config, CCHD_ERROR_INVALID_ARG);
 
-  // Check for init command first
+  // Check for the init and install commands first
   if (argc >= 2 && strcmp(argv[1], "init") == 0) {
     cchd_error err = cchd_handle_init(argc, argv);
     exit(err == CCHD_SUCCESS ? 0 : 1);
   }
+  if (argc >= 2 && strcmp(argv[1], "install") == 0) {
+    cchd_error err = cchd_handle_install(argc, argv);
+    exit(err == CCHD_SUCCESS ? 0 : 1);
+  }
 
   // Check for help flag first
   for (int i = 1; i < argc; i++) {
@@ -65,7 +70,26 @@ cchd_error cchd_parse_args(int argc, char *argv[], cchd_config_t *config) {
       // Skip known options and their arguments
       if (strcmp(argv[i], "--server") == 0 ||
           strcmp(argv[i], "--timeout") == 0 ||
-          strcmp(argv[i], "--api-key") == 0) {
+          strcmp(argv[i], "--api-key") == 0 ||
+          strcmp(argv[i], "--user-id") == 0 ||
+          strcmp(argv[i], "--deadline") == 0 ||
+          strcmp(argv[i], "--lang") == 0 ||
+          strcmp(argv[i], "--forward-env") == 0 ||
+          strcmp(argv[i], "--on-empty-response") == 0 ||
+          strcmp(argv[i], "--response-format") == 0 ||
+          strcmp(argv[i], "--spool-dir") == 0 ||
+          strcmp(argv[i], "--route") == 0 ||
+          strcmp(argv[i], "--retry-budget") == 0 ||
+          strcmp(argv[i], "--exec") == 0 ||
+          strcmp(argv[i], "--exec-sandbox-profile") == 0 ||
+          strcmp(argv[i], "--output-fd") == 0 ||
+          strcmp(argv[i], "--output-convention") == 0 ||
+          strcmp(argv[i], "--fail-cache-ttl") == 0 ||
+          strcmp(argv[i], "--proxy") == 0 ||
+          strcmp(argv[i], "--arbiter") == 0 ||
+          strcmp(argv[i], "--side-effect") == 0 ||
+          strcmp(argv[i], "--on-block") == 0 ||
+          strcmp(argv[i], "--max-forward-prompt") == 0) {
         i++;  // Skip the argument
         continue;
       }
@@ -77,7 +101,12 @@ cchd_error cchd_parse_args(int argc, char *argv[], cchd_config_t *config) {
           strcmp(argv[i], "--plain") != 0 &&
           strcmp(argv[i], "--no-color") != 0 &&
           strcmp(argv[i], "--no-input") != 0 &&
-          strcmp(argv[i], "--insecure") != 0) {
+          strcmp(argv[i], "--insecure") != 0 &&
+          strcmp(argv[i], "--include-raw") != 0 &&
+          strcmp(argv[i], "--hash-user-id") != 0 &&
+          strcmp(argv[i], "--exec-sandbox") != 0 &&
+          strcmp(argv[i], "--safe-start") != 0 &&
+          strcmp(argv[i], "--fan-out") != 0) {
         fprintf(stderr, "Error: Unknown option '%s'\n\n", argv[i]);
         fprintf(stderr, "Run '%s --help' for usage information\n", argv[0]);
         return CCHD_ERROR_INVALID_ARG;
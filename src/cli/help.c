@@ -20,13 +20,15 @@ void cchd_print_concise_help(const char *program_name) {
   printf("cchd - Claude Code hooks dispatcher [version %s]\n\n", CCHD_VERSION);
 
   printf("Usage: %s [options]\n", program_name);
-  printf("       %s init <template> [filename]\n\n", program_name);
+  printf("       %s init <template> [filename]\n", program_name);
+  printf("       %s install [--settings PATH] [--dry-run]\n\n", program_name);
 
   printf("cchd processes Claude Code hook events through custom servers to\n");
   printf("allow, block, or modify operations before they execute.\n\n");
 
   printf("Commands:\n");
-  printf("  init      Initialize a new hook server from a template\n\n");
+  printf("  init      Initialize a new hook server from a template\n");
+  printf("  install   Configure Claude Code's settings.json to run cchd\n\n");
 
   printf("Example:\n");
   printf(
@@ -55,7 +57,8 @@ void cchd_print_verbose_usage(const char *program_name) {
 
   printf("%sUSAGE%s\n", bold, reset);
   printf("  %s [options]\n", program_name);
-  printf("  %s init <template> [filename]\n\n", program_name);
+  printf("  %s init <template> [filename]\n", program_name);
+  printf("  %s install [--settings PATH] [--dry-run]\n\n", program_name);
 
   printf("%sDESCRIPTION%s\n", bold, reset);
   printf("  Processes Claude Code hook events through custom servers.\n\n");
@@ -63,7 +66,10 @@ void cchd_print_verbose_usage(const char *program_name) {
   printf("%sCOMMANDS%s\n", bold, reset);
   printf(
       "  init                  Initialize a new hook server from a template\n");
-  printf("                        Use '%s init --help' for more info\n\n",
+  printf("                        Use '%s init --help' for more info\n",
+         program_name);
+  printf("  install               Configure settings.json to run cchd\n");
+  printf("                        Use '%s install --help' for more info\n\n",
          program_name);
 
   printf("%sOPTIONS%s\n", bold, reset);
@@ -77,9 +83,37 @@ void cchd_print_verbose_usage(const char *program_name) {
   printf(
       "  --fail-open           Allow if server unavailable (default: block)\n");
   printf("  --api-key KEY         API key for authentication\n");
+  printf("  --proxy URL           Proxy for server requests (overrides env)\n");
   printf("  --json                Output JSON format\n");
   printf("  --plain               Plain output for scripts\n");
   printf("  --no-color            Disable colors\n");
+  printf("  --include-raw         Send original stdin as base64 rawdata\n");
+  printf("  --max-forward-prompt N\n");
+  printf("                        Forward at most N bytes of a prompt\n");
+  printf("  --user-id SOURCES     Attach userid from os, env:VAR, exec:CMD\n");
+  printf("  --hash-user-id        Send userid as a SHA-256 hex digest\n");
+  printf("  --response-format F   Require modern, legacy, or auto responses\n");
+  printf("  --on-empty-response   allow|block when the 200 body is empty\n");
+  printf("  --output-fd N         Write the decision output to fd N\n");
+  printf("  --output-convention MAP\n");
+  printf("                        [EVENT=]cchd|exit|json: how Claude is told\n");
+  printf("  --exec CMD            Ask a local policy program, not a server\n");
+  printf("  --exec-sandbox        Run the --exec program sandboxed (Linux)\n");
+  printf("  --exec-sandbox-profile FILE\n");
+  printf("                        Extra syscalls to deny in the sandbox\n");
+  printf("  --retry-budget N      Retries allowed per session, refilled slowly\n");
+  printf("  --safe-start          Block mutating tools until server answers\n");
+  printf("  --fail-cache-ttl MS   Repeat a failure's outcome for MS (max 10000)\n");
+  printf("  --fan-out             Ask every server and combine the answers\n");
+  printf("  --arbiter URL         Endpoint that settles --fan-out conflicts\n");
+  printf("  --side-effect NAME=exec:CMD|webhook:URL\n");
+  printf("                        Local action a decision can set off\n");
+  printf("  --on-block NAMES      Side effects to run on every block\n");
+  printf("  --route KEY=URL       Send a tool or event type to one server\n");
+  printf("  --spool-dir DIR       Spool audit events while server is down\n");
+  printf("  --forward-env VARS    Send these env vars in forwardedenv\n");
+  printf("  --lang LANGS          Preferred reason languages, e.g. de-CH,fr\n");
+  printf("  --deadline MS         Time Claude waits, from start (retries stop)\n");
   printf("  --version             Show version information\n\n");
 
   printf("%sQUICK START%s\n", bold, reset);
@@ -91,7 +125,8 @@ void cchd_print_verbose_usage(const char *program_name) {
   printf("  2. Start the server:\n");
   printf("     $ uv run %s      # Python\n", CCHD_TEMPLATE_PYTHON);
   printf("     $ bun %s     # TypeScript\n", CCHD_TEMPLATE_TYPESCRIPT);
-  printf("     $ go run %s          # Go\n\n", CCHD_TEMPLATE_GO);
+  printf("     $ go run %s quickstart-go-*.go  # Go\n\n",
+         CCHD_TEMPLATE_GO);
 
   printf("  3. Configure Claude to use http://localhost:8080/hook\n\n");
 
@@ -36,18 +36,36 @@
 // This makes the 'init --help' command instant and ensures it works offline.
 // The filenames are compile-time constants to ensure consistency with the actual
 // template files in the repository.
+// Templates that span several files list the others in support_files, a
+// NULL-terminated array (or NULL for single-file templates). They are saved
+// next to the main file under their own names, since the main file is the
+// one users rename and customize.
 typedef struct {
   const char *name;
   const char *filename;
   const char *description;
+  const char *const *support_files;
 } template_info_t;
 
+// The Go template is one package split across files. Adding a file to the
+// package in templates/ means adding it here too; the init tests check that
+// the two lists agree.
+static const char *const go_support_files[] = {
+    "quickstart-go-audit.go",      "quickstart-go-cache.go",
+    "quickstart-go-config.go",     "quickstart-go-detect.go",
+    "quickstart-go-encryption.go", "quickstart-go-packages.go",
+    "quickstart-go-reasons.go",    "quickstart-go-server.go",
+    "quickstart-go-session.go",    "quickstart-go-shadow.go",
+    "quickstart-go-slo.go",        "quickstart-go-tools.go",
+    NULL,
+};
+
 static const template_info_t templates[] = {
     {"python", CCHD_TEMPLATE_PYTHON,
-     "Python server using aiohttp (requires UV)"},
+     "Python server using aiohttp (requires UV)", NULL},
     {"typescript", CCHD_TEMPLATE_TYPESCRIPT,
-     "TypeScript server using Bun or Node.js"},
-    {"go", CCHD_TEMPLATE_GO, "Go server using net/http"},
+     "TypeScript server using Bun or Node.js", NULL},
+    {"go", CCHD_TEMPLATE_GO, "Go server using net/http", go_support_files},
 };
 
 static const size_t template_count = sizeof(templates) / sizeof(templates[0]);
@@ -215,6 +233,66 @@ static cchd_error save_template_file(const char *content,
   return CCHD_SUCCESS;
 }
 
+// Builds the path of a support file in the same directory as the main
+// template file. The caller frees the result with cchd_secure_free.
+static char *sibling_path(const char *main_path, const char *filename) {
+  const char *last_slash = strrchr(main_path, '/');
+  size_t dir_len = last_slash ? (size_t)(last_slash - main_path) + 1 : 0;
+  size_t path_len = dir_len + strlen(filename) + 1;
+
+  char *path = cchd_secure_malloc(path_len);
+  if (!path) {
+    return NULL;
+  }
+  snprintf(path, path_len, "%.*s%s", (int)dir_len, main_path, filename);
+  return path;
+}
+
+// Downloads and saves each support file of a template beside main_path.
+// On failure, the files saved so far are removed again so that a rerun
+// isn't refused because some of them already exist.
+static cchd_error install_support_files(const template_info_t *template,
+                                        const char *main_path) {
+  if (template->support_files == NULL) {
+    return CCHD_SUCCESS;
+  }
+
+  cchd_error err = CCHD_SUCCESS;
+  size_t installed = 0;
+  for (; template->support_files[installed] != NULL; installed++) {
+    const char *filename = template->support_files[installed];
+    char *path = sibling_path(main_path, filename);
+    if (!path) {
+      err = CCHD_ERROR_MEMORY;
+      break;
+    }
+
+    download_buffer_t buffer = {NULL, 0, 0};
+    err = download_template(filename, &buffer);
+    if (err == CCHD_SUCCESS) {
+      err = save_template_file(buffer.data, path);
+    }
+    if (buffer.data) {
+      cchd_secure_free(buffer.data, buffer.capacity);
+    }
+    cchd_secure_free(path, strlen(path) + 1);
+    if (err != CCHD_SUCCESS) {
+      break;
+    }
+  }
+
+  if (err != CCHD_SUCCESS) {
+    for (size_t i = 0; i < installed; i++) {
+      char *path = sibling_path(main_path, template->support_files[i]);
+      if (path) {
+        unlink(path);
+        cchd_secure_free(path, strlen(path) + 1);
+      }
+    }
+  }
+  return err;
+}
+
 static cchd_error ensure_directory_exists(const char *path) {
   struct stat st;
   if (stat(path, &st) == 0) {
@@ -431,6 +509,26 @@ cchd_error cchd_handle_init(int argc, char *argv[]) {
     cchd_secure_free(full_path, strlen(full_path) + 1);
     return CCHD_ERROR_IO;
   }
+  for (size_t i = 0;
+       template->support_files && template->support_files[i] != NULL; i++) {
+    char *support_path = sibling_path(full_path, template->support_files[i]);
+    if (!support_path) {
+      cchd_secure_free(full_path, strlen(full_path) + 1);
+      return CCHD_ERROR_MEMORY;
+    }
+    bool exists = stat(support_path, &st) == 0;
+    if (exists) {
+      fprintf(stderr, "Error: File '%s' already exists\n", support_path);
+      fprintf(stderr,
+              "Use a different directory or remove the existing file\n");
+    }
+    cchd_secure_free(support_path, strlen(support_path) + 1);
+    if (exists) {
+      cchd_secure_free(full_path, strlen(full_path) + 1);
+      return CCHD_ERROR_IO;
+    }
+  }
+
   // Initialize CURL
   if (curl_global_init(CURL_GLOBAL_DEFAULT) != 0) {
     fprintf(stderr, "Error: Failed to initialize network library\n");
@@ -457,14 +555,27 @@ cchd_error cchd_handle_init(int argc, char *argv[]) {
   // Save template to file
   err = save_template_file(buffer.data, full_path);
   cchd_secure_free(buffer.data, buffer.capacity);
-  curl_global_cleanup();
 
   if (err != CCHD_SUCCESS) {
+    curl_global_cleanup();
     fprintf(stderr, "Error: Failed to save template file\n");
     cchd_secure_free(full_path, strlen(full_path) + 1);
     return err;
   }
 
+  // The main file alone doesn't build for multi-file templates, so it is
+  // removed again if any of its support files can't be installed.
+  err = install_support_files(template, full_path);
+  curl_global_cleanup();
+
+  if (err != CCHD_SUCCESS) {
+    unlink(full_path);
+    fprintf(stderr, "Error: Failed to install the template's support files\n");
+    fprintf(stderr, "Check your internet connection and try again\n");
+    cchd_secure_free(full_path, strlen(full_path) + 1);
+    return err;
+  }
+
   // Update settings.json with hook command
   char hook_command[512];
   snprintf(hook_command, sizeof(hook_command),
@@ -481,6 +592,14 @@ cchd_error cchd_handle_init(int argc, char *argv[]) {
   const char *reset = cchd_use_colors(NULL) ? COLOR_RESET : "";
 
   printf("%s✓ Created %s%s\n", green, full_path, reset);
+  if (template->support_files) {
+    size_t support_count = 0;
+    while (template->support_files[support_count] != NULL) {
+      support_count++;
+    }
+    printf("%s✓ Created %zu support files next to it%s\n", green,
+           support_count, reset);
+  }
   printf("%s✓ Updated .claude/settings.json%s\n\n", green, reset);
 
   // Print next steps based on template
@@ -490,7 +609,12 @@ cchd_error cchd_handle_init(int argc, char *argv[]) {
   } else if (strcmp(template_name, "typescript") == 0) {
     printf("  1. Run the server:  bun %s\n", full_path);
   } else if (strcmp(template_name, "go") == 0) {
-    printf("  1. Run the server:  go run %s\n", full_path);
+    char *support_glob = sibling_path(full_path, "quickstart-go-*.go");
+    printf("  1. Run the server:  go run %s %s\n", full_path,
+           support_glob ? support_glob : "quickstart-go-*.go");
+    if (support_glob) {
+      cchd_secure_free(support_glob, strlen(support_glob) + 1);
+    }
   }
   printf("  2. The hook is already configured in .claude/settings.json\n");
   printf("  3. Customize the handler functions for your needs\n");
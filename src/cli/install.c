@@ -0,0 +1,781 @@
+/*
+ * Settings installation command implementation.
+ *
+ * The new settings are built from a read-only parse of the old file, copying
+ * every key and hook as it was and replacing only the hook entries whose
+ * command runs cchd. The dry-run diff compares the old text with the text we
+ * would write, so it shows exactly what a real run changes, formatting
+ * included.
+ */
+
+#include "install.h"
+
+#include <errno.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/stat.h>
+#include <unistd.h>
+#include <yyjson.h>
+
+#include "../core/types.h"
+#include "../utils/colors.h"
+#include "../utils/logging.h"
+#include "../utils/memory.h"
+
+#define DEFAULT_SETTINGS_PATH ".claude/settings.json"
+#define INSTALL_COMMAND_MAX 4096
+
+// Lines of unchanged context around each change in --dry-run output, as in
+// diff -u.
+#define DIFF_CONTEXT_LINES 3
+
+// Files beyond this many lines are shown as a full replacement rather than
+// paying for the quadratic line diff. Real settings files are far smaller.
+#define DIFF_MAX_LINES 2000
+
+// Hook events cchd is installed for. Only the tool events take a matcher;
+// Claude Code ignores it elsewhere, so it is left out there.
+typedef struct {
+  const char *name;
+  bool has_matcher;
+} install_event_t;
+
+static const install_event_t install_events[] = {
+    {"PreToolUse", true}, {"PostToolUse", true},  {"Notification", false},
+    {"UserPromptSubmit", false}, {"Stop", false}, {"SubagentStop", false},
+    {"PreCompact", false},
+};
+
+static const size_t install_event_count =
+    sizeof(install_events) / sizeof(install_events[0]);
+
+static void print_install_usage(const char *program_name) {
+  const char *bold = cchd_use_colors(NULL) ? COLOR_BOLD : "";
+  const char *reset = cchd_use_colors(NULL) ? COLOR_RESET : "";
+
+  printf("%sUSAGE%s\n", bold, reset);
+  printf("  %s install [--settings PATH] [--server URL] [--dry-run] "
+         "[-- FLAGS...]\n\n",
+         program_name);
+
+  printf("%sDESCRIPTION%s\n", bold, reset);
+  printf("  Configure Claude Code to run cchd for every hook event.\n");
+  printf("  Existing cchd hooks are replaced; other settings and hooks are\n");
+  printf("  kept. The previous file is saved with a .bak suffix.\n\n");
+
+  printf("%sOPTIONS%s\n", bold, reset);
+  printf("  --settings PATH       Settings file (default: %s)\n",
+         DEFAULT_SETTINGS_PATH);
+  printf("  --server URL          Server the hooks use (default: %s)\n",
+         DEFAULT_SERVER_URL);
+  printf("  --dry-run             Print the change as a diff, write nothing\n");
+  printf("  -- FLAGS...           Further cchd flags for every hook\n\n");
+
+  printf("%sEXAMPLES%s\n", bold, reset);
+  printf("  %s install\n", program_name);
+  printf("  %s install --settings ~/.claude/settings.json --dry-run\n",
+         program_name);
+  printf("  %s install --server https://policy.example.com/hook -- "
+         "--fail-open\n",
+         program_name);
+}
+
+// Characters that need no quoting in a POSIX shell word.
+static bool is_shell_safe(const char *arg) {
+  if (arg[0] == '\0') {
+    return false;
+  }
+  return strspn(arg,
+                "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+                "0123456789_@%+=:,./-") == strlen(arg);
+}
+
+// Appends arg to the command, single-quoted if the shell would otherwise
+// split or expand it, since Claude Code runs hook commands through a shell.
+static bool append_word(char *command, size_t size, const char *arg) {
+  size_t len = strlen(command);
+  if (len > 0) {
+    if (len + 1 >= size) {
+      return false;
+    }
+    command[len++] = ' ';
+  }
+  if (is_shell_safe(arg)) {
+    if (len + strlen(arg) >= size) {
+      return false;
+    }
+    strcpy(command + len, arg);
+    return true;
+  }
+
+  if (len + 1 >= size) {
+    return false;
+  }
+  command[len++] = '\'';
+  for (const char *p = arg; *p != '\0'; p++) {
+    const char *piece = *p == '\'' ? "'\\''" : NULL;
+    size_t piece_len = piece ? strlen(piece) : 1;
+    if (len + piece_len >= size) {
+      return false;
+    }
+    if (piece) {
+      memcpy(command + len, piece, piece_len);
+    } else {
+      command[len] = *p;
+    }
+    len += piece_len;
+  }
+  if (len + 2 > size) {
+    return false;
+  }
+  command[len++] = '\'';
+  command[len] = '\0';
+  return true;
+}
+
+// A hook entry is ours if its program is cchd, by name or by path.
+static bool is_cchd_command(const char *command) {
+  command += strspn(command, " \t");
+  size_t word_len = strcspn(command, " \t");
+  const char *name = command;
+  for (size_t i = 0; i < word_len; i++) {
+    if (command[i] == '/') {
+      name = command + i + 1;
+    }
+  }
+  return (size_t)(command + word_len - name) == 4 &&
+         strncmp(name, "cchd", 4) == 0;
+}
+
+static bool is_cchd_hook(yyjson_val *hook) {
+  yyjson_val *command = yyjson_obj_get(hook, "command");
+  return yyjson_is_str(command) && is_cchd_command(yyjson_get_str(command));
+}
+
+// Reads the whole file into a buffer of *capacity bytes. A missing file is
+// not an error: *content stays NULL.
+static cchd_error read_settings(const char *path, char **content, size_t *size,
+                                size_t *capacity) {
+  *content = NULL;
+  *size = 0;
+  *capacity = 0;
+
+  FILE *file = fopen(path, "r");
+  if (file == NULL) {
+    if (errno == ENOENT) {
+      return CCHD_SUCCESS;
+    }
+    fprintf(stderr, "Error: Cannot read %s: %s\n", path, strerror(errno));
+    return CCHD_ERROR_IO;
+  }
+
+  size_t allocated = 4096;
+  char *data = cchd_secure_malloc(allocated);
+  if (data == NULL) {
+    fclose(file);
+    return CCHD_ERROR_MEMORY;
+  }
+  size_t len = 0;
+  size_t n;
+  while ((n = fread(data + len, 1, allocated - len - 1, file)) > 0) {
+    len += n;
+    if (len + 1 == allocated) {
+      char *bigger = cchd_secure_realloc(data, allocated, allocated * 2);
+      if (bigger == NULL) {
+        cchd_secure_free(data, allocated);
+        fclose(file);
+        return CCHD_ERROR_MEMORY;
+      }
+      data = bigger;
+      allocated *= 2;
+    }
+  }
+  bool failed = ferror(file);
+  fclose(file);
+  if (failed) {
+    fprintf(stderr, "Error: Cannot read %s\n", path);
+    cchd_secure_free(data, allocated);
+    return CCHD_ERROR_IO;
+  }
+
+  data[len] = '\0';
+  *content = data;
+  *size = len;
+  *capacity = allocated;
+  return CCHD_SUCCESS;
+}
+
+static yyjson_mut_val *new_cchd_group(yyjson_mut_doc *doc,
+                                      const install_event_t *event,
+                                      const char *command) {
+  yyjson_mut_val *group = yyjson_mut_obj(doc);
+  if (event->has_matcher) {
+    yyjson_mut_obj_add_str(doc, group, "matcher", "*");
+  }
+  yyjson_mut_val *hooks = yyjson_mut_obj_add_arr(doc, group, "hooks");
+  yyjson_mut_val *hook = yyjson_mut_arr_add_obj(doc, hooks);
+  yyjson_mut_obj_add_str(doc, hook, "type", "command");
+  yyjson_mut_obj_add_str(doc, hook, "command", command);
+  return group;
+}
+
+// Copies one event's matcher groups without their cchd hooks, drops groups
+// left empty by that, and appends a single group running command.
+static yyjson_mut_val *build_event(yyjson_mut_doc *doc, yyjson_val *groups,
+                                   const install_event_t *event,
+                                   const char *command) {
+  yyjson_mut_val *result = yyjson_mut_arr(doc);
+
+  yyjson_val *group;
+  size_t idx, max;
+  yyjson_arr_foreach(groups, idx, max, group) {
+    yyjson_val *hooks = yyjson_obj_get(group, "hooks");
+    if (!yyjson_is_arr(hooks)) {
+      yyjson_mut_arr_append(result, yyjson_val_mut_copy(doc, group));
+      continue;
+    }
+
+    yyjson_mut_val *kept_group = yyjson_mut_obj(doc);
+    yyjson_mut_val *kept_hooks = yyjson_mut_arr(doc);
+    size_t removed = 0;
+
+    yyjson_val *key, *val;
+    size_t key_idx, key_max;
+    yyjson_obj_foreach(group, key_idx, key_max, key, val) {
+      if (val != hooks) {
+        yyjson_mut_obj_add(kept_group, yyjson_val_mut_copy(doc, key),
+                           yyjson_val_mut_copy(doc, val));
+        continue;
+      }
+      yyjson_mut_obj_add(kept_group, yyjson_val_mut_copy(doc, key),
+                         kept_hooks);
+      yyjson_val *hook;
+      size_t hook_idx, hook_max;
+      yyjson_arr_foreach(hooks, hook_idx, hook_max, hook) {
+        if (is_cchd_hook(hook)) {
+          removed++;
+        } else {
+          yyjson_mut_arr_append(kept_hooks, yyjson_val_mut_copy(doc, hook));
+        }
+      }
+    }
+
+    if (removed == 0 || yyjson_mut_arr_size(kept_hooks) > 0) {
+      yyjson_mut_arr_append(result, kept_group);
+    }
+  }
+
+  yyjson_mut_arr_append(result, new_cchd_group(doc, event, command));
+  return result;
+}
+
+static const install_event_t *find_install_event(const char *name) {
+  for (size_t i = 0; i < install_event_count; i++) {
+    if (strcmp(install_events[i].name, name) == 0) {
+      return &install_events[i];
+    }
+  }
+  return NULL;
+}
+
+// Builds the hooks object: events we don't manage are copied untouched and
+// keep their place, managed ones are rebuilt in place, and missing ones are
+// added at the end.
+static cchd_error build_hooks(yyjson_mut_doc *doc, yyjson_val *hooks,
+                              const char *command, yyjson_mut_val **out) {
+  yyjson_mut_val *result = yyjson_mut_obj(doc);
+  bool seen[sizeof(install_events) / sizeof(install_events[0])] = {false};
+
+  if (hooks != NULL) {
+    yyjson_val *key, *val;
+    size_t idx, max;
+    yyjson_obj_foreach(hooks, idx, max, key, val) {
+      const install_event_t *event = find_install_event(yyjson_get_str(key));
+      if (event == NULL) {
+        yyjson_mut_obj_add(result, yyjson_val_mut_copy(doc, key),
+                           yyjson_val_mut_copy(doc, val));
+        continue;
+      }
+      if (!yyjson_is_arr(val)) {
+        fprintf(stderr, "Error: hooks.%s must be an array\n", event->name);
+        return CCHD_ERROR_CONFIG_INVALID;
+      }
+      seen[event - install_events] = true;
+      yyjson_mut_obj_add(result, yyjson_val_mut_copy(doc, key),
+                         build_event(doc, val, event, command));
+    }
+  }
+
+  for (size_t i = 0; i < install_event_count; i++) {
+    if (!seen[i]) {
+      yyjson_mut_obj_add(result, yyjson_mut_str(doc, install_events[i].name),
+                         build_event(doc, NULL, &install_events[i], command));
+    }
+  }
+
+  *out = result;
+  return CCHD_SUCCESS;
+}
+
+// Produces the new settings text for the old content (NULL for a new file).
+// The caller frees *output with free().
+static cchd_error build_settings(const char *path, const char *content,
+                                 size_t size, const char *command,
+                                 char **output, size_t *output_len) {
+  yyjson_doc *old_doc = NULL;
+  yyjson_val *old_root = NULL;
+  if (content != NULL && content[strspn(content, " \t\r\n")] != '\0') {
+    yyjson_read_err read_err;
+    old_doc = yyjson_read_opts((char *)content, size, 0, NULL, &read_err);
+    if (old_doc == NULL) {
+      fprintf(stderr, "Error: %s is not valid JSON: %s at byte %zu\n", path,
+              read_err.msg, read_err.pos);
+      fprintf(stderr, "Fix the file or move it away, then run install again\n");
+      return CCHD_ERROR_CONFIG_PARSE;
+    }
+    old_root = yyjson_doc_get_root(old_doc);
+    if (!yyjson_is_obj(old_root)) {
+      fprintf(stderr, "Error: %s must contain a JSON object\n", path);
+      yyjson_doc_free(old_doc);
+      return CCHD_ERROR_CONFIG_INVALID;
+    }
+  }
+
+  yyjson_val *old_hooks = yyjson_obj_get(old_root, "hooks");
+  if (old_hooks != NULL && !yyjson_is_obj(old_hooks)) {
+    fprintf(stderr, "Error: 'hooks' in %s must be an object\n", path);
+    yyjson_doc_free(old_doc);
+    return CCHD_ERROR_CONFIG_INVALID;
+  }
+
+  yyjson_mut_doc *doc = yyjson_mut_doc_new(NULL);
+  if (doc == NULL) {
+    yyjson_doc_free(old_doc);
+    return CCHD_ERROR_MEMORY;
+  }
+  yyjson_mut_val *root = yyjson_mut_obj(doc);
+  yyjson_mut_doc_set_root(doc, root);
+
+  yyjson_mut_val *hooks = NULL;
+  cchd_error err = build_hooks(doc, old_hooks, command, &hooks);
+  if (err == CCHD_SUCCESS) {
+    // Keys keep their order, with hooks where it was or else last.
+    if (old_root != NULL) {
+      yyjson_val *key, *val;
+      size_t idx, max;
+      yyjson_obj_foreach(old_root, idx, max, key, val) {
+        yyjson_mut_obj_add(root, yyjson_val_mut_copy(doc, key),
+                           val == old_hooks ? hooks
+                                            : yyjson_val_mut_copy(doc, val));
+      }
+    }
+    if (old_hooks == NULL) {
+      yyjson_mut_obj_add(root, yyjson_mut_str(doc, "hooks"), hooks);
+    }
+
+    size_t len = 0;
+    char *json = yyjson_mut_write(doc, YYJSON_WRITE_PRETTY_TWO_SPACES, &len);
+    // Room for the trailing newline editors expect.
+    char *text = json ? realloc(json, len + 2) : NULL;
+    if (text == NULL) {
+      free(json);
+      err = CCHD_ERROR_MEMORY;
+    } else {
+      text[len++] = '\n';
+      text[len] = '\0';
+      *output = text;
+      *output_len = len;
+    }
+  }
+
+  yyjson_mut_doc_free(doc);
+  yyjson_doc_free(old_doc);
+  return err;
+}
+
+typedef struct {
+  const char *start;
+  size_t len;
+} diff_line_t;
+
+// Splits text into lines without their newlines. The caller frees *lines
+// with free().
+static bool split_lines(const char *text, size_t size, diff_line_t **lines,
+                        size_t *count) {
+  *lines = NULL;
+  *count = 0;
+  size_t n = 0;
+  for (size_t i = 0; i < size; i++) {
+    if (text[i] == '\n' || i + 1 == size) {
+      n++;
+    }
+  }
+  if (n == 0) {
+    return true;
+  }
+
+  diff_line_t *result = calloc(n, sizeof(*result));
+  if (result == NULL) {
+    return false;
+  }
+  size_t line = 0;
+  const char *start = text;
+  for (size_t i = 0; i < size; i++) {
+    if (text[i] == '\n' || i + 1 == size) {
+      size_t end = text[i] == '\n' ? i : i + 1;
+      result[line].start = start;
+      result[line].len = (size_t)(text + end - start);
+      line++;
+      start = text + i + 1;
+    }
+  }
+  *lines = result;
+  *count = n;
+  return true;
+}
+
+static bool lines_equal(const diff_line_t *a, const diff_line_t *b) {
+  return a->len == b->len && memcmp(a->start, b->start, a->len) == 0;
+}
+
+typedef enum { DIFF_SAME, DIFF_REMOVE, DIFF_ADD } diff_op_kind;
+
+typedef struct {
+  diff_op_kind kind;
+  size_t old_line;
+  size_t new_line;
+} diff_op_t;
+
+// Computes an edit script from a longest common subsequence of lines. Counts
+// of at most DIFF_MAX_LINES keep the table small; larger inputs get a plain
+// remove-all, add-all script.
+static diff_op_t *diff_lines(const diff_line_t *a, size_t n,
+                             const diff_line_t *b, size_t m, size_t *count) {
+  diff_op_t *ops = calloc(n + m + 1, sizeof(*ops));
+  if (ops == NULL) {
+    return NULL;
+  }
+
+  uint32_t *lcs = NULL;
+  if (n <= DIFF_MAX_LINES && m <= DIFF_MAX_LINES) {
+    lcs = calloc((n + 1) * (m + 1), sizeof(*lcs));
+  }
+  if (lcs != NULL) {
+    for (size_t i = n; i-- > 0;) {
+      for (size_t j = m; j-- > 0;) {
+        uint32_t *cell = &lcs[i * (m + 1) + j];
+        if (lines_equal(&a[i], &b[j])) {
+          *cell = lcs[(i + 1) * (m + 1) + j + 1] + 1;
+        } else {
+          uint32_t down = lcs[(i + 1) * (m + 1) + j];
+          uint32_t right = lcs[i * (m + 1) + j + 1];
+          *cell = down > right ? down : right;
+        }
+      }
+    }
+  }
+
+  size_t i = 0, j = 0, k = 0;
+  while (i < n || j < m) {
+    diff_op_kind kind;
+    if (i < n && j < m && lcs != NULL && lines_equal(&a[i], &b[j])) {
+      kind = DIFF_SAME;
+    } else if (j >= m || (i < n && (lcs == NULL ||
+                                    lcs[(i + 1) * (m + 1) + j] >=
+                                        lcs[i * (m + 1) + j + 1]))) {
+      kind = DIFF_REMOVE;
+    } else {
+      kind = DIFF_ADD;
+    }
+    ops[k++] = (diff_op_t){kind, i, j};
+    if (kind != DIFF_ADD) {
+      i++;
+    }
+    if (kind != DIFF_REMOVE) {
+      j++;
+    }
+  }
+  free(lcs);
+  *count = k;
+  return ops;
+}
+
+// diff -u hunk ranges: a zero-length range names the line before it.
+static void print_range(size_t start, size_t length) {
+  if (length == 0) {
+    printf("%zu,0", start);
+  } else if (length == 1) {
+    printf("%zu", start + 1);
+  } else {
+    printf("%zu,%zu", start + 1, length);
+  }
+}
+
+static cchd_error print_diff(const char *path, const char *old_text,
+                             size_t old_size, const char *new_text,
+                             size_t new_size) {
+  diff_line_t *a = NULL, *b = NULL;
+  size_t n = 0, m = 0;
+  if (!split_lines(old_text ? old_text : "", old_size, &a, &n) ||
+      !split_lines(new_text, new_size, &b, &m)) {
+    free(a);
+    return CCHD_ERROR_MEMORY;
+  }
+  size_t count = 0;
+  diff_op_t *ops = diff_lines(a, n, b, m, &count);
+  if (ops == NULL) {
+    free(a);
+    free(b);
+    return CCHD_ERROR_MEMORY;
+  }
+
+  const char *red = cchd_use_colors(NULL) ? COLOR_RED : "";
+  const char *green = cchd_use_colors(NULL) ? COLOR_GREEN : "";
+  const char *reset = cchd_use_colors(NULL) ? COLOR_RESET : "";
+
+  printf("--- %s\n", old_text ? path : "/dev/null");
+  printf("+++ %s\n", path);
+
+  size_t k = 0;
+  while (k < count) {
+    if (ops[k].kind == DIFF_SAME) {
+      k++;
+      continue;
+    }
+
+    // A hunk runs from the context before this change to the context after
+    // the last change that is close enough to share it.
+    size_t start = k > DIFF_CONTEXT_LINES ? k - DIFF_CONTEXT_LINES : 0;
+    size_t end = k;
+    size_t same_run = 0;
+    for (size_t s = k; s < count; s++) {
+      if (ops[s].kind == DIFF_SAME) {
+        if (++same_run > 2 * DIFF_CONTEXT_LINES) {
+          break;
+        }
+      } else {
+        same_run = 0;
+        end = s + 1;
+      }
+    }
+    end = end + DIFF_CONTEXT_LINES < count ? end + DIFF_CONTEXT_LINES : count;
+
+    size_t old_length = 0, new_length = 0;
+    for (size_t s = start; s < end; s++) {
+      old_length += ops[s].kind != DIFF_ADD;
+      new_length += ops[s].kind != DIFF_REMOVE;
+    }
+    printf("@@ -");
+    print_range(ops[start].old_line, old_length);
+    printf(" +");
+    print_range(ops[start].new_line, new_length);
+    printf(" @@\n");
+
+    for (size_t s = start; s < end; s++) {
+      if (ops[s].kind == DIFF_SAME) {
+        const diff_line_t *line = &a[ops[s].old_line];
+        printf(" %.*s\n", (int)line->len, line->start);
+      } else if (ops[s].kind == DIFF_REMOVE) {
+        const diff_line_t *line = &a[ops[s].old_line];
+        printf("%s-%.*s%s\n", red, (int)line->len, line->start, reset);
+      } else {
+        const diff_line_t *line = &b[ops[s].new_line];
+        printf("%s+%.*s%s\n", green, (int)line->len, line->start, reset);
+      }
+    }
+    k = end;
+  }
+
+  free(ops);
+  free(a);
+  free(b);
+  return CCHD_SUCCESS;
+}
+
+static cchd_error write_file(const char *path, const char *data, size_t len,
+                             mode_t mode) {
+  FILE *file = fopen(path, "w");
+  if (file == NULL) {
+    fprintf(stderr, "Error: Cannot write %s: %s\n", path, strerror(errno));
+    return CCHD_ERROR_IO;
+  }
+  bool ok = fwrite(data, 1, len, file) == len;
+  ok = fclose(file) == 0 && ok;
+  if (!ok) {
+    fprintf(stderr, "Error: Failed to write %s\n", path);
+    unlink(path);
+    return CCHD_ERROR_IO;
+  }
+  chmod(path, mode);
+  return CCHD_SUCCESS;
+}
+
+// Creates the settings file's directory when it is missing, which is the
+// usual case for a project's first .claude/settings.json. Only one level is
+// created: a deeper missing path is more likely a typo.
+static cchd_error ensure_parent_directory(const char *path) {
+  const char *slash = strrchr(path, '/');
+  if (slash == NULL || slash == path) {
+    return CCHD_SUCCESS;
+  }
+  char *parent = cchd_secure_strdup(path);
+  if (parent == NULL) {
+    return CCHD_ERROR_MEMORY;
+  }
+  parent[slash - path] = '\0';
+  cchd_error err = CCHD_SUCCESS;
+  if (mkdir(parent, 0755) != 0 && errno != EEXIST) {
+    fprintf(stderr, "Error: Cannot create %s: %s\n", parent, strerror(errno));
+    err = CCHD_ERROR_IO;
+  }
+  cchd_secure_free(parent, strlen(parent) + 1);
+  return err;
+}
+
+// Writes the backup, then the new file beside the old one and renames it
+// into place, so an interrupted install never leaves half a settings file.
+static cchd_error save_settings(const char *path, const char *old_content,
+                                size_t old_size, const char *new_content,
+                                size_t new_size) {
+  cchd_error err = ensure_parent_directory(path);
+  if (err != CCHD_SUCCESS) {
+    return err;
+  }
+
+  size_t path_len = strlen(path);
+  char *side_path = cchd_secure_malloc(path_len + 5);
+  if (side_path == NULL) {
+    return CCHD_ERROR_MEMORY;
+  }
+
+  mode_t mode = 0644;
+  struct stat st;
+  if (stat(path, &st) == 0) {
+    mode = st.st_mode & 0777;
+  }
+
+  if (old_content != NULL) {
+    snprintf(side_path, path_len + 5, "%s.bak", path);
+    err = write_file(side_path, old_content, old_size, mode);
+    if (err == CCHD_SUCCESS) {
+      printf("Saved the previous settings to %s\n", side_path);
+    }
+  }
+
+  if (err == CCHD_SUCCESS) {
+    snprintf(side_path, path_len + 5, "%s.new", path);
+    err = write_file(side_path, new_content, new_size, mode);
+  }
+  if (err == CCHD_SUCCESS && rename(side_path, path) != 0) {
+    fprintf(stderr, "Error: Cannot replace %s: %s\n", path, strerror(errno));
+    unlink(side_path);
+    err = CCHD_ERROR_IO;
+  }
+
+  cchd_secure_free(side_path, path_len + 5);
+  return err;
+}
+
+cchd_error cchd_handle_install(int argc, char *argv[]) {
+  const char *program_name = argv[0];
+  const char *settings_path = DEFAULT_SETTINGS_PATH;
+  const char *server_url = DEFAULT_SERVER_URL;
+  bool dry_run = false;
+  int extra_start = argc;
+
+  for (int i = 2; i < argc; i++) {
+    if (strcmp(argv[i], "-h") == 0 || strcmp(argv[i], "--help") == 0) {
+      print_install_usage(program_name);
+      exit(0);
+    } else if (strcmp(argv[i], "--dry-run") == 0) {
+      dry_run = true;
+    } else if (strcmp(argv[i], "--settings") == 0 ||
+               strcmp(argv[i], "--server") == 0) {
+      if (i + 1 >= argc) {
+        fprintf(stderr, "Error: %s requires a value\n", argv[i]);
+        return CCHD_ERROR_INVALID_ARG;
+      }
+      if (strcmp(argv[i], "--settings") == 0) {
+        settings_path = argv[++i];
+      } else {
+        server_url = argv[++i];
+      }
+    } else if (strcmp(argv[i], "--") == 0) {
+      extra_start = i + 1;
+      break;
+    } else {
+      fprintf(stderr, "Error: Unknown install option '%s'\n\n", argv[i]);
+      fprintf(stderr, "Run '%s install --help' for usage information\n",
+              program_name);
+      return CCHD_ERROR_INVALID_ARG;
+    }
+  }
+
+  if (strncmp(server_url, "http://", 7) != 0 &&
+      strncmp(server_url, "https://", 8) != 0) {
+    fprintf(stderr, "Error: Invalid URL format: %s\n", server_url);
+    fprintf(stderr, "URLs must start with 'http://' or 'https://'\n");
+    return CCHD_ERROR_INVALID_URL;
+  }
+
+  char command[INSTALL_COMMAND_MAX] = "";
+  bool fits = append_word(command, sizeof(command), "cchd") &&
+              append_word(command, sizeof(command), "--server") &&
+              append_word(command, sizeof(command), server_url);
+  for (int i = extra_start; fits && i < argc; i++) {
+    fits = append_word(command, sizeof(command), argv[i]);
+  }
+  if (!fits) {
+    fprintf(stderr, "Error: The hook command is longer than %d bytes\n",
+            INSTALL_COMMAND_MAX - 1);
+    return CCHD_ERROR_INVALID_ARG;
+  }
+
+  char *old_content = NULL;
+  size_t old_size = 0;
+  size_t old_capacity = 0;
+  cchd_error err =
+      read_settings(settings_path, &old_content, &old_size, &old_capacity);
+  if (err != CCHD_SUCCESS) {
+    return err;
+  }
+
+  char *new_content = NULL;
+  size_t new_size = 0;
+  err = build_settings(settings_path, old_content, old_size, command,
+                       &new_content, &new_size);
+  if (err != CCHD_SUCCESS) {
+    if (old_content) {
+      cchd_secure_free(old_content, old_capacity);
+    }
+    return err;
+  }
+
+  const char *green = cchd_use_colors(NULL) ? COLOR_GREEN : "";
+  const char *reset = cchd_use_colors(NULL) ? COLOR_RESET : "";
+  bool unchanged = old_content != NULL && old_size == new_size &&
+                   memcmp(old_content, new_content, new_size) == 0;
+
+  if (unchanged) {
+    printf("%s✓ %s already runs '%s' for every hook event%s\n", green,
+           settings_path, command, reset);
+  } else if (dry_run) {
+    err = print_diff(settings_path, old_content, old_size, new_content,
+                     new_size);
+  } else {
+    err = save_settings(settings_path, old_content, old_size, new_content,
+                        new_size);
+    if (err == CCHD_SUCCESS) {
+      printf("%s✓ Updated %s to run '%s' for every hook event%s\n", green,
+             settings_path, command, reset);
+      LOG_INFO("Installed cchd hooks into %s", settings_path);
+    }
+  }
+
+  free(new_content);
+  if (old_content) {
+    cchd_secure_free(old_content, old_capacity);
+  }
+  return err;
+}
@@ -0,0 +1,19 @@
+/*
+ * Settings installation command for CCHD.
+ *
+ * Wires the dispatcher into Claude Code's settings.json: one hook entry per
+ * event type, each invoking cchd with the same flags. Getting the event names,
+ * matchers and nesting right by hand is the most common setup mistake, so the
+ * command owns that structure and leaves everything else in the file alone.
+ */
+
+#pragma once
+
+#include "../core/error.h"
+
+// Handle 'cchd install [--settings PATH] [--server URL] [--dry-run] [-- ...]'.
+// Existing cchd hook entries are replaced and all other settings and hooks are
+// kept, so running it again is harmless. The previous file is saved next to
+// it with a .bak suffix before it is rewritten. With --dry-run nothing is
+// written and the change is printed as a unified diff instead.
+CCHD_NODISCARD cchd_error cchd_handle_install(int argc, char *argv[]);
@@ -9,17 +9,47 @@
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
+#include <time.h>
 #include <unistd.h>
 #include <yyjson.h>
 
+#include "../network/failcache.h"
 #include "../utils/logging.h"
 #include "../utils/memory.h"
+#include "../utils/sha256.h"
 
 #define MAX_SERVERS 10
+#define MAX_ROUTES 32
+
+// Routes map a tool name or hook event name to the one server that handles
+// it; the "default" key catches everything else.
+typedef struct {
+  char *key;
+  char *url;
+} cchd_route_t;
+
+// Output conventions are keyed by hook event name, with "default" for the
+// events not named.
+#define MAX_CONVENTIONS 16
+
+typedef struct {
+  char *event;
+  cchd_output_convention convention;
+} cchd_convention_t;
+
+typedef struct {
+  char *name;
+  cchd_side_effect_type type;
+  char *target;
+} cchd_side_effect_t;
 
 struct cchd_config {
   char *server_urls[MAX_SERVERS];
+  cchd_response_format server_formats[MAX_SERVERS];
+  // Sampling weights; all set (>0) for weighted servers, else all 0.
+  double server_weights[MAX_SERVERS];
   size_t server_count;
+  cchd_response_format response_format;
   char *api_key;
   int64_t timeout_ms;
   bool fail_open;
@@ -30,6 +60,33 @@ struct cchd_config {
   bool no_color;
   bool no_input;
   bool insecure;
+  bool include_raw;
+  char *user_id_sources;
+  bool hash_user_id;
+  int64_t deadline_ms;
+  struct timespec started;
+  char *lang;
+  char *forward_env;
+  cchd_empty_response_policy on_empty_response;
+  char *spool_dir;
+  cchd_route_t routes[MAX_ROUTES];
+  size_t route_count;
+  int64_t retry_budget;
+  char *exec_command;
+  bool exec_sandbox;
+  char *exec_sandbox_profile;
+  int output_fd;
+  bool safe_start;
+  int64_t fail_cache_ttl_ms;
+  char *proxy;
+  bool fan_out;
+  char *arbiter;
+  cchd_convention_t conventions[MAX_CONVENTIONS];
+  size_t convention_count;
+  cchd_side_effect_t side_effects[CCHD_MAX_SIDE_EFFECTS];
+  size_t side_effect_count;
+  char *on_block;
+  int64_t max_forward_prompt;
 };
 
 cchd_error cchd_config_create(cchd_config_t **config) {
@@ -43,8 +100,13 @@ cchd_error cchd_config_create(cchd_config_t **config) {
   // Set defaults
   (*config)->timeout_ms = DEFAULT_TIMEOUT_MS;
   (*config)->server_urls[0] = strdup(DEFAULT_SERVER_URL);
+  (*config)->output_fd = STDOUT_FILENO;
   (*config)->server_count = 1;
 
+  // The deadline counts from dispatcher start, since Claude's clock started
+  // before stdin was even read.
+  clock_gettime(CLOCK_MONOTONIC, &(*config)->started);
+
   return CCHD_SUCCESS;
 }
 
@@ -62,10 +124,263 @@ void cchd_config_destroy(cchd_config_t *config) {
   if (config->api_key) {
     cchd_secure_free(config->api_key, strlen(config->api_key) + 1);
   }
+  // Proxy URLs may carry credentials too.
+  if (config->proxy) {
+    cchd_secure_free(config->proxy, strlen(config->proxy) + 1);
+  }
+
+  free(config->user_id_sources);
+  free(config->lang);
+  free(config->forward_env);
+  free(config->spool_dir);
+  free(config->exec_command);
+  free(config->exec_sandbox_profile);
+  free(config->arbiter);
+  for (size_t i = 0; i < config->route_count; i++) {
+    free(config->routes[i].key);
+    free(config->routes[i].url);
+  }
+  for (size_t i = 0; i < config->convention_count; i++) {
+    free(config->conventions[i].event);
+  }
+  for (size_t i = 0; i < config->side_effect_count; i++) {
+    free(config->side_effects[i].name);
+    free(config->side_effects[i].target);
+  }
+  free(config->on_block);
 
   free(config);
 }
 
+static bool parse_empty_response_policy(const char *value,
+                                        cchd_empty_response_policy *policy) {
+  if (strcmp(value, "allow") == 0) {
+    *policy = CCHD_EMPTY_RESPONSE_ALLOW;
+  } else if (strcmp(value, "block") == 0) {
+    *policy = CCHD_EMPTY_RESPONSE_BLOCK;
+  } else {
+    return false;
+  }
+  return true;
+}
+
+static bool parse_response_format(const char *value,
+                                  cchd_response_format *format) {
+  if (strcmp(value, "auto") == 0) {
+    *format = CCHD_RESPONSE_FORMAT_AUTO;
+  } else if (strcmp(value, "modern") == 0) {
+    *format = CCHD_RESPONSE_FORMAT_MODERN;
+  } else if (strcmp(value, "legacy") == 0) {
+    *format = CCHD_RESPONSE_FORMAT_LEGACY;
+  } else {
+    return false;
+  }
+  return true;
+}
+
+// Replacing the server list drops the per-server format pins and weights
+// with it.
+static void clear_servers(cchd_config_t *config) {
+  for (size_t i = 0; i < config->server_count; i++) {
+    free(config->server_urls[i]);
+    config->server_urls[i] = NULL;
+    config->server_formats[i] = CCHD_RESPONSE_FORMAT_UNSET;
+    config->server_weights[i] = 0;
+  }
+  config->server_count = 0;
+}
+
+// Splits a trailing "=WEIGHT" off a --server entry, as in
+// "https://new.example.com/hook=0.1". Entries without one are left alone,
+// and so is the value of a query parameter such as "?v=2".
+static void split_weight(char *entry, double *weight) {
+  *weight = 0;
+  char *equals = strrchr(entry, '=');
+  if (equals == NULL || equals == entry) {
+    return;
+  }
+  char *param = NULL;
+  for (char *p = entry; p < equals; p++) {
+    if (*p == '?' || *p == '&') {
+      param = p;
+    }
+  }
+  if (param != NULL && memchr(param, '=', (size_t)(equals - param)) == NULL) {
+    return;
+  }
+  char *end = NULL;
+  double value = strtod(equals + 1, &end);
+  if (end != equals + 1 && *end == '\0' && value > 0) {
+    *weight = value;
+    *equals = '\0';
+  }
+}
+
+// Weights only mean something when every server has one.
+static bool weights_complete(const cchd_config_t *config) {
+  size_t weighted = 0;
+  for (size_t i = 0; i < config->server_count; i++) {
+    if (config->server_weights[i] > 0) {
+      weighted++;
+    }
+  }
+  return weighted == 0 || weighted == config->server_count;
+}
+
+// Adds a route, replacing any earlier one for the same key so command-line
+// routes override those from the config file.
+static bool set_route(cchd_config_t *config, const char *key, size_t key_len,
+                      const char *url) {
+  for (size_t i = 0; i < config->route_count; i++) {
+    if (strlen(config->routes[i].key) == key_len &&
+        strncmp(config->routes[i].key, key, key_len) == 0) {
+      char *copy = strdup(url);
+      if (copy == NULL) {
+        return false;
+      }
+      free(config->routes[i].url);
+      config->routes[i].url = copy;
+      return true;
+    }
+  }
+
+  if (config->route_count >= MAX_ROUTES) {
+    LOG_WARNING("Ignoring route for %.*s: at most %d routes", (int)key_len,
+                key, MAX_ROUTES);
+    return false;
+  }
+  cchd_route_t *route = &config->routes[config->route_count];
+  route->key = strndup(key, key_len);
+  route->url = strdup(url);
+  if (route->key == NULL || route->url == NULL) {
+    free(route->key);
+    free(route->url);
+    return false;
+  }
+  config->route_count++;
+  return true;
+}
+
+static bool parse_output_convention(const char *value, size_t len,
+                                    cchd_output_convention *convention) {
+  if (len == 4 && strncmp(value, "cchd", len) == 0) {
+    *convention = CCHD_OUTPUT_CONVENTION_CCHD;
+  } else if (len == 4 && strncmp(value, "exit", len) == 0) {
+    *convention = CCHD_OUTPUT_CONVENTION_EXIT;
+  } else if (len == 4 && strncmp(value, "json", len) == 0) {
+    *convention = CCHD_OUTPUT_CONVENTION_JSON;
+  } else {
+    return false;
+  }
+  return true;
+}
+
+static bool set_convention(cchd_config_t *config, const char *event,
+                           size_t event_len,
+                           cchd_output_convention convention) {
+  for (size_t i = 0; i < config->convention_count; i++) {
+    if (strlen(config->conventions[i].event) == event_len &&
+        strncmp(config->conventions[i].event, event, event_len) == 0) {
+      config->conventions[i].convention = convention;
+      return true;
+    }
+  }
+
+  if (config->convention_count >= MAX_CONVENTIONS) {
+    LOG_WARNING("Ignoring output convention for %.*s: at most %d",
+                (int)event_len, event, MAX_CONVENTIONS);
+    return false;
+  }
+  char *copy = strndup(event, event_len);
+  if (copy == NULL) {
+    return false;
+  }
+  config->conventions[config->convention_count++] =
+      (cchd_convention_t){.event = copy, .convention = convention};
+  return true;
+}
+
+// Applies a comma-separated list of EVENT=CONVENTION entries; an entry
+// without an event sets the default.
+static bool set_conventions(cchd_config_t *config, const char *list) {
+  const char *entry = list;
+  while (true) {
+    const char *end = strchr(entry, ',');
+    size_t len = end != NULL ? (size_t)(end - entry) : strlen(entry);
+    const char *equals = memchr(entry, '=', len);
+    const char *event = "default";
+    size_t event_len = strlen(event);
+    const char *value = entry;
+    if (equals != NULL) {
+      event = entry;
+      event_len = (size_t)(equals - entry);
+      value = equals + 1;
+    }
+    cchd_output_convention convention;
+    if (event_len == 0 ||
+        !parse_output_convention(value, (size_t)(entry + len - value),
+                                 &convention) ||
+        !set_convention(config, event, event_len, convention)) {
+      return false;
+    }
+    if (end == NULL) {
+      return true;
+    }
+    entry = end + 1;
+  }
+}
+
+static bool set_side_effect(cchd_config_t *config, const char *name,
+                            size_t name_len, cchd_side_effect_type type,
+                            const char *target) {
+  char *copy = strdup(target);
+  if (copy == NULL) {
+    return false;
+  }
+  for (size_t i = 0; i < config->side_effect_count; i++) {
+    cchd_side_effect_t *effect = &config->side_effects[i];
+    if (strlen(effect->name) == name_len &&
+        strncmp(effect->name, name, name_len) == 0) {
+      free(effect->target);
+      effect->type = type;
+      effect->target = copy;
+      return true;
+    }
+  }
+
+  if (config->side_effect_count >= CCHD_MAX_SIDE_EFFECTS) {
+    LOG_WARNING("Ignoring side effect %.*s: at most %d side effects",
+                (int)name_len, name, CCHD_MAX_SIDE_EFFECTS);
+    free(copy);
+    return false;
+  }
+  cchd_side_effect_t *effect = &config->side_effects[config->side_effect_count];
+  effect->name = strndup(name, name_len);
+  if (effect->name == NULL) {
+    free(copy);
+    return false;
+  }
+  effect->type = type;
+  effect->target = copy;
+  config->side_effect_count++;
+  return true;
+}
+
+// Reads "exec:CMD" or "webhook:URL".
+static bool parse_side_effect(const char *spec, cchd_side_effect_type *type,
+                              const char **target) {
+  if (strncmp(spec, "exec:", 5) == 0) {
+    *type = CCHD_SIDE_EFFECT_EXEC;
+    *target = spec + 5;
+  } else if (strncmp(spec, "webhook:", 8) == 0) {
+    *type = CCHD_SIDE_EFFECT_WEBHOOK;
+    *target = spec + 8;
+  } else {
+    return false;
+  }
+  return **target != '\0';
+}
+
 static char *get_config_file_path(void) {
   char *config_path = NULL;
 
@@ -149,19 +464,46 @@ cchd_error cchd_config_load_file(cchd_config_t *config, const char *path) {
       if (yyjson_is_arr(servers_array)) {
         size_t server_count = yyjson_arr_size(servers_array);
         if (server_count > 0 && server_count <= MAX_SERVERS) {
-          // Clear existing servers
-          for (size_t i = 0; i < config->server_count; i++) {
-            free(config->server_urls[i]);
-          }
-          config->server_count = 0;
+          clear_servers(config);
 
           size_t idx, max;
           yyjson_val *server_val;
           yyjson_arr_foreach(servers_array, idx, max, server_val) {
-            if (yyjson_is_str(server_val) &&
-                config->server_count < MAX_SERVERS) {
+            if (config->server_count >= MAX_SERVERS) {
+              break;
+            }
+            if (yyjson_is_str(server_val)) {
               config->server_urls[config->server_count++] =
                   strdup(yyjson_get_str(server_val));
+            } else if (yyjson_is_obj(server_val)) {
+              // {"url": ..., "response_format": ...} pins one server's format
+              yyjson_val *url = yyjson_obj_get(server_val, "url");
+              if (!yyjson_is_str(url)) {
+                LOG_WARNING("Ignoring server_urls entry without a url");
+                continue;
+              }
+              yyjson_val *format =
+                  yyjson_obj_get(server_val, "response_format");
+              if (yyjson_is_str(format) &&
+                  !parse_response_format(
+                      yyjson_get_str(format),
+                      &config->server_formats[config->server_count])) {
+                LOG_WARNING("Ignoring invalid response_format for %s: %s",
+                            yyjson_get_str(url), yyjson_get_str(format));
+              }
+              yyjson_val *weight = yyjson_obj_get(server_val, "weight");
+              if (yyjson_is_num(weight) && yyjson_get_num(weight) > 0) {
+                config->server_weights[config->server_count] =
+                    yyjson_get_num(weight);
+              }
+              config->server_urls[config->server_count++] =
+                  strdup(yyjson_get_str(url));
+            }
+          }
+          if (!weights_complete(config)) {
+            LOG_WARNING("Ignoring server weights: every server needs one");
+            for (size_t i = 0; i < config->server_count; i++) {
+              config->server_weights[i] = 0;
             }
           }
         }
@@ -169,18 +511,31 @@ cchd_error cchd_config_load_file(cchd_config_t *config, const char *path) {
         // Try single server_url for backward compatibility
         yyjson_val *server = yyjson_obj_get(root, "server_url");
         if (yyjson_is_str(server)) {
-          free(config->server_urls[0]);
+          clear_servers(config);
           config->server_urls[0] = strdup(yyjson_get_str(server));
           config->server_count = 1;
         }
       }
 
+      yyjson_val *response_format = yyjson_obj_get(root, "response_format");
+      if (yyjson_is_str(response_format) &&
+          !parse_response_format(yyjson_get_str(response_format),
+                                 &config->response_format)) {
+        LOG_WARNING("Ignoring invalid response_format: %s",
+                    yyjson_get_str(response_format));
+      }
+
       // Load other settings
       yyjson_val *timeout = yyjson_obj_get(root, "timeout_ms");
       if (yyjson_is_int(timeout)) {
         config->timeout_ms = yyjson_get_int(timeout);
       }
 
+      yyjson_val *deadline = yyjson_obj_get(root, "deadline_ms");
+      if (yyjson_is_int(deadline) && yyjson_get_int(deadline) > 0) {
+        config->deadline_ms = yyjson_get_int(deadline);
+      }
+
       yyjson_val *fail_open = yyjson_obj_get(root, "fail_open");
       if (yyjson_is_bool(fail_open)) {
         config->fail_open = yyjson_get_bool(fail_open);
@@ -191,6 +546,167 @@ cchd_error cchd_config_load_file(cchd_config_t *config, const char *path) {
         config->debug = yyjson_get_bool(debug);
       }
 
+      yyjson_val *include_raw = yyjson_obj_get(root, "include_raw");
+      if (yyjson_is_bool(include_raw)) {
+        config->include_raw = yyjson_get_bool(include_raw);
+      }
+
+      yyjson_val *user_id = yyjson_obj_get(root, "user_id");
+      if (yyjson_is_str(user_id)) {
+        free(config->user_id_sources);
+        config->user_id_sources = strdup(yyjson_get_str(user_id));
+      }
+
+      yyjson_val *on_empty = yyjson_obj_get(root, "on_empty_response");
+      if (yyjson_is_str(on_empty) &&
+          !parse_empty_response_policy(yyjson_get_str(on_empty),
+                                       &config->on_empty_response)) {
+        LOG_WARNING("Ignoring invalid on_empty_response: %s",
+                    yyjson_get_str(on_empty));
+      }
+
+      yyjson_val *routes = yyjson_obj_get(root, "routes");
+      if (yyjson_is_obj(routes)) {
+        size_t idx, max;
+        yyjson_val *key, *url;
+        yyjson_obj_foreach(routes, idx, max, key, url) {
+          if (yyjson_is_str(url)) {
+            set_route(config, yyjson_get_str(key), yyjson_get_len(key),
+                      yyjson_get_str(url));
+          }
+        }
+      }
+
+      // "output_convention" is a convention for every event, or an object
+      // with one per hook event name.
+      yyjson_val *conventions = yyjson_obj_get(root, "output_convention");
+      if (yyjson_is_str(conventions) &&
+          !set_conventions(config, yyjson_get_str(conventions))) {
+        LOG_WARNING("Ignoring invalid output_convention: %s",
+                    yyjson_get_str(conventions));
+      } else if (yyjson_is_obj(conventions)) {
+        size_t idx, max;
+        yyjson_val *event, *value;
+        cchd_output_convention convention;
+        yyjson_obj_foreach(conventions, idx, max, event, value) {
+          if (!yyjson_is_str(value) ||
+              !parse_output_convention(yyjson_get_str(value),
+                                       yyjson_get_len(value), &convention)) {
+            LOG_WARNING("Ignoring invalid output_convention for %s",
+                        yyjson_get_str(event));
+            continue;
+          }
+          set_convention(config, yyjson_get_str(event), yyjson_get_len(event),
+                         convention);
+        }
+      }
+
+      // Each side effect is an object with an "exec" command or a "webhook"
+      // URL, keyed by its name.
+      yyjson_val *side_effects = yyjson_obj_get(root, "side_effects");
+      if (yyjson_is_obj(side_effects)) {
+        size_t idx, max;
+        yyjson_val *name, *effect;
+        yyjson_obj_foreach(side_effects, idx, max, name, effect) {
+          yyjson_val *command = yyjson_obj_get(effect, "exec");
+          yyjson_val *webhook = yyjson_obj_get(effect, "webhook");
+          if (yyjson_is_str(command)) {
+            set_side_effect(config, yyjson_get_str(name), yyjson_get_len(name),
+                            CCHD_SIDE_EFFECT_EXEC, yyjson_get_str(command));
+          } else if (yyjson_is_str(webhook)) {
+            set_side_effect(config, yyjson_get_str(name), yyjson_get_len(name),
+                            CCHD_SIDE_EFFECT_WEBHOOK, yyjson_get_str(webhook));
+          } else {
+            LOG_WARNING("Ignoring side effect %s without exec or webhook",
+                        yyjson_get_str(name));
+          }
+        }
+      }
+
+      yyjson_val *on_block = yyjson_obj_get(root, "on_block");
+      if (yyjson_is_str(on_block)) {
+        free(config->on_block);
+        config->on_block = strdup(yyjson_get_str(on_block));
+      }
+
+      yyjson_val *exec_command = yyjson_obj_get(root, "exec");
+      if (yyjson_is_str(exec_command)) {
+        free(config->exec_command);
+        config->exec_command = strdup(yyjson_get_str(exec_command));
+      }
+
+      yyjson_val *exec_sandbox = yyjson_obj_get(root, "exec_sandbox");
+      if (yyjson_is_bool(exec_sandbox)) {
+        config->exec_sandbox = yyjson_get_bool(exec_sandbox);
+      }
+
+      yyjson_val *profile = yyjson_obj_get(root, "exec_sandbox_profile");
+      if (yyjson_is_str(profile)) {
+        free(config->exec_sandbox_profile);
+        config->exec_sandbox_profile = strdup(yyjson_get_str(profile));
+      }
+
+      yyjson_val *output_fd = yyjson_obj_get(root, "output_fd");
+      if (yyjson_is_int(output_fd) && yyjson_get_int(output_fd) >= 0 &&
+          yyjson_get_int(output_fd) <= INT_MAX) {
+        config->output_fd = (int)yyjson_get_int(output_fd);
+      }
+
+      yyjson_val *retry_budget = yyjson_obj_get(root, "retry_budget");
+      if (yyjson_is_int(retry_budget) && yyjson_get_int(retry_budget) >= 0) {
+        config->retry_budget = yyjson_get_int(retry_budget);
+      }
+
+      yyjson_val *max_prompt = yyjson_obj_get(root, "max_forward_prompt");
+      if (yyjson_is_int(max_prompt) && yyjson_get_int(max_prompt) >= 0) {
+        config->max_forward_prompt = yyjson_get_int(max_prompt);
+      }
+
+      yyjson_val *fail_cache = yyjson_obj_get(root, "fail_cache_ttl_ms");
+      if (yyjson_is_int(fail_cache) && yyjson_get_int(fail_cache) >= 0 &&
+          yyjson_get_int(fail_cache) <= FAIL_CACHE_MAX_TTL_MS) {
+        config->fail_cache_ttl_ms = yyjson_get_int(fail_cache);
+      }
+
+      yyjson_val *spool_dir = yyjson_obj_get(root, "spool_dir");
+      if (yyjson_is_str(spool_dir)) {
+        free(config->spool_dir);
+        config->spool_dir = strdup(yyjson_get_str(spool_dir));
+      }
+
+      yyjson_val *forward_env = yyjson_obj_get(root, "forward_env");
+      if (yyjson_is_str(forward_env)) {
+        free(config->forward_env);
+        config->forward_env = strdup(yyjson_get_str(forward_env));
+      }
+
+      yyjson_val *lang = yyjson_obj_get(root, "lang");
+      if (yyjson_is_str(lang)) {
+        free(config->lang);
+        config->lang = strdup(yyjson_get_str(lang));
+      }
+
+      yyjson_val *safe_start = yyjson_obj_get(root, "safe_start");
+      if (yyjson_is_bool(safe_start)) {
+        config->safe_start = yyjson_get_bool(safe_start);
+      }
+
+      yyjson_val *fan_out = yyjson_obj_get(root, "fan_out");
+      if (yyjson_is_bool(fan_out)) {
+        config->fan_out = yyjson_get_bool(fan_out);
+      }
+
+      yyjson_val *arbiter = yyjson_obj_get(root, "arbiter");
+      if (yyjson_is_str(arbiter)) {
+        free(config->arbiter);
+        config->arbiter = strdup(yyjson_get_str(arbiter));
+      }
+
+      yyjson_val *hash_user_id = yyjson_obj_get(root, "hash_user_id");
+      if (yyjson_is_bool(hash_user_id)) {
+        config->hash_user_id = yyjson_get_bool(hash_user_id);
+      }
+
       yyjson_val *api_key_val = yyjson_obj_get(root, "api_key");
       if (yyjson_is_str(api_key_val)) {
         if (config->api_key) {
@@ -198,6 +714,14 @@ cchd_error cchd_config_load_file(cchd_config_t *config, const char *path) {
         }
         config->api_key = cchd_secure_strdup(yyjson_get_str(api_key_val));
       }
+
+      yyjson_val *proxy = yyjson_obj_get(root, "proxy");
+      if (yyjson_is_str(proxy)) {
+        if (config->proxy) {
+          cchd_secure_free(config->proxy, strlen(config->proxy) + 1);
+        }
+        config->proxy = cchd_secure_strdup(yyjson_get_str(proxy));
+      }
     }
     yyjson_doc_free(doc);
   }
@@ -214,7 +738,7 @@ cchd_error cchd_config_load_env(cchd_config_t *config) {
 
   const char *env_server = getenv("HOOK_SERVER_URL");
   if (env_server != NULL) {
-    free(config->server_urls[0]);
+    clear_servers(config);
     config->server_urls[0] = strdup(env_server);
     config->server_count = 1;
   }
@@ -227,6 +751,17 @@ cchd_error cchd_config_load_env(cchd_config_t *config) {
     config->api_key = cchd_secure_strdup(env_api_key);
   }
 
+  const char *env_lang = getenv("CCHD_LANG");
+  if (env_lang != NULL && *env_lang != '\0') {
+    free(config->lang);
+    config->lang = strdup(env_lang);
+  }
+
+  const char *env_deadline = getenv("CCHD_DEADLINE_MS");
+  if (env_deadline != NULL && atol(env_deadline) > 0) {
+    config->deadline_ms = atol(env_deadline);
+  }
+
   return CCHD_SUCCESS;
 }
 
@@ -246,11 +781,7 @@ cchd_error cchd_config_load_args(cchd_config_t *config, int argc,
           return CCHD_ERROR_MEMORY;
         }
 
-        // Clear existing servers
-        for (size_t j = 0; j < config->server_count; j++) {
-          free(config->server_urls[j]);
-        }
-        config->server_count = 0;
+        clear_servers(config);
 
         char *token = strtok(servers_copy, ",");
         while (token != NULL && config->server_count < MAX_SERVERS) {
@@ -261,13 +792,20 @@ cchd_error cchd_config_load_args(cchd_config_t *config, int argc,
           while (end > token && *end == ' ')
             *end-- = '\0';
 
+          split_weight(token, &config->server_weights[config->server_count]);
           config->server_urls[config->server_count++] = strdup(token);
           token = strtok(NULL, ",");
         }
         free(servers_copy);
+
+        if (!weights_complete(config)) {
+          fprintf(stderr,
+                  "Error: --server weights must be given for every server\n");
+          return CCHD_ERROR_INVALID_ARG;
+        }
       } else {
         // Single server
-        free(config->server_urls[0]);
+        clear_servers(config);
         config->server_urls[0] = strdup(server_arg);
         config->server_count = 1;
       }
@@ -295,8 +833,153 @@ cchd_error cchd_config_load_args(cchd_config_t *config, int argc,
         cchd_secure_free(config->api_key, strlen(config->api_key) + 1);
       }
       config->api_key = cchd_secure_strdup(argv[++i]);
+    } else if (strcmp(argv[i], "--proxy") == 0 && i + 1 < argc) {
+      if (config->proxy) {
+        cchd_secure_free(config->proxy, strlen(config->proxy) + 1);
+      }
+      config->proxy = cchd_secure_strdup(argv[++i]);
     } else if (strcmp(argv[i], "--insecure") == 0) {
       config->insecure = true;
+    } else if (strcmp(argv[i], "--include-raw") == 0) {
+      config->include_raw = true;
+    } else if (strcmp(argv[i], "--user-id") == 0 && i + 1 < argc) {
+      free(config->user_id_sources);
+      config->user_id_sources = strdup(argv[++i]);
+    } else if (strcmp(argv[i], "--deadline") == 0 && i + 1 < argc) {
+      int64_t deadline_ms = atol(argv[++i]);
+      if (deadline_ms > 0) {
+        config->deadline_ms = deadline_ms;
+      }
+    } else if (strcmp(argv[i], "--response-format") == 0 && i + 1 < argc) {
+      if (!parse_response_format(argv[++i], &config->response_format)) {
+        fprintf(stderr,
+                "Error: --response-format must be 'modern', 'legacy', or "
+                "'auto', not '%s'\n",
+                argv[i]);
+        return CCHD_ERROR_INVALID_ARG;
+      }
+    } else if (strcmp(argv[i], "--on-empty-response") == 0 && i + 1 < argc) {
+      if (!parse_empty_response_policy(argv[++i],
+                                       &config->on_empty_response)) {
+        fprintf(stderr,
+                "Error: --on-empty-response must be 'allow' or 'block', not "
+                "'%s'\n",
+                argv[i]);
+        return CCHD_ERROR_INVALID_ARG;
+      }
+    } else if (strcmp(argv[i], "--output-convention") == 0 && i + 1 < argc) {
+      if (!set_conventions(config, argv[++i])) {
+        fprintf(stderr,
+                "Error: --output-convention expects [EVENT=]cchd|exit|json, "
+                "comma-separated, not '%s'\n",
+                argv[i]);
+        return CCHD_ERROR_INVALID_ARG;
+      }
+    } else if (strcmp(argv[i], "--route") == 0 && i + 1 < argc) {
+      const char *route = argv[++i];
+      const char *equals = strchr(route, '=');
+      if (equals == NULL || equals == route || equals[1] == '\0') {
+        fprintf(stderr, "Error: --route expects KEY=URL, not '%s'\n", route);
+        return CCHD_ERROR_INVALID_ARG;
+      }
+      if (!set_route(config, route, (size_t)(equals - route), equals + 1)) {
+        return CCHD_ERROR_INVALID_ARG;
+      }
+    } else if (strcmp(argv[i], "--exec") == 0 && i + 1 < argc) {
+      free(config->exec_command);
+      config->exec_command = strdup(argv[++i]);
+    } else if (strcmp(argv[i], "--exec-sandbox") == 0) {
+      config->exec_sandbox = true;
+    } else if (strcmp(argv[i], "--exec-sandbox-profile") == 0 &&
+               i + 1 < argc) {
+      free(config->exec_sandbox_profile);
+      config->exec_sandbox_profile = strdup(argv[++i]);
+      config->exec_sandbox = true;
+    } else if (strcmp(argv[i], "--output-fd") == 0 && i + 1 < argc) {
+      char *end = NULL;
+      long output_fd = strtol(argv[++i], &end, 10);
+      if (end == argv[i] || *end != '\0' || output_fd < 0 ||
+          output_fd > INT_MAX) {
+        fprintf(stderr,
+                "Error: --output-fd must be a file descriptor number, not "
+                "'%s'\n",
+                argv[i]);
+        return CCHD_ERROR_INVALID_ARG;
+      }
+      config->output_fd = (int)output_fd;
+    } else if (strcmp(argv[i], "--retry-budget") == 0 && i + 1 < argc) {
+      char *end = NULL;
+      long long retry_budget = strtoll(argv[++i], &end, 10);
+      if (end == argv[i] || *end != '\0' || retry_budget < 0) {
+        fprintf(stderr,
+                "Error: --retry-budget must be a number of retries, not "
+                "'%s'\n",
+                argv[i]);
+        return CCHD_ERROR_INVALID_ARG;
+      }
+      config->retry_budget = retry_budget;
+    } else if (strcmp(argv[i], "--max-forward-prompt") == 0 &&
+               i + 1 < argc) {
+      char *end = NULL;
+      long long max_prompt = strtoll(argv[++i], &end, 10);
+      if (end == argv[i] || *end != '\0' || max_prompt < 0) {
+        fprintf(stderr,
+                "Error: --max-forward-prompt must be a number of bytes, not "
+                "'%s'\n",
+                argv[i]);
+        return CCHD_ERROR_INVALID_ARG;
+      }
+      config->max_forward_prompt = max_prompt;
+    } else if (strcmp(argv[i], "--fail-cache-ttl") == 0 && i + 1 < argc) {
+      char *end = NULL;
+      long long ttl_ms = strtoll(argv[++i], &end, 10);
+      if (end == argv[i] || *end != '\0' || ttl_ms < 0 ||
+          ttl_ms > FAIL_CACHE_MAX_TTL_MS) {
+        fprintf(stderr,
+                "Error: --fail-cache-ttl must be between 0 and %d ms, not "
+                "'%s'\n",
+                FAIL_CACHE_MAX_TTL_MS, argv[i]);
+        return CCHD_ERROR_INVALID_ARG;
+      }
+      config->fail_cache_ttl_ms = ttl_ms;
+    } else if (strcmp(argv[i], "--spool-dir") == 0 && i + 1 < argc) {
+      free(config->spool_dir);
+      config->spool_dir = strdup(argv[++i]);
+    } else if (strcmp(argv[i], "--forward-env") == 0 && i + 1 < argc) {
+      free(config->forward_env);
+      config->forward_env = strdup(argv[++i]);
+    } else if (strcmp(argv[i], "--lang") == 0 && i + 1 < argc) {
+      free(config->lang);
+      config->lang = strdup(argv[++i]);
+    } else if (strcmp(argv[i], "--hash-user-id") == 0) {
+      config->hash_user_id = true;
+    } else if (strcmp(argv[i], "--safe-start") == 0) {
+      config->safe_start = true;
+    } else if (strcmp(argv[i], "--fan-out") == 0) {
+      config->fan_out = true;
+    } else if (strcmp(argv[i], "--arbiter") == 0 && i + 1 < argc) {
+      free(config->arbiter);
+      config->arbiter = strdup(argv[++i]);
+    } else if (strcmp(argv[i], "--side-effect") == 0 && i + 1 < argc) {
+      const char *entry = argv[++i];
+      const char *equals = strchr(entry, '=');
+      cchd_side_effect_type type;
+      const char *target = NULL;
+      if (equals == NULL || equals == entry ||
+          !parse_side_effect(equals + 1, &type, &target)) {
+        fprintf(stderr,
+                "Error: --side-effect expects NAME=exec:CMD or "
+                "NAME=webhook:URL, not '%s'\n",
+                entry);
+        return CCHD_ERROR_INVALID_ARG;
+      }
+      if (!set_side_effect(config, entry, (size_t)(equals - entry), type,
+                           target)) {
+        return CCHD_ERROR_INVALID_ARG;
+      }
+    } else if (strcmp(argv[i], "--on-block") == 0 && i + 1 < argc) {
+      free(config->on_block);
+      config->on_block = strdup(argv[++i]);
     }
   }
 
@@ -320,6 +1003,10 @@ const char *cchd_config_get_api_key(const cchd_config_t *config) {
   return config ? config->api_key : NULL;
 }
 
+const char *cchd_config_get_proxy(const cchd_config_t *config) {
+  return config ? config->proxy : NULL;
+}
+
 int64_t cchd_config_get_timeout_ms(const cchd_config_t *config) {
   return config ? config->timeout_ms : DEFAULT_TIMEOUT_MS;
 }
@@ -356,6 +1043,233 @@ bool cchd_config_is_insecure(const cchd_config_t *config) {
   return config ? config->insecure : false;
 }
 
+bool cchd_config_is_include_raw(const cchd_config_t *config) {
+  return config ? config->include_raw : false;
+}
+
+const char *cchd_config_get_user_id_sources(const cchd_config_t *config) {
+  return config ? config->user_id_sources : NULL;
+}
+
+bool cchd_config_is_hash_user_id(const cchd_config_t *config) {
+  return config ? config->hash_user_id : false;
+}
+
+cchd_response_format cchd_config_get_response_format(
+    const cchd_config_t *config, size_t server_index) {
+  if (config == NULL) {
+    return CCHD_RESPONSE_FORMAT_AUTO;
+  }
+  if (server_index < config->server_count &&
+      config->server_formats[server_index] != CCHD_RESPONSE_FORMAT_UNSET) {
+    return config->server_formats[server_index];
+  }
+  return config->response_format != CCHD_RESPONSE_FORMAT_UNSET
+             ? config->response_format
+             : CCHD_RESPONSE_FORMAT_AUTO;
+}
+
+bool cchd_config_is_allow_empty_response(const cchd_config_t *config) {
+  if (config == NULL) {
+    return false;
+  }
+  switch (config->on_empty_response) {
+  case CCHD_EMPTY_RESPONSE_ALLOW:
+    return true;
+  case CCHD_EMPTY_RESPONSE_BLOCK:
+    return false;
+  case CCHD_EMPTY_RESPONSE_FAIL_MODE:
+  default:
+    return config->fail_open;
+  }
+}
+
+size_t cchd_config_get_route_count(const cchd_config_t *config) {
+  return config ? config->route_count : 0;
+}
+
+const char *cchd_config_get_route_url(const cchd_config_t *config,
+                                      size_t index) {
+  if (config == NULL || index >= config->route_count) {
+    return NULL;
+  }
+  return config->routes[index].url;
+}
+
+static const char *find_route(const cchd_config_t *config, const char *key) {
+  if (key == NULL) {
+    return NULL;
+  }
+  for (size_t i = 0; i < config->route_count; i++) {
+    if (strcmp(config->routes[i].key, key) == 0) {
+      return config->routes[i].url;
+    }
+  }
+  return NULL;
+}
+
+const char *cchd_config_get_route(const cchd_config_t *config,
+                                  const char *hook_event_name,
+                                  const char *tool_name) {
+  if (config == NULL || config->route_count == 0) {
+    return NULL;
+  }
+  const char *url = find_route(config, tool_name);
+  if (url == NULL) {
+    url = find_route(config, hook_event_name);
+  }
+  if (url == NULL) {
+    url = find_route(config, "default");
+  }
+  return url;
+}
+
+cchd_output_convention cchd_config_get_output_convention(
+    const cchd_config_t *config, const char *hook_event_name) {
+  if (config == NULL) {
+    return CCHD_OUTPUT_CONVENTION_CCHD;
+  }
+  const cchd_convention_t *fallback = NULL;
+  for (size_t i = 0; i < config->convention_count; i++) {
+    const cchd_convention_t *entry = &config->conventions[i];
+    if (hook_event_name != NULL && strcmp(entry->event, hook_event_name) == 0) {
+      return entry->convention;
+    }
+    if (strcmp(entry->event, "default") == 0) {
+      fallback = entry;
+    }
+  }
+  return fallback != NULL ? fallback->convention : CCHD_OUTPUT_CONVENTION_CCHD;
+}
+
+const char *cchd_config_get_exec_command(const cchd_config_t *config) {
+  return config ? config->exec_command : NULL;
+}
+
+bool cchd_config_is_safe_start(const cchd_config_t *config) {
+  return config ? config->safe_start : false;
+}
+
+bool cchd_config_is_fan_out(const cchd_config_t *config) {
+  return config ? config->fan_out : false;
+}
+
+const char *cchd_config_get_arbiter(const cchd_config_t *config) {
+  return config ? config->arbiter : NULL;
+}
+
+size_t cchd_config_get_side_effect_count(const cchd_config_t *config) {
+  return config ? config->side_effect_count : 0;
+}
+
+const char *cchd_config_get_side_effect_name(const cchd_config_t *config,
+                                             size_t index) {
+  if (config == NULL || index >= config->side_effect_count) {
+    return NULL;
+  }
+  return config->side_effects[index].name;
+}
+
+cchd_side_effect_type cchd_config_get_side_effect_type(
+    const cchd_config_t *config, size_t index) {
+  if (config == NULL || index >= config->side_effect_count) {
+    return CCHD_SIDE_EFFECT_EXEC;
+  }
+  return config->side_effects[index].type;
+}
+
+const char *cchd_config_get_side_effect_target(const cchd_config_t *config,
+                                               size_t index) {
+  if (config == NULL || index >= config->side_effect_count) {
+    return NULL;
+  }
+  return config->side_effects[index].target;
+}
+
+const char *cchd_config_get_on_block(const cchd_config_t *config) {
+  return config ? config->on_block : NULL;
+}
+
+bool cchd_config_is_exec_sandbox(const cchd_config_t *config) {
+  return config ? config->exec_sandbox : false;
+}
+
+const char *cchd_config_get_exec_sandbox_profile(const cchd_config_t *config) {
+  return config ? config->exec_sandbox_profile : NULL;
+}
+
+size_t cchd_config_pick_server(const cchd_config_t *config,
+                               const char *event_id) {
+  if (config == NULL || event_id == NULL || config->server_count < 2 ||
+      config->server_weights[0] <= 0) {
+    return 0;
+  }
+
+  double total = 0;
+  for (size_t i = 0; i < config->server_count; i++) {
+    total += config->server_weights[i];
+  }
+
+  // The top 53 bits of the id's hash give a uniform point in [0, 1).
+  uint8_t digest[SHA256_DIGEST_SIZE];
+  cchd_sha256(event_id, strlen(event_id), digest);
+  uint64_t bits = 0;
+  for (size_t i = 0; i < 8; i++) {
+    bits = (bits << 8) | digest[i];
+  }
+  double point = (double)(bits >> 11) / (double)(UINT64_C(1) << 53) * total;
+
+  double cumulative = 0;
+  for (size_t i = 0; i < config->server_count; i++) {
+    cumulative += config->server_weights[i];
+    if (point < cumulative) {
+      return i;
+    }
+  }
+  return config->server_count - 1;
+}
+
+int cchd_config_get_output_fd(const cchd_config_t *config) {
+  return config ? config->output_fd : STDOUT_FILENO;
+}
+
+int64_t cchd_config_get_retry_budget(const cchd_config_t *config) {
+  return config ? config->retry_budget : 0;
+}
+
+int64_t cchd_config_get_max_forward_prompt(const cchd_config_t *config) {
+  return config ? config->max_forward_prompt : 0;
+}
+
+int64_t cchd_config_get_fail_cache_ttl_ms(const cchd_config_t *config) {
+  return config ? config->fail_cache_ttl_ms : 0;
+}
+
+const char *cchd_config_get_spool_dir(const cchd_config_t *config) {
+  return config ? config->spool_dir : NULL;
+}
+
+const char *cchd_config_get_forward_env(const cchd_config_t *config) {
+  return config ? config->forward_env : NULL;
+}
+
+const char *cchd_config_get_lang(const cchd_config_t *config) {
+  return config ? config->lang : NULL;
+}
+
+int64_t cchd_config_get_remaining_ms(const cchd_config_t *config) {
+  if (config == NULL || config->deadline_ms <= 0) {
+    return -1;
+  }
+
+  struct timespec now;
+  clock_gettime(CLOCK_MONOTONIC, &now);
+  int64_t elapsed_ms = (now.tv_sec - config->started.tv_sec) * 1000 +
+                       (now.tv_nsec - config->started.tv_nsec) / 1000000;
+  int64_t remaining_ms = config->deadline_ms - elapsed_ms;
+  return remaining_ms > 0 ? remaining_ms : 0;
+}
+
 // Setters
 void cchd_config_set_debug(cchd_config_t *config, bool debug) {
   if (config) {
@@ -367,4 +1281,37 @@ void cchd_config_add_server_url(cchd_config_t *config, const char *url) {
   if (config && url && config->server_count < MAX_SERVERS) {
     config->server_urls[config->server_count++] = strdup(url);
   }
+}
+
+void cchd_config_replace_server(cchd_config_t *config, size_t index,
+                                char *const *urls, size_t count) {
+  if (config == NULL || index >= config->server_count || count == 0) {
+    return;
+  }
+  // The servers after it stay, since one of its own always fits in its
+  // place.
+  size_t after = config->server_count - index - 1;
+  if (index + count + after > MAX_SERVERS) {
+    LOG_WARNING("Dropping %zu servers for %s: at most %d servers",
+                index + count + after - MAX_SERVERS,
+                config->server_urls[index], MAX_SERVERS);
+    count = MAX_SERVERS - index - after;
+  }
+
+  cchd_response_format format = config->server_formats[index];
+  double weight = config->server_weights[index];
+  free(config->server_urls[index]);
+  memmove(&config->server_urls[index + count],
+          &config->server_urls[index + 1], after * sizeof(char *));
+  memmove(&config->server_formats[index + count],
+          &config->server_formats[index + 1],
+          after * sizeof(cchd_response_format));
+  memmove(&config->server_weights[index + count],
+          &config->server_weights[index + 1], after * sizeof(double));
+  for (size_t i = 0; i < count; i++) {
+    config->server_urls[index + i] = strdup(urls[i]);
+    config->server_formats[index + i] = format;
+    config->server_weights[index + i] = weight / (double)count;
+  }
+  config->server_count = index + count + after;
 }
\ No newline at end of file
@@ -20,6 +20,24 @@
 // an inconsistent state.
 typedef struct cchd_config cchd_config_t;
 
+// What to do when the server answers 200 with an empty body, which carries no
+// decision. The default follows the fail mode, like any other unusable answer.
+typedef enum {
+  CCHD_EMPTY_RESPONSE_FAIL_MODE = 0,
+  CCHD_EMPTY_RESPONSE_ALLOW,
+  CCHD_EMPTY_RESPONSE_BLOCK,
+} cchd_empty_response_policy;
+
+// Local side effects are named, so a server can ask for one without being
+// able to say what runs. EXEC runs a command through /bin/sh; WEBHOOK posts
+// to a URL.
+#define CCHD_MAX_SIDE_EFFECTS 16
+
+typedef enum {
+  CCHD_SIDE_EFFECT_EXEC,
+  CCHD_SIDE_EFFECT_WEBHOOK,
+} cchd_side_effect_type;
+
 // Create and destroy configuration objects with proper lifecycle management.
 // The create function allocates and initializes with defaults, while destroy
 // ensures all allocated resources (URLs, keys) are properly freed to prevent leaks.
@@ -43,6 +61,9 @@ const char *cchd_config_get_server_url(const cchd_config_t *config,
                                        size_t index);
 size_t cchd_config_get_server_count(const cchd_config_t *config);
 const char *cchd_config_get_api_key(const cchd_config_t *config);
+// Proxy for server requests from --proxy or the config file, overriding the
+// proxy environment variables; "" means none. NULL when not set.
+const char *cchd_config_get_proxy(const cchd_config_t *config);
 int64_t cchd_config_get_timeout_ms(const cchd_config_t *config);
 bool cchd_config_is_fail_open(const cchd_config_t *config);
 bool cchd_config_is_quiet(const cchd_config_t *config);
@@ -52,10 +73,82 @@ bool cchd_config_is_plain_output(const cchd_config_t *config);
 bool cchd_config_is_no_color(const cchd_config_t *config);
 bool cchd_config_is_no_input(const cchd_config_t *config);
 bool cchd_config_is_insecure(const cchd_config_t *config);
+bool cchd_config_is_include_raw(const cchd_config_t *config);
+const char *cchd_config_get_user_id_sources(const cchd_config_t *config);
+bool cchd_config_is_hash_user_id(const cchd_config_t *config);
+const char *cchd_config_get_forward_env(const cchd_config_t *config);
+const char *cchd_config_get_spool_dir(const cchd_config_t *config);
+// Policy program run instead of contacting a server, and whether it runs
+// sandboxed. A profile implies the sandbox.
+const char *cchd_config_get_exec_command(const cchd_config_t *config);
+bool cchd_config_is_exec_sandbox(const cchd_config_t *config);
+const char *cchd_config_get_exec_sandbox_profile(const cchd_config_t *config);
+// Index of the server an event goes to first. With weighted servers it is
+// drawn by weight from a hash of the event id, so retries of one event stay
+// on one server; otherwise it is 0.
+size_t cchd_config_pick_server(const cchd_config_t *config,
+                               const char *event_id);
+// File descriptor the Claude-facing output goes to; stdout by default.
+int cchd_config_get_output_fd(const cchd_config_t *config);
+// Whether tools that change things are blocked until the session's server
+// has answered once.
+bool cchd_config_is_safe_start(const cchd_config_t *config);
+// Whether every event goes to all servers and their answers are combined,
+// instead of the servers being fallbacks for each other.
+bool cchd_config_is_fan_out(const cchd_config_t *config);
+// Endpoint that settles fan-out answers which conflict; NULL when unset.
+const char *cchd_config_get_arbiter(const cchd_config_t *config);
+// The configured side effects, by index: each has a name, a type and the
+// command or URL it runs.
+size_t cchd_config_get_side_effect_count(const cchd_config_t *config);
+const char *cchd_config_get_side_effect_name(const cchd_config_t *config,
+                                             size_t index);
+cchd_side_effect_type cchd_config_get_side_effect_type(
+    const cchd_config_t *config, size_t index);
+const char *cchd_config_get_side_effect_target(const cchd_config_t *config,
+                                               size_t index);
+// Comma-separated side effects run on every block; NULL when unset.
+const char *cchd_config_get_on_block(const cchd_config_t *config);
+// Retries a session may make in total before refills; 0 means unlimited.
+int64_t cchd_config_get_retry_budget(const cchd_config_t *config);
+// Bytes of a prompt forwarded to the server; 0 means all of it.
+int64_t cchd_config_get_max_forward_prompt(const cchd_config_t *config);
+// How long a failed request's outcome is repeated for identical events; 0
+// means it isn't.
+int64_t cchd_config_get_fail_cache_ttl_ms(const cchd_config_t *config);
+// The server routed to for an event: the route for its tool name if any,
+// else for its hook event name, else the "default" route. NULL when no route
+// matches, in which case the configured server list is used.
+const char *cchd_config_get_route(const cchd_config_t *config,
+                                  const char *hook_event_name,
+                                  const char *tool_name);
+size_t cchd_config_get_route_count(const cchd_config_t *config);
+const char *cchd_config_get_route_url(const cchd_config_t *config,
+                                      size_t index);
+// Format the server at server_index must answer in: its own pin from the
+// config file if it has one, else --response-format, else auto.
+cchd_response_format cchd_config_get_response_format(
+    const cchd_config_t *config, size_t server_index);
+// Whether an empty 200 response allows the operation, after resolving the
+// fail-mode default.
+bool cchd_config_is_allow_empty_response(const cchd_config_t *config);
+// How the decision for an event is handed back to Claude: the convention
+// for its hook event name, else the "default" one, else cchd's own.
+cchd_output_convention cchd_config_get_output_convention(
+    const cchd_config_t *config, const char *hook_event_name);
+const char *cchd_config_get_lang(const cchd_config_t *config);
+// Milliseconds left before the --deadline, measured from config creation;
+// 0 once it has passed and -1 when no deadline is set.
+int64_t cchd_config_get_remaining_ms(const cchd_config_t *config);
 
 // Configuration setters for programmatic use during initialization.
 // These are primarily used by the load functions and testing code.
 // Application code should prefer using the load functions to ensure
 // proper validation and consistent behavior.
 void cchd_config_set_debug(cchd_config_t *config, bool debug);
-void cchd_config_add_server_url(cchd_config_t *config, const char *url);
\ No newline at end of file
+void cchd_config_add_server_url(cchd_config_t *config, const char *url);
+// Replaces the server at index with count servers in its place, each with
+// its response format pin and an equal share of its weight. Servers past the
+// limit are dropped.
+void cchd_config_replace_server(cchd_config_t *config, size_t index,
+                                char *const *urls, size_t count);
\ No newline at end of file
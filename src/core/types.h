@@ -20,12 +20,42 @@ typedef struct cchd_config cchd_config_t;
 // Response buffer dynamically grows to accommodate HTTP responses of varying
 // sizes. We use a separate capacity field to minimize reallocation overhead
 // when receiving large responses in chunks.
+// server_index records which configured server produced the response, since
+// settings such as the pinned response format can differ per server. It is
+// SIZE_MAX when the event was routed to a server outside the list.
+// server_url names that server for the audit trail; it points into the
+// configuration and is NULL when a policy program answered.
 typedef struct {
   char *data;
   size_t size;
   size_t capacity;
+  size_t server_index;
+  const char *server_url;
 } cchd_response_buffer_t;
 
+// Response format a server is expected to answer in. Modern servers give
+// PreToolUse decisions as hookSpecificOutput.permissionDecision; legacy ones
+// use the top-level decision field. Auto accepts either, and UNSET marks a
+// server without its own pin, which then inherits the global setting.
+typedef enum {
+  CCHD_RESPONSE_FORMAT_UNSET = 0,
+  CCHD_RESPONSE_FORMAT_AUTO,
+  CCHD_RESPONSE_FORMAT_MODERN,
+  CCHD_RESPONSE_FORMAT_LEGACY,
+} cchd_response_format;
+
+// How a decision is handed back to Claude. CCHD is cchd's own convention:
+// exit 0, 1 or 2 for allow, block or ask, with the input or the
+// modification echoed on stdout. EXIT is Claude Code's exit-code convention,
+// where only exit 2 blocks and the reason goes to stderr. JSON is its stdout
+// convention: exit 0 with the decision in the JSON Claude reads for the
+// event.
+typedef enum {
+  CCHD_OUTPUT_CONVENTION_CCHD = 0,
+  CCHD_OUTPUT_CONVENTION_EXIT,
+  CCHD_OUTPUT_CONVENTION_JSON,
+} cchd_output_convention;
+
 // C23 compatibility macros ensure code can compile on both C23 and pre-C23
 // compilers. These allow us to use modern C23 features while maintaining
 // backward compatibility with C11/C17 toolchains that users might have
@@ -66,5 +96,6 @@ typedef struct {
 #define RESPONSE_BUFFER_INITIAL_SIZE (64 * 1024)
 #define TIMESTAMP_BUFFER_SIZE 32
 #define ID_BUFFER_SIZE 64
+#define NONCE_BYTES 16
 #define INITIAL_RETRY_DELAY_MS 500
 #define TYPE_BUFFER_SIZE 256
\ No newline at end of file
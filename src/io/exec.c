@@ -0,0 +1,241 @@
+/*
+ * External policy program implementation.
+ *
+ * The payload is written and the answer read through one poll loop, so a
+ * program that starts answering before it has read all its input can't
+ * deadlock against us on full pipes.
+ */
+
+#include "exec.h"
+
+#include <errno.h>
+#include <fcntl.h>
+#include <poll.h>
+#include <signal.h>
+#include <stdio.h>
+#include <string.h>
+#include <sys/wait.h>
+#include <time.h>
+#include <unistd.h>
+
+#include "../core/config.h"
+#include "../core/error.h"
+#include "../utils/logging.h"
+#include "../utils/memory.h"
+#include "sandbox.h"
+
+static int64_t monotonic_ms(void) {
+  struct timespec now;
+  clock_gettime(CLOCK_MONOTONIC, &now);
+  return (int64_t)now.tv_sec * 1000 + now.tv_nsec / 1000000;
+}
+
+// The request timeout, cut to whatever the --deadline leaves.
+static int64_t exec_timeout_ms(const cchd_config_t *config) {
+  int64_t timeout_ms = cchd_config_get_timeout_ms(config);
+  int64_t remaining_ms = cchd_config_get_remaining_ms(config);
+  if (remaining_ms >= 0 && remaining_ms < timeout_ms) {
+    return remaining_ms;
+  }
+  return timeout_ms;
+}
+
+// pipe2 isn't available on macOS, so close-on-exec is set separately. The
+// child's ends are dup'ed onto stdio, which clears the flag on the copies.
+static bool open_pipe(int fds[2]) {
+  if (pipe(fds) != 0) {
+    return false;
+  }
+  fcntl(fds[0], F_SETFD, FD_CLOEXEC);
+  fcntl(fds[1], F_SETFD, FD_CLOEXEC);
+  return true;
+}
+
+static bool append_output(cchd_response_buffer_t *response, const char *data,
+                          size_t len) {
+  size_t required_size = response->size + len + 1;
+  if (required_size > EXEC_OUTPUT_MAX_BYTES) {
+    return false;
+  }
+  if (required_size > response->capacity) {
+    size_t new_capacity = response->capacity ? response->capacity * 2
+                                             : RESPONSE_BUFFER_INITIAL_SIZE;
+    if (new_capacity < required_size) {
+      new_capacity = required_size;
+    }
+    char *new_data =
+        cchd_secure_realloc(response->data, response->capacity, new_capacity);
+    if (new_data == NULL) {
+      return false;
+    }
+    response->data = new_data;
+    response->capacity = new_capacity;
+  }
+  memcpy(response->data + response->size, data, len);
+  response->size += len;
+  response->data[response->size] = '\0';
+  return true;
+}
+
+// Never returns: the child either becomes the policy program or exits.
+static void run_child(const cchd_config_t *config, const char *command,
+                      int stdin_fd, int stdout_fd) {
+  if (dup2(stdin_fd, STDIN_FILENO) < 0 || dup2(stdout_fd, STDOUT_FILENO) < 0) {
+    _exit(126);
+  }
+  if (cchd_config_is_exec_sandbox(config) &&
+      !cchd_sandbox_apply(cchd_config_get_exec_sandbox_profile(config))) {
+    _exit(126);
+  }
+  execl("/bin/sh", "sh", "-c", command, (char *)NULL);
+  _exit(127);
+}
+
+// Feeds the payload and collects the answer until the program closes its
+// stdout. Returns 0, or a negative CCHD error code after killing it.
+static int32_t exchange(pid_t pid, int write_fd, int read_fd,
+                        const char *json_payload,
+                        cchd_response_buffer_t *response, int64_t timeout_ms) {
+  size_t payload_len = strlen(json_payload);
+  size_t written = 0;
+  int64_t deadline = monotonic_ms() + timeout_ms;
+
+  fcntl(write_fd, F_SETFL, fcntl(write_fd, F_GETFL) | O_NONBLOCK);
+  if (payload_len == 0) {
+    close(write_fd);
+    write_fd = -1;
+  }
+
+  int32_t result = 0;
+  for (;;) {
+    int64_t left_ms = deadline - monotonic_ms();
+    if (left_ms <= 0) {
+      LOG_ERROR("Policy program timed out after %lldms",
+                (long long)timeout_ms);
+      result = -CCHD_ERROR_TIMEOUT;
+      break;
+    }
+
+    struct pollfd fds[2] = {{.fd = read_fd, .events = POLLIN},
+                            {.fd = write_fd, .events = POLLOUT}};
+    int ready = poll(fds, write_fd >= 0 ? 2 : 1, (int)left_ms);
+    if (ready < 0 && errno != EINTR) {
+      result = -CCHD_ERROR_IO;
+      break;
+    }
+    if (ready <= 0) {
+      continue;
+    }
+
+    if (write_fd >= 0 && fds[1].revents != 0) {
+      ssize_t n =
+          write(write_fd, json_payload + written, payload_len - written);
+      if (n > 0) {
+        written += (size_t)n;
+      }
+      // A program that stops reading early just doesn't get the rest.
+      if (written == payload_len || (n < 0 && errno != EAGAIN)) {
+        close(write_fd);
+        write_fd = -1;
+      }
+    }
+
+    if (fds[0].revents != 0) {
+      char chunk[4096];
+      ssize_t n = read(read_fd, chunk, sizeof(chunk));
+      if (n == 0) {
+        break;
+      }
+      if (n < 0) {
+        if (errno == EINTR || errno == EAGAIN) {
+          continue;
+        }
+        result = -CCHD_ERROR_IO;
+        break;
+      }
+      if (!append_output(response, chunk, (size_t)n)) {
+        LOG_ERROR("Policy program output exceeds %d bytes",
+                  EXEC_OUTPUT_MAX_BYTES);
+        result = -CCHD_ERROR_SERVER_INVALID;
+        break;
+      }
+    }
+  }
+
+  if (write_fd >= 0) {
+    close(write_fd);
+  }
+  if (result != 0) {
+    kill(pid, SIGKILL);
+  }
+  return result;
+}
+
+int32_t cchd_exec_policy(const cchd_config_t *config, const char *json_payload,
+                         cchd_response_buffer_t *response) {
+  const char *command = cchd_config_get_exec_command(config);
+  if (command == NULL || json_payload == NULL || response == NULL) {
+    return -CCHD_ERROR_INVALID_ARG;
+  }
+
+  int64_t timeout_ms = exec_timeout_ms(config);
+  if (timeout_ms <= 0) {
+    LOG_WARNING("Deadline passed before the policy program could run");
+    return -CCHD_ERROR_TIMEOUT;
+  }
+
+  int to_child[2];
+  int from_child[2];
+  if (!open_pipe(to_child)) {
+    return -CCHD_ERROR_RESOURCE;
+  }
+  if (!open_pipe(from_child)) {
+    close(to_child[0]);
+    close(to_child[1]);
+    return -CCHD_ERROR_RESOURCE;
+  }
+
+  // A program that exits without reading its input must not take the
+  // dispatcher down with SIGPIPE.
+  struct sigaction ignore = {.sa_handler = SIG_IGN};
+  struct sigaction previous;
+  sigaction(SIGPIPE, &ignore, &previous);
+
+  LOG_DEBUG("Running policy program: %s", command);
+  pid_t pid = fork();
+  if (pid == 0) {
+    run_child(config, command, to_child[0], from_child[1]);
+  }
+  close(to_child[0]);
+  close(from_child[1]);
+
+  int32_t result;
+  if (pid < 0) {
+    LOG_ERROR("Cannot start policy program: %s", strerror(errno));
+    close(to_child[1]);
+    result = -CCHD_ERROR_RESOURCE;
+  } else {
+    response->size = 0;
+    result = exchange(pid, to_child[1], from_child[0], json_payload, response,
+                      timeout_ms);
+
+    int status = 0;
+    while (waitpid(pid, &status, 0) < 0 && errno == EINTR) {
+    }
+    if (result == 0) {
+      if (WIFEXITED(status) && WEXITSTATUS(status) == 0) {
+        response->server_index = SIZE_MAX;
+        result = 200;
+      } else if (WIFEXITED(status)) {
+        LOG_ERROR("Policy program exited with status %d", WEXITSTATUS(status));
+        result = -CCHD_ERROR_HTTP_SERVER;
+      } else {
+        LOG_ERROR("Policy program was killed by signal %d", WTERMSIG(status));
+        result = -CCHD_ERROR_HTTP_SERVER;
+      }
+    }
+  }
+  close(from_child[0]);
+  sigaction(SIGPIPE, &previous, NULL);
+  return result;
+}
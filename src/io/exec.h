@@ -0,0 +1,29 @@
+/*
+ * External policy program for CCHD.
+ *
+ * With --exec the decision comes from a local program instead of a server:
+ * it reads the CloudEvent on stdin and answers on stdout with the same JSON a
+ * server would send. Everything downstream (response parsing, fail mode,
+ * output) is shared with the HTTP path.
+ */
+
+#pragma once
+
+#include <stdint.h>
+
+#include "../core/types.h"
+
+// Forward declaration to read the command and sandbox settings.
+typedef struct cchd_config cchd_config_t;
+
+// Upper bound on what a policy program may print, matching the idea that a
+// response is a small decision document.
+#define EXEC_OUTPUT_MAX_BYTES (4 * 1024 * 1024)
+
+// Runs the configured policy program through /bin/sh with json_payload on
+// its stdin and collects its stdout into response. The program gets the
+// request timeout, cut to the deadline, to answer. Returns 200 when it exits
+// 0, or a negative CCHD error code, like cchd_send_request_to_server.
+CCHD_NODISCARD int32_t cchd_exec_policy(const cchd_config_t *config,
+                                        const char *json_payload,
+                                        cchd_response_buffer_t *response);
@@ -13,6 +13,7 @@
 #include <string.h>
 #include <sys/stat.h>
 #include <unistd.h>
+#include <zlib.h>
 
 #include "../utils/logging.h"
 #include "../utils/memory.h"
@@ -22,6 +23,82 @@ static_assert(INPUT_MAX_SIZE >= 512 * 1024, "Input max size too small");
 static_assert(INPUT_BUFFER_INITIAL_SIZE >= 8192,
               "Initial input buffer too small");
 
+// A JSON document can't start with the gzip magic number, so compressed
+// input is told apart without a flag.
+static bool is_gzip(const char *buffer, size_t size) {
+  return size >= 2 && (unsigned char)buffer[0] == 0x1f &&
+         (unsigned char)buffer[1] == 0x8b;
+}
+
+// Replaces a gzip buffer with what it decompresses to. The output is held
+// to INPUT_MAX_SIZE like plain input, so a small bomb can't exhaust memory.
+// Returns false, with the buffer freed, when the input is corrupt or too
+// large.
+static bool gunzip_input(char **buffer, size_t *size, size_t *capacity) {
+  size_t out_capacity = INPUT_BUFFER_INITIAL_SIZE;
+  char *out = cchd_secure_malloc(out_capacity);
+  if (out == NULL) {
+    cchd_secure_free(*buffer, *capacity);
+    errno = ENOMEM;
+    return false;
+  }
+
+  errno = 0;
+  z_stream stream = {.next_in = (Bytef *)*buffer, .avail_in = (uInt)*size};
+  // 16 + MAX_WBITS accepts gzip framing only.
+  int status = inflateInit2(&stream, 16 + MAX_WBITS);
+  while (status == Z_OK) {
+    if (stream.total_out + 1 >= out_capacity) {
+      if (out_capacity >= INPUT_MAX_SIZE) {
+        LOG_ERROR("Decompressed input exceeds maximum size limit (%d bytes)",
+                  INPUT_MAX_SIZE);
+        errno = E2BIG;
+        status = Z_MEM_ERROR;
+        break;
+      }
+      size_t new_capacity = out_capacity * 2 < INPUT_MAX_SIZE
+                                ? out_capacity * 2
+                                : INPUT_MAX_SIZE;
+      char *new_out = cchd_secure_realloc(out, out_capacity, new_capacity);
+      if (new_out == NULL) {
+        errno = ENOMEM;
+        status = Z_MEM_ERROR;
+        break;
+      }
+      out = new_out;
+      out_capacity = new_capacity;
+    }
+    // One byte stays free for the terminator.
+    stream.next_out = (Bytef *)out + stream.total_out;
+    stream.avail_out = (uInt)(out_capacity - stream.total_out - 1);
+    status = inflate(&stream, Z_NO_FLUSH);
+    if (status == Z_BUF_ERROR && stream.avail_out > 0) {
+      break;  // Truncated input: no more to read and no progress.
+    }
+    if (status == Z_BUF_ERROR) {
+      status = Z_OK;
+    }
+  }
+  size_t out_size = stream.total_out;
+  inflateEnd(&stream);
+
+  cchd_secure_free(*buffer, *capacity);
+  if (status != Z_STREAM_END) {
+    if (errno != E2BIG && errno != ENOMEM) {
+      LOG_ERROR("Input is not valid gzip data");
+      errno = EINVAL;
+    }
+    cchd_secure_free(out, out_capacity);
+    return false;
+  }
+  LOG_DEBUG("Decompressed %zu bytes of gzip input to %zu", *size, out_size);
+  out[out_size] = '\0';
+  *buffer = out;
+  *size = out_size;
+  *capacity = out_capacity;
+  return true;
+}
+
 char *cchd_read_input_from_stdin(void) {
   if (stdin == NULL) {
     LOG_ERROR("stdin is NULL");
@@ -88,6 +165,11 @@ char *cchd_read_input_from_stdin(void) {
     }
   }
 
+  if (is_gzip(buffer, total_size) &&
+      !gunzip_input(&buffer, &total_size, &capacity)) {
+    return nullptr;
+  }
+
   buffer[total_size] = '\0';
   if (strlen(buffer) != total_size || total_size > INPUT_MAX_SIZE) {
     LOG_ERROR("Buffer size validation failed");
@@ -226,6 +308,11 @@ char *cchd_read_input_from_stdin_async(void) {
 
   fcntl(stdin_fd, F_SETFL, original_flags);
 
+  if (is_gzip(buffer, total_size) &&
+      !gunzip_input(&buffer, &total_size, &capacity)) {
+    return nullptr;
+  }
+
   buffer[total_size] = '\0';
   if (strlen(buffer) != total_size || total_size > INPUT_MAX_SIZE) {
     LOG_ERROR("Buffer size validation failed");
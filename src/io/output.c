@@ -4,40 +4,193 @@
 
 #include "output.h"
 
+#include <errno.h>
+#include <signal.h>
 #include <stdio.h>
+#include <string.h>
+#include <unistd.h>
 
 #include "../core/config.h"
 #include "../utils/logging.h"
 
-void cchd_handle_output(bool suppress_output, const char *modified_output_json,
-                        const char *input_json_string,
-                        const cchd_config_t *config, int32_t exit_code) {
+// Stream for the output fd. A duplicate is wrapped so closing the stream
+// leaves the caller's descriptor open.
+static FILE *open_output(const cchd_config_t *config) {
+  int fd = cchd_config_get_output_fd(config);
+  if (fd == STDOUT_FILENO) {
+    return stdout;
+  }
+  int copy = dup(fd);
+  FILE *stream = copy >= 0 ? fdopen(copy, "w") : nullptr;
+  if (stream == nullptr) {
+    LOG_ERROR("Cannot write output to fd %d", fd);
+    if (copy >= 0) {
+      close(copy);
+    }
+  }
+  return stream;
+}
+
+// Writes s as a JSON string literal.
+static void write_json_string(FILE *out, const char *s) {
+  fputc('"', out);
+  for (; *s != '\0'; s++) {
+    unsigned char c = (unsigned char)*s;
+    if (c == '"' || c == '\\') {
+      fprintf(out, "\\%c", c);
+    } else if (c < 0x20) {
+      fprintf(out, "\\u%04x", c);
+    } else {
+      fputc(c, out);
+    }
+  }
+  fputc('"', out);
+}
+
+// Flushes the output. When Claude has gone away (the user cancelled the
+// hook) the write fails with EPIPE; that's expected and only worth a debug
+// line, since nobody is left to read the decision.
+static void finish_output(FILE *out) {
+  if (fflush(out) == 0 && !ferror(out)) {
+    return;
+  }
+  if (errno == EPIPE) {
+    LOG_DEBUG("Output pipe closed by Claude, decision not delivered");
+  } else {
+    LOG_ERROR("Failed to write output: %s", strerror(errno));
+  }
+}
+
+// Events whose stdout JSON can stop what they report: PreToolUse through
+// its permissionDecision, the others through a top-level "decision".
+static bool has_json_decision(const char *hook_event_name) {
+  static const char *const events[] = {"PreToolUse", "PostToolUse",
+                                       "UserPromptSubmit", "Stop",
+                                       "SubagentStop"};
+  for (size_t i = 0; hook_event_name != nullptr &&
+                     i < sizeof(events) / sizeof(events[0]);
+       i++) {
+    if (strcmp(hook_event_name, events[i]) == 0) {
+      return true;
+    }
+  }
+  return false;
+}
+
+// Claude shows the reason to the model or the user, so a decision without
+// one from the server still gets something readable.
+static const char *decision_reason(const char *reason, int32_t exit_code) {
+  if (reason != nullptr) {
+    return reason;
+  }
+  switch (exit_code) {
+  case 1:
+    return "Blocked by policy";
+  case 2:
+    return "Approval required by policy";
+  default:
+    return "Policy server unavailable";
+  }
+}
+
+// The stdout JSON for a decision that isn't an allow. An ask becomes a
+// PreToolUse "ask"; the other events can only block.
+static void write_json_decision(FILE *out, const char *hook_event_name,
+                                const char *reason, int32_t exit_code) {
+  if (strcmp(hook_event_name, "PreToolUse") == 0) {
+    fprintf(out,
+            "{\"hookSpecificOutput\":{\"hookEventName\":\"PreToolUse\","
+            "\"permissionDecision\":\"%s\",\"permissionDecisionReason\":",
+            exit_code == 2 ? "ask" : "deny");
+    write_json_string(out, reason);
+    fprintf(out, "}}\n");
+  } else {
+    fprintf(out, "{\"decision\":\"block\",\"reason\":");
+    write_json_string(out, reason);
+    fprintf(out, "}\n");
+  }
+}
+
+int32_t cchd_handle_output(bool suppress_output,
+                           const char *modified_output_json,
+                           const char *input_json_string,
+                           const char *decided_by,
+                           const char *hook_event_name, const char *reason,
+                           const cchd_config_t *config, int32_t exit_code) {
   if (input_json_string == nullptr || config == nullptr) {
     LOG_ERROR("Invalid parameters in handle_output");
-    return;
+    return exit_code;
+  }
+
+  cchd_output_convention convention =
+      cchd_config_get_output_convention(config, hook_event_name);
+  // JSON can't stop the other events, for which exit 2 is the way.
+  if (convention == CCHD_OUTPUT_CONVENTION_JSON &&
+      !has_json_decision(hook_event_name)) {
+    convention = CCHD_OUTPUT_CONVENTION_EXIT;
   }
 
-  if (!suppress_output) {
-    if (cchd_config_is_json_output(config)) {
+  // Claude doesn't echo the input back, and it won't act on a decision
+  // wrapped in it, so only cchd's convention prints one.
+  bool write_input = convention == CCHD_OUTPUT_CONVENTION_CCHD;
+  bool write_decision =
+      convention == CCHD_OUTPUT_CONVENTION_JSON && exit_code != 0;
+  int32_t final_exit_code = exit_code;
+  if (convention == CCHD_OUTPUT_CONVENTION_EXIT && exit_code != 0) {
+    // Any other nonzero code is a non-blocking error to Claude, which would
+    // let a block or a fail-closed outcome through.
+    final_exit_code = 2;
+  } else if (convention == CCHD_OUTPUT_CONVENTION_JSON) {
+    final_exit_code = 0;
+  }
+
+  if ((!suppress_output && (write_input || modified_output_json)) ||
+      write_decision) {
+    FILE *out = open_output(config);
+    if (out == nullptr) {
+      return final_exit_code;
+    }
+
+    // A closed pipe must turn into EPIPE rather than killing cchd with
+    // SIGPIPE. Output is the last thing written, so the signal stays ignored
+    // through the flush at exit.
+    signal(SIGPIPE, SIG_IGN);
+
+    if (write_decision) {
+      write_json_decision(out, hook_event_name,
+                          decision_reason(reason, exit_code), exit_code);
+    } else if (!write_input) {
+      // An allow with a modification, which carries its own output.
+      fprintf(out, "%s\n", modified_output_json);
+    } else if (cchd_config_is_json_output(config)) {
       // Output structured JSON response
-      printf("{\"status\":\"%s\",\"exit_code\":%d,\"modified\":%s",
-             exit_code == 0 ? "allowed"
-                            : (exit_code == 1 ? "blocked" : "ask_user"),
-             exit_code, modified_output_json ? "true" : "false");
+      fprintf(out, "{\"status\":\"%s\",\"exit_code\":%d,\"modified\":%s",
+              exit_code == 0 ? "allowed"
+                             : (exit_code == 1 ? "blocked" : "ask_user"),
+              exit_code, modified_output_json ? "true" : "false");
+      if (decided_by) {
+        fprintf(out, ",\"server\":");
+        write_json_string(out, decided_by);
+      }
       if (modified_output_json) {
-        printf(",\"data\":%s", modified_output_json);
+        fprintf(out, ",\"data\":%s", modified_output_json);
       }
-      printf("}\n");
+      fprintf(out, "}\n");
     } else if (cchd_config_is_plain_output(config)) {
       // Plain output without any formatting
       const char *output =
           modified_output_json ? modified_output_json : input_json_string;
-      printf("%s\n", output);
+      fprintf(out, "%s\n", output);
     } else {
       // Default formatted output
       const char *output =
           modified_output_json ? modified_output_json : input_json_string;
-      printf("%s\n", output);
+      fprintf(out, "%s\n", output);
+    }
+    finish_output(out);
+    if (out != stdout) {
+      fclose(out);
     }
   }
-}
\ No newline at end of file
+  return final_exit_code;
+}
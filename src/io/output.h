@@ -22,6 +22,13 @@ typedef struct cchd_config cchd_config_t;
 // Handles modified output from server, original input passthrough, or error responses.
 // The suppress_output flag allows hooks to block all output for security reasons.
 // Exit code determines whether to output success or error formatting.
-void cchd_handle_output(bool suppress_output, const char *modified_output_json,
-                        const char *input_json_string,
-                        const cchd_config_t *config, int32_t exit_code);
\ No newline at end of file
+// decided_by is the server that answered, reported as "server" in --json
+// output; NULL leaves it out.
+// The event's output convention decides the shape: cchd's own, as above, or
+// one of Claude Code's, which put the reason in the stdout JSON or rely on
+// exit 2. Returns the exit code the convention calls for.
+CCHD_NODISCARD int32_t cchd_handle_output(
+    bool suppress_output, const char *modified_output_json,
+    const char *input_json_string, const char *decided_by,
+    const char *hook_event_name, const char *reason,
+    const cchd_config_t *config, int32_t exit_code);
@@ -0,0 +1,290 @@
+/*
+ * Sandbox implementation.
+ *
+ * The seccomp filter is a denylist returning EPERM, so ordinary programs
+ * (shells, interpreters) keep working while escalation and escape paths are
+ * closed. Network access is cut by refusing every socket that isn't a local
+ * AF_UNIX one, which needs no namespaces and so works without privileges.
+ */
+
+#include "sandbox.h"
+
+#include <stdio.h>
+
+#ifdef __linux__
+
+#include <errno.h>
+#include <grp.h>
+#include <linux/audit.h>
+#include <linux/filter.h>
+#include <linux/seccomp.h>
+#include <pwd.h>
+#include <stddef.h>
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/prctl.h>
+#include <sys/socket.h>
+#include <sys/syscall.h>
+#include <unistd.h>
+
+#if defined(__x86_64__)
+#define SANDBOX_AUDIT_ARCH AUDIT_ARCH_X86_64
+#elif defined(__aarch64__)
+#define SANDBOX_AUDIT_ARCH AUDIT_ARCH_AARCH64
+#endif
+
+#define SANDBOX_MAX_DENIED 256
+
+// Instructions besides the two per denied syscall: the arch check (3), the
+// syscall number load (1), the x32 check (2), the socket domain check (4)
+// and the final allow (1).
+#define SANDBOX_FIXED_INSNS 11
+
+// Low 32 bits of the first syscall argument, the socket domain.
+#if __BYTE_ORDER__ == __ORDER_LITTLE_ENDIAN__
+#define SANDBOX_ARG0_LOW offsetof(struct seccomp_data, args[0])
+#else
+#define SANDBOX_ARG0_LOW (offsetof(struct seccomp_data, args[0]) + 4)
+#endif
+
+typedef struct {
+  const char *name;
+  int number;
+} sandbox_syscall_t;
+
+#define SYSCALL_ENTRY(name) {#name, __NR_##name}
+
+// Denied for every sandboxed program: debugging other processes, kernel and
+// mount manipulation, namespaces, and io_uring, which can reach the network
+// without calling socket.
+static const sandbox_syscall_t default_denied[] = {
+    SYSCALL_ENTRY(ptrace),
+    SYSCALL_ENTRY(process_vm_readv),
+    SYSCALL_ENTRY(process_vm_writev),
+    SYSCALL_ENTRY(mount),
+    SYSCALL_ENTRY(umount2),
+    SYSCALL_ENTRY(pivot_root),
+    SYSCALL_ENTRY(chroot),
+    SYSCALL_ENTRY(unshare),
+    SYSCALL_ENTRY(setns),
+    SYSCALL_ENTRY(reboot),
+    SYSCALL_ENTRY(kexec_load),
+    SYSCALL_ENTRY(init_module),
+    SYSCALL_ENTRY(finit_module),
+    SYSCALL_ENTRY(delete_module),
+    SYSCALL_ENTRY(bpf),
+    SYSCALL_ENTRY(perf_event_open),
+    SYSCALL_ENTRY(keyctl),
+    SYSCALL_ENTRY(add_key),
+    SYSCALL_ENTRY(request_key),
+    SYSCALL_ENTRY(userfaultfd),
+    SYSCALL_ENTRY(open_by_handle_at),
+    SYSCALL_ENTRY(swapon),
+    SYSCALL_ENTRY(swapoff),
+    SYSCALL_ENTRY(io_uring_setup),
+    SYSCALL_ENTRY(io_uring_enter),
+    SYSCALL_ENTRY(io_uring_register),
+};
+
+// Further names a profile may use. Anything else can be given by number.
+static const sandbox_syscall_t profile_names[] = {
+    SYSCALL_ENTRY(execve),   SYSCALL_ENTRY(execveat), SYSCALL_ENTRY(clone),
+    SYSCALL_ENTRY(clone3),   SYSCALL_ENTRY(kill),     SYSCALL_ENTRY(tgkill),
+    SYSCALL_ENTRY(openat),   SYSCALL_ENTRY(unlinkat), SYSCALL_ENTRY(renameat2),
+    SYSCALL_ENTRY(mkdirat),  SYSCALL_ENTRY(fchmod),   SYSCALL_ENTRY(fchmodat),
+    SYSCALL_ENTRY(fchown),   SYSCALL_ENTRY(fchownat), SYSCALL_ENTRY(socketpair),
+    SYSCALL_ENTRY(connect),  SYSCALL_ENTRY(bind),     SYSCALL_ENTRY(listen),
+    SYSCALL_ENTRY(accept4),  SYSCALL_ENTRY(sendto),   SYSCALL_ENTRY(recvfrom),
+    SYSCALL_ENTRY(truncate), SYSCALL_ENTRY(ftruncate),
+};
+
+static int lookup_syscall(const char *name) {
+  for (size_t i = 0; i < sizeof(default_denied) / sizeof(*default_denied);
+       i++) {
+    if (strcmp(default_denied[i].name, name) == 0) {
+      return default_denied[i].number;
+    }
+  }
+  for (size_t i = 0; i < sizeof(profile_names) / sizeof(*profile_names); i++) {
+    if (strcmp(profile_names[i].name, name) == 0) {
+      return profile_names[i].number;
+    }
+  }
+
+  char *end = NULL;
+  long number = strtol(name, &end, 10);
+  if (end != name && *end == '\0' && number >= 0 && number < 4096) {
+    return (int)number;
+  }
+  return -1;
+}
+
+// Appends the profile's syscalls to denied. An unreadable profile or an
+// unknown name is an error rather than a silently weaker sandbox.
+static bool load_profile(const char *path, int *denied, size_t *count) {
+  FILE *file = fopen(path, "r");
+  if (file == NULL) {
+    fprintf(stderr, "Error: Cannot read sandbox profile %s: %s\n", path,
+            strerror(errno));
+    return false;
+  }
+
+  char line[128];
+  bool ok = true;
+  while (ok && fgets(line, sizeof(line), file) != NULL) {
+    char *comment = strchr(line, '#');
+    if (comment != NULL) {
+      *comment = '\0';
+    }
+    char *name = line + strspn(line, " \t");
+    name[strcspn(name, " \t\r\n")] = '\0';
+    if (name[0] == '\0') {
+      continue;
+    }
+
+    int number = lookup_syscall(name);
+    if (number < 0) {
+      fprintf(stderr, "Error: Unknown syscall '%s' in sandbox profile %s\n",
+              name, path);
+      ok = false;
+    } else if (*count >= SANDBOX_MAX_DENIED) {
+      fprintf(stderr, "Error: Sandbox profile %s denies too many syscalls\n",
+              path);
+      ok = false;
+    } else {
+      denied[(*count)++] = number;
+    }
+  }
+  fclose(file);
+  return ok;
+}
+
+// Root programs become nobody. Group membership goes first, since a process
+// can't change its groups once it has given up root.
+static bool drop_privileges(void) {
+  if (geteuid() != 0) {
+    return true;
+  }
+  struct passwd *nobody = getpwnam("nobody");
+  if (nobody == NULL) {
+    fprintf(stderr, "Error: Sandbox needs the 'nobody' user to drop root\n");
+    return false;
+  }
+  if (setgroups(0, NULL) != 0 || setgid(nobody->pw_gid) != 0 ||
+      setuid(nobody->pw_uid) != 0 || setuid(0) == 0) {
+    fprintf(stderr, "Error: Sandbox failed to drop root: %s\n",
+            strerror(errno));
+    return false;
+  }
+  return true;
+}
+
+static bool install_filter(const int *denied, size_t count) {
+  size_t length = SANDBOX_FIXED_INSNS + count * 2;
+  struct sock_filter *filter = calloc(length, sizeof(*filter));
+  if (filter == NULL) {
+    fprintf(stderr, "Error: Out of memory building the sandbox filter\n");
+    return false;
+  }
+
+  size_t n = 0;
+  filter[n++] = (struct sock_filter)BPF_STMT(
+      BPF_LD | BPF_W | BPF_ABS, offsetof(struct seccomp_data, arch));
+  filter[n++] = (struct sock_filter)BPF_JUMP(BPF_JMP | BPF_JEQ | BPF_K,
+                                             SANDBOX_AUDIT_ARCH, 1, 0);
+  filter[n++] = (struct sock_filter)BPF_STMT(BPF_RET | BPF_K,
+                                             SECCOMP_RET_KILL_PROCESS);
+  filter[n++] = (struct sock_filter)BPF_STMT(
+      BPF_LD | BPF_W | BPF_ABS, offsetof(struct seccomp_data, nr));
+#ifdef __x86_64__
+  // x32 syscall numbers would otherwise slip past the checks below.
+  filter[n++] = (struct sock_filter)BPF_JUMP(BPF_JMP | BPF_JGE | BPF_K,
+                                             0x40000000, 0, 1);
+  filter[n++] = (struct sock_filter)BPF_STMT(BPF_RET | BPF_K,
+                                             SECCOMP_RET_KILL_PROCESS);
+#endif
+
+  for (size_t i = 0; i < count; i++) {
+    filter[n++] = (struct sock_filter)BPF_JUMP(BPF_JMP | BPF_JEQ | BPF_K,
+                                               (uint32_t)denied[i], 0, 1);
+    filter[n++] = (struct sock_filter)BPF_STMT(BPF_RET | BPF_K,
+                                               SECCOMP_RET_ERRNO | EPERM);
+  }
+
+  // socket() is allowed for AF_UNIX only: no network.
+  filter[n++] = (struct sock_filter)BPF_JUMP(BPF_JMP | BPF_JEQ | BPF_K,
+                                             __NR_socket, 0, 3);
+  filter[n++] =
+      (struct sock_filter)BPF_STMT(BPF_LD | BPF_W | BPF_ABS, SANDBOX_ARG0_LOW);
+  filter[n++] =
+      (struct sock_filter)BPF_JUMP(BPF_JMP | BPF_JEQ | BPF_K, AF_UNIX, 1, 0);
+  filter[n++] = (struct sock_filter)BPF_STMT(BPF_RET | BPF_K,
+                                             SECCOMP_RET_ERRNO | EACCES);
+  filter[n++] =
+      (struct sock_filter)BPF_STMT(BPF_RET | BPF_K, SECCOMP_RET_ALLOW);
+
+  struct sock_fprog program = {.len = (unsigned short)n, .filter = filter};
+  bool installed =
+      prctl(PR_SET_SECCOMP, SECCOMP_MODE_FILTER, &program, 0, 0) == 0;
+  if (!installed) {
+    fprintf(stderr, "Error: Cannot install the sandbox filter: %s\n",
+            strerror(errno));
+  }
+  free(filter);
+  return installed;
+}
+
+bool cchd_sandbox_supported(void) {
+#ifdef SANDBOX_AUDIT_ARCH
+  return true;
+#else
+  return false;
+#endif
+}
+
+bool cchd_sandbox_apply(const char *profile_path) {
+#ifdef SANDBOX_AUDIT_ARCH
+  int denied[SANDBOX_MAX_DENIED];
+  size_t count = 0;
+  for (size_t i = 0; i < sizeof(default_denied) / sizeof(*default_denied);
+       i++) {
+    denied[count++] = default_denied[i].number;
+  }
+  if (profile_path != NULL && !load_profile(profile_path, denied, &count)) {
+    return false;
+  }
+
+  // Nothing inherited from the dispatcher past stdio, such as its server
+  // connection, stays reachable.
+  long max_fd = sysconf(_SC_OPEN_MAX);
+  for (int fd = 3; fd < (max_fd > 0 ? max_fd : 1024); fd++) {
+    close(fd);
+  }
+
+  if (!drop_privileges()) {
+    return false;
+  }
+  if (prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0) != 0) {
+    fprintf(stderr, "Error: Cannot set no_new_privs: %s\n", strerror(errno));
+    return false;
+  }
+  return install_filter(denied, count);
+#else
+  (void)profile_path;
+  fprintf(stderr, "Error: --exec-sandbox is not supported on this CPU\n");
+  return false;
+#endif
+}
+
+#else
+
+bool cchd_sandbox_supported(void) { return false; }
+
+bool cchd_sandbox_apply(const char *profile_path) {
+  (void)profile_path;
+  fprintf(stderr, "Error: --exec-sandbox is only supported on Linux\n");
+  return false;
+}
+
+#endif
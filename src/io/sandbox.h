@@ -0,0 +1,22 @@
+/*
+ * Sandbox for --exec policy programs.
+ *
+ * A policy program sees every event and decides what Claude may do, so a
+ * compromised or buggy one is a strong foothold. With --exec-sandbox it runs
+ * with the least we can give it on Linux: no new privileges, no root, no
+ * network, and a seccomp filter that denies syscalls a filter never needs.
+ */
+
+#pragma once
+
+#include <stdbool.h>
+
+// Reports whether --exec-sandbox can be honored on this platform. Callers
+// refuse to run an unsandboxed program when the sandbox was asked for.
+bool cchd_sandbox_supported(void);
+
+// Confines the calling process. Meant for the forked child right before it
+// executes the policy program. profile_path, if set, names a file of extra
+// syscalls to deny, one name or number per line, with # comments. Returns
+// false after printing why on stderr, in which case the child must not exec.
+bool cchd_sandbox_apply(const char *profile_path);
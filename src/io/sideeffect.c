@@ -0,0 +1,236 @@
+/*
+ * Local side effects implementation.
+ *
+ * The dispatcher forks twice, so the side effects run in a grandchild that
+ * is adopted by init, with stdio on /dev/null and every other descriptor
+ * closed. Claude waits for the hook's pipes to close, not just for it to
+ * exit, and a side effect holding one open would hold up the decision.
+ */
+
+#include "sideeffect.h"
+
+#include <curl/curl.h>
+#include <fcntl.h>
+#include <signal.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/wait.h>
+#include <unistd.h>
+#include <yyjson.h>
+
+#include "../core/config.h"
+#include "../utils/logging.h"
+
+static size_t find_side_effect(const cchd_config_t *config, const char *name,
+                               size_t len) {
+  for (size_t i = 0; i < cchd_config_get_side_effect_count(config); i++) {
+    const char *candidate = cchd_config_get_side_effect_name(config, i);
+    if (strlen(candidate) == len && strncmp(candidate, name, len) == 0) {
+      return i;
+    }
+  }
+  LOG_WARNING("Ignoring unknown side effect %.*s", (int)len, name);
+  return SIZE_MAX;
+}
+
+uint32_t cchd_side_effects_requested(const cchd_config_t *config,
+                                     const char *response_data) {
+  if (response_data == nullptr) {
+    return 0;
+  }
+  yyjson_doc *doc = yyjson_read(response_data, strlen(response_data), 0);
+  yyjson_val *names = yyjson_obj_get(yyjson_doc_get_root(doc), "side_effects");
+  uint32_t requested = 0;
+  size_t idx, max;
+  yyjson_val *name;
+  yyjson_arr_foreach(names, idx, max, name) {
+    if (!yyjson_is_str(name)) {
+      continue;
+    }
+    size_t index =
+        find_side_effect(config, yyjson_get_str(name), yyjson_get_len(name));
+    if (index != SIZE_MAX) {
+      requested |= UINT32_C(1) << index;
+    }
+  }
+  yyjson_doc_free(doc);
+  return requested;
+}
+
+static uint32_t on_block_side_effects(const cchd_config_t *config) {
+  const char *list = cchd_config_get_on_block(config);
+  uint32_t requested = 0;
+  while (list != nullptr && *list != '\0') {
+    const char *end = strchr(list, ',');
+    size_t len = end != nullptr ? (size_t)(end - list) : strlen(list);
+    if (len > 0) {
+      size_t index = find_side_effect(config, list, len);
+      if (index != SIZE_MAX) {
+        requested |= UINT32_C(1) << index;
+      }
+    }
+    list = end != nullptr ? end + 1 : nullptr;
+  }
+  return requested;
+}
+
+// What every side effect is given: the decision, the exit code it was
+// reached with, the reason if there is one and the hook event.
+static char *build_payload(const char *input_json_string, const char *reason,
+                           int32_t exit_code) {
+  yyjson_mut_doc *doc = yyjson_mut_doc_new(NULL);
+  if (doc == nullptr) {
+    return nullptr;
+  }
+  yyjson_mut_val *root = yyjson_mut_obj(doc);
+  yyjson_mut_doc_set_root(doc, root);
+  yyjson_mut_obj_add_str(doc, root, "decision",
+                         exit_code == 0   ? "allow"
+                         : exit_code == 2 ? "ask"
+                                          : "block");
+  yyjson_mut_obj_add_int(doc, root, "exit_code", exit_code);
+  if (reason != nullptr) {
+    yyjson_mut_obj_add_str(doc, root, "reason", reason);
+  }
+
+  yyjson_doc *event_doc =
+      yyjson_read(input_json_string, strlen(input_json_string), 0);
+  yyjson_val *event = yyjson_doc_get_root(event_doc);
+  yyjson_mut_obj_add_val(doc, root, "event",
+                         event != nullptr ? yyjson_val_mut_copy(doc, event)
+                                          : yyjson_mut_null(doc));
+  yyjson_doc_free(event_doc);
+
+  char *payload = yyjson_mut_write(doc, 0, NULL);
+  yyjson_mut_doc_free(doc);
+  return payload;
+}
+
+static void detach(void) {
+  setsid();
+  int null_fd = open("/dev/null", O_RDWR);
+  if (null_fd >= 0) {
+    dup2(null_fd, STDIN_FILENO);
+    dup2(null_fd, STDOUT_FILENO);
+    dup2(null_fd, STDERR_FILENO);
+  }
+  long max_fd = sysconf(_SC_OPEN_MAX);
+  if (max_fd < 0 || max_fd > 4096) {
+    max_fd = 4096;
+  }
+  for (int fd = STDERR_FILENO + 1; fd < max_fd; fd++) {
+    close(fd);
+  }
+}
+
+// Runs the command with the payload on its stdin, killing it if it runs
+// past the timeout.
+static void run_command(const char *command, const char *payload) {
+  int fds[2];
+  if (pipe(fds) != 0) {
+    return;
+  }
+  pid_t pid = fork();
+  if (pid == 0) {
+    close(fds[1]);
+    dup2(fds[0], STDIN_FILENO);
+    close(fds[0]);
+    execl("/bin/sh", "sh", "-c", command, (char *)NULL);
+    _exit(127);
+  }
+  close(fds[0]);
+  if (pid < 0) {
+    close(fds[1]);
+    return;
+  }
+
+  // A command that doesn't read its input just doesn't get it.
+  size_t len = strlen(payload);
+  for (size_t written = 0; written < len;) {
+    ssize_t n = write(fds[1], payload + written, len - written);
+    if (n <= 0) {
+      break;
+    }
+    written += (size_t)n;
+  }
+  close(fds[1]);
+
+  for (int waited_ms = 0; waitpid(pid, NULL, WNOHANG) == 0;
+       waited_ms += 100) {
+    if (waited_ms >= SIDE_EFFECT_TIMEOUT_SECONDS * 1000) {
+      kill(pid, SIGKILL);
+      waitpid(pid, NULL, 0);
+      return;
+    }
+    usleep(100 * 1000);
+  }
+}
+
+// Posts the payload to the webhook, through --proxy when one is set and
+// otherwise the proxy environment libcurl reads itself.
+static void post_webhook(const cchd_config_t *config, const char *url,
+                         const char *payload) {
+  CURL *curl = curl_easy_init();
+  if (curl == nullptr) {
+    return;
+  }
+  struct curl_slist *headers =
+      curl_slist_append(NULL, "Content-Type: application/json");
+  curl_easy_setopt(curl, CURLOPT_URL, url);
+  curl_easy_setopt(curl, CURLOPT_HTTPHEADER, headers);
+  curl_easy_setopt(curl, CURLOPT_POSTFIELDS, payload);
+  curl_easy_setopt(curl, CURLOPT_TIMEOUT_MS,
+                   (long)SIDE_EFFECT_TIMEOUT_SECONDS * 1000);
+  curl_easy_setopt(curl, CURLOPT_NOSIGNAL, 1L);
+  if (cchd_config_get_proxy(config) != nullptr) {
+    curl_easy_setopt(curl, CURLOPT_PROXY, cchd_config_get_proxy(config));
+  }
+  curl_easy_perform(curl);
+  curl_slist_free_all(headers);
+  curl_easy_cleanup(curl);
+}
+
+void cchd_side_effects_run(const cchd_config_t *config, uint32_t requested,
+                           const char *input_json_string, const char *reason,
+                           int32_t exit_code) {
+  if (exit_code != 0 && exit_code != 2) {
+    requested |= on_block_side_effects(config);
+  }
+  if (requested == 0 || input_json_string == nullptr) {
+    return;
+  }
+
+  char *payload = build_payload(input_json_string, reason, exit_code);
+  if (payload == nullptr) {
+    LOG_WARNING("Cannot describe the decision to its side effects");
+    return;
+  }
+
+  pid_t pid = fork();
+  if (pid == 0) {
+    if (fork() != 0) {
+      _exit(0);
+    }
+    detach();
+    signal(SIGPIPE, SIG_IGN);
+    for (size_t i = 0; i < cchd_config_get_side_effect_count(config); i++) {
+      if ((requested & (UINT32_C(1) << i)) == 0) {
+        continue;
+      }
+      const char *target = cchd_config_get_side_effect_target(config, i);
+      if (cchd_config_get_side_effect_type(config, i) ==
+          CCHD_SIDE_EFFECT_WEBHOOK) {
+        post_webhook(config, target, payload);
+      } else {
+        run_command(target, payload);
+      }
+    }
+    _exit(0);
+  }
+  if (pid < 0) {
+    LOG_WARNING("Cannot start side effects");
+  } else {
+    waitpid(pid, NULL, 0);
+  }
+  free(payload);
+}
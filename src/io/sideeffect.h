@@ -0,0 +1,33 @@
+/*
+ * Local side effects for CCHD.
+ *
+ * A decision can set off local actions, such as a desktop notification or a
+ * copy of the block to a SIEM, configured once on the machine instead of in
+ * every server. A server asks for them by name in its response's
+ * "side_effects" list, and --on-block names the ones every block sets off.
+ * They run in a detached process after the decision has been written, so
+ * they can neither change nor delay it.
+ */
+
+#pragma once
+
+#include <stdint.h>
+
+// Forward declaration to read the configured side effects.
+typedef struct cchd_config cchd_config_t;
+
+// Seconds a side effect may run before it is killed, so a hung command or
+// webhook doesn't leave processes behind.
+#define SIDE_EFFECT_TIMEOUT_SECONDS 30
+
+// The configured side effects a server response asks for, one bit per side
+// effect index. Names that aren't configured are skipped with a warning.
+uint32_t cchd_side_effects_requested(const cchd_config_t *config,
+                                     const char *response_data);
+
+// Starts the requested side effects, and the --on-block ones when the
+// decision is a block, in the background. Each gets a JSON description of
+// the decision and the event. Returns without waiting for them.
+void cchd_side_effects_run(const cchd_config_t *config, uint32_t requested,
+                           const char *input_json_string, const char *reason,
+                           int32_t exit_code);
@@ -0,0 +1,264 @@
+/*
+ * Durable event spool implementation.
+ *
+ * Each event is one file named by its spool time, so lexical order is
+ * delivery order. A lock file serializes dispatchers sharing a spool.
+ */
+
+#include "spool.h"
+
+#include <dirent.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <limits.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/file.h>
+#include <sys/stat.h>
+#include <time.h>
+#include <unistd.h>
+
+#include "../core/config.h"
+#include "../network/http.h"
+#include "../utils/logging.h"
+#include "../utils/memory.h"
+
+#define SPOOL_SUFFIX ".event.json"
+
+bool cchd_spool_accepts(const char *hook_event_name) {
+  if (hook_event_name == nullptr) {
+    return false;
+  }
+  return strcmp(hook_event_name, "Notification") == 0 ||
+         strcmp(hook_event_name, "PreCompact") == 0 ||
+         strcmp(hook_event_name, "SessionEnd") == 0;
+}
+
+static bool is_spool_entry(const char *name) {
+  size_t len = strlen(name);
+  size_t suffix_len = strlen(SPOOL_SUFFIX);
+  return name[0] != '.' && len > suffix_len &&
+         strcmp(name + len - suffix_len, SPOOL_SUFFIX) == 0;
+}
+
+// Opens and exclusively locks the spool's lock file, creating the directory
+// on first use. Returns the locked descriptor, or -1.
+static int lock_spool(const char *dir) {
+  if (mkdir(dir, 0700) != 0 && errno != EEXIST) {
+    LOG_ERROR("Cannot create spool directory %s: %s", dir, strerror(errno));
+    return -1;
+  }
+
+  char lock_path[PATH_MAX];
+  snprintf(lock_path, sizeof(lock_path), "%s/.lock", dir);
+  int fd = open(lock_path, O_RDWR | O_CREAT | O_CLOEXEC, 0600);
+  if (fd < 0) {
+    LOG_ERROR("Cannot open spool lock %s: %s", lock_path, strerror(errno));
+    return -1;
+  }
+  if (flock(fd, LOCK_EX) != 0) {
+    LOG_ERROR("Cannot lock spool %s: %s", dir, strerror(errno));
+    close(fd);
+    return -1;
+  }
+  return fd;
+}
+
+static void unlock_spool(int fd) {
+  flock(fd, LOCK_UN);
+  close(fd);
+}
+
+static int compare_names(const void *a, const void *b) {
+  return strcmp(*(char *const *)a, *(char *const *)b);
+}
+
+// Lists spooled event file names in delivery order and sums their sizes.
+// The caller frees each name and the array.
+static char **list_spool(const char *dir, size_t *count, off_t *total_bytes) {
+  *count = 0;
+  *total_bytes = 0;
+
+  DIR *handle = opendir(dir);
+  if (handle == nullptr) {
+    return nullptr;
+  }
+
+  size_t capacity = 0;
+  char **names = nullptr;
+  struct dirent *entry;
+  while ((entry = readdir(handle)) != nullptr) {
+    if (!is_spool_entry(entry->d_name)) {
+      continue;
+    }
+    if (*count == capacity) {
+      size_t new_capacity = capacity ? capacity * 2 : 16;
+      char **grown = realloc(names, new_capacity * sizeof(*names));
+      if (grown == nullptr) {
+        break;
+      }
+      names = grown;
+      capacity = new_capacity;
+    }
+    char *name = strdup(entry->d_name);
+    if (name == nullptr) {
+      break;
+    }
+    names[(*count)++] = name;
+
+    char path[PATH_MAX];
+    struct stat info;
+    snprintf(path, sizeof(path), "%s/%s", dir, entry->d_name);
+    if (stat(path, &info) == 0) {
+      *total_bytes += info.st_size;
+    }
+  }
+  closedir(handle);
+
+  if (*count > 0) {
+    qsort(names, *count, sizeof(*names), compare_names);
+  }
+  return names;
+}
+
+static void free_names(char **names, size_t count) {
+  for (size_t i = 0; i < count; i++) {
+    free(names[i]);
+  }
+  free(names);
+}
+
+cchd_error cchd_spool_store(const cchd_config_t *config, const char *payload) {
+  const char *dir = cchd_config_get_spool_dir(config);
+  CHECK_NULL(dir, CCHD_ERROR_INVALID_ARG);
+  CHECK_NULL(payload, CCHD_ERROR_INVALID_ARG);
+
+  int lock_fd = lock_spool(dir);
+  if (lock_fd < 0) {
+    return CCHD_ERROR_IO;
+  }
+
+  size_t count = 0;
+  off_t total_bytes = 0;
+  char **names = list_spool(dir, &count, &total_bytes);
+  free_names(names, count);
+
+  size_t payload_len = strlen(payload);
+  if (total_bytes + (off_t)payload_len > SPOOL_MAX_BYTES) {
+    LOG_WARNING("Spool %s is full (%lld bytes), dropping event", dir,
+                (long long)total_bytes);
+    unlock_spool(lock_fd);
+    return CCHD_ERROR_IO;
+  }
+
+  // Zero-padded spool time plus the pid keeps names unique across
+  // concurrent dispatchers and sorts them in arrival order.
+  struct timespec now;
+  clock_gettime(CLOCK_REALTIME, &now);
+  char name[96];
+  snprintf(name, sizeof(name), "%020lld-%09ld-%d" SPOOL_SUFFIX,
+           (long long)now.tv_sec, (long)now.tv_nsec, (int)getpid());
+
+  char temp_path[PATH_MAX];
+  char final_path[PATH_MAX];
+  snprintf(temp_path, sizeof(temp_path), "%s/.%s.tmp", dir, name);
+  snprintf(final_path, sizeof(final_path), "%s/%s", dir, name);
+
+  // Write then rename, so a crash never leaves a half-written event that
+  // replay would send.
+  cchd_error result = CCHD_SUCCESS;
+  int fd = open(temp_path, O_WRONLY | O_CREAT | O_EXCL | O_CLOEXEC, 0600);
+  if (fd < 0) {
+    result = CCHD_ERROR_IO;
+  } else {
+    bool written = write(fd, payload, payload_len) == (ssize_t)payload_len &&
+                   fsync(fd) == 0;
+    close(fd);
+    if (!written || rename(temp_path, final_path) != 0) {
+      unlink(temp_path);
+      result = CCHD_ERROR_IO;
+    }
+  }
+
+  if (result == CCHD_SUCCESS) {
+    LOG_INFO("Spooled event to %s", final_path);
+  } else {
+    LOG_ERROR("Failed to spool event in %s: %s", dir, strerror(errno));
+  }
+  unlock_spool(lock_fd);
+  return result;
+}
+
+static char *read_file(const char *path) {
+  FILE *file = fopen(path, "r");
+  if (file == nullptr) {
+    return nullptr;
+  }
+  fseek(file, 0, SEEK_END);
+  long size = ftell(file);
+  fseek(file, 0, SEEK_SET);
+  if (size <= 0 || size > SPOOL_MAX_BYTES) {
+    fclose(file);
+    return nullptr;
+  }
+
+  char *data = cchd_secure_malloc((size_t)size + 1);
+  if (data != nullptr) {
+    size_t read_size = fread(data, 1, (size_t)size, file);
+    data[read_size] = '\0';
+  }
+  fclose(file);
+  return data;
+}
+
+bool cchd_spool_replay(const cchd_config_t *config, const char *program_name) {
+  const char *dir = cchd_config_get_spool_dir(config);
+  if (dir == nullptr) {
+    return true;
+  }
+
+  int lock_fd = lock_spool(dir);
+  if (lock_fd < 0) {
+    return false;
+  }
+
+  size_t count = 0;
+  off_t total_bytes = 0;
+  char **names = list_spool(dir, &count, &total_bytes);
+
+  size_t delivered = 0;
+  for (; delivered < count; delivered++) {
+    char path[PATH_MAX];
+    snprintf(path, sizeof(path), "%s/%s", dir, names[delivered]);
+
+    char *payload = read_file(path);
+    if (payload == nullptr) {
+      LOG_WARNING("Dropping unreadable spooled event %s", path);
+      unlink(path);
+      continue;
+    }
+
+    cchd_response_buffer_t response = {0};
+    int32_t status =
+        cchd_send_request_to_server(config, payload, &response, program_name);
+    cchd_secure_free(payload, strlen(payload) + 1);
+    if (response.data != nullptr) {
+      cchd_secure_free(response.data, response.capacity);
+    }
+
+    if (status >= 400 && status < 500 && status != 429) {
+      LOG_WARNING("Server rejected spooled event %s (HTTP %d), dropping it",
+                  path, status);
+    } else if (status != 200) {
+      LOG_INFO("Server still unavailable, keeping %zu spooled events",
+               count - delivered);
+      break;
+    }
+    unlink(path);
+  }
+
+  free_names(names, count);
+  unlock_spool(lock_fd);
+  return delivered == count;
+}
@@ -0,0 +1,38 @@
+/*
+ * Durable event spool for CCHD.
+ *
+ * Audit-only events carry no decision, so losing them during a server outage
+ * loses the audit trail while nothing is gained by failing them. With
+ * --spool-dir they are written to disk when the server can't take them and
+ * replayed in order once it can, giving at-least-once delivery without making
+ * Claude wait. Decision-bearing events never touch the spool.
+ */
+
+#pragma once
+
+#include <stdbool.h>
+
+#include "../core/error.h"
+#include "../core/types.h"
+
+// Forward declaration to read the spool directory from configuration.
+typedef struct cchd_config cchd_config_t;
+
+// Upper bound on spool disk usage. Events that would exceed it are dropped
+// with a warning rather than filling the disk during a long outage.
+#define SPOOL_MAX_BYTES (16 * 1024 * 1024)
+
+// Reports whether events of this type may be spooled: Notification,
+// PreCompact and SessionEnd, whose responses Claude doesn't act on.
+bool cchd_spool_accepts(const char *hook_event_name);
+
+// Persists a CloudEvents payload for later delivery. Files are written
+// atomically with owner-only permissions, since events hold user data.
+CCHD_NODISCARD cchd_error cchd_spool_store(const cchd_config_t *config,
+                                           const char *payload);
+
+// Delivers spooled events oldest first, stopping at the first that the server
+// can't take yet. Events the server rejects with a 4xx are dropped, since
+// resending them can't succeed. Returns true once the spool is empty, so the
+// caller knows a new event may be sent directly without overtaking older ones.
+bool cchd_spool_replay(const cchd_config_t *config, const char *program_name);
@@ -6,6 +6,7 @@
  * to a configured HTTP server, and returns the server's response.
  */
 
+#include <fcntl.h>
 #include <signal.h>
 #include <stdio.h>
 #include <stdlib.h>
@@ -21,7 +22,14 @@
 #include "core/types.h"
 #include "io/input.h"
 #include "io/output.h"
+#include "io/sandbox.h"
+#include "io/sideeffect.h"
+#include "io/spool.h"
+#include "network/failcache.h"
+#include "network/fanout.h"
 #include "network/http.h"
+#include "network/srv.h"
+#include "network/safestart.h"
 #include "protocol/json.h"
 #include "protocol/validation.h"
 #include "utils/colors.h"
@@ -32,6 +40,17 @@
 static _Thread_local int thread_id = 0;
 #endif
 
+// Only the server list is expanded from SRV records, so every other URL
+// must name a host.
+static bool validate_host_url(const char *url, const cchd_config_t *config) {
+  if (cchd_srv_is_srv_url(url)) {
+    fprintf(stderr, "Error: SRV URLs are only supported for servers: %s\n",
+            url);
+    return false;
+  }
+  return cchd_validate_server_url(url, config);
+}
+
 static cchd_error initialize_cchd(int argc, char *argv[],
                                   cchd_config_t **config) {
   // Show help if no input and no arguments
@@ -57,6 +76,9 @@ static cchd_error initialize_cchd(int argc, char *argv[],
     return err;
   }
 
+  // SRV servers are looked up on every run, so targets follow DNS.
+  cchd_srv_resolve_servers(*config);
+
   // Validate server URLs
   bool has_valid_server = false;
   for (size_t i = 0; i < cchd_config_get_server_count(*config); i++) {
@@ -76,6 +98,46 @@ static cchd_error initialize_cchd(int argc, char *argv[],
     return CCHD_ERROR_INVALID_URL;
   }
 
+  // A decision written to a closed or read-only fd would be lost after the
+  // server was asked, so the fd is checked before anything is sent.
+  int output_fd = cchd_config_get_output_fd(*config);
+  int output_flags = fcntl(output_fd, F_GETFL);
+  if (output_flags < 0 || (output_flags & O_ACCMODE) == O_RDONLY) {
+    fprintf(stderr, "Error: --output-fd %d is not open for writing\n",
+            output_fd);
+    cchd_config_destroy(*config);
+    return CCHD_ERROR_INVALID_ARG;
+  }
+
+  // Asking for a sandbox that can't be set up must not run the program
+  // unconfined.
+  if (cchd_config_get_exec_command(*config) != NULL &&
+      cchd_config_is_exec_sandbox(*config) && !cchd_sandbox_supported()) {
+    fprintf(stderr, "Error: --exec-sandbox is only supported on Linux\n");
+    cchd_config_destroy(*config);
+    return CCHD_ERROR_UNSUPPORTED;
+  }
+
+  // A routed event has no fallback server, so every route must be usable.
+  for (size_t i = 0; i < cchd_config_get_route_count(*config); i++) {
+    if (!validate_host_url(cchd_config_get_route_url(*config, i), *config)) {
+      cchd_config_destroy(*config);
+      return CCHD_ERROR_INVALID_URL;
+    }
+  }
+
+  // Webhooks are checked like servers, so a typo shows up at startup rather
+  // than as a side effect that silently never arrives.
+  for (size_t i = 0; i < cchd_config_get_side_effect_count(*config); i++) {
+    if (cchd_config_get_side_effect_type(*config, i) ==
+            CCHD_SIDE_EFFECT_WEBHOOK &&
+        !validate_host_url(cchd_config_get_side_effect_target(*config, i),
+                           *config)) {
+      cchd_config_destroy(*config);
+      return CCHD_ERROR_INVALID_URL;
+    }
+  }
+
   // Set up debug logging if requested
   if (cchd_config_is_debug(*config)) {
     cchd_log_set_level(LOG_LEVEL_DEBUG);
@@ -168,36 +230,173 @@ static char *transform_input_json(const char *input_json_string,
   return protocol_json;
 }
 
+// Returns a string field of the hook event from the CloudEvents payload,
+// parsing it into *doc on first use. Only settings that depend on the event
+// need it, so the parse is skipped when none of them are in use.
+static const char *get_event_field(const char *protocol_json_string,
+                                   yyjson_doc **doc, const char *field) {
+  if (*doc == NULL) {
+    *doc = yyjson_read(protocol_json_string, strlen(protocol_json_string), 0);
+  }
+  yyjson_val *data = yyjson_obj_get(yyjson_doc_get_root(*doc), "data");
+  return yyjson_get_str(yyjson_obj_get(data, field));
+}
+
+static const char *get_hook_event_name(const char *protocol_json_string,
+                                       yyjson_doc **doc) {
+  return get_event_field(protocol_json_string, doc, "hook_event_name");
+}
+
+// Spools an audit event the server can't take now. Returns false when the
+// spool can't hold it either, leaving the event to the fail mode.
+static bool spool_event(const cchd_config_t *config,
+                        const char *protocol_json_string) {
+  if (cchd_spool_store(config, protocol_json_string) != CCHD_SUCCESS) {
+    return false;
+  }
+  if (!cchd_config_is_quiet(config)) {
+    fprintf(stderr, "Server unavailable, event spooled to %s\n",
+            cchd_config_get_spool_dir(config));
+  }
+  return true;
+}
+
 static int32_t process_request_and_response(const cchd_config_t *config,
+                                            const char *input_json_string,
                                             const char *protocol_json_string,
                                             char **modified_output_json,
                                             bool *suppress_output,
+                                            const char **decided_by,
+                                            char **reason,
+                                            uint32_t *side_effects,
                                             const char *program_name) {
+  yyjson_doc *protocol_doc = NULL;
+  bool spoolable =
+      cchd_config_get_spool_dir(config) != NULL &&
+      cchd_spool_accepts(get_hook_event_name(protocol_json_string,
+                                             &protocol_doc));
+
+  // Spooled events are older than this one, so they go first. While any are
+  // left this event queues behind them to keep delivery in order.
+  if (spoolable && !cchd_spool_replay(config, program_name) &&
+      spool_event(config, protocol_json_string)) {
+    yyjson_doc_free(protocol_doc);
+    return 0;
+  }
+
+  // Identical events right after a failure get the same outcome, so a
+  // flapping server doesn't allow and block the same operation in turn.
+  int32_t cached_exit_code = 0;
+  if (cchd_fail_cache_lookup(config, input_json_string, &cached_exit_code)) {
+    if (cached_exit_code != 0 && !cchd_config_is_quiet(config)) {
+      fprintf(stderr, "Error: Server unavailable (fail cache)\n\n");
+      fprintf(stderr,
+              "The same event was blocked moments ago when the server "
+              "didn't answer.\n");
+    }
+    *suppress_output = cached_exit_code != 0;
+    yyjson_doc_free(protocol_doc);
+    return cached_exit_code;
+  }
+
+  cchd_safe_start_t safe_start = {.confirmed = true};
+  if (cchd_config_is_safe_start(config)) {
+    cchd_safe_start_open(&safe_start, get_event_field(protocol_json_string,
+                                                      &protocol_doc,
+                                                      "session_id"));
+  }
+
   cchd_response_buffer_t server_response = {
       .data = NULL, .size = 0, .capacity = 0};
-  int32_t server_http_status = cchd_send_request_to_server(
-      config, protocol_json_string, &server_response, program_name);
+  const char *hook_event_name =
+      get_hook_event_name(protocol_json_string, &protocol_doc);
+  const char *tool_name =
+      get_event_field(protocol_json_string, &protocol_doc, "tool_name");
+  int32_t server_http_status =
+      cchd_fan_out_applies(config, hook_event_name, tool_name)
+          ? cchd_fan_out(config, protocol_json_string, hook_event_name,
+                         &server_response, program_name)
+          : cchd_send_request_to_server(config, protocol_json_string,
+                                        &server_response, program_name);
 
   int32_t program_exit_code = 0;
 
+  // Audit events the server couldn't take wait in the spool instead of
+  // going to the fail mode. A 4xx would be rejected again, so it isn't kept.
+  bool rejected = server_http_status >= 400 && server_http_status < 500 &&
+                  server_http_status != 429;
+  if (spoolable && server_http_status != 200 && !rejected &&
+      spool_event(config, protocol_json_string)) {
+    if (server_response.data != NULL) {
+      cchd_secure_free(server_response.data, server_response.capacity);
+    }
+    yyjson_doc_free(protocol_doc);
+    return 0;
+  }
+
+  if (server_http_status == 200) {
+    cchd_safe_start_confirm(&safe_start);
+  }
+
   if (server_http_status == 200 && server_response.data != NULL) {
+    // Responses are read by the event they answer: permissionDecision only
+    // counts for PreToolUse, and a pinned format's checks depend on it.
+    cchd_response_format format = cchd_config_get_response_format(
+        config, server_response.server_index);
+
     cchd_error err = cchd_process_server_response(
         server_response.data, modified_output_json, config, suppress_output,
-        server_http_status, &program_exit_code);
+        server_http_status, hook_event_name, format, &program_exit_code,
+        reason);
     if (err != CCHD_SUCCESS) {
       LOG_ERROR("Failed to process server response: %s", cchd_strerror(err));
     }
+    *side_effects =
+        cchd_side_effects_requested(config, server_response.data);
+
+    // Which server decided, so weighted rollouts can compare outcomes.
+    *decided_by = server_response.server_url;
+    if (*decided_by != NULL) {
+      LOG_INFO("Decision by %s: exit code %d", *decided_by,
+               program_exit_code);
+    }
+  } else if (cchd_safe_start_blocks(&safe_start, hook_event_name,
+                                    tool_name)) {
+    // Before the server has ever answered, --fail-open can't tell "not up
+    // yet" from "down", so nothing that changes things goes through.
+    LOG_WARNING("Safe start: blocked %s before the server answered",
+                tool_name ? tool_name : "tool");
+    if (!cchd_config_is_quiet(config)) {
+      fprintf(stderr, "Error: Server unavailable (safe start)\n\n");
+      fprintf(stderr,
+              "%s was blocked because the server hasn't answered yet in this "
+              "session.\n",
+              tool_name ? tool_name : "The tool");
+      fprintf(stderr,
+              "Read-only tools follow the fail mode until it does.\n");
+    }
+    program_exit_code = CCHD_ERROR_BLOCKED;
+    *suppress_output = true;
   } else if (!cchd_config_is_fail_open(config)) {
     if (!cchd_config_is_quiet(config)) {
       fprintf(stderr, "Error: Server unavailable (fail-closed mode)\n\n");
-      fprintf(stderr, "The operation was blocked because the server");
-      if (cchd_config_get_server_count(config) > 1) {
+      if (server_http_status == -CCHD_ERROR_PROXY) {
+        fprintf(stderr,
+                "The operation was blocked because the proxy could not be "
+                "used,\nso the server was never reached.\n\n");
+      } else if (cchd_config_get_exec_command(config) != NULL) {
+        fprintf(stderr,
+                "The operation was blocked because the policy program "
+                "failed.\n\n");
+      } else if (cchd_config_get_server_count(config) > 1) {
+        fprintf(stderr, "The operation was blocked because the server");
         fprintf(stderr, "s are not responding:\n");
         for (size_t i = 0; i < cchd_config_get_server_count(config); i++) {
           fprintf(stderr, "  • %s\n", cchd_config_get_server_url(config, i));
         }
         fprintf(stderr, "\n");
       } else {
+        fprintf(stderr, "The operation was blocked because the server");
         fprintf(stderr, " at\n%s is not responding.\n\n",
                 cchd_config_get_server_url(config, 0));
       }
@@ -214,9 +413,14 @@ static int32_t process_request_and_response(const cchd_config_t *config,
     *suppress_output = true;
   }
 
+  if (server_http_status != 200 || server_response.data == NULL) {
+    cchd_fail_cache_store(config, input_json_string, program_exit_code);
+  }
+
   if (server_response.data != NULL) {
     cchd_secure_free(server_response.data, server_response.capacity);
   }
+  yyjson_doc_free(protocol_doc);
 
   return program_exit_code;
 }
@@ -265,14 +469,29 @@ int main(int argc, char *argv[]) {
   // Process request and response
   char *modified_output_json = NULL;
   bool suppress_output = false;
+  const char *decided_by = NULL;
+  char *reason = NULL;
+  uint32_t side_effects = 0;
   int32_t program_exit_code = process_request_and_response(
-      config, protocol_json_string, &modified_output_json, &suppress_output,
-      argv[0]);
+      config, input_json_string, protocol_json_string, &modified_output_json,
+      &suppress_output, &decided_by, &reason, &side_effects, argv[0]);
+  int32_t decision_exit_code = program_exit_code;
+  // The output convention is chosen by event.
+  yyjson_doc *protocol_doc = NULL;
+  const char *hook_event_name =
+      get_hook_event_name(protocol_json_string, &protocol_doc);
   cchd_secure_free(protocol_json_string, protocol_json_len + 1);
 
   // Handle output
-  cchd_handle_output(suppress_output, modified_output_json, input_json_string,
-                     config, program_exit_code);
+  program_exit_code = cchd_handle_output(
+      suppress_output, modified_output_json, input_json_string, decided_by,
+      hook_event_name, reason, config, program_exit_code);
+  yyjson_doc_free(protocol_doc);
+
+  // Only once Claude has the decision.
+  cchd_side_effects_run(config, side_effects, input_json_string, reason,
+                        decision_exit_code);
+  free(reason);
 
   // Cleanup resources
   cleanup_resources(input_json_string, input_json_capacity,
@@ -0,0 +1,135 @@
+/*
+ * Session retry budget implementation.
+ *
+ * Tokens are stored in thousandths so slow refill accrues between events
+ * without floating point. The state file holds the tokens and the time they
+ * were last counted.
+ */
+
+#include "budget.h"
+
+#include <errno.h>
+#include <fcntl.h>
+#include <stdio.h>
+#include <string.h>
+#include <sys/file.h>
+#include <time.h>
+#include <unistd.h>
+
+#include "../core/config.h"
+#include "../utils/logging.h"
+#include "../utils/state.h"
+
+#define BUDGET_PREFIX "retry-"
+#define MILLITOKENS_PER_TOKEN 1000
+
+static int64_t now_ms(void) {
+  struct timespec now;
+  clock_gettime(CLOCK_REALTIME, &now);
+  return (int64_t)now.tv_sec * 1000 + now.tv_nsec / 1000000;
+}
+
+void cchd_retry_budget_open(cchd_retry_budget_t *budget,
+                            const cchd_config_t *config,
+                            const char *session_id) {
+  budget->enabled = false;
+  budget->capacity = cchd_config_get_retry_budget(config);
+  if (budget->capacity <= 0 || session_id == nullptr) {
+    return;
+  }
+
+  char dir[PATH_MAX - 80];
+  if (!cchd_state_directory(dir, sizeof(dir))) {
+    return;
+  }
+  cchd_state_path(budget->path, sizeof(budget->path), dir, BUDGET_PREFIX,
+                  session_id);
+  budget->enabled = true;
+
+  if (access(budget->path, F_OK) != 0) {
+    cchd_state_prune(dir, BUDGET_PREFIX, STATE_EXPIRY_SECONDS);
+  }
+}
+
+// Opens and locks the state file, refills it for the time since it was last
+// counted, and returns the descriptor with the current millitokens, or -1.
+static int lock_and_refill(const cchd_retry_budget_t *budget,
+                           int64_t *millitokens) {
+  int fd = open(budget->path, O_RDWR | O_CREAT | O_CLOEXEC, 0600);
+  if (fd < 0) {
+    LOG_WARNING("Cannot open retry budget %s: %s", budget->path,
+                strerror(errno));
+    return -1;
+  }
+  if (flock(fd, LOCK_EX) != 0) {
+    close(fd);
+    return -1;
+  }
+
+  int64_t capacity = budget->capacity * MILLITOKENS_PER_TOKEN;
+  int64_t now = now_ms();
+  char state[64] = {0};
+  long long stored = 0;
+  long long updated = 0;
+  ssize_t n = read(fd, state, sizeof(state) - 1);
+  if (n > 0 && sscanf(state, "%lld %lld", &stored, &updated) == 2) {
+    // A clock stepped backwards refills nothing rather than draining.
+    int64_t elapsed = now > updated ? now - (int64_t)updated : 0;
+    int64_t refill = elapsed * MILLITOKENS_PER_TOKEN / RETRY_BUDGET_REFILL_MS;
+    *millitokens = stored + refill;
+  } else {
+    // New sessions start with a full budget.
+    *millitokens = capacity;
+  }
+  if (*millitokens > capacity || *millitokens < 0) {
+    *millitokens = capacity;
+  }
+  return fd;
+}
+
+static void store_and_unlock(int fd, int64_t millitokens) {
+  char state[64];
+  int len = snprintf(state, sizeof(state), "%lld %lld\n",
+                     (long long)millitokens, (long long)now_ms());
+  if (ftruncate(fd, 0) != 0 || pwrite(fd, state, (size_t)len, 0) != len) {
+    LOG_WARNING("Cannot update retry budget: %s", strerror(errno));
+  }
+  flock(fd, LOCK_UN);
+  close(fd);
+}
+
+bool cchd_retry_budget_take(const cchd_retry_budget_t *budget) {
+  if (budget == nullptr || !budget->enabled) {
+    return true;
+  }
+
+  int64_t millitokens = 0;
+  int fd = lock_and_refill(budget, &millitokens);
+  if (fd < 0) {
+    // A budget we can't read shouldn't take retries away.
+    return true;
+  }
+
+  bool granted = millitokens >= MILLITOKENS_PER_TOKEN;
+  if (granted) {
+    millitokens -= MILLITOKENS_PER_TOKEN;
+  }
+  store_and_unlock(fd, millitokens);
+  LOG_DEBUG("Retry budget: %s, %lld left", granted ? "granted" : "exhausted",
+            (long long)(millitokens / MILLITOKENS_PER_TOKEN));
+  return granted;
+}
+
+int64_t cchd_retry_budget_remaining(const cchd_retry_budget_t *budget) {
+  if (budget == nullptr || !budget->enabled) {
+    return -1;
+  }
+
+  int64_t millitokens = 0;
+  int fd = lock_and_refill(budget, &millitokens);
+  if (fd < 0) {
+    return -1;
+  }
+  store_and_unlock(fd, millitokens);
+  return millitokens / MILLITOKENS_PER_TOKEN;
+}
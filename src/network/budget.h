@@ -0,0 +1,42 @@
+/*
+ * Session retry budget for CCHD.
+ *
+ * Each hook runs in its own dispatcher process, so per-request retries alone
+ * let one flaky period make every later event of a session retry again. The
+ * budget is a token bucket shared by all dispatchers of a session: each retry
+ * takes a token, tokens come back slowly, and an empty bucket means events go
+ * straight to the fail mode instead of retrying.
+ */
+
+#pragma once
+
+#include <limits.h>
+#include <stdbool.h>
+#include <stdint.h>
+
+// Forward declaration to read the budget size from configuration.
+typedef struct cchd_config cchd_config_t;
+
+// One token comes back per interval, up to the configured budget.
+#define RETRY_BUDGET_REFILL_MS 60000
+
+// Bucket of one session. The state lives in a small file in the user's
+// runtime directory, locked while it is read and updated.
+typedef struct {
+  bool enabled;
+  int64_t capacity;
+  char path[PATH_MAX];
+} cchd_retry_budget_t;
+
+// Sets up the budget of a session. The budget is disabled when no budget is
+// configured, the session id is missing, or there is no private directory to
+// keep it in; a disabled budget allows every retry.
+void cchd_retry_budget_open(cchd_retry_budget_t *budget,
+                            const cchd_config_t *config,
+                            const char *session_id);
+
+// Takes a token for one retry. Returns false when the budget is spent.
+bool cchd_retry_budget_take(const cchd_retry_budget_t *budget);
+
+// Whole tokens left after refilling, or -1 when the budget is disabled.
+int64_t cchd_retry_budget_remaining(const cchd_retry_budget_t *budget);
@@ -0,0 +1,101 @@
+/*
+ * Failure cache implementation.
+ *
+ * Entries are keyed by a hash of the whole hook input, which already carries
+ * the session id, so only the same event of the same session can match. An
+ * entry holds the exit code and the time it expires, and is renamed into
+ * place so a dispatcher reading it never sees half of one.
+ */
+
+#include "failcache.h"
+
+#include <errno.h>
+#include <fcntl.h>
+#include <limits.h>
+#include <stdio.h>
+#include <string.h>
+#include <time.h>
+#include <unistd.h>
+
+#include "../core/config.h"
+#include "../utils/logging.h"
+#include "../utils/state.h"
+
+#define FAIL_CACHE_PREFIX "failed-"
+
+// Entries are well past any TTL after this long, so pruning on store keeps
+// the directory from filling up during a long outage.
+#define FAIL_CACHE_EXPIRY_SECONDS 60
+
+static int64_t now_ms(void) {
+  struct timespec now;
+  clock_gettime(CLOCK_REALTIME, &now);
+  return (int64_t)now.tv_sec * 1000 + now.tv_nsec / 1000000;
+}
+
+static bool entry_path(const cchd_config_t *config, const char *input,
+                       char *path, size_t size, char *dir, size_t dir_size) {
+  if (cchd_config_get_fail_cache_ttl_ms(config) <= 0 || input == nullptr ||
+      !cchd_state_directory(dir, dir_size)) {
+    return false;
+  }
+  cchd_state_path(path, size, dir, FAIL_CACHE_PREFIX, input);
+  return true;
+}
+
+bool cchd_fail_cache_lookup(const cchd_config_t *config, const char *input,
+                            int32_t *exit_code) {
+  char dir[PATH_MAX - 80];
+  char path[PATH_MAX];
+  if (!entry_path(config, input, path, sizeof(path), dir, sizeof(dir))) {
+    return false;
+  }
+
+  FILE *file = fopen(path, "r");
+  if (file == nullptr) {
+    return false;
+  }
+  int code = 0;
+  long long expires = 0;
+  bool parsed = fscanf(file, "%d %lld", &code, &expires) == 2;
+  fclose(file);
+
+  // An expiry further out than any TTL means the clock stepped backwards,
+  // and the entry is not trusted.
+  int64_t left_ms = (int64_t)expires - now_ms();
+  if (!parsed || left_ms <= 0 || left_ms > FAIL_CACHE_MAX_TTL_MS) {
+    return false;
+  }
+  LOG_INFO("Repeating outcome of a failed request %lldms ago: exit code %d",
+           (long long)(cchd_config_get_fail_cache_ttl_ms(config) - left_ms),
+           code);
+  *exit_code = code;
+  return true;
+}
+
+void cchd_fail_cache_store(const cchd_config_t *config, const char *input,
+                           int32_t exit_code) {
+  char dir[PATH_MAX - 80];
+  char path[PATH_MAX];
+  if (!entry_path(config, input, path, sizeof(path), dir, sizeof(dir))) {
+    return;
+  }
+  cchd_state_prune(dir, FAIL_CACHE_PREFIX, FAIL_CACHE_EXPIRY_SECONDS);
+
+  char temp_path[PATH_MAX + 16];
+  snprintf(temp_path, sizeof(temp_path), "%s.%d", path, (int)getpid());
+  int fd = open(temp_path, O_WRONLY | O_CREAT | O_TRUNC | O_CLOEXEC, 0600);
+  if (fd < 0) {
+    LOG_WARNING("Cannot record failed request %s: %s", temp_path,
+                strerror(errno));
+    return;
+  }
+  bool written =
+      dprintf(fd, "%d %lld\n", exit_code,
+              (long long)(now_ms() +
+                          cchd_config_get_fail_cache_ttl_ms(config))) > 0;
+  if (close(fd) != 0 || !written || rename(temp_path, path) != 0) {
+    LOG_WARNING("Cannot record failed request %s: %s", path, strerror(errno));
+    unlink(temp_path);
+  }
+}
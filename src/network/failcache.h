@@ -0,0 +1,31 @@
+/*
+ * Failure cache for CCHD.
+ *
+ * When a server flaps, a burst of identical events can land on both sides of
+ * a blip and get allowed one moment and blocked the next. With
+ * --fail-cache-ttl, the fail mode's outcome for an event is remembered for a
+ * few seconds and repeated for identical events in that window without
+ * contacting the server. An entry is never extended by the events it
+ * answers, so a sustained outage is still retried once per window.
+ */
+
+#pragma once
+
+#include <stdbool.h>
+#include <stdint.h>
+
+// Forward declaration to read the TTL from configuration.
+typedef struct cchd_config cchd_config_t;
+
+// Longest TTL accepted. The cache is meant to smooth flaps, not to stand in
+// for the server.
+#define FAIL_CACHE_MAX_TTL_MS 10000
+
+// Finds a live outcome for an event with exactly this input. Returns false
+// when the cache is off or no outcome is remembered.
+bool cchd_fail_cache_lookup(const cchd_config_t *config, const char *input,
+                            int32_t *exit_code);
+
+// Remembers the fail mode's exit code for input for the configured TTL.
+void cchd_fail_cache_store(const cchd_config_t *config, const char *input,
+                           int32_t exit_code);
@@ -0,0 +1,208 @@
+/*
+ * Fan-out implementation.
+ *
+ * Servers are asked in turn rather than in parallel, reusing the one
+ * connection handle and its retries; the --deadline bounds the whole round.
+ * Answers are classified first and only the deciding one is processed, so
+ * messages and modifications come from exactly one response.
+ */
+
+#include "fanout.h"
+
+#include <stdlib.h>
+#include <string.h>
+#include <yyjson.h>
+
+#include "../core/config.h"
+#include "../protocol/json.h"
+#include "../utils/logging.h"
+#include "../utils/memory.h"
+#include "http.h"
+
+typedef struct {
+  int32_t status;
+  cchd_response_buffer_t response;
+  cchd_verdict verdict;
+  char *modified;
+} fan_out_answer;
+
+bool cchd_fan_out_applies(const cchd_config_t *config,
+                          const char *hook_event_name, const char *tool_name) {
+  return cchd_config_is_fan_out(config) &&
+         cchd_config_get_server_count(config) > 1 &&
+         cchd_config_get_exec_command(config) == NULL &&
+         cchd_config_get_route(config, hook_event_name, tool_name) == NULL;
+}
+
+// Two modifications only agree when they make the same change.
+static bool answers_agree(const fan_out_answer *a, const fan_out_answer *b) {
+  if (a->verdict != b->verdict) {
+    return false;
+  }
+  if (a->verdict != CCHD_VERDICT_MODIFY || a->modified == nullptr ||
+      b->modified == nullptr) {
+    return a->modified == b->modified;
+  }
+  return strcmp(a->modified, b->modified) == 0;
+}
+
+// The arbiter gets the event and every server's answer, including the ones
+// that failed, with the verdict each was read as.
+static char *build_arbiter_request(const cchd_config_t *config,
+                                   const char *json_payload,
+                                   const fan_out_answer *answers,
+                                   size_t count) {
+  yyjson_mut_doc *doc = yyjson_mut_doc_new(NULL);
+  if (doc == NULL) {
+    return NULL;
+  }
+  yyjson_mut_val *root = yyjson_mut_obj(doc);
+  yyjson_mut_doc_set_root(doc, root);
+
+  yyjson_doc *event_doc = yyjson_read(json_payload, strlen(json_payload), 0);
+  yyjson_mut_obj_add_val(
+      doc, root, "event",
+      yyjson_val_mut_copy(doc, yyjson_doc_get_root(event_doc)));
+  yyjson_doc_free(event_doc);
+
+  yyjson_mut_val *decisions = yyjson_mut_obj_add_arr(doc, root, "decisions");
+  for (size_t i = 0; i < count; i++) {
+    yyjson_mut_val *decision = yyjson_mut_arr_add_obj(doc, decisions);
+    yyjson_mut_obj_add_str(doc, decision, "server",
+                           cchd_config_get_server_url(config, i));
+    yyjson_mut_obj_add_int(doc, decision, "status", answers[i].status);
+    yyjson_mut_obj_add_str(doc, decision, "verdict",
+                           cchd_verdict_name(answers[i].verdict));
+
+    yyjson_doc *response_doc =
+        answers[i].status == 200 && answers[i].response.data != NULL
+            ? yyjson_read(answers[i].response.data, answers[i].response.size,
+                          0)
+            : NULL;
+    yyjson_val *response_root = yyjson_doc_get_root(response_doc);
+    yyjson_mut_obj_add_val(doc, decision, "response",
+                           response_root != NULL
+                               ? yyjson_val_mut_copy(doc, response_root)
+                               : yyjson_mut_null(doc));
+    yyjson_doc_free(response_doc);
+  }
+
+  char *request = yyjson_mut_write(doc, 0, NULL);
+  yyjson_mut_doc_free(doc);
+  return request;
+}
+
+// Hands the conflict to the arbiter. Returns true with its answer in
+// response when it gave a usable one.
+static bool ask_arbiter(const cchd_config_t *config, const char *json_payload,
+                        const char *hook_event_name,
+                        const fan_out_answer *answers, size_t count,
+                        cchd_response_buffer_t *response,
+                        const char *program_name) {
+  const char *arbiter = cchd_config_get_arbiter(config);
+  char *request = build_arbiter_request(config, json_payload, answers, count);
+  if (request == NULL) {
+    return false;
+  }
+
+  LOG_INFO("Servers disagree, asking arbiter %s", arbiter);
+  int32_t status = cchd_send_request_to_url(config, request, response,
+                                            program_name, arbiter);
+  free(request);
+
+  char *modified = NULL;
+  cchd_verdict verdict =
+      status == 200 ? cchd_classify_server_response(
+                          response->data, hook_event_name, &modified)
+                    : CCHD_VERDICT_INVALID;
+  free(modified);
+  if (verdict == CCHD_VERDICT_INVALID) {
+    LOG_WARNING("Arbiter %s gave no usable answer (HTTP %d), taking the "
+                "strictest answer",
+                arbiter, status);
+    return false;
+  }
+  return true;
+}
+
+int32_t cchd_fan_out(const cchd_config_t *config, const char *json_payload,
+                     const char *hook_event_name,
+                     cchd_response_buffer_t *response,
+                     const char *program_name) {
+  size_t count = cchd_config_get_server_count(config);
+  fan_out_answer *answers = calloc(count, sizeof(*answers));
+  if (answers == NULL) {
+    return -CCHD_ERROR_MEMORY;
+  }
+
+  size_t failed = SIZE_MAX;
+  size_t valid = 0;
+  for (size_t i = 0; i < count; i++) {
+    const char *url = cchd_config_get_server_url(config, i);
+    answers[i].status = cchd_send_request_to_url(
+        config, json_payload, &answers[i].response, program_name, url);
+    answers[i].verdict = CCHD_VERDICT_INVALID;
+    if (answers[i].status == 200) {
+      answers[i].response.server_index = i;
+      answers[i].verdict = cchd_classify_server_response(
+          answers[i].response.data, hook_event_name, &answers[i].modified);
+    }
+    if (answers[i].verdict == CCHD_VERDICT_INVALID) {
+      LOG_WARNING("Fan-out server %s failed (HTTP %d)", url,
+                  answers[i].status);
+      if (failed == SIZE_MAX) {
+        failed = i;
+      }
+    } else {
+      valid++;
+    }
+  }
+
+  // A failed server goes to the fail mode as a single server would, by
+  // handing on its status or its invalid answer.
+  size_t winner = failed;
+  bool arbitrated = false;
+  if (failed == SIZE_MAX || (cchd_config_is_fail_open(config) && valid > 0)) {
+    size_t first = SIZE_MAX;
+    size_t strictest = SIZE_MAX;
+    bool agreed = true;
+    for (size_t i = 0; i < count; i++) {
+      if (answers[i].verdict == CCHD_VERDICT_INVALID) {
+        continue;
+      }
+      if (first == SIZE_MAX) {
+        first = i;
+      } else if (!answers_agree(&answers[first], &answers[i])) {
+        agreed = false;
+      }
+      if (strictest == SIZE_MAX ||
+          answers[i].verdict > answers[strictest].verdict) {
+        strictest = i;
+      }
+    }
+
+    winner = agreed ? first : strictest;
+    if (!agreed && answers[strictest].verdict != CCHD_VERDICT_BLOCK &&
+        cchd_config_get_arbiter(config) != NULL) {
+      arbitrated = ask_arbiter(config, json_payload, hook_event_name, answers,
+                               count, response, program_name);
+    }
+  }
+
+  int32_t status = arbitrated ? 200 : answers[winner].status;
+  if (!arbitrated) {
+    if (response->data != NULL) {
+      cchd_secure_free(response->data, response->capacity);
+    }
+    *response = answers[winner].response;
+    answers[winner].response.data = NULL;
+  }
+  for (size_t i = 0; i < count; i++) {
+    if (answers[i].response.data != NULL) {
+      cchd_secure_free(answers[i].response.data, answers[i].response.capacity);
+    }
+    free(answers[i].modified);
+  }
+  free(answers);
+  return status;
+}
@@ -0,0 +1,38 @@
+/*
+ * Fan-out to several policy servers for CCHD.
+ *
+ * With --fan-out, every event goes to all configured servers instead of the
+ * first one that answers, and the answers are combined: a block from any
+ * server wins, and otherwise the servers must agree. When they don't, say
+ * one allows, one asks and one modifies, the optional --arbiter endpoint gets
+ * all the answers and makes the call; without one, or when it fails, the
+ * strictest answer wins.
+ */
+
+#pragma once
+
+#include <stdbool.h>
+#include <stdint.h>
+
+#include "../core/types.h"
+
+// Forward declaration to read the servers and fail mode from configuration.
+typedef struct cchd_config cchd_config_t;
+
+// Whether an event is fanned out: --fan-out is set, there are several
+// servers, no policy program replaces them and no route sends the event to
+// one server.
+bool cchd_fan_out_applies(const cchd_config_t *config,
+                          const char *hook_event_name, const char *tool_name);
+
+// Sends the event to every server and leaves the deciding answer in
+// response, with server_url naming the server or arbiter it came from.
+// Returns 200, or the failing status under which the fail mode decides, like
+// cchd_send_request_to_server. Unless --fail-open is set, a server that
+// fails or answers invalidly fails the event, since its answer could have
+// been the block.
+CCHD_NODISCARD int32_t cchd_fan_out(const cchd_config_t *config,
+                                    const char *json_payload,
+                                    const char *hook_event_name,
+                                    cchd_response_buffer_t *response,
+                                    const char *program_name);
@@ -34,4 +34,12 @@ void cchd_http_cleanup(void);
 // The retry logic helps ensure reliability in unstable network conditions.
 CCHD_NODISCARD int32_t cchd_send_request_to_server(
     const cchd_config_t *config, const char *json_payload,
-    cchd_response_buffer_t *server_response, const char *program_name);
\ No newline at end of file
+    cchd_response_buffer_t *server_response, const char *program_name);
+
+// Send request to one given server, with the same retries as above but no
+// fallback, for callers that need every server's answer or talk to a server
+// outside the list. Returns the HTTP status code or negative error code.
+CCHD_NODISCARD int32_t cchd_send_request_to_url(
+    const cchd_config_t *config, const char *json_payload,
+    cchd_response_buffer_t *server_response, const char *program_name,
+    const char *server_url);
@@ -0,0 +1,91 @@
+/*
+ * Safe start implementation.
+ *
+ * Tools are gated by an allowlist of read-only ones rather than a list of
+ * mutating ones, so new tools and MCP tools, whose effects we can't know,
+ * wait for the server too.
+ */
+
+#include "safestart.h"
+
+#include <errno.h>
+#include <fcntl.h>
+#include <string.h>
+#include <unistd.h>
+
+#include "../core/types.h"
+#include "../utils/logging.h"
+#include "../utils/state.h"
+
+#define SAFE_START_PREFIX "confirmed-"
+
+// Tools that only read local state or plan. Web tools are left out: they
+// change nothing locally, but they can send data out.
+static const char *const read_only_tools[] = {
+    "Read",      "Glob", "Grep",         "LS",         "NotebookRead",
+    "TodoRead",  "TodoWrite", "Task", "ExitPlanMode", "BashOutput",
+};
+
+void cchd_safe_start_open(cchd_safe_start_t *safe_start,
+                          const char *session_id) {
+  safe_start->confirmed = false;
+  safe_start->path[0] = '\0';
+  if (session_id == nullptr) {
+    return;
+  }
+
+  char dir[PATH_MAX - 80];
+  if (!cchd_state_directory(dir, sizeof(dir))) {
+    return;
+  }
+  cchd_state_path(safe_start->path, sizeof(safe_start->path), dir,
+                  SAFE_START_PREFIX, session_id);
+  safe_start->confirmed = access(safe_start->path, F_OK) == 0;
+  if (!safe_start->confirmed) {
+    cchd_state_prune(dir, SAFE_START_PREFIX, STATE_EXPIRY_SECONDS);
+  }
+}
+
+void cchd_safe_start_confirm(cchd_safe_start_t *safe_start) {
+  if (safe_start->confirmed) {
+    return;
+  }
+  safe_start->confirmed = true;
+
+  // O_EXCL makes exactly one of several racing dispatchers log the change.
+  bool first = true;
+  if (safe_start->path[0] != '\0') {
+    int fd = open(safe_start->path, O_WRONLY | O_CREAT | O_EXCL | O_CLOEXEC,
+                  0600);
+    if (fd >= 0) {
+      close(fd);
+    } else if (errno == EEXIST) {
+      first = false;
+    } else {
+      LOG_WARNING("Cannot record safe start confirmation %s: %s",
+                  safe_start->path, strerror(errno));
+    }
+  }
+  if (first) {
+    LOG_INFO("Server answered, leaving safe start mode");
+  }
+}
+
+bool cchd_safe_start_blocks(const cchd_safe_start_t *safe_start,
+                            const char *hook_event_name,
+                            const char *tool_name) {
+  if (safe_start->confirmed || hook_event_name == nullptr ||
+      strcmp(hook_event_name, "PreToolUse") != 0) {
+    return false;
+  }
+  if (tool_name == nullptr) {
+    return true;
+  }
+  for (size_t i = 0; i < sizeof(read_only_tools) / sizeof(*read_only_tools);
+       i++) {
+    if (strcmp(read_only_tools[i], tool_name) == 0) {
+      return false;
+    }
+  }
+  return true;
+}
@@ -0,0 +1,38 @@
+/*
+ * Safe start for CCHD.
+ *
+ * Until a session's server has answered once, a failed request says nothing
+ * about whether policy is running at all: the server may simply not be up
+ * yet. With --safe-start, tools that can change things are blocked in that
+ * window whatever the fail mode, and read-only tools follow the fail mode as
+ * usual. The first answer from the server ends it for the whole session.
+ */
+
+#pragma once
+
+#include <limits.h>
+#include <stdbool.h>
+
+// Whether one session's server has been confirmed. The confirmation is a
+// marker file in the user's state directory, so every later dispatcher of
+// the session sees it.
+typedef struct {
+  bool confirmed;
+  char path[PATH_MAX];
+} cchd_safe_start_t;
+
+// Looks up the session's confirmation. Without a session id or a private
+// state directory nothing can be remembered, so every event starts out
+// unconfirmed.
+void cchd_safe_start_open(cchd_safe_start_t *safe_start,
+                          const char *session_id);
+
+// Records that the server answered, logging the move out of safe start the
+// first time it happens in the session.
+void cchd_safe_start_confirm(cchd_safe_start_t *safe_start);
+
+// Reports whether an event whose request failed must be blocked: a
+// PreToolUse of any tool not known to be read-only, before confirmation.
+bool cchd_safe_start_blocks(const cchd_safe_start_t *safe_start,
+                            const char *hook_event_name,
+                            const char *tool_name);
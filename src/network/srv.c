@@ -0,0 +1,229 @@
+/*
+ * DNS SRV server discovery implementation.
+ *
+ * Targets are ordered as RFC 2782 describes: lowest priority first, and
+ * within a priority a draw weighted by the record's weights, repeated for
+ * each place in the list. The draw is seeded per dispatcher, so concurrent
+ * hooks spread over the targets in proportion to their weights.
+ */
+
+#include "srv.h"
+
+#include <arpa/nameser.h>
+#include <netinet/in.h>
+#include <resolv.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <unistd.h>
+
+#include "../core/config.h"
+#include "../utils/logging.h"
+
+#define SRV_MAX_TARGETS 32
+
+typedef struct {
+  uint16_t priority;
+  uint16_t weight;
+  uint16_t port;
+  char host[NS_MAXDNAME];
+} srv_target;
+
+bool cchd_srv_is_srv_url(const char *url) {
+  return url != nullptr &&
+         strncmp(url, SRV_URL_PREFIX, strlen(SRV_URL_PREFIX)) == 0;
+}
+
+// Splits srv+SCHEME://NAME/REST into the scheme, the record name and the
+// rest of the URL.
+static bool parse_srv_url(const char *url, char *scheme, size_t scheme_size,
+                          char *name, size_t name_size, const char **rest) {
+  if (!cchd_srv_is_srv_url(url)) {
+    return false;
+  }
+  const char *start = url + strlen(SRV_URL_PREFIX);
+  const char *separator = strstr(start, "://");
+  if (separator == nullptr ||
+      (size_t)(separator - start) >= scheme_size) {
+    return false;
+  }
+  memcpy(scheme, start, (size_t)(separator - start));
+  scheme[separator - start] = '\0';
+  if (strcmp(scheme, "http") != 0 && strcmp(scheme, "https") != 0) {
+    return false;
+  }
+
+  // The port comes from the record, so the name can't have one.
+  const char *host = separator + 3;
+  size_t host_len = strcspn(host, "/?#");
+  if (host_len == 0 || host_len >= name_size ||
+      memchr(host, ':', host_len) != nullptr) {
+    return false;
+  }
+  memcpy(name, host, host_len);
+  name[host_len] = '\0';
+  *rest = host + host_len;
+  return true;
+}
+
+bool cchd_srv_is_valid_url(const char *url) {
+  char scheme[8];
+  char name[NS_MAXDNAME];
+  const char *rest = nullptr;
+  return parse_srv_url(url, scheme, sizeof(scheme), name, sizeof(name), &rest);
+}
+
+static size_t query_targets(const char *name, srv_target *targets,
+                            size_t max) {
+  unsigned char answer[8192];
+  int len = res_query(name, ns_c_in, ns_t_srv, answer, sizeof(answer));
+  // An answer too long for the buffer comes back with its full length.
+  if (len < 0 || len > (int)sizeof(answer)) {
+    return 0;
+  }
+  ns_msg message;
+  if (ns_initparse(answer, len, &message) != 0) {
+    return 0;
+  }
+
+  size_t count = 0;
+  for (int i = 0; i < ns_msg_count(message, ns_s_an) && count < max; i++) {
+    ns_rr record;
+    if (ns_parserr(&message, ns_s_an, i, &record) != 0 ||
+        ns_rr_type(record) != ns_t_srv || ns_rr_rdlen(record) < 7) {
+      continue;
+    }
+    const unsigned char *rdata = ns_rr_rdata(record);
+    srv_target *target = &targets[count];
+    target->priority = ns_get16(rdata);
+    target->weight = ns_get16(rdata + 2);
+    target->port = ns_get16(rdata + 4);
+    // A target of "." says the service is deliberately not offered.
+    if (dn_expand(ns_msg_base(message), ns_msg_end(message), rdata + 6,
+                  target->host, sizeof(target->host)) < 0 ||
+        target->host[0] == '\0' || strcmp(target->host, ".") == 0) {
+      continue;
+    }
+    count++;
+  }
+  return count;
+}
+
+static uint64_t next_random(uint64_t *state) {
+  *state ^= *state << 13;
+  *state ^= *state >> 7;
+  *state ^= *state << 17;
+  return *state;
+}
+
+// Zero weights go first within a priority, where the draw can still pick
+// them but rarely does, as RFC 2782 asks.
+static bool sorts_before(const srv_target *a, const srv_target *b) {
+  if (a->priority != b->priority) {
+    return a->priority < b->priority;
+  }
+  return a->weight == 0 && b->weight != 0;
+}
+
+static void swap_targets(srv_target *a, srv_target *b) {
+  srv_target temp = *a;
+  *a = *b;
+  *b = temp;
+}
+
+static void order_targets(srv_target *targets, size_t count) {
+  for (size_t i = 1; i < count; i++) {
+    for (size_t j = i; j > 0 && sorts_before(&targets[j], &targets[j - 1]);
+         j--) {
+      swap_targets(&targets[j], &targets[j - 1]);
+    }
+  }
+
+  struct timespec now;
+  clock_gettime(CLOCK_REALTIME, &now);
+  uint64_t state = ((uint64_t)now.tv_sec << 32) ^ (uint64_t)now.tv_nsec ^
+                   ((uint64_t)getpid() << 16) ^ 0x9e3779b97f4a7c15ULL;
+
+  for (size_t start = 0; start < count;) {
+    size_t end = start;
+    while (end < count && targets[end].priority == targets[start].priority) {
+      end++;
+    }
+    for (size_t place = start; place + 1 < end; place++) {
+      uint64_t total = 0;
+      for (size_t i = place; i < end; i++) {
+        total += targets[i].weight;
+      }
+      uint64_t draw = next_random(&state) % (total + 1);
+      uint64_t running = 0;
+      size_t pick = place;
+      for (size_t i = place; i < end; i++) {
+        running += targets[i].weight;
+        if (running >= draw) {
+          pick = i;
+          break;
+        }
+      }
+      swap_targets(&targets[place], &targets[pick]);
+    }
+    start = end;
+  }
+}
+
+// Expands the SRV server at index. Returns how many servers took its place.
+static size_t resolve_server(cchd_config_t *config, size_t index) {
+  const char *url = cchd_config_get_server_url(config, index);
+  char scheme[8];
+  char name[NS_MAXDNAME];
+  const char *rest = nullptr;
+  if (!parse_srv_url(url, scheme, sizeof(scheme), name, sizeof(name),
+                     &rest)) {
+    return 1;  // Reported when the server list is validated.
+  }
+
+  srv_target targets[SRV_MAX_TARGETS];
+  size_t count = query_targets(name, targets, SRV_MAX_TARGETS);
+  if (count == 0) {
+    LOG_WARNING("SRV lookup for %s found no targets", name);
+    return 1;
+  }
+  order_targets(targets, count);
+
+  char *urls[SRV_MAX_TARGETS];
+  size_t built = 0;
+  for (size_t i = 0; i < count; i++) {
+    size_t size = strlen(scheme) + strlen(targets[i].host) + strlen(rest) + 16;
+    urls[built] = malloc(size);
+    if (urls[built] == nullptr) {
+      continue;
+    }
+    snprintf(urls[built], size, "%s://%s:%u%s", scheme, targets[i].host,
+             (unsigned)targets[i].port, rest);
+    LOG_DEBUG("SRV %s target %zu: %s (priority %u, weight %u)", name, built,
+              urls[built], (unsigned)targets[i].priority,
+              (unsigned)targets[i].weight);
+    built++;
+  }
+  if (built == 0) {
+    return 1;
+  }
+
+  size_t before = cchd_config_get_server_count(config);
+  cchd_config_replace_server(config, index, urls, built);
+  for (size_t i = 0; i < built; i++) {
+    free(urls[i]);
+  }
+  return cchd_config_get_server_count(config) - before + 1;
+}
+
+void cchd_srv_resolve_servers(cchd_config_t *config) {
+  for (size_t i = 0; i < cchd_config_get_server_count(config);) {
+    if (cchd_srv_is_srv_url(cchd_config_get_server_url(config, i))) {
+      i += resolve_server(config, i);
+    } else {
+      i++;
+    }
+  }
+}
@@ -0,0 +1,32 @@
+/*
+ * DNS SRV server discovery for CCHD.
+ *
+ * A server given as srv+https://_hook._tcp.policy.internal/hook names an
+ * SRV record instead of a host. At startup it is replaced by the targets the
+ * record lists, ordered by priority and, within one priority, by a weighted
+ * draw, so dispatchers spread over the targets and fail over through them
+ * like any server list. The record is looked up again by every dispatcher,
+ * so a target removed from DNS stops getting events as soon as the
+ * resolver's cache lets go of it.
+ */
+
+#pragma once
+
+#include <stdbool.h>
+
+// Forward declaration to rewrite the server list in configuration.
+typedef struct cchd_config cchd_config_t;
+
+#define SRV_URL_PREFIX "srv+"
+
+// Whether url names an SRV record rather than a host.
+bool cchd_srv_is_srv_url(const char *url);
+
+// Whether an SRV url is well formed: srv+http or srv+https, and a record
+// name without a port, since the port comes from the record.
+bool cchd_srv_is_valid_url(const char *url);
+
+// Replaces each SRV server in the list with its targets. A name that
+// doesn't resolve is left in place, and any request to it fails as a DNS
+// error, so the fail mode decides as for a host that doesn't resolve.
+void cchd_srv_resolve_servers(cchd_config_t *config);
@@ -5,14 +5,23 @@
 #include "cloudevents.h"
 
 #include <assert.h>
+#include <fcntl.h>
 #include <inttypes.h>
 #include <stdatomic.h>
 #include <stdio.h>
+#include <stdlib.h>
 #include <string.h>
 #include <time.h>
+#include <unistd.h>
+#if defined(__linux__)
+#include <sys/random.h>
+#endif
 
+#include "../core/config.h"
+#include "../network/budget.h"
 #include "../utils/logging.h"
 #include "../utils/memory.h"
+#include "identity.h"
 #include "json.h"
 
 // Compile-time validations ensure our buffers can handle worst-case scenarios.
@@ -117,6 +126,38 @@ static bool add_required_cloudevents_attributes(yyjson_mut_doc *output_doc,
   return true;
 }
 
+// Fills bytes from the system CSPRNG. The event id is predictable from the
+// clock, so replay protection needs a separate value an attacker can't guess.
+static bool fill_random(uint8_t *bytes, size_t len) {
+#if defined(__APPLE__) || defined(__OpenBSD__) || defined(__FreeBSD__) || \
+    defined(__NetBSD__)
+  arc4random_buf(bytes, len);
+  return true;
+#else
+#if defined(__linux__)
+  if (getrandom(bytes, len, 0) == (ssize_t)len) {
+    return true;
+  }
+#endif
+  // Older kernels without getrandom, or other Unix systems.
+  int fd = open("/dev/urandom", O_RDONLY | O_CLOEXEC);
+  if (fd < 0) {
+    return false;
+  }
+  size_t filled = 0;
+  while (filled < len) {
+    ssize_t n = read(fd, bytes + filled, len - filled);
+    if (n <= 0) {
+      close(fd);
+      return false;
+    }
+    filled += (size_t)n;
+  }
+  close(fd);
+  return true;
+#endif
+}
+
 static bool add_optional_cloudevents_attributes(yyjson_mut_doc *output_doc,
                                                 yyjson_mut_val *output_root,
                                                 yyjson_val *input_root) {
@@ -152,6 +193,23 @@ static bool add_optional_cloudevents_attributes(yyjson_mut_doc *output_doc,
     }
   }
 
+  // Random 128-bit nonce for servers that reject replayed events. It is part
+  // of the payload, so retries of this event send the same nonce. A server
+  // that saw the first attempt will then answer a retry with 409, which is
+  // not retried and leaves the decision to the fail mode.
+  uint8_t nonce_bytes[NONCE_BYTES];
+  if (fill_random(nonce_bytes, sizeof(nonce_bytes))) {
+    char nonce[NONCE_BYTES * 2 + 1];
+    for (size_t i = 0; i < sizeof(nonce_bytes); i++) {
+      snprintf(nonce + i * 2, 3, "%02x", nonce_bytes[i]);
+    }
+    if (!yyjson_mut_obj_add_strcpy(output_doc, output_root, "nonce", nonce)) {
+      return false;
+    }
+  } else {
+    LOG_WARNING("No system randomness available, sending event without nonce");
+  }
+
   yyjson_val *correlation_id_value =
       yyjson_obj_get(input_root, "correlation_id");
   if (yyjson_is_str(correlation_id_value)) {
@@ -164,7 +222,197 @@ static bool add_optional_cloudevents_attributes(yyjson_mut_doc *output_doc,
   return true;
 }
 
-yyjson_mut_doc *cchd_transform_to_cloudevents(yyjson_doc *input_doc) {
+// Standard base64 (RFC 4648, with padding) into secure memory, since the
+// encoded text is as sensitive as the hook input it carries. The caller frees
+// the result with cchd_secure_free(result, *encoded_size).
+static char *base64_encode(const char *data, size_t len,
+                           size_t *encoded_size) {
+  static const char alphabet[] =
+      "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+
+  *encoded_size = ((len + 2) / 3) * 4 + 1;
+  char *out = cchd_secure_malloc(*encoded_size);
+  if (out == nullptr) {
+    return nullptr;
+  }
+
+  size_t o = 0;
+  for (size_t i = 0; i < len; i += 3) {
+    uint32_t chunk = (uint32_t)(unsigned char)data[i] << 16;
+    if (i + 1 < len) {
+      chunk |= (uint32_t)(unsigned char)data[i + 1] << 8;
+    }
+    if (i + 2 < len) {
+      chunk |= (uint32_t)(unsigned char)data[i + 2];
+    }
+    out[o++] = alphabet[(chunk >> 18) & 0x3F];
+    out[o++] = alphabet[(chunk >> 12) & 0x3F];
+    out[o++] = i + 1 < len ? alphabet[(chunk >> 6) & 0x3F] : '=';
+    out[o++] = i + 2 < len ? alphabet[chunk & 0x3F] : '=';
+  }
+  out[o] = '\0';
+  return out;
+}
+
+// Environment variable names as POSIX shells accept them.
+static bool is_env_name(const char *name, size_t len) {
+  if (len == 0 || (name[0] >= '0' && name[0] <= '9')) {
+    return false;
+  }
+  for (size_t i = 0; i < len; i++) {
+    char c = name[i];
+    if (!((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+          (c >= '0' && c <= '9') || c == '_')) {
+      return false;
+    }
+  }
+  return true;
+}
+
+// Builds the forwardedenv value: a JSON object, in a string because
+// CloudEvents attributes can't hold maps, with each --forward-env variable
+// that is set. Returns nullptr when none are set. The caller frees it.
+static char *build_forwarded_env(yyjson_mut_doc *output_doc,
+                                 const char *names) {
+  yyjson_mut_val *env_object = yyjson_mut_obj(output_doc);
+  if (env_object == nullptr) {
+    return nullptr;
+  }
+
+  char name[256];
+  const char *cursor = names;
+  while (*cursor != '\0') {
+    while (*cursor == ' ' || *cursor == ',') {
+      cursor++;
+    }
+    size_t len = strcspn(cursor, ", ");
+    if (len == 0) {
+      continue;
+    }
+
+    if (len >= sizeof(name) || !is_env_name(cursor, len)) {
+      LOG_WARNING("Ignoring invalid variable name in --forward-env: %.*s",
+                  (int)len, cursor);
+    } else {
+      memcpy(name, cursor, len);
+      name[len] = '\0';
+      const char *value = getenv(name);
+      // The key is copied too: yyjson references keys, and name is reused.
+      if (value != nullptr && yyjson_mut_obj_get(env_object, name) == nullptr &&
+          !yyjson_mut_obj_add(env_object, yyjson_mut_strcpy(output_doc, name),
+                              yyjson_mut_strcpy(output_doc, value))) {
+        return nullptr;
+      }
+    }
+    cursor += len;
+  }
+
+  if (yyjson_mut_obj_size(env_object) == 0) {
+    return nullptr;
+  }
+  return yyjson_mut_val_write(env_object, 0, nullptr);
+}
+
+// Opt-in extension attributes. Each is guarded by its own setting because it
+// either grows the payload or carries data the user must choose to share.
+static bool add_extension_attributes(yyjson_mut_doc *output_doc,
+                                     yyjson_mut_val *output_root,
+                                     const char *raw_input,
+                                     const cchd_config_t *config) {
+  // Original stdin, base64-encoded. The data field is rebuilt from the parsed
+  // input, so key order and whitespace may differ from what Claude sent;
+  // servers that verify signatures over the input or archive it verbatim need
+  // the exact bytes. It roughly doubles the payload, hence the opt-in.
+  if (cchd_config_is_include_raw(config) && raw_input != nullptr) {
+    size_t encoded_size = 0;
+    char *encoded = base64_encode(raw_input, strlen(raw_input), &encoded_size);
+    if (encoded == nullptr) {
+      return false;
+    }
+    bool added = yyjson_mut_obj_add_strcpy(output_doc, output_root, "rawdata",
+                                           encoded);
+    cchd_secure_free(encoded, encoded_size);
+    if (!added) {
+      return false;
+    }
+  }
+
+  // Selected environment variables for policies that judge commands by the
+  // environment they run in. Only the named variables are ever read, so the
+  // user decides what leaves the machine.
+  const char *forward_env = cchd_config_get_forward_env(config);
+  if (forward_env != nullptr) {
+    char *forwarded = build_forwarded_env(output_doc, forward_env);
+    if (forwarded != nullptr) {
+      bool added = yyjson_mut_obj_add_strcpy(output_doc, output_root,
+                                             "forwardedenv", forwarded);
+      free(forwarded);
+      if (!added) {
+        return false;
+      }
+    }
+  }
+
+  // Who is running Claude, for per-user policy. Sources that yield nothing
+  // leave the attribute out rather than failing the hook.
+  char *user_id = cchd_resolve_user_id(config);
+  if (user_id != nullptr) {
+    bool added =
+        yyjson_mut_obj_add_strcpy(output_doc, output_root, "userid", user_id);
+    cchd_secure_free(user_id, strlen(user_id) + 1);
+    if (!added) {
+      return false;
+    }
+  }
+
+  // Retries the session has left, so servers can chart budget depletion.
+  cchd_retry_budget_t budget;
+  cchd_retry_budget_open(
+      &budget, config,
+      yyjson_mut_get_str(yyjson_mut_obj_get(output_root, "sessionid")));
+  int64_t retries_left = cchd_retry_budget_remaining(&budget);
+  if (retries_left >= 0 &&
+      !yyjson_mut_obj_add_int(output_doc, output_root, "retrybudget",
+                              retries_left)) {
+    return false;
+  }
+
+  return true;
+}
+
+// Cuts the forwarded prompt to --max-forward-prompt bytes, backing off to a
+// UTF-8 character boundary, and says so in the prompttruncated and
+// promptlength attributes. Only the copy in data is cut; the input that
+// cchd passes through to Claude keeps the whole prompt.
+static bool truncate_forwarded_prompt(yyjson_mut_doc *output_doc,
+                                      yyjson_mut_val *output_root,
+                                      yyjson_mut_val *data_object,
+                                      const cchd_config_t *config) {
+  int64_t max_bytes = cchd_config_get_max_forward_prompt(config);
+  yyjson_mut_val *prompt = yyjson_mut_obj_get(data_object, "prompt");
+  if (max_bytes <= 0 || !yyjson_mut_is_str(prompt) ||
+      yyjson_mut_get_len(prompt) <= (size_t)max_bytes) {
+    return true;
+  }
+
+  const char *text = yyjson_mut_get_str(prompt);
+  size_t length = yyjson_mut_get_len(prompt);
+  size_t cut = (size_t)max_bytes;
+  while (cut > 0 && ((unsigned char)text[cut] & 0xC0) == 0x80) {
+    cut--;
+  }
+  LOG_DEBUG("Forwarding %zu of %zu prompt bytes", cut, length);
+  return yyjson_mut_obj_put(data_object, yyjson_mut_str(output_doc, "prompt"),
+                            yyjson_mut_strncpy(output_doc, text, cut)) &&
+         yyjson_mut_obj_add_bool(output_doc, output_root, "prompttruncated",
+                                 true) &&
+         yyjson_mut_obj_add_int(output_doc, output_root, "promptlength",
+                                (int64_t)length);
+}
+
+yyjson_mut_doc *cchd_transform_to_cloudevents(yyjson_doc *input_doc,
+                                              const char *raw_input,
+                                              const cchd_config_t *config) {
   CHECK_NULL(input_doc, NULL);
 
   yyjson_val *input_root = yyjson_doc_get_root(input_doc);
@@ -200,13 +448,20 @@ yyjson_mut_doc *cchd_transform_to_cloudevents(yyjson_doc *input_doc) {
     return NULL;
   }
 
+  if (!add_extension_attributes(output_doc, output_root, raw_input, config)) {
+    yyjson_mut_doc_free(output_doc);
+    return NULL;
+  }
+
   // Embed original hook data
   yyjson_mut_val *data_object = build_data_object(output_doc, input_root);
   if (data_object == NULL) {
     yyjson_mut_doc_free(output_doc);
     return NULL;
   }
-  if (!yyjson_mut_obj_add_val(output_doc, output_root, "data", data_object)) {
+  if (!truncate_forwarded_prompt(output_doc, output_root, data_object,
+                                 config) ||
+      !yyjson_mut_obj_add_val(output_doc, output_root, "data", data_object)) {
     yyjson_mut_doc_free(output_doc);
     return NULL;
   }
@@ -13,9 +13,15 @@
 
 #include "../core/types.h"
 
+// Forward declaration avoids circular dependency with config.h.
+// Opt-in extension attributes are only added when configuration asks for them.
+typedef struct cchd_config cchd_config_t;
+
 // Transform input to CloudEvents format with required metadata.
 // Adds CloudEvents attributes (specversion, type, source, id) while preserving
 // original data. Returns new document that caller must free. This standardization
 // enables reliable event routing and processing across diverse systems.
+// raw_input is the exact stdin text, used for the opt-in "rawdata" attribute.
 CCHD_NODISCARD yyjson_mut_doc *cchd_transform_to_cloudevents(
-    yyjson_doc *input_doc);
\ No newline at end of file
+    yyjson_doc *input_doc, const char *raw_input,
+    const cchd_config_t *config);
\ No newline at end of file
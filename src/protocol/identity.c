@@ -0,0 +1,154 @@
+/*
+ * User identity resolution implementation.
+ */
+
+#include "identity.h"
+
+#include <ctype.h>
+#include <pwd.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/wait.h>
+#include <unistd.h>
+
+#include "../core/config.h"
+#include "../utils/logging.h"
+#include "../utils/memory.h"
+#include "../utils/sha256.h"
+
+// Copies value into secure memory if it is a usable identity: surrounding
+// whitespace is trimmed, and control characters or an oversized value are
+// rejected so a misbehaving source can't inject anything into the event.
+static char *accept_identity(const char *value, const char *source) {
+  if (value == nullptr) {
+    return nullptr;
+  }
+
+  while (isspace((unsigned char)*value)) {
+    value++;
+  }
+  size_t len = strlen(value);
+  while (len > 0 && isspace((unsigned char)value[len - 1])) {
+    len--;
+  }
+  if (len == 0) {
+    return nullptr;
+  }
+  if (len > USER_ID_MAX_LENGTH) {
+    LOG_WARNING("Ignoring user id from %s: longer than %d bytes", source,
+                USER_ID_MAX_LENGTH);
+    return nullptr;
+  }
+  for (size_t i = 0; i < len; i++) {
+    if (iscntrl((unsigned char)value[i])) {
+      LOG_WARNING("Ignoring user id from %s: contains control characters",
+                  source);
+      return nullptr;
+    }
+  }
+
+  char *identity = cchd_secure_malloc(len + 1);
+  if (identity == nullptr) {
+    return nullptr;
+  }
+  memcpy(identity, value, len);
+  identity[len] = '\0';
+  return identity;
+}
+
+static char *identity_from_os(void) {
+  struct passwd *pw = getpwuid(geteuid());
+  return accept_identity(pw ? pw->pw_name : nullptr, "os");
+}
+
+static char *identity_from_env(const char *name) {
+  return accept_identity(getenv(name), "env");
+}
+
+// Runs a credential helper and takes the first line of its output. The helper
+// blocks the hook while it runs, so it should answer from a local cache.
+static char *identity_from_exec(const char *command) {
+  FILE *helper = popen(command, "r");
+  if (helper == nullptr) {
+    LOG_WARNING("Failed to run user id helper");
+    return nullptr;
+  }
+
+  char line[USER_ID_MAX_LENGTH + 2] = {0};
+  bool have_line = fgets(line, sizeof(line), helper) != nullptr;
+  // Drain the rest so the helper doesn't die of SIGPIPE before exiting.
+  char discard[256];
+  while (fgets(discard, sizeof(discard), helper) != nullptr) {
+  }
+  int status = pclose(helper);
+
+  char *identity = nullptr;
+  if (status == -1 || !WIFEXITED(status) || WEXITSTATUS(status) != 0) {
+    LOG_WARNING("User id helper failed (status %d)", status);
+  } else if (have_line) {
+    identity = accept_identity(line, "exec");
+  }
+  cchd_secure_zero(line, sizeof(line));
+  return identity;
+}
+
+// Replaces identity with its SHA-256 hex digest, freeing the plain value.
+static char *hash_identity(char *identity) {
+  char *hashed = cchd_secure_malloc(SHA256_HEX_SIZE);
+  if (hashed != nullptr) {
+    cchd_sha256_hex(identity, strlen(identity), hashed);
+  }
+  cchd_secure_free(identity, strlen(identity) + 1);
+  return hashed;
+}
+
+char *cchd_resolve_user_id(const cchd_config_t *config) {
+  const char *sources = cchd_config_get_user_id_sources(config);
+  if (sources == nullptr || *sources == '\0') {
+    return nullptr;
+  }
+
+  char *identity = nullptr;
+  const char *cursor = sources;
+  while (identity == nullptr && *cursor != '\0') {
+    while (*cursor == ' ' || *cursor == ',') {
+      cursor++;
+    }
+    const char *end = strchr(cursor, ',');
+    size_t len = end ? (size_t)(end - cursor) : strlen(cursor);
+
+    if (strncmp(cursor, "exec:", 5) == 0) {
+      // The command owns the rest of the list.
+      identity = identity_from_exec(cursor + 5);
+      break;
+    }
+
+    char source[USER_ID_MAX_LENGTH + 1];
+    if (len < sizeof(source)) {
+      memcpy(source, cursor, len);
+      source[len] = '\0';
+      while (len > 0 && source[len - 1] == ' ') {
+        source[--len] = '\0';
+      }
+
+      if (strcmp(source, "os") == 0) {
+        identity = identity_from_os();
+      } else if (strncmp(source, "env:", 4) == 0 && source[4] != '\0') {
+        identity = identity_from_env(source + 4);
+      } else if (len > 0) {
+        LOG_WARNING("Ignoring unknown user id source: %s", source);
+      }
+    }
+
+    cursor += end ? len + 1 : len;
+  }
+
+  if (identity == nullptr) {
+    LOG_DEBUG("No user id source yielded a value");
+    return nullptr;
+  }
+
+  return cchd_config_is_hash_user_id(config) ? hash_identity(identity)
+                                             : identity;
+}
@@ -0,0 +1,31 @@
+/*
+ * User identity resolution for CCHD.
+ *
+ * Resolves who is running Claude for the "userid" CloudEvents extension
+ * attribute, so servers can apply per-user policy. The identity comes from a
+ * configured list of sources and can be hashed before it leaves the machine.
+ */
+
+#pragma once
+
+#include <stddef.h>
+
+#include "../core/types.h"
+
+// Forward declaration to read the configured sources and hashing choice.
+typedef struct cchd_config cchd_config_t;
+
+// Longest identity accepted from any source, in bytes.
+#define USER_ID_MAX_LENGTH 256
+
+// Resolve the user id from the comma-separated --user-id sources, trying
+// them in order and taking the first that yields a non-empty value:
+//   os        the effective OS user's login name
+//   env:NAME  the value of environment variable NAME
+//   exec:CMD  the first line CMD prints, if it exits 0 (a credential helper);
+//             CMD runs through /bin/sh and extends to the end of the list,
+//             so it must be the last source and may contain commas
+// Returns the identity in secure memory, as SHA-256 hex when --hash-user-id
+// is set, or nullptr when no sources are configured or none yields a value.
+// The caller frees it with cchd_secure_free(result, strlen(result) + 1).
+CCHD_NODISCARD char *cchd_resolve_user_id(const cchd_config_t *config);
@@ -98,7 +98,8 @@ char *cchd_process_input_to_protocol(const char *input_json_string,
 
   // Transform to CloudEvents format
   yyjson_mut_doc *protocol_json_document =
-      cchd_transform_to_cloudevents(input_json_document);
+      cchd_transform_to_cloudevents(input_json_document, input_json_string,
+                                    config);
   yyjson_doc_free(input_json_document);
 
   if (protocol_json_document == NULL) {
@@ -174,35 +175,94 @@ static const char *parse_decision(yyjson_val *response_root) {
   return NULL;
 }
 
-static void handle_decision(const char *decision, yyjson_val *response_root,
-                            int32_t *exit_code_out) {
-  if (decision == NULL || response_root == NULL || exit_code_out == NULL ||
-      strlen(decision) == 0) {
-    LOG_ERROR("Invalid parameters in handle_decision");
-    if (exit_code_out != NULL) {
-      *exit_code_out = 1;
+// Nesting beyond this is copied as it came, which is still stable for the
+// same response, rather than recursing until the stack runs out.
+#define CANONICAL_MAX_DEPTH 256
+
+typedef struct {
+  yyjson_val *key;
+  yyjson_val *value;
+  size_t index;
+} json_member;
+
+// Byte order of the keys; duplicate keys keep the order they came in.
+static int compare_members(const void *a, const void *b) {
+  const json_member *x = a;
+  const json_member *y = b;
+  size_t x_len = yyjson_get_len(x->key);
+  size_t y_len = yyjson_get_len(y->key);
+  int order = memcmp(yyjson_get_str(x->key), yyjson_get_str(y->key),
+                     x_len < y_len ? x_len : y_len);
+  if (order != 0) {
+    return order;
+  }
+  if (x_len != y_len) {
+    return x_len < y_len ? -1 : 1;
+  }
+  return x->index < y->index ? -1 : 1;
+}
+
+static yyjson_mut_val *copy_sorted(yyjson_mut_doc *doc, yyjson_val *value,
+                                   int depth) {
+  if (depth >= CANONICAL_MAX_DEPTH ||
+      (!yyjson_is_arr(value) && !yyjson_is_obj(value))) {
+    return yyjson_val_mut_copy(doc, value);
+  }
+
+  size_t idx, max;
+  if (yyjson_is_arr(value)) {
+    yyjson_mut_val *array = yyjson_mut_arr(doc);
+    yyjson_val *item;
+    yyjson_arr_foreach(value, idx, max, item) {
+      yyjson_mut_val *copy = copy_sorted(doc, item, depth + 1);
+      if (copy == NULL || !yyjson_mut_arr_append(array, copy)) {
+        return NULL;
+      }
     }
-    return;
+    return array;
   }
 
-  const char *reason = NULL;
-  yyjson_val *reason_value = yyjson_obj_get(response_root, "reason");
-  if (yyjson_is_str(reason_value)) {
-    reason = yyjson_get_str(reason_value);
+  size_t count = yyjson_obj_size(value);
+  json_member *members = calloc(count > 0 ? count : 1, sizeof(*members));
+  if (members == NULL) {
+    return NULL;
   }
+  yyjson_val *key, *member;
+  yyjson_obj_foreach(value, idx, max, key, member) {
+    members[idx] = (json_member){.key = key, .value = member, .index = idx};
+  }
+  qsort(members, count, sizeof(*members), compare_members);
 
-  if (strcmp(decision, "block") == 0) {
-    *exit_code_out = 1;
-    if (reason) {
-      fprintf(stderr, "✗ Blocked: %s\n", reason);
-    }
-  } else if (strcmp(decision, "approve") == 0 ||
-             strcmp(decision, "allow") == 0) {
-    *exit_code_out = 0;
-    if (reason) {
-      fprintf(stderr, "✓ Allowed: %s\n", reason);
+  yyjson_mut_val *object = yyjson_mut_obj(doc);
+  for (size_t i = 0; object != NULL && i < count; i++) {
+    yyjson_mut_val *copy = copy_sorted(doc, members[i].value, depth + 1);
+    if (copy == NULL ||
+        !yyjson_mut_obj_add(object, yyjson_val_mut_copy(doc, members[i].key),
+                            copy)) {
+      object = NULL;
     }
   }
+  free(members);
+  return object;
+}
+
+// Writes value compactly with every object's keys sorted, so identical
+// modifications come out byte-identical whatever order the server wrote
+// them in, for golden tests and signatures over the output. Returns NULL on
+// failure; release the result with free().
+static char *write_canonical(yyjson_val *value, size_t *len) {
+  yyjson_mut_doc *doc = yyjson_mut_doc_new(NULL);
+  if (doc == NULL) {
+    return NULL;
+  }
+  yyjson_mut_val *root = copy_sorted(doc, value, 0);
+  char *json = NULL;
+  if (root != NULL) {
+    yyjson_mut_doc_set_root(doc, root);
+    json = yyjson_mut_write(doc, 0, len);
+  }
+  yyjson_mut_doc_free(doc);
+  return json;
 }
 
 static void handle_modify(yyjson_val *response_root,
@@ -216,7 +276,7 @@ static void handle_modify(yyjson_val *response_root,
   yyjson_val *modified_value = yyjson_obj_get(response_root, "modified_data");
   if (modified_value != NULL) {
     size_t json_len = 0;
-    char *json_str = yyjson_val_write(modified_value, 0, &json_len);
+    char *json_str = write_canonical(modified_value, &json_len);
     if (json_str != NULL) {
       char *secure_json = cchd_secure_malloc(json_len + 1);
       if (secure_json != NULL) {
@@ -228,67 +288,244 @@ static void handle_modify(yyjson_val *response_root,
   }
 }
 
-static void handle_hook_specific(yyjson_val *response_root,
-                                 int32_t *exit_code_out) {
-  if (response_root == NULL || exit_code_out == NULL ||
-      !yyjson_is_obj(response_root)) {
-    LOG_ERROR("Invalid parameters in handle_hook_specific");
-    if (exit_code_out != NULL) {
-      *exit_code_out = 1;
+// The decision a response carries, whatever format it came in. Servers may
+// answer one event type in the modern format and another in the legacy one,
+// so each response is read on its own rather than by server.
+typedef enum {
+  RESPONSE_DECISION_NONE,
+  RESPONSE_DECISION_ALLOW,
+  RESPONSE_DECISION_BLOCK,
+  RESPONSE_DECISION_ASK,
+  RESPONSE_DECISION_RETURN,
+  RESPONSE_DECISION_UNKNOWN,
+} response_decision;
+
+typedef struct {
+  response_decision decision;
+  const char *value;
+  const char *reason;
+  bool modern;
+} normalized_response;
+
+static response_decision parse_decision_value(const char *value) {
+  if (strcmp(value, "allow") == 0 || strcmp(value, "approve") == 0) {
+    return RESPONSE_DECISION_ALLOW;
+  }
+  if (strcmp(value, "block") == 0 || strcmp(value, "deny") == 0) {
+    return RESPONSE_DECISION_BLOCK;
+  }
+  if (strcmp(value, "ask") == 0) {
+    return RESPONSE_DECISION_ASK;
+  }
+  if (strcmp(value, "return") == 0) {
+    return RESPONSE_DECISION_RETURN;
+  }
+  return RESPONSE_DECISION_UNKNOWN;
+}
+
+// Reads the legacy top-level decision, then lets a modern permissionDecision
+// override it. permissionDecision only exists for PreToolUse, which is judged
+// by the event that was sent; the response's own hookEventName is only
+// trusted when the event is unknown.
+static void normalize_response(yyjson_val *response_root,
+                               const char *hook_event_name,
+                               normalized_response *out) {
+  *out = (normalized_response){.decision = RESPONSE_DECISION_NONE};
+
+  const char *decision = parse_decision(response_root);
+  if (decision != NULL && strcmp(decision, "modify") != 0) {
+    out->decision = parse_decision_value(decision);
+    out->value = decision;
+    yyjson_val *reason_value = yyjson_obj_get(response_root, "reason");
+    // "return" carries guidance for the user, conventionally in "message".
+    yyjson_val *message_value = yyjson_obj_get(response_root, "message");
+    if (out->decision == RESPONSE_DECISION_RETURN &&
+        yyjson_is_str(message_value)) {
+      reason_value = message_value;
     }
-    return;
+    out->reason =
+        yyjson_is_str(reason_value) ? yyjson_get_str(reason_value) : NULL;
   }
 
   yyjson_val *hook_specific =
       yyjson_obj_get(response_root, "hookSpecificOutput");
-  if (hook_specific && yyjson_is_obj(hook_specific)) {
-    yyjson_val *hook_name = yyjson_obj_get(hook_specific, "hookEventName");
-    if (yyjson_is_str(hook_name) &&
-        strcmp(yyjson_get_str(hook_name), "PreToolUse") == 0) {
-      yyjson_val *perm_decision =
-          yyjson_obj_get(hook_specific, "permissionDecision");
-      if (yyjson_is_str(perm_decision)) {
-        const char *perm = yyjson_get_str(perm_decision);
-        yyjson_val *perm_reason =
-            yyjson_obj_get(hook_specific, "permissionDecisionReason");
-        const char *reason =
-            yyjson_is_str(perm_reason) ? yyjson_get_str(perm_reason) : NULL;
-
-        if (strcmp(perm, "deny") == 0) {
-          *exit_code_out = 1;
-          if (reason) {
-            fprintf(stderr, "✗ Denied: %s\n", reason);
-          }
-        } else if (strcmp(perm, "allow") == 0) {
-          *exit_code_out = 0;
-          if (reason) {
-            fprintf(stderr, "✓ Allowed: %s\n", reason);
-          }
-        } else if (strcmp(perm, "ask") == 0) {
-          *exit_code_out = 2;
-          if (reason) {
-            fprintf(stderr, "⚠ User approval required: %s\n", reason);
-          }
-        }
-      }
+  yyjson_val *permission = yyjson_obj_get(hook_specific, "permissionDecision");
+  if (!yyjson_is_obj(hook_specific) || !yyjson_is_str(permission)) {
+    return;
+  }
+
+  const char *event = hook_event_name;
+  if (event == NULL) {
+    event = yyjson_get_str(yyjson_obj_get(hook_specific, "hookEventName"));
+  }
+  if (event == NULL || strcmp(event, "PreToolUse") != 0) {
+    LOG_WARNING("Ignoring permissionDecision in a %s response",
+                event != NULL ? event : "non-PreToolUse");
+    return;
+  }
+
+  out->decision = parse_decision_value(yyjson_get_str(permission));
+  out->value = yyjson_get_str(permission);
+  yyjson_val *reason_value =
+      yyjson_obj_get(hook_specific, "permissionDecisionReason");
+  out->reason =
+      yyjson_is_str(reason_value) ? yyjson_get_str(reason_value) : NULL;
+  out->modern = true;
+}
+
+static void apply_decision(const normalized_response *response,
+                           int32_t *exit_code_out) {
+  const char *reason = response->reason;
+  switch (response->decision) {
+  case RESPONSE_DECISION_BLOCK:
+    *exit_code_out = 1;
+    if (reason) {
+      fprintf(stderr, "✗ %s: %s\n", response->modern ? "Denied" : "Blocked",
+              reason);
     }
+    break;
+  case RESPONSE_DECISION_ASK:
+    *exit_code_out = 2;
+    if (reason) {
+      fprintf(stderr, "⚠ User approval required: %s\n", reason);
+    }
+    break;
+  case RESPONSE_DECISION_ALLOW:
+    *exit_code_out = 0;
+    if (reason) {
+      fprintf(stderr, "✓ Allowed: %s\n", reason);
+    }
+    break;
+  case RESPONSE_DECISION_NONE:
+  case RESPONSE_DECISION_RETURN:
+  case RESPONSE_DECISION_UNKNOWN:
+    break;
   }
 }
 
+// Sends a prompt back to the user with the server's guidance. Claude Code's
+// UserPromptSubmit output {"decision": "block", "reason": ...} does exactly
+// that: the prompt is dropped before Claude sees it and the reason is shown
+// to the user, who can rephrase. That output arrived with the event itself
+// (Claude Code 1.0.54), so any Claude Code that sends UserPromptSubmit
+// understands it. No other event has such an outcome, so there "return"
+// falls back to a block.
+static void handle_return(const normalized_response *response,
+                          const char *hook_event_name,
+                          const cchd_config_t *config,
+                          char **modified_output_ptr,
+                          int32_t *exit_code_out) {
+  const char *message = response->reason;
+  if (hook_event_name == NULL ||
+      strcmp(hook_event_name, "UserPromptSubmit") != 0) {
+    LOG_INFO("Decision 'return' only applies to UserPromptSubmit, blocking %s",
+             hook_event_name != NULL ? hook_event_name : "event");
+    *exit_code_out = 1;
+    if (message) {
+      fprintf(stderr, "✗ Blocked: %s\n", message);
+    }
+    return;
+  }
+
+  yyjson_mut_doc *doc = yyjson_mut_doc_new(NULL);
+  if (doc == NULL) {
+    *exit_code_out = 1;
+    return;
+  }
+  yyjson_mut_val *root = yyjson_mut_obj(doc);
+  yyjson_mut_doc_set_root(doc, root);
+  yyjson_mut_obj_add_str(doc, root, "decision", "block");
+  if (message) {
+    yyjson_mut_obj_add_str(doc, root, "reason", message);
+  }
+
+  size_t json_len = 0;
+  char *json_str = yyjson_mut_write(doc, 0, &json_len);
+  yyjson_mut_doc_free(doc);
+  char *secure_json = json_str ? cchd_secure_malloc(json_len + 1) : NULL;
+  if (secure_json == NULL) {
+    free(json_str);
+    *exit_code_out = 1;
+    return;
+  }
+  memcpy(secure_json, json_str, json_len + 1);
+  free(json_str);
+
+  // Claude reads the output only from a hook that exits 0.
+  *modified_output_ptr = secure_json;
+  *exit_code_out = 0;
+  if (message && !cchd_config_is_quiet(config)) {
+    fprintf(stderr, "↩ Returned to user: %s\n", message);
+  }
+}
+
+// Reports whether a response matches the format pinned for its server. Modern
+// servers answer PreToolUse with hookSpecificOutput.permissionDecision, so a
+// top-level allow or block there is legacy; legacy servers never send
+// permissionDecision. "modify" exists only as a top-level decision and is
+// valid in both. These are the rules "conformance -response-format" checks.
+static bool matches_response_format(yyjson_val *response_root,
+                                    const char *hook_event_name,
+                                    cchd_response_format format) {
+  if (format == CCHD_RESPONSE_FORMAT_MODERN && hook_event_name != NULL &&
+      strcmp(hook_event_name, "PreToolUse") == 0) {
+    const char *decision = parse_decision(response_root);
+    if (decision != NULL && strcmp(decision, "modify") != 0) {
+      return false;
+    }
+  }
+
+  if (format == CCHD_RESPONSE_FORMAT_LEGACY) {
+    yyjson_val *hook_specific =
+        yyjson_obj_get(response_root, "hookSpecificOutput");
+    if (yyjson_is_obj(hook_specific) &&
+        yyjson_obj_get(hook_specific, "permissionDecision") != NULL) {
+      return false;
+    }
+  }
+
+  return true;
+}
+
 cchd_error cchd_process_server_response(const char *response_data,
                                         char **modified_output_ptr,
                                         const cchd_config_t *config,
                                         bool *suppress_output_ptr,
                                         int32_t server_http_status,
-                                        int32_t *exit_code_out) {
+                                        const char *hook_event_name,
+                                        cchd_response_format format,
+                                        int32_t *exit_code_out,
+                                        char **reason_out) {
+  if (reason_out != NULL) {
+    *reason_out = NULL;
+  }
   if (response_data == NULL || modified_output_ptr == NULL || config == NULL ||
-      suppress_output_ptr == NULL || exit_code_out == NULL ||
-      strlen(response_data) == 0) {
+      suppress_output_ptr == NULL || exit_code_out == NULL) {
     LOG_ERROR("Invalid parameters in process_server_response");
-    *exit_code_out = cchd_config_is_fail_open(config) ? 0 : 1;
+    if (exit_code_out != NULL) {
+      *exit_code_out = cchd_config_is_fail_open(config) ? 0 : 1;
+    }
     return CCHD_ERROR_INVALID_ARG;
   }
 
+  // An empty 200 is a common server bug rather than a decision. It gets its
+  // own warning so it can be told apart from malformed JSON in the logs, and
+  // its own policy so a strict operator never has it silently allowed.
+  if (server_http_status == 200 &&
+      response_data[strspn(response_data, " \t\r\n")] == '\0') {
+    bool allow = cchd_config_is_allow_empty_response(config);
+    LOG_WARNING("Server returned an empty response, %s",
+                allow ? "allowing" : "blocking");
+    if (!cchd_config_is_quiet(config)) {
+      fprintf(stderr, "%s: server returned an empty response\n",
+              allow ? "⚠ Allowed" : "✗ Blocked");
+    }
+    *modified_output_ptr = NULL;
+    *suppress_output_ptr = false;
+    *exit_code_out = allow ? 0 : 1;
+    return CCHD_SUCCESS;
+  }
+
   if (server_http_status >= 400 && server_http_status < 500) {
     LOG_ERROR("Client error from server: HTTP %d", server_http_status);
     *exit_code_out = 1;
@@ -318,6 +555,22 @@ cchd_error cchd_process_server_response(const char *response_data,
     return CCHD_ERROR_SERVER_INVALID;
   }
 
+  // A pinned server answering in the other format has regressed. Treat the
+  // answer as invalid rather than adapting, so the fail mode decides.
+  if (!matches_response_format(response_root, hook_event_name, format)) {
+    const char *expected =
+        format == CCHD_RESPONSE_FORMAT_MODERN ? "modern" : "legacy";
+    LOG_WARNING("Server response is not in the pinned %s format", expected);
+    if (!cchd_config_is_quiet(config)) {
+      fprintf(stderr,
+              "Error: Server response is not in the pinned %s format\n",
+              expected);
+    }
+    yyjson_doc_free(response_doc);
+    *exit_code_out = cchd_config_is_fail_open(config) ? 0 : 1;
+    return CCHD_ERROR_SERVER_INVALID;
+  }
+
   bool should_continue = true;
   bool suppress_output = false;
   const char *stop_reason = NULL;
@@ -327,6 +580,9 @@ cchd_error cchd_process_server_response(const char *response_data,
   if (!should_continue) {
     if (stop_reason) {
       fprintf(stderr, "Stopped: %s\n", stop_reason);
+      if (reason_out != NULL) {
+        *reason_out = strdup(stop_reason);
+      }
     }
     yyjson_doc_free(response_doc);
     *exit_code_out = 1;
@@ -337,19 +593,95 @@ cchd_error cchd_process_server_response(const char *response_data,
     *suppress_output_ptr = true;
   }
 
+  // A decision we don't understand must not pass as an allow.
+  normalized_response normalized;
+  normalize_response(response_root, hook_event_name, &normalized);
+  if (normalized.decision == RESPONSE_DECISION_UNKNOWN) {
+    LOG_WARNING("Server sent unknown decision '%s'", normalized.value);
+    if (!cchd_config_is_quiet(config)) {
+      fprintf(stderr, "Error: Server sent unknown decision '%s'\n",
+              normalized.value);
+    }
+    yyjson_doc_free(response_doc);
+    *exit_code_out = cchd_config_is_fail_open(config) ? 0 : 1;
+    return CCHD_ERROR_SERVER_INVALID;
+  }
+
   *exit_code_out = 0;
 
   const char *decision = parse_decision(response_root);
-  if (decision != NULL) {
-    if (strcmp(decision, "modify") == 0) {
-      handle_modify(response_root, modified_output_ptr);
-    } else {
-      handle_decision(decision, response_root, exit_code_out);
-    }
+  if (decision != NULL && strcmp(decision, "modify") == 0) {
+    handle_modify(response_root, modified_output_ptr);
+  }
+  if (normalized.decision == RESPONSE_DECISION_RETURN) {
+    handle_return(&normalized, hook_event_name, config, modified_output_ptr,
+                  exit_code_out);
+  } else {
+    apply_decision(&normalized, exit_code_out);
+  }
+  if (reason_out != NULL && normalized.reason != NULL) {
+    *reason_out = strdup(normalized.reason);
   }
-
-  handle_hook_specific(response_root, exit_code_out);
 
   yyjson_doc_free(response_doc);
   return CCHD_SUCCESS;
-}
\ No newline at end of file
+}
+
+cchd_verdict cchd_classify_server_response(const char *response_data,
+                                           const char *hook_event_name,
+                                           char **modified_out) {
+  *modified_out = NULL;
+  yyjson_doc *response_doc = response_data != NULL
+                                 ? yyjson_read(response_data,
+                                               strlen(response_data), 0)
+                                 : NULL;
+  yyjson_val *response_root = yyjson_doc_get_root(response_doc);
+  if (!yyjson_is_obj(response_root)) {
+    yyjson_doc_free(response_doc);
+    return CCHD_VERDICT_INVALID;
+  }
+
+  bool should_continue = true;
+  bool suppress_output = false;
+  const char *stop_reason = NULL;
+  parse_base_response(response_root, &should_continue, &suppress_output,
+                      &stop_reason);
+  normalized_response normalized;
+  normalize_response(response_root, hook_event_name, &normalized);
+
+  // The same precedence as processing: a stop or a block wins over any
+  // modification the response also carries.
+  cchd_verdict verdict = CCHD_VERDICT_ALLOW;
+  const char *decision = parse_decision(response_root);
+  if (!should_continue || normalized.decision == RESPONSE_DECISION_BLOCK ||
+      normalized.decision == RESPONSE_DECISION_RETURN) {
+    verdict = CCHD_VERDICT_BLOCK;
+  } else if (normalized.decision == RESPONSE_DECISION_UNKNOWN) {
+    verdict = CCHD_VERDICT_INVALID;
+  } else if (normalized.decision == RESPONSE_DECISION_ASK) {
+    verdict = CCHD_VERDICT_ASK;
+  } else if (decision != NULL && strcmp(decision, "modify") == 0) {
+    verdict = CCHD_VERDICT_MODIFY;
+    yyjson_val *modified = yyjson_obj_get(response_root, "modified_data");
+    *modified_out = modified != NULL ? write_canonical(modified, NULL) : NULL;
+  }
+
+  yyjson_doc_free(response_doc);
+  return verdict;
+}
+
+const char *cchd_verdict_name(cchd_verdict verdict) {
+  switch (verdict) {
+  case CCHD_VERDICT_ALLOW:
+    return "allow";
+  case CCHD_VERDICT_MODIFY:
+    return "modify";
+  case CCHD_VERDICT_ASK:
+    return "ask";
+  case CCHD_VERDICT_BLOCK:
+    return "block";
+  case CCHD_VERDICT_INVALID:
+    break;
+  }
+  return "invalid";
+}
@@ -36,7 +36,37 @@ CCHD_NODISCARD char *cchd_process_input_to_protocol(
 // Parses response JSON and handles action fields (exit_code, output, suppress_output).
 // Updates provided pointers with results. Returns error code if response is invalid.
 // This careful parsing ensures we only act on valid server instructions.
+// Each response is normalized on its own, legacy or modern, judged by the
+// hook_event_name it answers; format lets a response in the wrong pinned
+// format be rejected instead of silently interpreted. Unknown decisions go to
+// the fail mode. The server's reason for the decision, if it gave one, is
+// written to reason_out, to be released with free(); NULL skips it.
 CCHD_NODISCARD cchd_error cchd_process_server_response(
     const char *response_data, char **modified_output_ptr,
     const cchd_config_t *config, bool *suppress_output_ptr,
-    int32_t server_http_status, int32_t *exit_code_out);
\ No newline at end of file
+    int32_t server_http_status, const char *hook_event_name,
+    cchd_response_format format, int32_t *exit_code_out, char **reason_out);
+
+// How a server's response would be acted on, ordered from least to most
+// strict, so the answers of several servers can be compared before one of
+// them is processed.
+typedef enum {
+  CCHD_VERDICT_ALLOW,
+  CCHD_VERDICT_MODIFY,
+  CCHD_VERDICT_ASK,
+  CCHD_VERDICT_BLOCK,
+  CCHD_VERDICT_INVALID,
+} cchd_verdict;
+
+// Classifies a response the way cchd_process_server_response would act on
+// it, without acting. For a modification, the modified_data is written to
+// modified_out, to be released with free(), in the same sorted-key form
+// that is output, so that two modifications can be told apart; otherwise it
+// is set to NULL.
+CCHD_NODISCARD cchd_verdict cchd_classify_server_response(
+    const char *response_data, const char *hook_event_name,
+    char **modified_out);
+
+// The verdict as it is named to an arbiter: "allow", "modify", "ask",
+// "block" or "invalid".
+const char *cchd_verdict_name(cchd_verdict verdict);
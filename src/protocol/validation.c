@@ -8,6 +8,7 @@
 #include <string.h>
 
 #include "../core/config.h"
+#include "../network/srv.h"
 #include "../utils/colors.h"
 #include "../utils/logging.h"
 
@@ -19,6 +20,24 @@ bool cchd_validate_server_url(const char *url, const cchd_config_t *config) {
     return false;
   }
 
+  // An SRV server still in the list didn't resolve; its requests fail as a
+  // DNS error would, so only its form is checked here.
+  if (cchd_srv_is_srv_url(url)) {
+    if (cchd_srv_is_valid_url(url)) {
+      return true;
+    }
+    if (!cchd_config_is_quiet(config) && !cchd_config_is_json_output(config)) {
+      const char *red = cchd_use_colors(config) ? COLOR_RED : "";
+      const char *reset = cchd_use_colors(config) ? COLOR_RESET : "";
+      fprintf(stderr, "%sError: Invalid SRV URL format: %s%s\n", red, url,
+              reset);
+      fprintf(stderr, "SRV URLs look like "
+                      "'srv+https://_service._tcp.example.com/path', without "
+                      "a port\n");
+    }
+    return false;
+  }
+
   // Must start with http:// or https://
   if (strncmp(url, "http://", 7) != 0 && strncmp(url, "https://", 8) != 0) {
     if (!cchd_config_is_quiet(config) && !cchd_config_is_json_output(config)) {
@@ -0,0 +1,118 @@
+/*
+ * SHA-256 implementation following FIPS 180-4.
+ */
+
+#include "sha256.h"
+
+#include <string.h>
+
+#include "memory.h"
+
+static const uint32_t round_constants[64] = {
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1,
+    0x923f82a4, 0xab1c5ed5, 0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3,
+    0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174, 0xe49b69c1, 0xefbe4786,
+    0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147,
+    0x06ca6351, 0x14292967, 0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13,
+    0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85, 0xa2bfe8a1, 0xa81a664b,
+    0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a,
+    0x5b9cca4f, 0x682e6ff3, 0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208,
+    0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+};
+
+static uint32_t rotr(uint32_t x, unsigned n) {
+  return (x >> n) | (x << (32 - n));
+}
+
+static void compress(uint32_t state[8], const uint8_t block[64]) {
+  uint32_t w[64];
+  for (int i = 0; i < 16; i++) {
+    w[i] = (uint32_t)block[i * 4] << 24 | (uint32_t)block[i * 4 + 1] << 16 |
+           (uint32_t)block[i * 4 + 2] << 8 | (uint32_t)block[i * 4 + 3];
+  }
+  for (int i = 16; i < 64; i++) {
+    uint32_t s0 = rotr(w[i - 15], 7) ^ rotr(w[i - 15], 18) ^ (w[i - 15] >> 3);
+    uint32_t s1 = rotr(w[i - 2], 17) ^ rotr(w[i - 2], 19) ^ (w[i - 2] >> 10);
+    w[i] = w[i - 16] + s0 + w[i - 7] + s1;
+  }
+
+  uint32_t a = state[0], b = state[1], c = state[2], d = state[3];
+  uint32_t e = state[4], f = state[5], g = state[6], h = state[7];
+  for (int i = 0; i < 64; i++) {
+    uint32_t s1 = rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25);
+    uint32_t ch = (e & f) ^ (~e & g);
+    uint32_t t1 = h + s1 + ch + round_constants[i] + w[i];
+    uint32_t s0 = rotr(a, 2) ^ rotr(a, 13) ^ rotr(a, 22);
+    uint32_t maj = (a & b) ^ (a & c) ^ (b & c);
+    uint32_t t2 = s0 + maj;
+    h = g;
+    g = f;
+    f = e;
+    e = d + t1;
+    d = c;
+    c = b;
+    b = a;
+    a = t1 + t2;
+  }
+
+  state[0] += a;
+  state[1] += b;
+  state[2] += c;
+  state[3] += d;
+  state[4] += e;
+  state[5] += f;
+  state[6] += g;
+  state[7] += h;
+
+  // The schedule holds message words, which may be the identity being hashed.
+  cchd_secure_zero(w, sizeof(w));
+}
+
+void cchd_sha256(const void *data, size_t len,
+                 uint8_t digest[SHA256_DIGEST_SIZE]) {
+  uint32_t state[8] = {0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+                       0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19};
+  const uint8_t *bytes = data;
+
+  size_t offset = 0;
+  for (; len - offset >= 64; offset += 64) {
+    compress(state, bytes + offset);
+  }
+
+  // Pad the tail with 0x80, zeros, and the message length in bits. The tail
+  // needs a second block when fewer than 9 bytes are left for the padding.
+  uint8_t block[128] = {0};
+  size_t tail = len - offset;
+  memcpy(block, bytes + offset, tail);
+  block[tail] = 0x80;
+  size_t block_len = tail < 56 ? 64 : 128;
+  uint64_t bit_len = (uint64_t)len * 8;
+  for (int i = 0; i < 8; i++) {
+    block[block_len - 1 - i] = (uint8_t)(bit_len >> (i * 8));
+  }
+  compress(state, block);
+  if (block_len == 128) {
+    compress(state, block + 64);
+  }
+  cchd_secure_zero(block, sizeof(block));
+
+  for (int i = 0; i < 8; i++) {
+    digest[i * 4] = (uint8_t)(state[i] >> 24);
+    digest[i * 4 + 1] = (uint8_t)(state[i] >> 16);
+    digest[i * 4 + 2] = (uint8_t)(state[i] >> 8);
+    digest[i * 4 + 3] = (uint8_t)state[i];
+  }
+}
+
+void cchd_sha256_hex(const void *data, size_t len, char hex[SHA256_HEX_SIZE]) {
+  static const char digits[] = "0123456789abcdef";
+  uint8_t digest[SHA256_DIGEST_SIZE];
+  cchd_sha256(data, len, digest);
+  for (int i = 0; i < SHA256_DIGEST_SIZE; i++) {
+    hex[i * 2] = digits[digest[i] >> 4];
+    hex[i * 2 + 1] = digits[digest[i] & 0x0F];
+  }
+  hex[SHA256_HEX_SIZE - 1] = '\0';
+}
@@ -0,0 +1,23 @@
+/*
+ * SHA-256 digest for CCHD.
+ *
+ * A small self-contained implementation (FIPS 180-4) so privacy features such
+ * as user id hashing don't pull a crypto library into a dispatcher that only
+ * otherwise links libcurl and yyjson.
+ */
+
+#pragma once
+
+#include <stddef.h>
+#include <stdint.h>
+
+#define SHA256_DIGEST_SIZE 32
+#define SHA256_HEX_SIZE (SHA256_DIGEST_SIZE * 2 + 1)
+
+// Compute the SHA-256 digest of data into digest.
+void cchd_sha256(const void *data, size_t len,
+                 uint8_t digest[SHA256_DIGEST_SIZE]);
+
+// Compute the SHA-256 digest of data as lowercase hex into hex, which must
+// hold SHA256_HEX_SIZE bytes including the terminating NUL.
+void cchd_sha256_hex(const void *data, size_t len, char hex[SHA256_HEX_SIZE]);
@@ -0,0 +1,73 @@
+/*
+ * Per-user state directory implementation.
+ */
+
+#include "state.h"
+
+#include <dirent.h>
+#include <errno.h>
+#include <limits.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/stat.h>
+#include <unistd.h>
+
+#include "../core/types.h"
+#include "logging.h"
+#include "sha256.h"
+
+// Under a shared /tmp another user could have created the directory first,
+// so ownership and permissions are checked, not just existence.
+bool cchd_state_directory(char *dir, size_t size) {
+  const char *runtime_dir = getenv("XDG_RUNTIME_DIR");
+  if (runtime_dir != nullptr && runtime_dir[0] != '\0') {
+    snprintf(dir, size, "%s/cchd", runtime_dir);
+  } else {
+    const char *tmp_dir = getenv("TMPDIR");
+    if (tmp_dir == nullptr || tmp_dir[0] == '\0') {
+      tmp_dir = "/tmp";
+    }
+    snprintf(dir, size, "%s/cchd-%d", tmp_dir, (int)getuid());
+  }
+
+  if (mkdir(dir, 0700) != 0 && errno != EEXIST) {
+    LOG_WARNING("Cannot create state directory %s: %s", dir, strerror(errno));
+    return false;
+  }
+  struct stat info;
+  if (lstat(dir, &info) != 0 || !S_ISDIR(info.st_mode) ||
+      info.st_uid != getuid() || (info.st_mode & 0077) != 0) {
+    LOG_WARNING("State directory %s is not private, ignoring it", dir);
+    return false;
+  }
+  return true;
+}
+
+void cchd_state_path(char *path, size_t size, const char *dir,
+                     const char *prefix, const char *key) {
+  char digest[SHA256_HEX_SIZE];
+  cchd_sha256_hex(key, strlen(key), digest);
+  snprintf(path, size, "%s/%s%.32s", dir, prefix, digest);
+}
+
+void cchd_state_prune(const char *dir, const char *prefix, time_t max_age) {
+  DIR *handle = opendir(dir);
+  if (handle == nullptr) {
+    return;
+  }
+  time_t cutoff = time(nullptr) - max_age;
+  struct dirent *entry;
+  while ((entry = readdir(handle)) != nullptr) {
+    if (strncmp(entry->d_name, prefix, strlen(prefix)) != 0) {
+      continue;
+    }
+    char path[PATH_MAX];
+    struct stat info;
+    snprintf(path, sizeof(path), "%s/%s", dir, entry->d_name);
+    if (stat(path, &info) == 0 && info.st_mtime < cutoff) {
+      unlink(path);
+    }
+  }
+  closedir(handle);
+}
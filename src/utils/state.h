@@ -0,0 +1,33 @@
+/*
+ * Per-user state directory for CCHD.
+ *
+ * Every hook runs in a fresh dispatcher process, so anything a session has to
+ * remember between events (its retry budget, whether its server has answered
+ * yet) lives in small files in one private directory.
+ */
+
+#pragma once
+
+#include <stdbool.h>
+#include <stddef.h>
+#include <time.h>
+
+// Session state unused for this long is removed so old sessions don't pile
+// up.
+#define STATE_EXPIRY_SECONDS (24 * 60 * 60)
+
+// Finds or creates the directory, $XDG_RUNTIME_DIR/cchd or else
+// ${TMPDIR:-/tmp}/cchd-UID, and writes its path to dir. Returns false, after
+// a warning, when it can't be created or isn't private to this user.
+bool cchd_state_directory(char *dir, size_t size);
+
+// Builds the path of the state file for key, such as a session id, under
+// dir. Keys come from Claude, so they are hashed rather than trusted as file
+// names.
+void cchd_state_path(char *path, size_t size, const char *dir,
+                     const char *prefix, const char *key);
+
+// Removes files starting with prefix that haven't changed for max_age
+// seconds. Meant to run when a new file is created, so it costs nothing on
+// most events.
+void cchd_state_prune(const char *dir, const char *prefix, time_t max_age);
@@ -0,0 +1,3 @@
+module github.com/sammyjoyce/cchd/templates
+
+go 1.22
@@ -0,0 +1,409 @@
+// The audit log: one JSON record per decision, written to a file or
+// forwarded to a collector.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Audit log: With -audit-log, every decision is appended as one JSON line
+// containing the full event, so the log doubles as input for replaying
+// events against a new policy. The log rotates itself when it exceeds
+// -audit-max-size megabytes or -audit-max-age, renaming the current file
+// with a timestamp suffix and optionally gzipping it in the background.
+//
+// The same records can also go to a remote collector (-audit-http) and to
+// syslog (-audit-syslog) at once. Each sink has its own goroutine and a
+// buffer of -audit-buffer records: a slow or dead sink drops records, counted
+// under "audit_dropped" in /stats, instead of delaying decisions or the
+// other sinks, so the local file keeps a full copy through network trouble.
+type AuditRecord struct {
+	Time      string                 `json:"time"`
+	EventID   string                 `json:"event_id"`
+	EventType string                 `json:"event_type"`
+	SessionID string                 `json:"session_id,omitempty"`
+	UserID    string                 `json:"user_id,omitempty"`
+	ToolName  string                 `json:"tool_name,omitempty"`
+	Decision  string                 `json:"decision"`
+	Reason    string                 `json:"reason,omitempty"`
+	PolicyURL string                 `json:"policy_url,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Event     CloudEvent             `json:"event"`
+}
+
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	maxSize  int64
+	maxAge   time.Duration
+	compress bool
+	pending  sync.WaitGroup
+}
+
+// auditSink is one destination for audit lines. writeLine is only called
+// from the sink's own goroutine.
+type auditSink interface {
+	writeLine(line []byte) error
+	Close() error
+}
+
+type bufferedSink struct {
+	name    string
+	sink    auditSink
+	lines   chan []byte
+	dropped atomic.Int64
+	done    chan struct{}
+
+	// lastErr is the most recent write's error, or nil once a write succeeds.
+	lastErr atomic.Pointer[error]
+}
+
+func (b *bufferedSink) run() {
+	defer close(b.done)
+	for line := range b.lines {
+		if err := b.sink.writeLine(line); err != nil {
+			slog.Error("Writing audit sink", "sink", b.name, "error", err)
+			b.lastErr.Store(&err)
+		} else {
+			b.lastErr.Store(nil)
+		}
+	}
+}
+
+// check is the sink's readiness check: it fails while writes are failing
+// or the buffer is full, either of which means records are being lost.
+func (b *bufferedSink) check() error {
+	if err := b.lastErr.Load(); err != nil {
+		return fmt.Errorf("last write failed: %v", *err)
+	}
+	if len(b.lines) == cap(b.lines) {
+		return fmt.Errorf("buffer full, dropping records")
+	}
+	return nil
+}
+
+// auditFanout delivers each record to every configured sink.
+type auditFanout struct {
+	mu     sync.RWMutex
+	closed bool
+	sinks  []*bufferedSink
+}
+
+var audit *auditFanout
+
+func (f *auditFanout) add(name string, sink auditSink, buffer int) {
+	b := &bufferedSink{name: name, sink: sink, lines: make(chan []byte, buffer), done: make(chan struct{})}
+	f.sinks = append(f.sinks, b)
+	go b.run()
+}
+
+// record queues one decision for every sink. Failures are logged rather than
+// returned: losing an audit line must not change the decision sent to Claude.
+func (f *auditFanout) record(event CloudEvent, response Response) {
+	line, err := json.Marshal(newAuditRecord(event, response))
+	if err != nil {
+		slog.Error("Encoding audit record", "error", err)
+		return
+	}
+	line = append(line, '\n')
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		slog.Warn("Audit record arrived after shutdown; dropped", "event_id", SanitizeText(event.ID))
+		return
+	}
+	for _, b := range f.sinks {
+		select {
+		case b.lines <- line:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+}
+
+func (f *auditFanout) droppedCounts() map[string]int64 {
+	counts := make(map[string]int64, len(f.sinks))
+	for _, b := range f.sinks {
+		counts[b.name] = b.dropped.Load()
+	}
+	return counts
+}
+
+// Close drains every sink's buffer and closes the sinks. Records arriving
+// afterwards are dropped rather than written to a closed sink.
+func (f *auditFanout) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+	var first error
+	for _, b := range f.sinks {
+		close(b.lines)
+		<-b.done
+		if err := b.sink.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Flush on exit: A sink stuck on a dead collector must not hold the process
+// forever, so shutdown waits at most -shutdown-timeout for the buffers to
+// drain and reports whatever was still queued.
+func (f *auditFanout) closeWithin(timeout time.Duration) {
+	done := make(chan error, 1)
+	go func() { done <- f.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			slog.Error("Closing audit sinks", "error", err)
+		}
+	case <-time.After(timeout):
+		for _, b := range f.sinks {
+			if n := len(b.lines); n > 0 {
+				slog.Warn("Audit records not flushed", "sink", b.name, "records", n, "timeout", timeout)
+			}
+		}
+	}
+}
+
+// closeBody drains what's left of a response body before closing it: An
+// unread body makes the transport drop the connection instead of reusing
+// it, so a busy sink would open a new socket, and leave one in TIME_WAIT,
+// for every request. Large leftovers aren't worth reading and are dropped.
+func closeBody(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+}
+
+// httpAuditSink POSTs each record as newline-delimited JSON.
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpAuditSink) writeLine(line []byte) error {
+	resp, err := h.client.Post(h.url, "application/x-ndjson", bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", h.url, resp.Status)
+	}
+	return nil
+}
+
+// Close drops the pooled keep-alive connection, whose read and write
+// goroutines would otherwise outlive the sink.
+func (h *httpAuditSink) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+// syslogAuditSink sends records as RFC 5424 messages to udp://host:port,
+// tcp://host:port (octet-counted framing), or unix:///dev/log. It redials
+// after a failed write, so a restarted collector is picked up again. We
+// speak the protocol directly because log/syslog doesn't build on Windows.
+type syslogAuditSink struct {
+	network  string
+	addr     string
+	hostname string
+	conn     net.Conn
+}
+
+func newSyslogAuditSink(spec string) (*syslogAuditSink, error) {
+	network, addr, ok := strings.Cut(spec, "://")
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("invalid syslog address %q: expected udp://, tcp://, or unix://", spec)
+	case network == "unix":
+		network = "unixgram"
+	case network != "udp" && network != "tcp":
+		return nil, fmt.Errorf("unsupported syslog network %q", network)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	return &syslogAuditSink{network: network, addr: addr, hostname: hostname}, nil
+}
+
+func (s *syslogAuditSink) writeLine(line []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	// Facility local0, severity info: <134>.
+	msg := fmt.Sprintf("<134>1 %s %s cchd %d audit - %s", time.Now().UTC().Format(time.RFC3339Nano),
+		s.hostname, os.Getpid(), bytes.TrimRight(line, "\n"))
+	if s.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(s.conn, msg); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *syslogAuditSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func openAuditLog(path string, maxSize int64, maxAge time.Duration, compress bool) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize, maxAge: maxAge, compress: compress}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	a.file, a.size, a.openedAt = file, info.Size(), time.Now()
+	return nil
+}
+
+// effectiveDecision reports what a response means for Claude, folding the
+// modern permissionDecision into the legacy decision vocabulary.
+func effectiveDecision(response Response) string {
+	if response.Decision != "" {
+		return response.Decision
+	}
+	if response.HookSpecificOutput != nil && response.HookSpecificOutput.PermissionDecision != "" {
+		return response.HookSpecificOutput.PermissionDecision
+	}
+	return "allow"
+}
+
+func newAuditRecord(event CloudEvent, response Response) AuditRecord {
+	toolName, _ := event.Data["tool_name"].(string)
+	return AuditRecord{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		EventID:   event.ID,
+		EventType: event.Type,
+		SessionID: event.SessionID,
+		UserID:    event.UserID,
+		ToolName:  toolName,
+		Decision:  effectiveDecision(response),
+		Reason:    response.Reason,
+		PolicyURL: response.PolicyURL,
+		Metadata:  response.Metadata,
+		Event:     event,
+	}
+}
+
+// writeLine appends one record to the log, rotating first if needed.
+func (a *auditLog) writeLine(line []byte) error {
+	// Rotation and the write happen under one lock so a write can never go
+	// to a file being rotated away.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.shouldRotate(int64(len(line))) {
+		if err := a.rotate(); err != nil {
+			slog.Error("Rotating audit log", "error", err)
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+func (a *auditLog) shouldRotate(next int64) bool {
+	if a.size == 0 {
+		return false
+	}
+	if a.maxSize > 0 && a.size+next > a.maxSize {
+		return true
+	}
+	return a.maxAge > 0 && time.Since(a.openedAt) > a.maxAge
+}
+
+// rotate must be called with a.mu held.
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", a.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(a.path, rotated); err != nil {
+		return err
+	}
+	if a.compress {
+		a.pending.Add(1)
+		go func() {
+			defer a.pending.Done()
+			if err := gzipFile(rotated); err != nil {
+				slog.Error("Compressing rotated audit log", "error", err)
+			}
+		}()
+	}
+	return a.open()
+}
+
+// gzipFile compresses path to path.gz and removes the original once the
+// compressed copy is safely on disk.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close flushes the log and waits for background compression to finish.
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	err := a.file.Close()
+	a.mu.Unlock()
+	a.pending.Wait()
+	return err
+}
@@ -0,0 +1,438 @@
+// The PreToolUse decision cache: keys, content hashing, warming, and
+// command normalization.
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Decision cache: Claude reruns the same commands constantly, so PreToolUse
+// decisions can be cached for -cache-ttl in an LRU of -cache-size entries
+// (0 disables caching). Only plain allow/block decisions are cached; a
+// response carrying modifications, deferrals, delays, or post actions
+// depends on more than the input and is always recomputed.
+type cacheEntry struct {
+	key      string
+	response Response
+	expires  time.Time
+}
+
+type decisionCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+var decisions *decisionCache
+
+func newDecisionCache(capacity int, ttl time.Duration) *decisionCache {
+	return &decisionCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *decisionCache) get(key string) (Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return Response{}, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return Response{}, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.response, true
+}
+
+func (c *decisionCache) put(key string, response Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &cacheEntry{key: key, response: response, expires: time.Now().Add(c.ttl)}
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, response: response, expires: time.Now().Add(c.ttl)})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// isCacheableResponse reports whether a decision depends only on the input.
+func isCacheableResponse(response Response) bool {
+	switch response.Decision {
+	case "", "allow", "approve", "block":
+	default:
+		return false
+	}
+	return response.ModifiedData == nil && response.Defer == nil &&
+		response.Delay == nil && len(response.PostActions) == 0
+}
+
+// Custom cache keys: A cache key decides which calls share a decision, and
+// the default (decisionCacheKey) may not match a policy's notion of
+// "the same call": one may ignore a field, another judge Bash by the cwd.
+// Replace it at build time with SetCacheKeyFunc, or with -cache-key-fields,
+// a comma-separated list of data fields (dotted for nesting) that alone make
+// up the key, e.g. "tool_name,tool_input.command,cwd"; leave out tool_name
+// only if one decision really fits every tool. A key function returns false
+// for calls that must never be cached.
+//
+//	func init() {
+//		SetCacheKeyFunc(func(e CloudEvent) (string, bool) {
+//			key, ok := decisionCacheKey(e)
+//			cwd, _ := e.Data["cwd"].(string)
+//			return key + "|" + cwd, ok
+//		})
+//	}
+type CacheKeyFunc func(event CloudEvent) (string, bool)
+
+var cacheKeyFunc CacheKeyFunc = decisionCacheKey
+
+func SetCacheKeyFunc(fn CacheKeyFunc) {
+	cacheKeyFunc = fn
+}
+
+// fieldsCacheKey keys on the named data fields only. A missing field keys
+// as null, so calls lacking it still share an entry with each other.
+func fieldsCacheKey(fields []string) CacheKeyFunc {
+	return func(event CloudEvent) (string, bool) {
+		h := sha256.New()
+		io.WriteString(h, strings.Join(event.Languages, ",")+"\x00")
+		for _, field := range fields {
+			var value interface{} = event.Data
+			for _, part := range strings.Split(field, ".") {
+				m, _ := value.(map[string]interface{})
+				value = m[part]
+			}
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return "", false
+			}
+			fmt.Fprintf(h, "%s=%s\x00", field, encoded)
+		}
+		return hex.EncodeToString(h.Sum(nil)), true
+	}
+}
+
+// Content-hash keys: With -cache-content-hash, Read, Write, and Edit are
+// keyed on the file content involved as well as the path, so a changed file
+// is never served a stale decision for its path. The path stays in the key
+// because the path checks decide on it: an allowed write of some content
+// says nothing about the same content written to ~/.ssh. Files larger than
+// -cache-content-max-size are not hashed and not cached.
+var (
+	cacheContentHash    bool
+	cacheContentMaxSize int64 = 1 << 20
+)
+
+// decisionCacheKey identifies equivalent tool calls. Bash commands are keyed
+// on their normalized form so whitespace and flag-order differences share
+// an entry; other tools are keyed on the full tool input and the cwd, since
+// their relative paths resolve against it. It reports false when the call
+// can't be keyed and must not be cached.
+func decisionCacheKey(event CloudEvent) (string, bool) {
+	toolName, _ := event.Data["tool_name"].(string)
+	toolInput, _ := event.Data["tool_input"].(map[string]interface{})
+	// Reasons are localized and policies may read the forwarded
+	// environment and package risk, so they are part of the decision.
+	material := []byte(strings.Join(event.Languages, ",") + "\x00" + event.ForwardedEnv + "\x00" +
+		event.PackageRisk + "\x00" + toolName + "\x00")
+	command, isCommand := toolInput["command"].(string)
+	isBash := isCommand && toolName == "Bash"
+	// Reasons may name the session, user, or cwd; key on the ones they do.
+	if reasonsRead.session {
+		material = append(material, "session="+event.SessionID+"\x00"...)
+	}
+	if reasonsRead.user {
+		material = append(material, "user="+event.UserID+"\x00"...)
+	}
+	if reasonsRead.cwd || !isBash {
+		cwd, _ := event.Data["cwd"].(string)
+		altCWD, _ := event.Data["current_working_directory"].(string)
+		material = append(material, "cwd="+cwd+"\x00"+altCWD+"\x00"...)
+	}
+	switch {
+	case isBash:
+		material = append(material, normalizeCommand(command)...)
+	case cacheContentHash && (toolName == "Read" || toolName == "Write" || toolName == "Edit"):
+		content, ok := contentKeyMaterial(event, toolName, toolInput)
+		if !ok {
+			return "", false
+		}
+		material = append(material, content...)
+	default:
+		input, _ := json.Marshal(toolInput)
+		material = append(material, input...)
+	}
+	sum := sha256.Sum256(material)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// contentKeyMaterial builds a content-based key: the current file contents
+// for Read, the content being written for Write, and the current contents
+// plus the replacement for Edit. The path as written and as resolved lead
+// the material, since the path checks run on both.
+func contentKeyMaterial(event CloudEvent, toolName string, toolInput map[string]interface{}) ([]byte, bool) {
+	path, ok := resolvedToolPath(event)
+	if !ok {
+		return nil, false
+	}
+	written, _ := toolInput["file_path"].(string)
+	if written == "" {
+		written, _ = toolInput["path"].(string)
+	}
+	material := []byte(written + "\x00" + path + "\x00")
+	if toolName == "Write" {
+		content, ok := toolInput["content"].(string)
+		return append(material, content...), ok && int64(len(content)) <= cacheContentMaxSize
+	}
+	digest, ok := hashFile(path)
+	if !ok {
+		return nil, false
+	}
+	material = append(material, digest...)
+	if toolName == "Edit" {
+		edit := map[string]interface{}{}
+		for _, key := range []string{"old_string", "new_string", "replace_all"} {
+			edit[key] = toolInput[key]
+		}
+		encoded, _ := json.Marshal(edit)
+		material = append(material, encoded...)
+	}
+	return material, true
+}
+
+func hashFile(path string) ([]byte, bool) {
+	if path == "" {
+		return nil, false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() || info.Size() > cacheContentMaxSize {
+		return nil, false
+	}
+	h := sha256.New()
+	if n, err := io.Copy(h, io.LimitReader(f, cacheContentMaxSize+1)); err != nil || n > cacheContentMaxSize {
+		return nil, false
+	}
+	return h.Sum(nil), true
+}
+
+// cachedDecision consults the decision cache before running handler.
+func cachedDecision(event CloudEvent, handler func(CloudEvent) Response) Response {
+	if decisions == nil {
+		return handler(event)
+	}
+	key, ok := cacheKeyFunc(event)
+	if !ok {
+		return handler(event)
+	}
+	if response, ok := decisions.get(key); ok {
+		response.Timestamp = time.Now().Format(time.RFC3339)
+		return response
+	}
+	response := handler(event)
+	if isCacheableResponse(response) {
+		decisions.put(key, response)
+	}
+	return response
+}
+
+// Cache warming: -warm-cache evaluates a list of common calls at startup so
+// their first occurrence in a session is already cached. Each line is a
+// Bash command, PreToolUse data such as {"tool_name":"Read","tool_input":
+// {...}}, or a complete PreToolUse CloudEvent; blank lines and # comments
+// are skipped. Calls whose decision isn't cacheable are evaluated but not
+// kept, exactly as at run time.
+func warmDecisionCache(path string) (warmed int, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("reading warm cache list: %w", err)
+	}
+	defer silenceLogs()()
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		event := CloudEvent{SpecVersion: "1.0", Type: "com.claudecode.hook.PreToolUse", Source: "warm-cache"}
+		switch {
+		case !strings.HasPrefix(line, "{"):
+			event.Data = map[string]interface{}{
+				"tool_name":  "Bash",
+				"tool_input": map[string]interface{}{"command": line},
+			}
+		case strings.Contains(line, `"specversion"`):
+			if event, err = decodeCloudEvent([]byte(line)); err != nil {
+				return warmed, fmt.Errorf("%s:%d: %w", path, i+1, err)
+			}
+		default:
+			decoder := json.NewDecoder(strings.NewReader(line))
+			decoder.UseNumber()
+			if err := decoder.Decode(&event.Data); err != nil {
+				return warmed, fmt.Errorf("%s:%d: %w", path, i+1, err)
+			}
+		}
+		if event.Type != "com.claudecode.hook.PreToolUse" {
+			return warmed, fmt.Errorf("%s:%d: only PreToolUse decisions are cached", path, i+1)
+		}
+		normalizeFieldNames(event.Data)
+		if toolName, ok := event.Data["tool_name"].(string); ok {
+			event.Data["tool_name"] = NormalizeToolName(toolName)
+		}
+		if isCacheableResponse(cachedDecision(event, handlePreToolUse)) {
+			warmed++
+		}
+	}
+	return warmed, nil
+}
+
+// Command normalization: Builds cache keys that treat trivially different
+// spellings of a command as the same command. It is deliberately
+// conservative, since merging two genuinely different commands would apply
+// one's decision to the other:
+//   - Unquoted whitespace is collapsed; quoted text is kept byte-for-byte,
+//     quotes included, because '$HOME' and "$HOME" mean different things.
+//   - Unquoted shell operators become their own tokens, so "a|b" == "a | b".
+//   - Single-letter flag clusters are expanded, deduplicated, and sorted,
+//     but only for programs whose short flags never take a value.
+var orderIndependentFlagPrograms = map[string]bool{
+	"ls": true, "rm": true, "cat": true, "wc": true, "df": true, "uname": true,
+}
+
+func normalizeCommand(command string) string {
+	var segments [][]string
+	var current []string
+	for _, token := range shellTokens(command) {
+		if isShellOperator(token) {
+			segments = append(segments, current, []string{token})
+			current = nil
+			continue
+		}
+		current = append(current, token)
+	}
+	segments = append(segments, current)
+
+	var out []string
+	for _, words := range segments {
+		out = append(out, normalizeFlags(words)...)
+	}
+	return strings.Join(out, " ")
+}
+
+// shellTokens splits a command at unquoted whitespace and operators,
+// keeping each word's original quoting intact.
+func shellTokens(command string) []string {
+	var tokens []string
+	var word strings.Builder
+	var quote rune
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			word.WriteRune(r)
+			if r == '\\' && quote == '"' && i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+			} else if r == quote {
+				quote = 0
+			}
+		case r == '\\' && i+1 < len(runes):
+			word.WriteRune(r)
+			i++
+			word.WriteRune(runes[i])
+		case r == '\'' || r == '"':
+			quote = r
+			word.WriteRune(r)
+		case unicode.IsSpace(r):
+			flush()
+		case strings.ContainsRune("|&;<>()", r):
+			flush()
+			op := string(r)
+			if i+1 < len(runes) && (runes[i+1] == r && r != '(' && r != ')') {
+				op += string(runes[i+1])
+				i++
+			}
+			tokens = append(tokens, op)
+		default:
+			word.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+func isShellOperator(token string) bool {
+	switch token {
+	case "|", "||", "&", "&&", ";", ";;", "<", "<<", ">", ">>", "(", ")":
+		return true
+	}
+	return false
+}
+
+// normalizeFlags canonicalizes the leading flag clusters of one simple
+// command when its program is known to take only boolean short flags.
+func normalizeFlags(words []string) []string {
+	if len(words) == 0 || !orderIndependentFlagPrograms[filepath.Base(words[0])] {
+		return words
+	}
+	flags := map[rune]bool{}
+	i := 1
+	for ; i < len(words); i++ {
+		word := words[i]
+		if word == "--" || len(word) < 2 || word[0] != '-' || word[1] == '-' {
+			break
+		}
+		for _, r := range word[1:] {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				return words
+			}
+			flags[r] = true
+		}
+	}
+	if len(flags) == 0 {
+		return words
+	}
+	letters := make([]string, 0, len(flags))
+	for r := range flags {
+		letters = append(letters, string(r))
+	}
+	sort.Strings(letters)
+	normalized := []string{words[0], "-" + strings.Join(letters, "")}
+	return append(normalized, words[i:]...)
+}
@@ -0,0 +1,277 @@
+// Configuration files, -dump-config, and the environment helpers that
+// supply flag defaults.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration file: Besides flags and environment variables, settings can
+// come from a JSON file given with -config. The file holds named profiles
+// (e.g. a strict "work" policy and a looser "personal" one) selected with
+// -profile or CCHD_PROFILE. A profile's settings are keyed by flag name,
+// and a profile may inherit from another, overriding only what differs:
+//
+//	{
+//	  "profiles": {
+//	    "base": {"settings": {"audit-log": "/var/log/cchd-audit.jsonl"}},
+//	    "work": {"inherits": "base", "settings": {"unknown-events": "block"}}
+//	  }
+//	}
+//
+// Precedence, highest first: command-line flags, the selected profile,
+// CCHD_* environment variables, built-in defaults.
+type Config struct {
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+type Profile struct {
+	Inherits string                     `json:"inherits,omitempty"`
+	Settings map[string]json.RawMessage `json:"settings"`
+}
+
+func readConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// resolveProfile flattens a profile and its ancestors into one settings
+// map, with descendants overriding ancestors. Inheritance cycles and
+// references to undefined profiles are configuration errors.
+func resolveProfile(cfg *Config, name string) (map[string]json.RawMessage, error) {
+	var chain []Profile
+	seen := map[string]bool{}
+	for current := name; current != ""; {
+		if seen[current] {
+			return nil, fmt.Errorf("profile %q: inheritance cycle through %q", name, current)
+		}
+		seen[current] = true
+		profile, ok := cfg.Profiles[current]
+		if !ok {
+			return nil, fmt.Errorf("profile %q is not defined", current)
+		}
+		chain = append(chain, profile)
+		current = profile.Inherits
+	}
+
+	settings := map[string]json.RawMessage{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for key, value := range chain[i].Settings {
+			settings[key] = value
+		}
+	}
+	return settings, nil
+}
+
+// applyProfile sets every profile setting whose flag wasn't given on the
+// command line. Array values set a repeatable flag once per element.
+func applyProfile(settings map[string]json.RawMessage) error {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for name, raw := range settings {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("profile setting %q is not a known flag", name)
+		}
+		if explicit[name] {
+			continue
+		}
+		values, err := settingValues(raw)
+		if err != nil {
+			return fmt.Errorf("profile setting %q: %w", name, err)
+		}
+		for _, value := range values {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("profile setting %q: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// settingValues converts a JSON setting into flag strings: strings are used
+// as-is, numbers and booleans by their literal text, arrays element-wise.
+func settingValues(raw json.RawMessage) ([]string, error) {
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err == nil {
+		var values []string
+		for _, item := range list {
+			v, err := settingValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v...)
+		}
+		return values, nil
+	}
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		return []string{str}, nil
+	}
+	var scalar interface{}
+	if err := json.Unmarshal(raw, &scalar); err != nil {
+		return nil, err
+	}
+	switch scalar.(type) {
+	case float64, bool:
+		return []string{string(bytes.TrimSpace(raw))}, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %s", raw)
+	}
+}
+
+// Effective configuration: -dump-config prints every setting as a config
+// file with a single "effective" profile, so the output can be fed back in
+// with -config and -profile effective. The "sources" map, which the loader
+// ignores, says whether each value came from a flag, the profile, a CCHD_*
+// environment variable, or the default. Secrets are redacted.
+type effectiveConfig struct {
+	Profiles map[string]Profile `json:"profiles"`
+	Sources  map[string]string  `json:"sources"`
+}
+
+// repeatedValues records each value given to a repeatable flag, since those
+// flags can't report their own value for -dump-config.
+var repeatedValues = map[string][]string{}
+
+// repeatableFlag defines a flag that may be given more than once.
+func repeatableFlag(name, usage string, set func(string) error) {
+	flag.Func(name, usage, func(value string) error {
+		if err := set(value); err != nil {
+			return err
+		}
+		repeatedValues[name] = append(repeatedValues[name], value)
+		return nil
+	})
+}
+
+// configOnlyFlags select or inspect configuration and aren't settings.
+var configOnlyFlags = map[string]bool{"config": true, "profile": true, "dump-config": true}
+
+var secretFlagPattern = regexp.MustCompile(`(?i)(token|secret|password|credential|api-key)`)
+
+func writeEffectiveConfig(w io.Writer, explicit map[string]bool, profile map[string]json.RawMessage) error {
+	out := effectiveConfig{
+		Profiles: map[string]Profile{"effective": {Settings: map[string]json.RawMessage{}}},
+		Sources:  map[string]string{},
+	}
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if configOnlyFlags[f.Name] || err != nil {
+			return
+		}
+		var value interface{} = redactSetting(f.Name, f.Value.String())
+		if isRepeatableFlag(f) {
+			values := repeatedValues[f.Name]
+			redacted := make([]string, len(values))
+			for i, v := range values {
+				redacted[i] = redactSetting(f.Name, v)
+			}
+			value = redacted
+		}
+		var raw []byte
+		if raw, err = json.Marshal(value); err != nil {
+			return
+		}
+		out.Profiles["effective"].Settings[f.Name] = raw
+
+		_, fromProfile := profile[f.Name]
+		_, fromEnv := os.LookupEnv("CCHD_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_")))
+		switch {
+		case explicit[f.Name]:
+			out.Sources[f.Name] = "flag"
+		case fromProfile:
+			out.Sources[f.Name] = "profile"
+		case fromEnv && !isRepeatableFlag(f):
+			out.Sources[f.Name] = "env"
+		default:
+			out.Sources[f.Name] = "default"
+		}
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// isRepeatableFlag reports whether f was defined with repeatableFlag.
+// flag.Func values have no getter, which sets them apart from the rest.
+func isRepeatableFlag(f *flag.Flag) bool {
+	_, ok := f.Value.(flag.Getter)
+	return !ok
+}
+
+// redactSetting hides secret values: whole values for flags named like
+// secrets, and credentials or query strings embedded in URLs.
+func redactSetting(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if secretFlagPattern.MatchString(name) {
+		return "[REDACTED]"
+	}
+	if u, err := url.Parse(value); err == nil && u.Scheme != "" && u.Host != "" {
+		if u.User != nil {
+			u.User = url.User("REDACTED")
+		}
+		if u.RawQuery != "" {
+			u.RawQuery = "REDACTED"
+		}
+		return u.String()
+	}
+	return value
+}
+
+// envInt reads an integer environment variable for use as a flag default,
+// falling back when it is unset or malformed.
+func envInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// envString reads a string environment variable for use as a flag default,
+// falling back when it is unset.
+func envString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envDuration is the time.Duration counterpart of envInt.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// envFloat is the float64 counterpart of envInt.
+func envFloat(key string, fallback float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,907 @@
+// Security checks used by the handlers: tool input schemas, command
+// categories, encoded execution, secrets in tool output, and the named
+// Bash patterns with their prefilter.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tool input schemas: The server advertises a JSON Schema for each known
+// tool's input at /schemas so dispatchers can fetch, cache, and validate
+// inputs centrally. With -validate-tool-input the server applies the same
+// schemas itself. Tools without a schema pass through unvalidated, which
+// keeps new tools working until someone writes one.
+type schemaProperty struct {
+	Type string `json:"type"`
+}
+
+type toolSchema struct {
+	Type       string                    `json:"type"`
+	Required   []string                  `json:"required,omitempty"`
+	Properties map[string]schemaProperty `json:"properties"`
+}
+
+var validateToolInputs = false
+
+var toolInputSchemas = map[string]toolSchema{
+	"Bash":      objectSchema([]string{"command"}, "command", "string", "timeout", "number", "description", "string"),
+	"Read":      objectSchema([]string{"file_path"}, "file_path", "string", "offset", "number", "limit", "number"),
+	"Write":     objectSchema([]string{"file_path", "content"}, "file_path", "string", "content", "string"),
+	"Edit":      objectSchema([]string{"file_path", "old_string", "new_string"}, "file_path", "string", "old_string", "string", "new_string", "string", "replace_all", "boolean"),
+	"MultiEdit": objectSchema([]string{"file_path", "edits"}, "file_path", "string", "edits", "array"),
+	"Glob":      objectSchema([]string{"pattern"}, "pattern", "string", "path", "string"),
+	"Grep":      objectSchema([]string{"pattern"}, "pattern", "string", "path", "string", "glob", "string"),
+	"LS":        objectSchema([]string{"path"}, "path", "string", "ignore", "array"),
+	"WebFetch":  objectSchema([]string{"url", "prompt"}, "url", "string", "prompt", "string"),
+	"WebSearch": objectSchema([]string{"query"}, "query", "string", "allowed_domains", "array", "blocked_domains", "array"),
+}
+
+// objectSchema builds an object schema from alternating name/type pairs.
+func objectSchema(required []string, props ...string) toolSchema {
+	schema := toolSchema{Type: "object", Required: required, Properties: map[string]schemaProperty{}}
+	for i := 0; i+1 < len(props); i += 2 {
+		schema.Properties[props[i]] = schemaProperty{Type: props[i+1]}
+	}
+	return schema
+}
+
+func schemasHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tools": toolInputSchemas})
+}
+
+// validateToolInput checks an input against its tool's schema: required
+// properties must be present and declared properties must have the declared
+// JSON type. Undeclared properties are allowed so additive changes to a
+// tool's input don't start failing validation.
+func validateToolInput(toolName string, input interface{}) error {
+	schema, ok := toolInputSchemas[toolName]
+	if !ok {
+		return nil
+	}
+	fields, ok := input.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s tool_input must be an object", toolName)
+	}
+	for _, name := range schema.Required {
+		if _, ok := fields[name]; !ok {
+			return fmt.Errorf("%s tool_input is missing required field %q", toolName, name)
+		}
+	}
+	for name, prop := range schema.Properties {
+		value, ok := fields[name]
+		if ok && jsonType(value) != prop.Type {
+			return fmt.Errorf("%s tool_input field %q must be %s, got %s", toolName, name, prop.Type, jsonType(value))
+		}
+	}
+	return nil
+}
+
+// jsonType names the JSON Schema type of a decoded value.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number, float64:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return "unknown"
+	}
+}
+
+// Finding describes one thing a security check flagged. Rule is a stable
+// identifier for the check, Match is the offending text (truncated so logs
+// stay readable), and Message explains the problem to a human.
+type Finding struct {
+	Rule    string `json:"rule"`
+	Match   string `json:"match"`
+	Message string `json:"message"`
+}
+
+// Command categories: Rather than one flat list of forbidden commands,
+// programs are grouped into categories (network, package-install, ...) so a
+// policy can block a whole class, e.g. -block-categories network. Entries are
+// a program name, optionally followed by the subcommand that puts it in the
+// category ("npm install" is package-install, plain "npm test" is not).
+// -command-category adds or extends categories.
+var commandCategories = map[string][]string{
+	"network": {
+		"curl", "wget", "nc", "ncat", "netcat", "socat", "telnet", "ftp",
+		"ssh", "scp", "sftp", "rsync",
+	},
+	"package-install": {
+		"npm install", "npm i", "npm add", "yarn add", "pnpm add", "pnpm install",
+		"pip install", "pip3 install", "uv add", "uv pip", "poetry add",
+		"gem install", "cargo install", "go install", "go get",
+		"apt install", "apt-get install", "brew install", "dnf install", "yum install",
+	},
+	"destructive-fs": {"rm", "rmdir", "shred", "dd", "mkfs", "truncate", "wipefs"},
+	"privilege":      {"sudo", "su", "doas", "chmod", "chown", "chgrp", "setcap"},
+	"process":        {"kill", "killall", "pkill", "shutdown", "reboot", "systemctl"},
+}
+
+var blockedCategories = map[string]bool{}
+
+// commandSeparatorPattern splits a command line into the simple commands
+// that make it up, at pipes, lists, subshells, and command substitutions.
+var commandSeparatorPattern = regexp.MustCompile("\\|\\||&&|[|;&()`\\n]|\\$\\(")
+
+// commandInvocations returns the words of each simple command in a command
+// line, with leading environment assignments and wrapper programs like
+// "sudo" or "env" left in place so they can be categorized too.
+func commandInvocations(command string) [][]string {
+	var invocations [][]string
+	for _, segment := range commandSeparatorPattern.Split(command, -1) {
+		if words := strings.Fields(segment); len(words) > 0 {
+			invocations = append(invocations, words)
+		}
+	}
+	return invocations
+}
+
+// CategoryOf returns the sorted categories of every program a command line
+// runs. Programs are matched by base name so "/usr/bin/curl" is still
+// network, and a wrapper like "sudo rm" counts as both programs.
+func CategoryOf(command string) []string {
+	found := map[string]bool{}
+	for _, words := range commandInvocations(command) {
+		for _, i := range programIndexes(words) {
+			program := filepath.Base(unquote(words[i]))
+			next := ""
+			if i+1 < len(words) {
+				next = unquote(words[i+1])
+			}
+			for category, entries := range commandCategories {
+				for _, entry := range entries {
+					name, sub, hasSub := strings.Cut(entry, " ")
+					if program == name && (!hasSub || next == sub) {
+						found[category] = true
+					}
+				}
+			}
+		}
+	}
+	categories := make([]string, 0, len(found))
+	for category := range found {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// commandWrappers are programs that run the command after their own
+// options, mapped to the options that take a separate argument: In
+// "sudo -u root curl" the program is curl, not root. wrapperOperands
+// counts the positional arguments a wrapper takes before the command, like
+// timeout's duration.
+var (
+	commandWrappers = map[string][]string{
+		"sudo": {"-u", "--user", "-g", "--group", "-p", "--prompt", "-C", "--close-from",
+			"-D", "--chdir", "-r", "--role", "-t", "--type", "-T", "--command-timeout", "-U", "--other-user"},
+		"doas":    {"-u", "-C"},
+		"env":     {"-u", "--unset", "-C", "--chdir"},
+		"exec":    {"-a"},
+		"nice":    {"-n", "--adjustment"},
+		"nohup":   nil,
+		"ionice":  {"-c", "--class", "-n", "--classdata"},
+		"stdbuf":  {"-i", "--input", "-o", "--output", "-e", "--error"},
+		"time":    {"-f", "--format", "-o", "--output"},
+		"timeout": {"-s", "--signal", "-k", "--kill-after"},
+		"xargs": {"-a", "--arg-file", "-d", "--delimiter", "-E", "-I", "-L", "--max-lines",
+			"-n", "--max-args", "-P", "--max-procs", "-s", "--max-chars"},
+	}
+	wrapperOperands = map[string]int{"timeout": 1}
+)
+
+// programIndexes returns the positions of the programs a simple command
+// runs: the first word that isn't a VAR=value assignment and, while that is
+// a wrapper, the program after the wrapper's options and operands. Options
+// a wrapper doesn't list are taken to stand alone, so an unusual value can
+// at worst be checked as a program too, never hide one.
+func programIndexes(words []string) []int {
+	var indexes []int
+	for i := 0; i < len(words); i++ {
+		if isAssignment(words[i]) {
+			continue
+		}
+		indexes = append(indexes, i)
+		wrapper := filepath.Base(unquote(words[i]))
+		valueOptions, ok := commandWrappers[wrapper]
+		if !ok {
+			break
+		}
+		operands := wrapperOperands[wrapper]
+		for i+1 < len(words) {
+			next := words[i+1]
+			if next == "--" {
+				i++
+				break
+			}
+			if strings.HasPrefix(next, "-") && next != "-" {
+				i++
+				if slices.Contains(valueOptions, next) {
+					i++
+				}
+				continue
+			}
+			if operands > 0 && !isAssignment(next) {
+				operands--
+				i++
+				continue
+			}
+			break
+		}
+	}
+	return indexes
+}
+
+func isAssignment(word string) bool {
+	name, _, ok := strings.Cut(word, "=")
+	if !ok || name == "" {
+		return false
+	}
+	for i, r := range name {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// unquote strips the quotes around a word, so "env -S 'curl x'" and
+// "'rm' -rf" still name their programs.
+func unquote(word string) string {
+	return strings.Trim(word, `'"`)
+}
+
+// addCommandCategory parses a "name=prog1,prog2" definition from
+// -command-category, extending the category if it already exists.
+func addCommandCategory(spec string) error {
+	name, programs, ok := strings.Cut(spec, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("invalid command category %q: expected name=prog1,prog2", spec)
+	}
+	for _, program := range strings.Split(programs, ",") {
+		if program = strings.TrimSpace(program); program != "" {
+			commandCategories[name] = append(commandCategories[name], program)
+		}
+	}
+	return nil
+}
+
+// Destructive commands get a cool-down delay instead of a block when
+// -destructive-delay is set, since they are often legitimate but costly to
+// get wrong.
+var (
+	destructiveDelay   time.Duration
+	destructivePattern = regexp.MustCompile(`\brm\s+(-[a-zA-Z]*r[a-zA-Z]*f|-[a-zA-Z]*f[a-zA-Z]*r|-r\s+-f|-f\s+-r)\b|\bgit\s+(push\s+.*(--force|-f)\b|reset\s+--hard\b|clean\s+-[a-zA-Z]*f)`)
+)
+
+// Encoded execution detection: Attackers hide payloads from literal command
+// checks by encoding them and decoding at run time, e.g.
+// "echo <base64> | base64 -d | sh". We flag a decoder feeding an interpreter,
+// and long encoded blobs sent to an interpreter. The blob thresholds are
+// configurable because short base64/hex strings are common in benign commands.
+var (
+	encodedMinBase64Length = 40
+	encodedMinHexLength    = 64
+)
+
+var (
+	decoderPattern     = regexp.MustCompile(`\b(base64\s+(-d|-D|--decode)|xxd\s+(-p\s+)?-r|openssl\s+(enc|base64)\b[^|;&]*\s-d)\b`)
+	interpreterPattern = regexp.MustCompile(`(\|\s*(sudo\s+)?(ba|z|da|k)?sh\b|\|\s*(python[0-9.]*|perl|ruby|node)\b|\beval\b|\b(ba|z)?sh\s+-c\b|\bsource\s+/dev/stdin\b)`)
+	base64BlobPattern  = regexp.MustCompile(`[A-Za-z0-9+/]{16,}={0,2}`)
+	hexBlobPattern     = regexp.MustCompile(`\b(?:[0-9a-fA-F]{2}){16,}\b`)
+)
+
+// DetectEncodedExecution returns findings for decode-then-execute pipelines
+// and long encoded blobs handed to a shell or interpreter. Commands that
+// merely decode data without executing it are not flagged.
+func DetectEncodedExecution(command string) []Finding {
+	if !interpreterPattern.MatchString(command) {
+		return nil
+	}
+
+	var findings []Finding
+	if match := decoderPattern.FindString(command); match != "" {
+		findings = append(findings, Finding{
+			Rule:    "encoded-execution",
+			Match:   truncateMatch(match),
+			Message: "decoded data is piped into a shell or interpreter",
+		})
+	}
+	for _, blob := range base64BlobPattern.FindAllString(command, -1) {
+		if len(blob) >= encodedMinBase64Length && looksLikeBase64(blob) {
+			findings = append(findings, Finding{
+				Rule:    "encoded-blob",
+				Match:   truncateMatch(blob),
+				Message: fmt.Sprintf("%d-character base64 blob sent to an interpreter", len(blob)),
+			})
+		}
+	}
+	for _, blob := range hexBlobPattern.FindAllString(command, -1) {
+		if len(blob) >= encodedMinHexLength {
+			findings = append(findings, Finding{
+				Rule:    "encoded-blob",
+				Match:   truncateMatch(blob),
+				Message: fmt.Sprintf("%d-character hex blob sent to an interpreter", len(blob)),
+			})
+		}
+	}
+	return findings
+}
+
+// looksLikeBase64 filters out long runs that only match the base64 alphabet
+// by accident, like file paths or identifiers: Real encoded payloads mix
+// upper and lower case and almost always contain digits or padding.
+func looksLikeBase64(blob string) bool {
+	hasUpper := strings.IndexFunc(blob, unicode.IsUpper) >= 0
+	hasLower := strings.IndexFunc(blob, unicode.IsLower) >= 0
+	hasDigit := strings.IndexFunc(blob, unicode.IsDigit) >= 0
+	return hasUpper && hasLower && (hasDigit || strings.ContainsAny(blob, "+="))
+}
+
+// Secret detection: PostToolUse scans a tool's output for credentials it
+// may have leaked into Claude's context, e.g. a "cat .env" or a verbose
+// curl. Known token formats match by prefix; anything else must be a long,
+// high-entropy run of key characters. The thresholds trade recall for
+// quiet: At the defaults a random 32-character key trips about 95% of the
+// time, while identifiers, paths and hex digests stay below. Findings are
+// reported in the response metadata, or block with -secret-strict.
+var (
+	secretStrict     bool
+	secretMinLength  = 32
+	secretMinEntropy = 4.3
+)
+
+// secretMaxLength bounds entropy candidates: Longer runs are encoded
+// payloads like images or certificates, not keys.
+const secretMaxLength = 256
+
+// maxSecretFindings caps the findings for one output, which keeps a dump
+// of a credentials file from producing a huge response.
+const maxSecretFindings = 10
+
+var knownSecretPatterns = []struct {
+	rule    string
+	pattern *regexp.Regexp
+	message string
+}{
+	{"aws-access-key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), "AWS access key ID"},
+	{"github-token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`), "GitHub token"},
+	{"slack-token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`), "Slack token"},
+	{"private-key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`), "PEM private key"},
+}
+
+var secretCandidatePattern = regexp.MustCompile(`[A-Za-z0-9+/_-]+={0,2}`)
+
+// scanForSecrets returns a finding for each likely secret in data, with
+// the secret redacted so the finding itself is safe to log or return.
+func scanForSecrets(data []byte) []Finding {
+	var findings []Finding
+	var known []string
+	seen := map[string]bool{}
+	add := func(rule, match, message string) {
+		if !seen[match] && len(findings) < maxSecretFindings {
+			seen[match] = true
+			findings = append(findings, Finding{Rule: rule, Match: redactSecret(match), Message: message})
+		}
+	}
+
+	for _, p := range knownSecretPatterns {
+		for _, match := range p.pattern.FindAll(data, -1) {
+			known = append(known, string(match))
+			add(p.rule, string(match), p.message)
+		}
+	}
+
+candidates:
+	for _, match := range secretCandidatePattern.FindAll(data, -1) {
+		token := string(match)
+		if len(token) < secretMinLength || len(token) > secretMaxLength || !looksLikeBase64(token) {
+			continue
+		}
+		for _, k := range known {
+			if strings.Contains(token, k) || strings.Contains(k, token) {
+				continue candidates
+			}
+		}
+		if decodesToText(token) {
+			continue
+		}
+		if entropy := shannonEntropy(token); entropy >= secretMinEntropy {
+			add("high-entropy-string", token, fmt.Sprintf("%d-character string with %.1f bits of entropy per character", len(token), entropy))
+		}
+	}
+	return findings
+}
+
+// shannonEntropy returns the entropy of s in bits per byte.
+func shannonEntropy(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	var entropy float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(s))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// decodesToText reports whether s is base64 for printable text: Encoded
+// data such as a JSON payload scores like a key but isn't one.
+func decodesToText(s string) bool {
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		decoded, err := enc.DecodeString(s)
+		if err != nil || !utf8.Valid(decoded) {
+			continue
+		}
+		printable := true
+		for _, r := range string(decoded) {
+			if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+				printable = false
+				break
+			}
+		}
+		if printable {
+			return true
+		}
+	}
+	return false
+}
+
+// redactSecret keeps just enough of a secret to recognize which one leaked.
+func redactSecret(secret string) string {
+	const keep = 4
+	if len(secret) <= keep*2 {
+		return strings.Repeat("*", len(secret))
+	}
+	return secret[:keep] + "..." + fmt.Sprintf("(%d chars)", len(secret))
+}
+
+// responseStrings collects the string values in a decoded tool_response,
+// so secrets are matched in the text as the tool produced it rather than
+// in its JSON escaping.
+func responseStrings(v interface{}, out []string) []string {
+	switch v := v.(type) {
+	case string:
+		out = append(out, v)
+	case []interface{}:
+		for _, item := range v {
+			out = responseStrings(item, out)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			out = responseStrings(v[key], out)
+		}
+	}
+	return out
+}
+
+// truncateMatch shortens matched text for reasons and logs; an encoded
+// payload can be kilobytes long and is useless to a human in full.
+func truncateMatch(match string) string {
+	const maxLen = 32
+	if len(match) <= maxLen {
+		return match
+	}
+	return match[:maxLen] + "..."
+}
+
+// Security patterns: Named regular expressions checked against Bash commands
+// and file paths; Target limits a pattern to "command" or "path" input, and
+// an empty Target applies to both. The built-in set covers common SQL injection and path
+// traversal shapes; -patterns loads a JSON or YAML file of additional rules,
+// and "test-patterns" runs the active set against sample input so rules can
+// be tuned without restarting the server.
+type SecurityPattern struct {
+	ID       string `json:"id"`
+	Pattern  string `json:"pattern"`
+	Target   string `json:"target,omitempty"`
+	Decision string `json:"decision,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+
+	// PolicyURL links to the policy this rule enforces.
+	PolicyURL string `json:"policy_url,omitempty"`
+
+	re     *regexp.Regexp
+	source string // file:line the rule was loaded from, for errors
+
+	// literal is a substring every match must contain, if the pattern has
+	// one; matching skips the regex when the input lacks it.
+	literal  string
+	foldCase bool
+}
+
+var builtinSecurityPatterns = []SecurityPattern{
+	{ID: "sql-union-select", Target: "command", Pattern: `(?i)\bunion\s+(all\s+)?select\b`, Reason: "SQL UNION injection"},
+	{ID: "sql-drop", Target: "command", Pattern: `(?i)\bdrop\s+(table|database|schema)\b`, Reason: "destructive SQL DROP statement"},
+	{ID: "sql-tautology", Target: "command", Pattern: `(?i)'\s*or\s+'?1'?\s*=\s*'?1`, Reason: "SQL tautology injection"},
+	{ID: "sql-unbounded-delete", Target: "command", Pattern: `(?i)\bdelete\s+from\s+[\w."]+\s*(;|"|'|$)`, Reason: "SQL DELETE without a WHERE clause"},
+	{ID: "path-traversal", Target: "path", Pattern: `(^|[/\\])\.\.([/\\]|$)`, Reason: "path traversal sequence"},
+}
+
+var securityPatterns []SecurityPattern
+
+// compileSecurityPatterns validates and compiles a pattern set. Errors name
+// the offending rule so a bad entry in a shared file is easy to find.
+func compileSecurityPatterns(patterns []SecurityPattern, source string) ([]SecurityPattern, error) {
+	compiled := make([]SecurityPattern, 0, len(patterns))
+	for i, p := range patterns {
+		source := source
+		if p.source != "" {
+			source = p.source
+		}
+		if p.ID == "" {
+			return nil, fmt.Errorf("%s: pattern %d has no id", source, i+1)
+		}
+		switch p.Target {
+		case "", "command", "path":
+		default:
+			return nil, fmt.Errorf("%s: pattern %q has invalid target %q", source, p.ID, p.Target)
+		}
+		switch p.Decision {
+		case "":
+			p.Decision = "block"
+		case "block", "ask", "allow":
+		default:
+			return nil, fmt.Errorf("%s: pattern %q has invalid decision %q", source, p.ID, p.Decision)
+		}
+		if p.PolicyURL != "" {
+			if err := validPolicyURL(p.PolicyURL); err != nil {
+				return nil, fmt.Errorf("%s: pattern %q: %w", source, p.ID, err)
+			}
+		}
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: pattern %q: %w", source, p.ID, err)
+		}
+		p.re = re
+		p.literal, p.foldCase = requiredLiteral(p.Pattern)
+		compiled = append(compiled, p)
+	}
+	return compiled, nil
+}
+
+// loadSecurityPatterns compiles the built-in patterns plus those in path,
+// if given. A file pattern with a built-in's id replaces the built-in.
+func loadSecurityPatterns(path string) ([]SecurityPattern, error) {
+	patterns := append([]SecurityPattern{}, builtinSecurityPatterns...)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading patterns: %w", err)
+		}
+		var custom []SecurityPattern
+		if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+			custom, err = parsePatternsYAML(path, data)
+		} else {
+			custom, err = parsePatternsJSON(path, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range custom {
+			replaced := false
+			for i := range patterns {
+				if patterns[i].ID == c.ID {
+					patterns[i], replaced = c, true
+				}
+			}
+			if !replaced {
+				patterns = append(patterns, c)
+			}
+		}
+	}
+	return compileSecurityPatterns(patterns, "built-in patterns")
+}
+
+// parsePatternsJSON decodes a JSON array of patterns one element at a time
+// so each rule can be tagged with the line it starts on.
+func parsePatternsJSON(path string, data []byte) ([]SecurityPattern, error) {
+	lineAt := func(offset int64) int { return bytes.Count(data[:offset], []byte("\n")) + 1 }
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, fmt.Errorf("%s: expected a JSON array of patterns", path)
+	}
+	var patterns []SecurityPattern
+	for dec.More() {
+		// InputOffset is just past the previous element; skip the separator
+		// and whitespace to find where this one starts.
+		start := dec.InputOffset()
+		for start < int64(len(data)) && strings.ContainsRune(", \t\r\n", rune(data[start])) {
+			start++
+		}
+		var p SecurityPattern
+		if err := dec.Decode(&p); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineAt(start), err)
+		}
+		p.source = fmt.Sprintf("%s:%d", path, lineAt(start))
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// parsePatternsYAML reads the small YAML subset a shared ruleset needs: a
+// list of flat mappings, optionally under a top-level "patterns:" key, with
+// plain, 'single', or "double" quoted scalar values and # comments. "regex"
+// is accepted as a synonym for "pattern". Anything else is rejected with its
+// line number rather than guessed at, since a misread rule fails open.
+//
+//	patterns:
+//	  - id: no-curl-pipe
+//	    regex: 'curl[^|]*\|\s*(ba)?sh'
+//	    target: command
+//	    reason: piping downloads into a shell
+//	    policy_url: https://wiki.example.com/security/downloads
+func parsePatternsYAML(path string, data []byte) ([]SecurityPattern, error) {
+	var patterns []SecurityPattern
+	var current *SecurityPattern
+	itemIndent := -1
+	for i, raw := range strings.Split(string(data), "\n") {
+		line := strings.TrimRight(raw, " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		where := fmt.Sprintf("%s:%d", path, i+1)
+		indent := len(line) - len(trimmed)
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("%s: tabs are not allowed for indentation", where)
+		}
+		if trimmed == "patterns:" && indent == 0 && current == nil {
+			continue
+		}
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			if itemIndent >= 0 && indent != itemIndent {
+				return nil, fmt.Errorf("%s: inconsistent list indentation", where)
+			}
+			itemIndent = indent
+			patterns = append(patterns, SecurityPattern{source: where})
+			current = &patterns[len(patterns)-1]
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+			if trimmed == "" {
+				continue
+			}
+		} else if current == nil || indent <= itemIndent {
+			return nil, fmt.Errorf("%s: expected a list item starting with \"- \"", where)
+		}
+
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected key: value", where)
+		}
+		value, err := yamlScalar(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", where, err)
+		}
+		switch strings.TrimSpace(key) {
+		case "id":
+			current.ID = value
+		case "pattern", "regex":
+			current.Pattern = value
+		case "target":
+			current.Target = value
+		case "decision":
+			current.Decision = value
+		case "reason":
+			current.Reason = value
+		case "policy_url":
+			current.PolicyURL = value
+		default:
+			return nil, fmt.Errorf("%s: unknown pattern field %q", where, strings.TrimSpace(key))
+		}
+	}
+	return patterns, nil
+}
+
+// yamlScalar decodes one scalar value, dropping a trailing comment.
+func yamlScalar(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "'"):
+		var b strings.Builder
+		for i := 1; i < len(value); i++ {
+			if value[i] != '\'' {
+				b.WriteByte(value[i])
+				continue
+			}
+			if i+1 < len(value) && value[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+				continue
+			}
+			if rest := strings.TrimSpace(value[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected text after quoted value")
+			}
+			return b.String(), nil
+		}
+		return "", fmt.Errorf("unterminated single-quoted value")
+	case strings.HasPrefix(value, "\""):
+		for i := 1; i < len(value); i++ {
+			if value[i] == '\\' {
+				i++
+				continue
+			}
+			if value[i] == '"' {
+				unquoted, err := strconv.Unquote(value[:i+1])
+				if err != nil {
+					return "", fmt.Errorf("invalid double-quoted value (use single quotes for regexes): %w", err)
+				}
+				if rest := strings.TrimSpace(value[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+					return "", fmt.Errorf("unexpected text after quoted value")
+				}
+				return unquoted, nil
+			}
+		}
+		return "", fmt.Errorf("unterminated double-quoted value")
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// Pattern prefilter: With a large shared ruleset, running every regex on
+// every command dominates the scan, and almost all of them fail. Most rules
+// contain a literal that any match must include ("union", "drop"), so we
+// check for it with a substring search first and only run the regex when it
+// is present. Combining the rules into a single alternation doesn't help
+// here, since Go's regexp engine simulates every branch anyway.
+const minPrefilterLiteral = 3
+
+// requiredLiteral returns the longest literal that every match of pattern
+// must contain, or "" if there isn't a useful one.
+func requiredLiteral(pattern string) (string, bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	literal, foldCase := longestRequiredLiteral(re.Simplify())
+	if utf8.RuneCountInString(literal) < minPrefilterLiteral {
+		return "", false
+	}
+	if foldCase {
+		if !isASCII(literal) {
+			return "", false
+		}
+		literal = strings.ToLower(literal)
+	}
+	return literal, foldCase
+}
+
+func longestRequiredLiteral(re *syntax.Regexp) (string, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return string(re.Rune), re.Flags&syntax.FoldCase != 0
+	case syntax.OpCapture, syntax.OpPlus:
+		return longestRequiredLiteral(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return longestRequiredLiteral(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		var best string
+		var bestFold bool
+		for _, sub := range re.Sub {
+			if literal, fold := longestRequiredLiteral(sub); len(literal) > len(best) {
+				best, bestFold = literal, fold
+			}
+		}
+		return best, bestFold
+	}
+	return "", false
+}
+
+// mayMatch reports whether p could match input. Case-insensitive literals
+// are only trusted on ASCII input: Unicode case folding maps characters
+// such as U+017F onto ASCII letters in ways strings.ToLower doesn't, and a
+// skipped regex there would be a bypass.
+func (p *SecurityPattern) mayMatch(input, lower string, ascii bool) bool {
+	switch {
+	case p.literal == "":
+		return true
+	case !p.foldCase:
+		return strings.Contains(input, p.literal)
+	case ascii:
+		return strings.Contains(lower, p.literal)
+	default:
+		return true
+	}
+}
+
+// matchSecurityPatterns returns the patterns for target that match input,
+// in order.
+func matchSecurityPatterns(patterns []SecurityPattern, target, input string) []SecurityPattern {
+	ascii := isASCII(input)
+	lower := input
+	if ascii {
+		lower = strings.ToLower(input)
+	}
+	var matched []SecurityPattern
+	for i := range patterns {
+		p := &patterns[i]
+		if (p.Target == "" || p.Target == target) && p.mayMatch(input, lower, ascii) && p.re.MatchString(input) {
+			matched = append(matched, *p)
+		}
+	}
+	return matched
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// runTestPatterns implements "test-patterns": it reports which patterns
+// match the given input and, like grep, exits 1 when anything matched.
+func runTestPatterns(args []string) int {
+	fs := flag.NewFlagSet("test-patterns", flag.ExitOnError)
+	input := fs.String("input", "", "sample command or path to test")
+	target := fs.String("target", "", "only test patterns for this target: command or path")
+	file := fs.String("patterns", os.Getenv("CCHD_PATTERNS"), "JSON or YAML file of additional security patterns")
+	fs.Parse(args)
+
+	patterns, err := loadSecurityPatterns(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	matched := 0
+	for _, p := range patterns {
+		if *target != "" && p.Target != "" && p.Target != *target {
+			continue
+		}
+		if loc := p.re.FindStringIndex(*input); loc != nil {
+			matched++
+			fmt.Printf("MATCH  %-24s %-6s %q\n", p.ID, p.Decision, (*input)[loc[0]:loc[1]])
+		} else {
+			fmt.Printf("-      %s\n", p.ID)
+		}
+	}
+	fmt.Printf("\n%d patterns matched\n", matched)
+	if matched > 0 {
+		return 1
+	}
+	return 0
+}
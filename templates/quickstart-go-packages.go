@@ -0,0 +1,311 @@
+// Package risk enrichment for install commands run through Bash.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Package risk: Before deciding on an install command ("npm install X",
+// "pip install Y", ...), the server can look the packages up in an advisory
+// source and attach what it found to the event as the "packagerisk"
+// attribute, a JSON array in a string like "forwardedenv". A dispatcher
+// that enriches events itself may send the attribute, in which case the
+// server doesn't look again. The source is an OSV-compatible query API
+// (https://api.osv.dev/v1/query) or a local JSON file mapping
+// "ecosystem/name" to advisories:
+//
+//	{"npm/event-stream": [{"id": "GHSA-mh6f-8j2x-4483", "summary": "Malicious code", "versions": ["3.3.6"]}]}
+//
+// An advisory without versions affects every version. Lookups are cached
+// for -advisory-cache-ttl. Enrichment fails open: a package whose lookup
+// failed is listed with an error and no advisories, and the policy decides
+// what that means.
+type PackageRef struct {
+	Ecosystem string `json:"ecosystem"`
+	Name      string `json:"name"`
+	Version   string `json:"version,omitempty"`
+}
+
+type Advisory struct {
+	ID       string   `json:"id"`
+	Summary  string   `json:"summary,omitempty"`
+	Versions []string `json:"versions,omitempty"`
+}
+
+type PackageRisk struct {
+	PackageRef
+	Advisories []Advisory `json:"advisories,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// packageRisks returns the event's package risk annotations, if any.
+func packageRisks(event CloudEvent) ([]PackageRisk, error) {
+	if event.PackageRisk == "" {
+		return nil, nil
+	}
+	var risks []PackageRisk
+	if err := json.Unmarshal([]byte(event.PackageRisk), &risks); err != nil {
+		return nil, fmt.Errorf("decoding packagerisk attribute: %w", err)
+	}
+	return risks, nil
+}
+
+// installers maps an install command, as its leading words, to the
+// ecosystem its arguments name packages in.
+var installers = []struct {
+	words     []string
+	ecosystem string
+}{
+	{[]string{"npm", "install"}, "npm"}, {[]string{"npm", "i"}, "npm"}, {[]string{"npm", "add"}, "npm"},
+	{[]string{"yarn", "add"}, "npm"}, {[]string{"pnpm", "add"}, "npm"}, {[]string{"bun", "add"}, "npm"},
+	{[]string{"pip", "install"}, "PyPI"}, {[]string{"pip3", "install"}, "PyPI"},
+	{[]string{"python", "-m", "pip", "install"}, "PyPI"}, {[]string{"python3", "-m", "pip", "install"}, "PyPI"},
+	{[]string{"uv", "pip", "install"}, "PyPI"}, {[]string{"uv", "add"}, "PyPI"},
+	{[]string{"gem", "install"}, "RubyGems"},
+	{[]string{"cargo", "add"}, "crates.io"}, {[]string{"cargo", "install"}, "crates.io"},
+	{[]string{"go", "get"}, "Go"}, {[]string{"go", "install"}, "Go"},
+}
+
+// installFlagsWithValue are installer flags whose value is the next word,
+// which mustn't be mistaken for a package.
+var installFlagsWithValue = map[string]bool{
+	"-r": true, "--requirement": true, "-c": true, "--constraint": true, "-e": true, "--editable": true,
+	"-i": true, "--index-url": true, "--extra-index-url": true, "-t": true, "--target": true,
+	"--registry": true, "--prefix": true, "-v": true, "--version": true, "--git": true, "--path": true,
+}
+
+// installedPackages finds the packages a Bash command installs. Local
+// paths, URLs and requirement files are skipped: there's no name to look up.
+func installedPackages(command string) []PackageRef {
+	var packages []PackageRef
+	var segment []string
+	scan := func() {
+		words := segment
+		for len(words) > 0 && (words[0] == "sudo" || strings.Contains(words[0], "=")) {
+			words = words[1:]
+		}
+		for _, installer := range installers {
+			if len(words) < len(installer.words) || strings.Join(words[:len(installer.words)], " ") != strings.Join(installer.words, " ") {
+				continue
+			}
+			args := words[len(installer.words):]
+			for i := 0; i < len(args); i++ {
+				if installFlagsWithValue[args[i]] {
+					i++
+					continue
+				}
+				if ref, ok := parsePackageSpec(installer.ecosystem, args[i]); ok {
+					packages = append(packages, ref)
+				}
+			}
+			return
+		}
+	}
+	for _, token := range shellTokens(command) {
+		if isShellOperator(token) {
+			scan()
+			segment = nil
+			continue
+		}
+		segment = append(segment, token)
+	}
+	scan()
+	return packages
+}
+
+// parsePackageSpec splits an installer argument into a name and an exact
+// version, when it pins one.
+func parsePackageSpec(ecosystem, spec string) (PackageRef, bool) {
+	if spec == "" || strings.HasPrefix(spec, "-") || strings.HasPrefix(spec, ".") ||
+		strings.HasPrefix(spec, "/") || strings.HasPrefix(spec, "~") || strings.Contains(spec, "://") ||
+		strings.HasPrefix(spec, "git+") || strings.HasSuffix(spec, ".whl") || strings.HasSuffix(spec, ".tgz") {
+		return PackageRef{}, false
+	}
+	ref := PackageRef{Ecosystem: ecosystem, Name: spec}
+	switch ecosystem {
+	case "PyPI":
+		if i := strings.Index(spec, "=="); i >= 0 {
+			ref.Name, ref.Version = spec[:i], spec[i+2:]
+		} else if i := strings.IndexAny(spec, "<>=!~;"); i >= 0 {
+			ref.Name = spec[:i]
+		}
+		if i := strings.IndexByte(ref.Name, '['); i >= 0 {
+			ref.Name = ref.Name[:i]
+		}
+	default:
+		// npm scopes start with "@", so the version separator is the last one.
+		if i := strings.LastIndexByte(spec, '@'); i > 0 {
+			ref.Name, ref.Version = spec[:i], spec[i+1:]
+		}
+	}
+	ref.Name = strings.TrimSpace(ref.Name)
+	return ref, ref.Name != ""
+}
+
+var (
+	advisorySource string
+	advisoryTTL    = time.Hour
+	advisoryDB     map[string][]Advisory
+	advisoryClient = &http.Client{Timeout: 2 * time.Second}
+	advisoryCache  = struct {
+		sync.Mutex
+		entries map[PackageRef]advisoryCacheEntry
+	}{entries: map[PackageRef]advisoryCacheEntry{}}
+)
+
+type advisoryCacheEntry struct {
+	advisories []Advisory
+	expires    time.Time
+}
+
+// maxAdvisoryCacheEntries bounds the lookup cache; when it's full, expired
+// entries are dropped, and if none have expired the cache starts over.
+const maxAdvisoryCacheEntries = 10000
+
+func loadAdvisoryDB(path string) (map[string][]Advisory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading advisory database: %w", err)
+	}
+	var db map[string][]Advisory
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// lookupAdvisories returns the advisories affecting one package.
+func lookupAdvisories(ref PackageRef) ([]Advisory, error) {
+	advisoryCache.Lock()
+	entry, ok := advisoryCache.entries[ref]
+	advisoryCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.advisories, nil
+	}
+
+	var advisories []Advisory
+	var err error
+	if advisoryDB != nil {
+		for _, advisory := range advisoryDB[ref.Ecosystem+"/"+ref.Name] {
+			if len(advisory.Versions) == 0 || ref.Version == "" || containsString(advisory.Versions, ref.Version) {
+				advisories = append(advisories, advisory)
+			}
+		}
+	} else if advisories, err = queryOSV(ref); err != nil {
+		return nil, err
+	}
+
+	advisoryCache.Lock()
+	defer advisoryCache.Unlock()
+	if len(advisoryCache.entries) >= maxAdvisoryCacheEntries {
+		now := time.Now()
+		for key, old := range advisoryCache.entries {
+			if now.After(old.expires) {
+				delete(advisoryCache.entries, key)
+			}
+		}
+		if len(advisoryCache.entries) >= maxAdvisoryCacheEntries {
+			advisoryCache.entries = map[PackageRef]advisoryCacheEntry{}
+		}
+	}
+	advisoryCache.entries[ref] = advisoryCacheEntry{advisories: advisories, expires: time.Now().Add(advisoryTTL)}
+	return advisories, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// queryOSV asks an OSV-compatible API which vulnerabilities affect a
+// package. Without a pinned version OSV returns every known advisory for
+// the package, which is the cautious answer for "whatever is latest".
+func queryOSV(ref PackageRef) ([]Advisory, error) {
+	query := map[string]interface{}{
+		"package": map[string]string{"name": ref.Name, "ecosystem": ref.Ecosystem},
+	}
+	if ref.Version != "" {
+		query["version"] = ref.Version
+	}
+	body, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := advisoryClient.Post(advisorySource, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("advisory source returned %s", resp.Status)
+	}
+	var result struct {
+		Vulns []struct {
+			ID      string `json:"id"`
+			Summary string `json:"summary"`
+		} `json:"vulns"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding advisory response: %w", err)
+	}
+	advisories := make([]Advisory, 0, len(result.Vulns))
+	for _, vuln := range result.Vulns {
+		advisories = append(advisories, Advisory{ID: vuln.ID, Summary: vuln.Summary})
+	}
+	return advisories, nil
+}
+
+// enrichPackageRisk annotates a Bash install command with the risk of each
+// package it installs. It leaves events the dispatcher already enriched,
+// and everything that isn't an install, untouched.
+func enrichPackageRisk(event *CloudEvent) {
+	if advisorySource == "" || event.PackageRisk != "" ||
+		event.Type != "com.claudecode.hook.PreToolUse" {
+		return
+	}
+	if toolName, _ := event.Data["tool_name"].(string); toolName != "Bash" {
+		return
+	}
+	toolInput, _ := event.Data["tool_input"].(map[string]interface{})
+	command, _ := toolInput["command"].(string)
+	packages := installedPackages(command)
+	if len(packages) == 0 {
+		return
+	}
+	risks := make([]PackageRisk, len(packages))
+	var wg sync.WaitGroup
+	for i, ref := range packages {
+		wg.Add(1)
+		go func(i int, ref PackageRef) {
+			defer wg.Done()
+			risks[i].PackageRef = ref
+			advisories, err := lookupAdvisories(ref)
+			if err != nil {
+				slog.Warn("Advisory lookup failed", "ecosystem", ref.Ecosystem, "package", ref.Name, "error", err)
+				risks[i].Error = "lookup failed"
+				return
+			}
+			risks[i].Advisories = advisories
+		}(i, ref)
+	}
+	wg.Wait()
+	encoded, err := json.Marshal(risks)
+	if err != nil {
+		return
+	}
+	event.PackageRisk = string(encoded)
+}
@@ -0,0 +1,282 @@
+// Block reasons: templates, localized catalogs, and sanitization of the
+// text that ends up in front of Claude and the user.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// Reason templates: Block reasons are rendered from text/template strings
+// keyed by rule id, e.g. "Blocked {{.Tool}} in {{.CWD}}: {{.Rule}}", so
+// every check produces consistent messages without string concatenation.
+// Templates are parsed at startup, so a broken override fails fast instead
+// of surfacing as a garbled reason mid-session.
+type ReasonContext struct {
+	Event   string
+	Session string
+	User    string
+	Tool    string
+	CWD     string
+	Rule    string
+	Detail  string
+}
+
+var defaultReasonTemplates = map[string]string{
+	"blocked-category":   "Blocked {{.Tool}} command: {{.Detail}} commands are not allowed",
+	"encoded-blob":       "Blocked {{.Tool}} command: {{.Detail}}",
+	"invalid-tool-input": "Rejected {{.Tool}} call: {{.Detail}}",
+	"malformed-data":     "Rejected malformed {{.Event}} event: {{.Detail}}",
+	"encoded-execution":  "Blocked {{.Tool}} command: {{.Detail}}",
+	"prompt-injection":   "Blocked {{.Tool}} output: {{.Detail}}",
+	"secret-in-output":   "Blocked {{.Tool}} output: {{.Detail}}",
+	"unknown-event":      "Unrecognized hook event type {{printf \"%q\" .Event}}",
+}
+
+var reasonTemplates = map[string]*template.Template{}
+
+// compileReasonTemplate parses a reason template and trial-renders it against
+// an empty context, which turns a misspelled field like {{.Tol}} into a
+// startup error instead of a failed render on the first matching event.
+func compileReasonTemplate(rule, text string) (*template.Template, error) {
+	tmpl, err := template.New(rule).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("reason template for %q: %w", rule, err)
+	}
+	if err := tmpl.Execute(io.Discard, ReasonContext{}); err != nil {
+		return nil, fmt.Errorf("reason template for %q: %w", rule, err)
+	}
+	reasonsRead.session = reasonsRead.session || templateReads(tmpl, ReasonContext{Session: "x"})
+	reasonsRead.user = reasonsRead.user || templateReads(tmpl, ReasonContext{User: "x"})
+	reasonsRead.cwd = reasonsRead.cwd || templateReads(tmpl, ReasonContext{CWD: "x"})
+	return tmpl, nil
+}
+
+// reasonsRead records which per-call context fields any reason template
+// interpolates. A cached decision carries its rendered reason, so the
+// decision cache must key on those fields too.
+var reasonsRead struct{ session, user, cwd bool }
+
+// templateReads reports whether tmpl renders ctx differently from an empty
+// context, i.e. whether its output depends on the fields set in ctx.
+func templateReads(tmpl *template.Template, ctx ReasonContext) bool {
+	var empty, filled strings.Builder
+	tmpl.Execute(&empty, ReasonContext{})
+	if err := tmpl.Execute(&filled, ctx); err != nil {
+		return true
+	}
+	return empty.String() != filled.String()
+}
+
+// loadReasonTemplates compiles the built-in templates plus "rule=template"
+// overrides supplied with -reason-template.
+func loadReasonTemplates(overrides []string) error {
+	for rule, text := range defaultReasonTemplates {
+		tmpl, err := compileReasonTemplate(rule, text)
+		if err != nil {
+			return err
+		}
+		reasonTemplates[rule] = tmpl
+	}
+	for _, override := range overrides {
+		rule, text, ok := strings.Cut(override, "=")
+		if !ok || rule == "" {
+			return fmt.Errorf("invalid reason template %q: expected rule=template", override)
+		}
+		tmpl, err := compileReasonTemplate(rule, text)
+		if err != nil {
+			return err
+		}
+		reasonTemplates[rule] = tmpl
+	}
+	return nil
+}
+
+// Localized reasons: -reason-catalog loads translated reason templates keyed
+// by language and then rule id (built-in checks and security pattern ids
+// alike), e.g. {"de": {"blocked-category": "{{.Detail}}-Befehle sind nicht
+// erlaubt"}}. The language comes from the request's Accept-Language header,
+// which the dispatcher fills from its --lang setting. The first preferred
+// language with a translation for the rule wins; "de-CH" falls back to
+// "de", and a rule with no translation at all uses the English template.
+var localizedReasons = map[string]map[string]*template.Template{}
+
+func loadReasonCatalog(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading reason catalog: %w", err)
+	}
+	var catalog map[string]map[string]string
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for lang, rules := range catalog {
+		lang = strings.ToLower(lang)
+		if localizedReasons[lang] == nil {
+			localizedReasons[lang] = map[string]*template.Template{}
+		}
+		for rule, text := range rules {
+			tmpl, err := compileReasonTemplate(rule, text)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", path, lang, err)
+			}
+			localizedReasons[lang][rule] = tmpl
+		}
+	}
+	return nil
+}
+
+// reasonTemplateFor picks the template for rule in the most preferred
+// language that has one, falling back to the English templates.
+func reasonTemplateFor(rule string, languages []string) (*template.Template, bool) {
+	for _, lang := range languages {
+		for {
+			if tmpl, ok := localizedReasons[lang][rule]; ok {
+				return tmpl, true
+			}
+			i := strings.LastIndex(lang, "-")
+			if i < 0 {
+				break
+			}
+			lang = lang[:i]
+		}
+	}
+	tmpl, ok := reasonTemplates[rule]
+	return tmpl, ok
+}
+
+// parseAcceptLanguage returns the language tags of an Accept-Language header,
+// lowercased and ordered by preference. Tags with q=0 and "*" are dropped.
+func parseAcceptLanguage(header string) []string {
+	type preference struct {
+		tag string
+		q   float64
+	}
+	var prefs []preference
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			prefs = append(prefs, preference{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	tags := make([]string, len(prefs))
+	for i, p := range prefs {
+		tags[i] = p.tag
+	}
+	return tags
+}
+
+// renderReason renders the reason for a rule against the event. Values that
+// come from the event are attacker-influenced, so control characters are
+// stripped before interpolation to keep them from corrupting Claude's
+// display. If rendering fails we still return a usable reason.
+func renderReason(rule string, event CloudEvent, detail string) string {
+	toolName, _ := event.Data["tool_name"].(string)
+	cwd, _ := event.Data["current_working_directory"].(string)
+	ctx := ReasonContext{
+		Event:   stripControl(event.Type),
+		Session: stripControl(event.SessionID),
+		User:    stripControl(event.UserID),
+		Tool:    stripControl(toolName),
+		CWD:     stripControl(cwd),
+		Rule:    rule,
+		Detail:  stripControl(detail),
+	}
+
+	tmpl, ok := reasonTemplateFor(rule, event.Languages)
+	if !ok {
+		return fmt.Sprintf("Blocked by rule %s: %s", rule, ctx.Detail)
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, ctx); err != nil {
+		slog.Error("Rendering reason template", "rule", rule, "error", SanitizeText(err.Error()))
+		return fmt.Sprintf("Blocked by rule %s: %s", rule, ctx.Detail)
+	}
+	return buf.String()
+}
+
+// stripControl is SanitizeText for single-line values: it additionally
+// drops newlines and tabs so an interpolated value can't reshape a reason.
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, SanitizeText(s))
+}
+
+// Text sanitization: Reasons and context often echo attacker-controlled
+// input (a command, a file name), and raw control characters or ANSI escapes
+// in them can corrupt Claude's display or forge log lines. Everything we
+// emit or log passes through SanitizeText first.
+var ansiEscapePattern = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// SanitizeText returns s as valid UTF-8 with ANSI escape sequences removed
+// and control characters other than newline and tab stripped. Invalid byte
+// sequences become U+FFFD so the damage stays visible rather than silent.
+func SanitizeText(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	s = ansiEscapePattern.ReplaceAllString(s, "")
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// sanitizeResponse applies SanitizeText to every human-readable field of a
+// response just before it is sent.
+func sanitizeResponse(response Response) Response {
+	response.Reason = SanitizeText(response.Reason)
+	response.Status = sanitizeStatus(response.Status)
+	if response.HookSpecificOutput != nil {
+		output := *response.HookSpecificOutput
+		output.PermissionDecisionReason = SanitizeText(output.PermissionDecisionReason)
+		output.AdditionalContext = SanitizeText(output.AdditionalContext)
+		response.HookSpecificOutput = &output
+	}
+	if len(response.PostActions) > 0 {
+		actions := make([]PostAction, len(response.PostActions))
+		for i, action := range response.PostActions {
+			action.Message = SanitizeText(action.Message)
+			actions[i] = action
+		}
+		response.PostActions = actions
+	}
+	if response.Delay != nil {
+		delay := *response.Delay
+		delay.Message = SanitizeText(delay.Message)
+		response.Delay = &delay
+	}
+	if response.Defer != nil {
+		deferral := *response.Defer
+		deferral.Reason = SanitizeText(deferral.Reason)
+		response.Defer = &deferral
+	}
+	return response
+}
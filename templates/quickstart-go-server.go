@@ -0,0 +1,1069 @@
+// HTTP plumbing for the quick-start server: webhook signatures and replay
+// protection, dispatch hooks, stats, load shedding and per-session rate
+// limits, decision engines, request coalescing, the /hook handler itself,
+// health endpoints, logging, and TLS.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Webhook signatures: Once the server listens beyond localhost, anyone who
+// can reach it could forge events. With a secret shared with the dispatcher
+// in CCHD_WEBHOOK_SECRET, requests whose X-CCHD-Signature doesn't match
+// the body are rejected with 401 before the body is parsed. Without a
+// secret the check is skipped, for local development, and a warning is
+// logged at startup. The secret is only read from the environment so it
+// never appears in a process listing. The subcommands that send events
+// (conformance, bench) and the shadow sign with the same secret.
+const signatureHeader = "X-CCHD-Signature"
+
+var webhookSecret = []byte(os.Getenv("CCHD_WEBHOOK_SECRET"))
+
+func webhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature reports whether header is a valid signature of body.
+func verifySignature(secret, body []byte, header string) bool {
+	got, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(header), "sha256="))
+	if err != nil || len(got) != sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// signRequest adds a signature header when a secret is configured.
+func signRequest(req *http.Request, body []byte) {
+	if len(webhookSecret) > 0 {
+		req.Header.Set(signatureHeader, webhookSignature(webhookSecret, body))
+	}
+}
+
+// maxBodySize caps request bodies so an oversized or endless payload can't
+// exhaust memory before it is even parsed.
+var maxBodySize int64 = 1 << 20
+
+// Replay protection: With -replay-window set, every event must carry a
+// "nonce" attribute and a "time" within the window of the server's clock,
+// and a nonce seen within the window is rejected with 409. Together with
+// request signing this stops a captured, once-allowed event from being
+// replayed. Tuning the window:
+//   - It must exceed the worst clock skew between dispatcher and server plus
+//     the longest delivery delay, including dispatcher retries, or honest
+//     events are rejected as stale.
+//   - Nonces are remembered for one window, so memory grows with event rate
+//     times window; -replay-max-nonces caps it. If the cap is reached the
+//     oldest nonces are forgotten early, and because the event time check
+//     still applies, that only reopens replays for events inside the window.
+//
+// A minute is a reasonable default for a dispatcher on the same host.
+type ReplayGuard struct {
+	mu        sync.Mutex
+	window    time.Duration
+	maxNonces int
+	seen      map[string]time.Time
+	order     *list.List // nonces in arrival order, for expiry and eviction
+}
+
+var replayGuard *ReplayGuard
+
+func NewReplayGuard(window time.Duration, maxNonces int) *ReplayGuard {
+	return &ReplayGuard{window: window, maxNonces: maxNonces, seen: make(map[string]time.Time), order: list.New()}
+}
+
+// Check records nonce and reports an error if the event is stale, from the
+// future, missing a nonce, or a replay.
+func (g *ReplayGuard) Check(nonce, eventTime string) error {
+	if nonce == "" {
+		return fmt.Errorf("event has no nonce")
+	}
+	at, err := time.Parse(time.RFC3339Nano, eventTime)
+	if err != nil {
+		return fmt.Errorf("event time %q is missing or invalid", eventTime)
+	}
+	now := time.Now()
+	if skew := now.Sub(at); skew > g.window || skew < -g.window {
+		return fmt.Errorf("event time %s is outside the %s replay window", eventTime, g.window)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for front := g.order.Front(); front != nil && now.Sub(g.seen[front.Value.(string)]) > g.window; front = g.order.Front() {
+		delete(g.seen, g.order.Remove(front).(string))
+	}
+	if _, ok := g.seen[nonce]; ok {
+		return fmt.Errorf("replayed event nonce")
+	}
+	// Make room only after the replay check, so the oldest nonce is still
+	// caught when the guard is full.
+	for g.order.Len() > 0 && g.order.Len() >= g.maxNonces {
+		delete(g.seen, g.order.Remove(g.order.Front()).(string))
+	}
+	g.seen[nonce] = now
+	g.order.PushBack(nonce)
+	return nil
+}
+
+// Dispatch hooks: Extension points for custom logic around routing without
+// patching webhookHandler, analogous to HTTP middleware. Register them at
+// build time, typically from an init function:
+//
+//	func init() {
+//		RegisterPreDispatch(func(e CloudEvent) (CloudEvent, error) {
+//			e.Data["team"] = "platform"
+//			return e, nil
+//		})
+//	}
+//
+// Pre-dispatch hooks run in registration order after parsing and tool name
+// normalization; each receives the previous hook's output. An error stops
+// the chain and the event is blocked (fail closed), since a half-enriched
+// event could mislead the handlers. Post-dispatch hooks run in registration
+// order after the handler. An error blocks the event with the error as the
+// reason, so a broken auditing or veto hook can never silently allow.
+type (
+	PreDispatchFunc  func(event CloudEvent) (CloudEvent, error)
+	PostDispatchFunc func(event CloudEvent, response Response) (Response, error)
+)
+
+var (
+	preDispatchHooks  []PreDispatchFunc
+	postDispatchHooks []PostDispatchFunc
+)
+
+func RegisterPreDispatch(fn PreDispatchFunc) {
+	preDispatchHooks = append(preDispatchHooks, fn)
+}
+
+func RegisterPostDispatch(fn PostDispatchFunc) {
+	postDispatchHooks = append(postDispatchHooks, fn)
+}
+
+func runPreDispatch(event CloudEvent) (CloudEvent, error) {
+	for _, hook := range preDispatchHooks {
+		var err error
+		if event, err = hook(event); err != nil {
+			return event, err
+		}
+	}
+	return event, nil
+}
+
+func runPostDispatch(event CloudEvent, response Response) Response {
+	for _, hook := range postDispatchHooks {
+		next, err := hook(event, response)
+		if err != nil {
+			slog.Error("Post-dispatch hook failed", "error", SanitizeText(err.Error()))
+			return Response{
+				Version:   "1.0",
+				Decision:  "block",
+				Reason:    "Hook server rejected this event: " + err.Error(),
+				Timestamp: time.Now().Format(time.RFC3339),
+			}
+		}
+		response = next
+	}
+	return response
+}
+
+// Stats holds server-wide counters reported by /stats. Fields are atomic
+// so handlers can update them without sharing a lock.
+type Stats struct {
+	Requests    atomic.Int64
+	ShedEvents  atomic.Int64
+	RateLimited atomic.Int64
+	Coalesced   atomic.Int64
+
+	// Shadow evaluation (see shadowServer).
+	ShadowCompared  atomic.Int64
+	ShadowDisagreed atomic.Int64
+	ShadowDropped   atomic.Int64
+
+	// Decisions per tool and per session. Both label values come from the
+	// event, so each is capped to keep a hostile session from growing them
+	// without bound.
+	ByTool    *labeledCounter
+	BySession *labeledCounter
+}
+
+var stats = Stats{
+	ByTool:    newLabeledCounter(64),
+	BySession: newLabeledCounter(1000),
+}
+
+// overflowLabel collects counts for label values seen after a counter's
+// limit of distinct values was reached.
+const overflowLabel = "other"
+
+// labeledCounter counts events per label value, tracking at most limit
+// distinct values (0 for no limit); later values are bucketed into "other".
+type labeledCounter struct {
+	mu     sync.Mutex
+	limit  int
+	counts map[string]int64
+}
+
+func newLabeledCounter(limit int) *labeledCounter {
+	return &labeledCounter{limit: limit, counts: make(map[string]int64)}
+}
+
+func (c *labeledCounter) inc(label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.counts[label]; !ok && c.limit > 0 && len(c.counts) >= c.limit {
+		label = overflowLabel
+	}
+	c.counts[label]++
+}
+
+func (c *labeledCounter) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int64, len(c.counts))
+	for label, n := range c.counts {
+		counts[label] = n
+	}
+	return counts
+}
+
+// recordDecisionStats counts a decision under its tool and session labels.
+func recordDecisionStats(event CloudEvent) {
+	if toolName, ok := event.Data["tool_name"].(string); ok && toolName != "" {
+		stats.ByTool.inc(toolName)
+	}
+	if event.SessionID != "" {
+		stats.BySession.inc(event.SessionID)
+	}
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	var auditDropped map[string]int64
+	if audit != nil {
+		auditDropped = audit.droppedCounts()
+	}
+	var sloStatus *SLOStatus
+	if slo != nil {
+		status := slo.status()
+		sloStatus = &status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"requests":      stats.Requests.Load(),
+		"shed_events":   stats.ShedEvents.Load(),
+		"rate_limited":  stats.RateLimited.Load(),
+		"coalesced":     stats.Coalesced.Load(),
+		"by_tool":       stats.ByTool.snapshot(),
+		"by_session":    stats.BySession.snapshot(),
+		"audit_dropped": auditDropped,
+		"shadow": map[string]int64{
+			"compared":      stats.ShadowCompared.Load(),
+			"disagreements": stats.ShadowDisagreed.Load(),
+			"dropped":       stats.ShadowDropped.Load(),
+		},
+		"slo": sloStatus,
+	})
+}
+
+// tokenBucket is a minimal token-bucket limiter: It holds up to burst
+// tokens, refills at rate tokens per second, and each allowed event spends
+// one token. Safe for concurrent use.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Global load shedding: A safety valve for when Claude emits events at an
+// absurd rate. Events over -max-event-rate are resolved without running any
+// handler, using -shed-decision: "block" or "allow" answer directly, while
+// "fail" returns 503 so the dispatcher applies its own fail-open/closed mode.
+// This limit is checked before any per-session limit, so a single session
+// can never be the reason the global valve stays open.
+var (
+	eventLimiter *tokenBucket
+	shedDecision = "fail"
+)
+
+func parseShedDecision(value string) (string, error) {
+	switch value {
+	case "", "fail":
+		return "fail", nil
+	case "allow", "block":
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid shed decision %q: expected fail, allow, or block", value)
+	}
+}
+
+// shedEvent writes the response for an event rejected by the global limiter.
+// The body is never read, so the decision is recorded without an event.
+func shedEvent(w http.ResponseWriter, r *http.Request) {
+	stats.ShedEvents.Add(1)
+	if shedDecision == "fail" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "event rate limit exceeded"})
+		return
+	}
+	response := Response{
+		Version:   "1.0",
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	if shedDecision == "block" {
+		response.Decision = "block"
+		response.Reason = "Hook server is shedding load; try again shortly"
+	}
+	writeDecision(w, r, CloudEvent{}, response)
+}
+
+// Per-session rate limiting: One runaway session (a loop re-running the
+// same tool) shouldn't be able to starve the others. Each session ID gets
+// its own tokenBucket with -session-rate and -session-burst; over the limit
+// the event is blocked with 429. Buckets idle longer than -session-idle
+// are swept lazily so abandoned sessions don't accumulate.
+type sessionLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     int
+	idle      time.Duration
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+var sessionLimits *sessionLimiter
+
+func newSessionLimiter(rate float64, burst int, idle time.Duration) *sessionLimiter {
+	return &sessionLimiter{
+		rate:      rate,
+		burst:     burst,
+		idle:      idle,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow reports whether sessionID may send another event. Events without a
+// session ID share a single bucket.
+func (l *sessionLimiter) allow(sessionID string) bool {
+	l.mu.Lock()
+	now := time.Now()
+	if l.idle > 0 && now.Sub(l.lastSweep) >= l.idle {
+		l.sweep(now)
+	}
+	bucket, ok := l.buckets[sessionID]
+	if !ok {
+		bucket = newTokenBucket(l.rate, l.burst)
+		l.buckets[sessionID] = bucket
+	}
+	l.mu.Unlock()
+	return bucket.allow()
+}
+
+// sweep drops buckets that haven't been used for l.idle. Called with l.mu
+// held.
+func (l *sessionLimiter) sweep(now time.Time) {
+	for id, bucket := range l.buckets {
+		bucket.mu.Lock()
+		idle := now.Sub(bucket.last) >= l.idle
+		bucket.mu.Unlock()
+		if idle {
+			delete(l.buckets, id)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimited writes the 429 response for an event over its session's
+// limit. Like a failed shed, it answers before any policy runs, so nothing
+// is recorded beyond the counter in /stats.
+func rateLimited(w http.ResponseWriter) {
+	stats.RateLimited.Add(1)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]string{"decision": "block", "reason": "rate limited"})
+}
+
+// writeDecision sends every decision webhookHandler makes, including the
+// early blocks, so each one is sanitized, counted, remembered in the
+// session, audited, and shaped the way the client asked for.
+func writeDecision(w http.ResponseWriter, r *http.Request, event CloudEvent, response Response) {
+	response = sanitizeResponse(response)
+	recordDecisionStats(event)
+	logDecision(event, response)
+	if event.Type != "com.claudecode.hook.Stop" && event.Type != "com.claudecode.hook.SessionEnd" {
+		sessions.recordOutcome(event, response)
+	}
+	if audit != nil {
+		audit.record(event, response)
+	}
+	if cloudEventsResponses || acceptsCloudEvents(r) {
+		w.Header().Set("Content-Type", "application/cloudevents+json")
+		json.NewEncoder(w).Encode(wrapDecision(event, response))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CloudEvents responses: For tooling that consumes CloudEvents everywhere,
+// decisions can be returned as an envelope of type
+// com.claudecode.hook.Decision whose data is the usual Response and whose
+// "requestid" extension names the event being answered. Enabled for every
+// request with -cloudevents-response, or per request when the client sends
+// Accept: application/cloudevents+json.
+const decisionEventType = "com.claudecode.hook.Decision"
+
+var cloudEventsResponses = false
+
+type DecisionEvent struct {
+	SpecVersion     string   `json:"specversion"`
+	Type            string   `json:"type"`
+	Source          string   `json:"source"`
+	ID              string   `json:"id"`
+	Time            string   `json:"time,omitempty"`
+	DataContentType string   `json:"datacontenttype,omitempty"`
+	SessionID       string   `json:"sessionid,omitempty"`
+	RequestID       string   `json:"requestid,omitempty"`
+	Data            Response `json:"data"`
+}
+
+func acceptsCloudEvents(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/cloudevents+json")
+}
+
+func wrapDecision(event CloudEvent, response Response) DecisionEvent {
+	return DecisionEvent{
+		SpecVersion:     "1.0",
+		Type:            decisionEventType,
+		Source:          "/claude-code/hooks/server",
+		ID:              newEventID(),
+		Time:            time.Now().UTC().Format(time.RFC3339),
+		DataContentType: "application/json",
+		SessionID:       event.SessionID,
+		RequestID:       event.ID,
+		Data:            response,
+	}
+}
+
+// decodeDecision parses a decision in either shape: a bare Response or a
+// com.claudecode.hook.Decision envelope. Consumers of this server's output
+// (or of another server's) can use it without knowing which was sent.
+func decodeDecision(body []byte) (Response, error) {
+	var probe struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return Response{}, err
+	}
+	if probe.Type == decisionEventType {
+		var envelope DecisionEvent
+		if err := json.Unmarshal(body, &envelope); err != nil {
+			return Response{}, err
+		}
+		return envelope.Data, nil
+	}
+	var response Response
+	if err := json.Unmarshal(body, &response); err != nil {
+		return Response{}, err
+	}
+	return response, nil
+}
+
+// newEventID returns a random identifier suitable for a CloudEvents id.
+func newEventID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Decision engines: The handlers above are one way to decide; a deployment
+// with its own policy logic can replace them without forking by installing
+// a DecisionEngine from an init function:
+//
+//	func init() {
+//		SetDecisionEngine(ChainEngine{DefaultEngine{}, myEngine{}})
+//	}
+//
+// The engine replaces only the routing to handlers. Post actions,
+// post-dispatch hooks and the checks in webhookHandler apply to its
+// responses as they do to the built-in ones. An engine error blocks the
+// event (fail closed).
+type DecisionEngine interface {
+	Evaluate(ctx context.Context, event CloudEvent) (Response, error)
+}
+
+// SetDecisionEngine installs e for the /hook endpoint.
+func SetDecisionEngine(e DecisionEngine) {
+	hooks.engine = e
+}
+
+// DefaultEngine routes each event to the built-in handler for its type.
+type DefaultEngine struct{}
+
+func (DefaultEngine) Evaluate(ctx context.Context, event CloudEvent) (Response, error) {
+	// Route to appropriate handler based on CloudEvents type: This dispatcher
+	// pattern makes it easy to add new event types as Claude Code evolves.
+	var response Response
+	switch event.Type {
+	case "com.claudecode.hook.PreToolUse":
+		response = cachedDecision(event, handlePreToolUse)
+	case "com.claudecode.hook.PostToolUse":
+		response = handlePostToolUse(event)
+	case "com.claudecode.hook.UserPromptSubmit":
+		response = applyPromptReminders(handleUserPromptSubmit(event))
+	case "com.claudecode.hook.Notification":
+		response = handleNotification(event)
+	case "com.claudecode.hook.Stop":
+		response = handleStop(event)
+	case "com.claudecode.hook.SubagentStop":
+		response = handleSubagentStop(event)
+	case "com.claudecode.hook.PreCompact":
+		response = handlePreCompact(event)
+	case "com.claudecode.hook.SessionStart":
+		response = handleSessionStart(event)
+	case "com.claudecode.hook.SessionEnd":
+		response = handleSessionEnd(event)
+	default:
+		if handler, ok := customEventHandlers[event.Type]; ok {
+			response = handler(event)
+		} else {
+			response = handleUnknownEvent(event)
+		}
+	}
+	return response, nil
+}
+
+// ChainEngine asks each engine in turn and keeps the strictest answer: a
+// block (or deny) beats ask, which beats anything else, and ties go to the
+// earlier engine. A block ends the chain, since nothing can outrank it; an
+// error from any engine fails the whole chain.
+type ChainEngine []DecisionEngine
+
+func (c ChainEngine) Evaluate(ctx context.Context, event CloudEvent) (Response, error) {
+	best := Response{Version: "1.0", Timestamp: time.Now().Format(time.RFC3339)}
+	bestRank := -1
+	for _, e := range c {
+		response, err := e.Evaluate(ctx, event)
+		if err != nil {
+			return Response{}, err
+		}
+		if rank := decisionPrecedence(response); rank > bestRank {
+			best, bestRank = response, rank
+		}
+		if bestRank == precedenceBlock {
+			break
+		}
+	}
+	return best, nil
+}
+
+const (
+	precedenceAllow = iota
+	precedenceAsk
+	precedenceBlock
+)
+
+func decisionPrecedence(response Response) int {
+	switch effectiveDecision(response) {
+	case "block", "deny":
+		return precedenceBlock
+	case "ask":
+		return precedenceAsk
+	default:
+		return precedenceAllow
+	}
+}
+
+// decide evaluates an event with the handler's engine and post-processes
+// the result into the final decision.
+func (h *webhookHandler) decide(ctx context.Context, event CloudEvent) Response {
+	sessions.touch(event.SessionID, time.Now())
+
+	response, err := h.engine.Evaluate(ctx, event)
+	if err != nil {
+		slog.Error("Decision engine failed", "event_type", event.Type, "session_id", SanitizeText(event.SessionID),
+			"error", SanitizeText(err.Error()))
+		response = Response{
+			Version:   "1.0",
+			Decision:  "block",
+			Reason:    "Hook server could not evaluate this event",
+			Timestamp: time.Now().Format(time.RFC3339),
+		}
+	}
+
+	// Translate post actions, then run post-dispatch hooks: Hooks see the
+	// response as Claude will, and may audit or veto it.
+	response = applyPostActions(event, response)
+	response = runPostDispatch(event, response)
+	if response.PolicyURL != "" {
+		if err := validPolicyURL(response.PolicyURL); err != nil {
+			slog.Warn("Dropping policy link", "event_type", event.Type, "error", SanitizeText(err.Error()))
+			response.PolicyURL = ""
+		}
+	}
+	return response
+}
+
+// Request coalescing: A minimal singleflight. Concurrent calls with the same
+// key wait for the first caller's result instead of evaluating again. The
+// key includes the session id because decisions can depend on session state
+// (deferrals, parent links), so identical events from different sessions
+// are never merged.
+var coalesceEvents = false
+
+type flightCall struct {
+	done     chan struct{}
+	response Response
+}
+
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+var inflight = &flightGroup{calls: make(map[string]*flightCall)}
+
+// do runs fn once per key among concurrent callers and reports whether the
+// result was shared from another caller's evaluation.
+func (g *flightGroup) do(key string, fn func() Response) (Response, bool) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.response, true
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.response = fn()
+	return call.response, false
+}
+
+func coalesceKey(event CloudEvent) string {
+	data, _ := json.Marshal(event.Data)
+	sum := sha256.Sum256([]byte(event.Type + "\x00" + event.SessionID + "\x00" +
+		strings.Join(event.Languages, ",") + "\x00" + string(data)))
+	return hex.EncodeToString(sum[:])
+}
+
+// webhookHandler serves /hook, deciding with its engine.
+type webhookHandler struct {
+	engine DecisionEngine
+}
+
+// hooks is the /hook endpoint; SetDecisionEngine replaces its engine.
+var hooks = &webhookHandler{engine: DefaultEngine{}}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stats.Requests.Add(1)
+	if slo != nil {
+		defer slo.observe(time.Now())
+	}
+
+	// Contain panics: A bug triggered by one malformed event should fail that
+	// request, not leave the dispatcher waiting on a dropped connection.
+	defer func() {
+		if err := recover(); err != nil {
+			slog.Error("Panic handling event", "error", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+		}
+	}()
+
+	// Shed load before doing any work: Under a flood, even parsing the
+	// body is work we'd rather not do for an event we're going to reject.
+	if eventLimiter != nil && !eventLimiter.allow() {
+		shedEvent(w, r)
+		return
+	}
+
+	// Read request body: We read the entire body at once since hook payloads
+	// are typically small and this simplifies error handling.
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// Authenticate before parsing: A forged request shouldn't reach even
+	// the JSON decoder.
+	if len(webhookSecret) > 0 && !verifySignature(webhookSecret, body, r.Header.Get(signatureHeader)) {
+		http.Error(w, "Invalid or missing signature", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse JSON (CloudEvents format): The incoming data follows the CloudEvents
+	// specification, providing a consistent envelope for all event types.
+	event, err := decodeCloudEvent(body)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := validateCloudEvent(event); err != nil {
+		http.Error(w, "Invalid CloudEvent: "+SanitizeText(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// Per-session limit: Checked as soon as the session is known, and
+	// before decryption, which is the most expensive step that follows.
+	if sessionLimits != nil && !sessionLimits.allow(event.SessionID) {
+		rateLimited(w)
+		return
+	}
+
+	// Decrypt before anything reads the data: With a key configured, every
+	// event must arrive encrypted.
+	if decryptKey != nil {
+		if err := decryptEventData(&event, decryptKey); err != nil {
+			http.Error(w, SanitizeText(err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Reject a corrupt rawdata attribute up front: Handlers that rely on the
+	// original bytes should never see an event whose copy can't be decoded.
+	if _, _, err := rawInput(event); err != nil {
+		http.Error(w, "Invalid rawdata attribute", http.StatusBadRequest)
+		return
+	}
+	if _, err := forwardedEnv(event); err != nil {
+		http.Error(w, "Invalid forwardedenv attribute", http.StatusBadRequest)
+		return
+	}
+	if _, err := packageRisks(event); err != nil {
+		http.Error(w, "Invalid packagerisk attribute", http.StatusBadRequest)
+		return
+	}
+
+	// Reject replays before any policy runs: A captured event that was once
+	// allowed must not be accepted a second time.
+	if replayGuard != nil {
+		if err := replayGuard.Check(event.Nonce, event.Time); err != nil {
+			http.Error(w, SanitizeText(err.Error()), http.StatusConflict)
+			return
+		}
+	}
+
+	// Normalize field spellings first: Everything after this point, including
+	// session correlation, reads the snake_case names.
+	normalizeFieldNames(event.Data)
+
+	// Correlate subagents with their parent session: Tree-aware policies and
+	// per-session aggregation need the link before any handler runs.
+	correlateParentSession(&event)
+
+	event.Languages = parseAcceptLanguage(r.Header.Get("Accept-Language"))
+
+	// Carry the dispatcher's deadline: A malformed header is ignored rather
+	// than rejected, since it only limits how much optional work is done.
+	if header := r.Header.Get("Cchd-Timeout"); header != "" {
+		if timeout, err := parseTimeoutHeader(header); err == nil {
+			event.Deadline = time.Now().Add(timeout)
+		} else {
+			slog.Warn("Ignoring Cchd-Timeout header", "error", err)
+		}
+	}
+
+	// Normalize the tool name before routing: Handlers match on canonical
+	// names, so this is the single place upstream naming churn is absorbed.
+	if toolName, ok := event.Data["tool_name"].(string); ok {
+		event.Data["tool_name"] = NormalizeToolName(toolName)
+	}
+
+	// Run pre-dispatch hooks: They see the normalized event and may enrich
+	// it before validation and routing.
+	event, err = runPreDispatch(event)
+	if err != nil {
+		slog.Error("Pre-dispatch hook failed", "error", SanitizeText(err.Error()))
+		writeDecision(w, r, event, Response{
+			Version:   "1.0",
+			Decision:  "block",
+			Reason:    "Hook server failed to prepare this event",
+			Timestamp: time.Now().Format(time.RFC3339),
+		})
+		return
+	}
+
+	// Check the data has the shape its event type promises: The policy
+	// decides whether drift fails closed or is only logged.
+	if err := checkEventData(event); err != nil && malformedDataPolicy != "allow" {
+		slog.Warn("Malformed event data", "event_type", event.Type, "session_id", SanitizeText(event.SessionID),
+			"error", SanitizeText(err.Error()))
+		if malformedDataPolicy == "block" {
+			writeDecision(w, r, event, Response{
+				Version:   "1.0",
+				Decision:  "block",
+				Reason:    renderReason("malformed-data", event, err.Error()),
+				Timestamp: time.Now().Format(time.RFC3339),
+			})
+			return
+		}
+	}
+
+	// Validate tool input against the advertised schema: A malformed input
+	// is answered with a block so Claude sees why, rather than an HTTP error.
+	if validateToolInputs && event.Type == "com.claudecode.hook.PreToolUse" {
+		toolName, _ := event.Data["tool_name"].(string)
+		if err := validateToolInput(toolName, event.Data["tool_input"]); err != nil {
+			writeDecision(w, r, event, Response{
+				Version:   "1.0",
+				Decision:  "block",
+				Reason:    renderReason("invalid-tool-input", event, err.Error()),
+				Timestamp: time.Now().Format(time.RFC3339),
+			})
+			return
+		}
+	}
+
+	// Look up the packages an install command pulls in, so policies can
+	// weigh known advisories.
+	enrichPackageRisk(&event)
+
+	// Decide: Identical in-flight events share one evaluation when
+	// coalescing is enabled, so parallel subagents reading the same file
+	// cost one decision instead of several.
+	var response Response
+	if coalesceEvents {
+		var shared bool
+		// The evaluation is shared, so it must not end when the first
+		// request's client goes away.
+		ctx := context.WithoutCancel(r.Context())
+		response, shared = inflight.do(coalesceKey(event), func() Response { return h.decide(ctx, event) })
+		if shared {
+			stats.Coalesced.Add(1)
+		}
+	} else {
+		response = h.decide(r.Context(), event)
+	}
+
+	// Record deferrals in session state: The tool still runs, so a defer that
+	// accompanies a block is meaningless and dropped.
+	if response.Defer != nil {
+		if response.Decision == "block" {
+			response.Defer = nil
+		} else {
+			// Copy before filling in defaults: a coalesced response is
+			// shared with other requests.
+			deferral := *response.Defer
+			if deferral.Until == "" {
+				deferral.Until = "PostToolUse"
+			}
+			response.Defer = &deferral
+			sessions.recordDeferral(event.SessionID, toolInvocationKey(event), deferral)
+		}
+	}
+
+	// Send response: All responses use JSON format to maintain consistency
+	// with the CloudEvents input format. The shadow only sees events that
+	// reached the policy, since the early blocks above are not its concern.
+	if shadow != nil {
+		shadow.compare(event, sanitizeResponse(response))
+	}
+	writeDecision(w, r, event, response)
+}
+
+// Health endpoints: Orchestrators like Kubernetes probe liveness and
+// readiness separately. Liveness only proves the process is serving HTTP,
+// while readiness also reflects whether the server can make decisions, so a
+// pod that is starting up or draining stops receiving hook traffic.
+var ready atomic.Bool
+
+// readinessChecks are consulted by /readyz. Components that depend on
+// something external register a check here; a non-nil error marks the
+// server unready and is reported in the response body.
+var readinessChecks = map[string]func() error{}
+
+// registerReadinessChecks adds the checks for the configured audit sinks
+// and shadow server.
+func registerReadinessChecks() {
+	if audit != nil {
+		for _, b := range audit.sinks {
+			readinessChecks["audit "+b.name] = b.check
+		}
+	}
+	if shadow != nil {
+		readinessChecks["shadow"] = shadow.check
+	}
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	failures := map[string]string{}
+	if !ready.Load() {
+		failures["server"] = "not accepting hook traffic"
+	}
+	for name, check := range readinessChecks {
+		if err := check(); err != nil {
+			failures[name] = err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "unavailable",
+			"checks": failures,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
+
+// Logging: Server logs go to stderr through log/slog, as JSON by default
+// (-log-format text for a terminal) so aggregators can index their fields.
+// Every hook request produces one Info line with its outcome, see
+// logDecision; the handlers' detail lines, which include tool inputs and
+// prompts, are Debug.
+func configureLogging(format, level string) error {
+	var logLevel slog.Level
+	if level != "" {
+		if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("invalid -log-level %q: expected debug, info, warn, or error", level)
+		}
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format {
+	case "", "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid -log-format %q: expected json or text", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// logDecision writes the per-request log line. correlation_id is the
+// event's correlationid attribute, which ties a PreToolUse to its
+// PostToolUse, or the event id when the dispatcher sent none, so every line
+// can be joined to the audit log.
+func logDecision(event CloudEvent, response Response) {
+	correlationID := event.CorrelationID
+	if correlationID == "" {
+		correlationID = event.ID
+	}
+	attrs := []interface{}{
+		"event_type", SanitizeText(strings.TrimPrefix(event.Type, "com.claudecode.hook.")),
+		"event_id", SanitizeText(event.ID),
+		"correlation_id", SanitizeText(correlationID),
+		"session_id", SanitizeText(event.SessionID),
+	}
+	if toolName, _ := event.Data["tool_name"].(string); toolName != "" {
+		attrs = append(attrs, "tool_name", SanitizeText(toolName))
+	}
+	attrs = append(attrs, "decision", effectiveDecision(response))
+	reason := response.Reason
+	if reason == "" && response.HookSpecificOutput != nil {
+		reason = response.HookSpecificOutput.PermissionDecisionReason
+	}
+	if reason != "" {
+		attrs = append(attrs, "reason", reason)
+	}
+	slog.Info("Hook decision", attrs...)
+}
+
+// TLS: When the policy server runs on a different host than Claude, serve
+// hooks over HTTPS with -tls-cert and -tls-key (PEM files). Both must be set
+// together; -tls-min-version defaults to 1.2.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig validates the TLS flags and returns the server's tls.Config, or
+// nil when TLS is off. The key pair is loaded here so a bad certificate
+// fails at startup, not on the first handshake.
+func tlsConfig(certFile, keyFile, minVersion string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key must be set together")
+	}
+	if minVersion == "" {
+		minVersion = "1.2"
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid -tls-min-version %q: expected 1.0, 1.1, 1.2, or 1.3", minVersion)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	return &tls.Config{MinVersion: version, Certificates: []tls.Certificate{cert}}, nil
+}
@@ -0,0 +1,234 @@
+// Session state shared by handlers that reason across several events of
+// one Claude session.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session state: Some policies span several events (e.g. a PreToolUse that
+// defers to its PostToolUse), so we keep a small in-memory store keyed by
+// session id. Stop ends a turn, not the session, so state outlives it: A
+// session is dropped once it has sent no event for sessionIdleTimeout.
+type sessionStore struct {
+	mu        sync.Mutex
+	deferred  map[string]map[string]DeferAnnotation
+	parents   map[string]string
+	outcomes  map[string][]Outcome
+	lastSeen  map[string]time.Time
+	lastSweep time.Time
+}
+
+const sessionIdleTimeout = time.Hour
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		deferred: make(map[string]map[string]DeferAnnotation),
+		parents:  make(map[string]string),
+		outcomes: make(map[string][]Outcome),
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+// touch marks a session active and, at most once per sessionIdleTimeout,
+// clears the sessions that have been idle longer than that.
+func (s *sessionStore) touch(sessionID string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sessionID != "" {
+		s.lastSeen[sessionID] = now
+	}
+	if now.Sub(s.lastSweep) < sessionIdleTimeout {
+		return
+	}
+	s.lastSweep = now
+	for id, seen := range s.lastSeen {
+		if now.Sub(seen) > sessionIdleTimeout {
+			s.clearLocked(id)
+		}
+	}
+}
+
+// Outcome is an earlier decision in a session, for policies that depend on
+// what came before, like allowing a Write only after the file was Read.
+// The newest maxSessionOutcomes are kept per session.
+type Outcome struct {
+	EventType     string // without the "com.claudecode.hook." prefix
+	ToolName      string
+	Path          string // resolved file_path or path, if the tool had one
+	CorrelationID string
+	Decision      string // as effectiveDecision reports it
+	Time          time.Time
+}
+
+const maxSessionOutcomes = 256
+
+func (s *sessionStore) recordOutcome(event CloudEvent, response Response) {
+	if event.SessionID == "" {
+		return
+	}
+	outcome := Outcome{
+		EventType:     strings.TrimPrefix(event.Type, "com.claudecode.hook."),
+		CorrelationID: event.CorrelationID,
+		Decision:      effectiveDecision(response),
+		Time:          time.Now(),
+	}
+	outcome.ToolName, _ = event.Data["tool_name"].(string)
+	outcome.Path, _ = resolvedToolPath(event)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := append(s.outcomes[event.SessionID], outcome)
+	if len(history) > maxSessionOutcomes {
+		history = append([]Outcome(nil), history[len(history)-maxSessionOutcomes:]...)
+	}
+	s.outcomes[event.SessionID] = history
+}
+
+// lastOutcome returns the most recent outcome in the session that match
+// accepts. Filter on CorrelationID to stay within one tool chain.
+func (s *sessionStore) lastOutcome(sessionID string, match func(Outcome) bool) (Outcome, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := s.outcomes[sessionID]
+	for i := len(history) - 1; i >= 0; i-- {
+		if match(history[i]) {
+			return history[i], true
+		}
+	}
+	return Outcome{}, false
+}
+
+var sessions = newSessionStore()
+
+// recordDeferral remembers that the tool invocation identified by key was
+// allowed pending a later decision.
+func (s *sessionStore) recordDeferral(sessionID, key string, d DeferAnnotation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deferred[sessionID] == nil {
+		s.deferred[sessionID] = make(map[string]DeferAnnotation)
+	}
+	s.deferred[sessionID][key] = d
+}
+
+// takeDeferral returns and removes a pending deferral so each deferred tool
+// call is scrutinized exactly once.
+func (s *sessionStore) takeDeferral(sessionID, key string) (DeferAnnotation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deferred[sessionID][key]
+	if ok {
+		delete(s.deferred[sessionID], key)
+	}
+	return d, ok
+}
+
+// linkParent records that sessionID is a subagent of parentID. Links that
+// would form a cycle are ignored so rootSession always terminates.
+func (s *sessionStore) linkParent(sessionID, parentID string) {
+	if sessionID == "" || parentID == "" || sessionID == parentID {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := parentID; id != ""; id = s.parents[id] {
+		if id == sessionID {
+			return
+		}
+	}
+	s.parents[sessionID] = parentID
+}
+
+// parentSession returns the recorded parent of a subagent session, or ""
+// for top-level sessions.
+func (s *sessionStore) parentSession(sessionID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.parents[sessionID]
+}
+
+// rootSession walks parent links up to the top-level session, which is the
+// right key for aggregating activity across a whole agent tree.
+func (s *sessionStore) rootSession(sessionID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.parents[sessionID] != "" {
+		sessionID = s.parents[sessionID]
+	}
+	return sessionID
+}
+
+// clear drops all state for a session that has ended.
+func (s *sessionStore) clear(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clearLocked(sessionID)
+}
+
+// clearLocked drops all state for a session, including the parent links of
+// any subagents it spawned. The caller holds s.mu.
+func (s *sessionStore) clearLocked(sessionID string) {
+	delete(s.lastSeen, sessionID)
+	delete(s.deferred, sessionID)
+	delete(s.parents, sessionID)
+	delete(s.outcomes, sessionID)
+	for child, parent := range s.parents {
+		if parent == sessionID {
+			delete(s.parents, child)
+		}
+	}
+}
+
+// correlateParentSession links a subagent event to its parent session and
+// fills in ParentSessionID for handlers. The parent comes from the
+// "parentsessionid" extension attribute, falling back to a parent_session_id
+// field in the data, and finally to a link recorded by an earlier event.
+func correlateParentSession(event *CloudEvent) {
+	if event.ParentSessionID == "" {
+		event.ParentSessionID, _ = event.Data["parent_session_id"].(string)
+	}
+	if event.ParentSessionID != "" {
+		sessions.linkParent(event.SessionID, event.ParentSessionID)
+		return
+	}
+	event.ParentSessionID = sessions.parentSession(event.SessionID)
+}
+
+// forwardedEnv returns the environment variables the dispatcher was told to
+// forward with --forward-env. CloudEvents attributes can't hold maps, so the
+// "forwardedenv" attribute carries them as a JSON object in a string. Only
+// the variables named there are ever sent; the dispatcher never forwards
+// the whole environment. Enabling it is a trade-off: anything forwarded is
+// sent to this server and written to the audit log with the rest of the
+// event, so forward PATH or SHELL, never variables that may hold secrets.
+func forwardedEnv(event CloudEvent) (map[string]string, error) {
+	if event.ForwardedEnv == "" {
+		return nil, nil
+	}
+	var env map[string]string
+	if err := json.Unmarshal([]byte(event.ForwardedEnv), &env); err != nil {
+		return nil, fmt.Errorf("decoding forwardedenv attribute: %w", err)
+	}
+	return env, nil
+}
+
+// toolInvocationKey identifies a single tool call across its PreToolUse and
+// PostToolUse events. We prefer Claude's tool_use_id when present and fall
+// back to hashing the tool name and input, which json.Marshal serializes
+// with sorted keys so identical inputs always hash the same.
+func toolInvocationKey(event CloudEvent) string {
+	if id, ok := event.Data["tool_use_id"].(string); ok && id != "" {
+		return id
+	}
+	toolName, _ := event.Data["tool_name"].(string)
+	input, _ := json.Marshal(event.Data["tool_input"])
+	sum := sha256.Sum256(append([]byte(toolName+"\x00"), input...))
+	return hex.EncodeToString(sum[:])
+}
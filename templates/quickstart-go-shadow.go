@@ -0,0 +1,175 @@
+// Shadow evaluation of a candidate policy alongside the live one.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Shadow evaluation: With -shadow, every event is also sent to a candidate
+// server and its decision compared with this server's, which is the one
+// Claude gets. The comparison runs in the background after the response is
+// written, at most -shadow-concurrency at a time; when the shadow can't
+// keep up, events are skipped rather than queued, so a slow candidate
+// never costs latency. Only disagreements and shadow failures are logged,
+// as JSON lines to -shadow-log (stderr if unset). The shadow receives the
+// decrypted event, so point it only at a server trusted with the data.
+//
+// After shadowBreakerThreshold failures in a row the shadow's circuit opens:
+// events skip it for shadowBreakerCooldown, then a single event probes it
+// again. An open circuit is reported by /readyz, since a rollout comparing
+// against a dead candidate is collecting nothing.
+type shadowServer struct {
+	url    string
+	client *http.Client
+	slots  chan struct{}
+
+	failures  atomic.Int64 // consecutive failed calls
+	openUntil atomic.Int64 // unix nanoseconds; skip the shadow until then
+	lastErr   atomic.Pointer[string]
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+const (
+	shadowBreakerThreshold = 5
+	shadowBreakerCooldown  = 30 * time.Second
+)
+
+// ShadowRecord is one logged disagreement, or a failed shadow call.
+type ShadowRecord struct {
+	Time           string `json:"time"`
+	EventID        string `json:"event_id"`
+	EventType      string `json:"event_type"`
+	SessionID      string `json:"session_id,omitempty"`
+	ToolName       string `json:"tool_name,omitempty"`
+	Decision       string `json:"decision"`
+	Reason         string `json:"reason,omitempty"`
+	ShadowDecision string `json:"shadow_decision,omitempty"`
+	ShadowReason   string `json:"shadow_reason,omitempty"`
+	ShadowError    string `json:"shadow_error,omitempty"`
+}
+
+var shadow *shadowServer
+
+func newShadowServer(url string, concurrency int, timeout time.Duration, out io.Writer) *shadowServer {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	// Keep a connection per slot: The default of two idle connections per
+	// host would close and reopen the rest on every event.
+	transport := &http.Transport{MaxIdleConnsPerHost: concurrency}
+	return &shadowServer{
+		url:    url,
+		client: &http.Client{Timeout: timeout, Transport: transport},
+		slots:  make(chan struct{}, concurrency),
+		out:    out,
+	}
+}
+
+// compare sends event to the shadow in the background.
+func (s *shadowServer) compare(event CloudEvent, response Response) {
+	// While the circuit is open only the first event after the cooldown,
+	// which wins the swap, gets through as a probe.
+	if until := s.openUntil.Load(); until != 0 {
+		now := time.Now()
+		if now.UnixNano() < until || !s.openUntil.CompareAndSwap(until, now.Add(shadowBreakerCooldown).UnixNano()) {
+			stats.ShadowDropped.Add(1)
+			return
+		}
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		stats.ShadowDropped.Add(1)
+		return
+	}
+	go func() {
+		defer func() { <-s.slots }()
+		record := newAuditRecord(event, response)
+		entry := ShadowRecord{
+			Time:      record.Time,
+			EventID:   record.EventID,
+			EventType: record.EventType,
+			SessionID: record.SessionID,
+			ToolName:  record.ToolName,
+			Decision:  record.Decision,
+			Reason:    record.Reason,
+		}
+		candidate, err := s.decide(event)
+		stats.ShadowCompared.Add(1)
+		if err != nil {
+			entry.ShadowError = SanitizeText(err.Error())
+			s.lastErr.Store(&entry.ShadowError)
+			if s.failures.Add(1) >= shadowBreakerThreshold {
+				s.openUntil.Store(time.Now().Add(shadowBreakerCooldown).UnixNano())
+			}
+		} else {
+			s.failures.Store(0)
+			s.openUntil.Store(0)
+			entry.ShadowDecision = effectiveDecision(candidate)
+			entry.ShadowReason = candidate.Reason
+			if entry.ShadowDecision == entry.Decision {
+				return
+			}
+			stats.ShadowDisagreed.Add(1)
+		}
+		s.log(entry)
+	}()
+}
+
+func (s *shadowServer) decide(event CloudEvent) (Response, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return Response{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return Response{}, err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	req.Header.Set("Accept", "application/json")
+	signRequest(req, body)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return Response{}, err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return Response{}, fmt.Errorf("shadow returned %s", resp.Status)
+	}
+	var candidate Response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&candidate); err != nil {
+		return Response{}, fmt.Errorf("decoding shadow response: %w", err)
+	}
+	return candidate, nil
+}
+
+// check is the shadow's readiness check: it fails while the circuit is open.
+func (s *shadowServer) check() error {
+	if n := s.failures.Load(); n >= shadowBreakerThreshold {
+		return fmt.Errorf("circuit open after %d consecutive failures: %s", n, *s.lastErr.Load())
+	}
+	return nil
+}
+
+func (s *shadowServer) log(entry ShadowRecord) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.out.Write(append(line, '\n')); err != nil {
+		slog.Error("Writing shadow log", "error", err)
+	}
+}
@@ -0,0 +1,130 @@
+// Latency SLO tracking and the "slo-check" subcommand.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency SLO: With -slo-target, the server tracks how many decisions take
+// longer than the target. The objective (-slo-objective, e.g. 0.99) leaves
+// an error budget of 1-objective of events that may be slow. The window
+// (-slo-window) is a sliding one made of one-minute buckets: at any moment
+// the budget covers the events of the last window-worth of whole minutes
+// plus the current minute, and older minutes fall out as time passes.
+// budget_consumed is slow events divided by the slow events the budget
+// allows, so 1 means the budget is spent. /stats reports it under "slo",
+// and "slo-check" turns it into an exit status for CI.
+type sloTracker struct {
+	mu        sync.Mutex
+	target    time.Duration
+	objective float64
+	buckets   []sloBucket
+}
+
+type sloBucket struct {
+	minute     int64
+	events     int64
+	slowEvents int64
+}
+
+// SLOStatus is the tracker's view of the current window.
+type SLOStatus struct {
+	TargetMS       int64   `json:"target_ms"`
+	Objective      float64 `json:"objective"`
+	Window         string  `json:"window"`
+	Events         int64   `json:"events"`
+	SlowEvents     int64   `json:"slow_events"`
+	BudgetConsumed float64 `json:"budget_consumed"`
+}
+
+var slo *sloTracker
+
+func newSLOTracker(target time.Duration, objective float64, window time.Duration) *sloTracker {
+	minutes := int(window / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	return &sloTracker{target: target, objective: objective, buckets: make([]sloBucket, minutes+1)}
+}
+
+// observe records one decision that started at start.
+func (s *sloTracker) observe(start time.Time) {
+	now := time.Now()
+	minute := now.Unix() / 60
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := &s.buckets[minute%int64(len(s.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.events++
+	if now.Sub(start) > s.target {
+		b.slowEvents++
+	}
+}
+
+func (s *sloTracker) status() SLOStatus {
+	oldest := time.Now().Unix()/60 - int64(len(s.buckets)) + 1
+	status := SLOStatus{
+		TargetMS:  s.target.Milliseconds(),
+		Objective: s.objective,
+		Window:    (time.Duration(len(s.buckets)-1) * time.Minute).String(),
+	}
+	s.mu.Lock()
+	for _, b := range s.buckets {
+		if b.minute >= oldest {
+			status.Events += b.events
+			status.SlowEvents += b.slowEvents
+		}
+	}
+	s.mu.Unlock()
+	if allowed := float64(status.Events) * (1 - s.objective); allowed > 0 {
+		status.BudgetConsumed = float64(status.SlowEvents) / allowed
+	}
+	return status
+}
+
+// runSLOCheck implements "slo-check": it reads a running server's SLO
+// status and exits 1 when the error budget is spent, 2 if it can't tell.
+//
+//	go run . slo-check -server http://localhost:8080
+func runSLOCheck(args []string) int {
+	fs := flag.NewFlagSet("slo-check", flag.ExitOnError)
+	server := fs.String("server", fmt.Sprintf("http://localhost:%d", PORT), "server to check")
+	timeout := fs.Duration("timeout", 5*time.Second, "request timeout")
+	fs.Parse(args)
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get(strings.TrimSuffix(*server, "/") + "/stats")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer resp.Body.Close()
+	var body struct {
+		SLO *SLOStatus `json:"slo"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		fmt.Fprintf(os.Stderr, "decoding /stats: %v\n", err)
+		return 2
+	}
+	if body.SLO == nil {
+		fmt.Fprintln(os.Stderr, "server is not tracking an SLO; start it with -slo-target")
+		return 2
+	}
+	s := body.SLO
+	fmt.Printf("%d of %d events over %dms in the last %s; %.0f%% of the error budget consumed\n",
+		s.SlowEvents, s.Events, s.TargetMS, s.Window, s.BudgetConsumed*100)
+	if s.BudgetConsumed >= 1 {
+		return 1
+	}
+	return 0
+}
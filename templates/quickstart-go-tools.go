@@ -0,0 +1,697 @@
+// Offline subcommands that work against audit logs and running servers:
+// replay, tail, conformance, and bench.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replay: Re-runs audited events through the current policy and reports
+// which decisions would change, e.g. after editing a rule:
+//
+//	go run . replay -since -1h -type PreToolUse audit.log
+//
+// -since and -until take RFC3339 times or durations counted back from now,
+// and combine with -type so a large log can be scoped to one incident
+// window. Rotated .gz files are read transparently. The run ends with a
+// summary of changed decisions by event type and by old->new transition,
+// plus the ids of the changed events; -json prints only that summary, as
+// JSON, for use as a policy-change review artifact.
+type ReplaySummary struct {
+	Replayed    int            `json:"replayed"`
+	Changed     int            `json:"changed"`
+	ByEventType map[string]int `json:"changed_by_event_type"`
+	Transitions map[string]int `json:"transitions"`
+	ChangedIDs  []string       `json:"changed_event_ids"`
+}
+
+func (s *ReplaySummary) add(record AuditRecord, decision string) {
+	s.Replayed++
+	if decision == record.Decision {
+		return
+	}
+	s.Changed++
+	s.ByEventType[strings.TrimPrefix(record.EventType, "com.claudecode.hook.")]++
+	s.Transitions[record.Decision+"->"+decision]++
+	s.ChangedIDs = append(s.ChangedIDs, record.EventID)
+}
+
+func (s *ReplaySummary) print(w io.Writer) {
+	fmt.Fprintf(w, "\n%d events replayed, %d decisions changed\n", s.Replayed, s.Changed)
+	if s.Changed == 0 {
+		return
+	}
+	printCounts := func(title string, counts map[string]int) {
+		keys := make([]string, 0, len(counts))
+		for key := range counts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(w, "\n%s:\n", title)
+		for _, key := range keys {
+			fmt.Fprintf(w, "  %-28s %d\n", key, counts[key])
+		}
+	}
+	printCounts("Changed by event type", s.ByEventType)
+	printCounts("Transitions", s.Transitions)
+	fmt.Fprintf(w, "\nChanged events:\n")
+	for _, id := range s.ChangedIDs {
+		fmt.Fprintf(w, "  %s\n", id)
+	}
+}
+
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	eventType := fs.String("type", "", "only replay this event type (e.g. PreToolUse)")
+	sinceSpec := fs.String("since", "", "only replay events at or after this time (RFC3339 or e.g. -1h)")
+	untilSpec := fs.String("until", "", "only replay events at or before this time (RFC3339 or e.g. -10m)")
+	patternFile := fs.String("patterns", os.Getenv("CCHD_PATTERNS"), "JSON or YAML file of additional security patterns")
+	blockCategories := fs.String("block-categories", os.Getenv("CCHD_BLOCK_CATEGORIES"),
+		"comma-separated command categories to block")
+	asJSON := fs.Bool("json", false, "print only the summary, as JSON")
+	fs.Parse(args)
+
+	now := time.Now()
+	since, err := parseReplayTime(*sinceSpec, now)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	until, err := parseReplayTime(*untilSpec, now)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if securityPatterns, err = loadSecurityPatterns(*patternFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	for _, category := range strings.Split(*blockCategories, ",") {
+		if category = strings.TrimSpace(category); category != "" {
+			blockedCategories[category] = true
+		}
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: replay [flags] AUDIT_LOG...")
+		return 2
+	}
+
+	// Handlers print as they go; silence them so the report stays readable.
+	out := os.Stdout
+	defer silenceLogs()()
+
+	summary := ReplaySummary{ByEventType: map[string]int{}, Transitions: map[string]int{}, ChangedIDs: []string{}}
+	for _, path := range fs.Args() {
+		err := readAuditRecords(path, func(record AuditRecord) {
+			if *eventType != "" && record.EventType != *eventType &&
+				record.EventType != "com.claudecode.hook."+*eventType {
+				return
+			}
+			at, err := time.Parse(time.RFC3339Nano, record.Time)
+			if err != nil || (!since.IsZero() && at.Before(since)) || (!until.IsZero() && at.After(until)) {
+				return
+			}
+			decision := effectiveDecision(hooks.decide(context.Background(), record.Event))
+			summary.add(record, decision)
+			if *asJSON {
+				return
+			}
+			marker := " "
+			if decision != record.Decision {
+				marker = "*"
+			}
+			fmt.Fprintf(out, "%s %s %-28s %-8s -> %-8s %s\n", marker, record.Time,
+				strings.TrimPrefix(record.EventType, "com.claudecode.hook."),
+				record.Decision, decision, record.ToolName)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(summary)
+	} else {
+		summary.print(out)
+	}
+	if summary.Changed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// silenceLogs discards log output until the returned function restores
+// it. The log package's writer is restored too: Installing a slog handler
+// redirects the log package into it, and reinstalling the initial default
+// handler does not undo that.
+func silenceLogs() (restore func()) {
+	logger, out, flags := slog.Default(), log.Writer(), log.Flags()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	return func() {
+		slog.SetDefault(logger)
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	}
+}
+
+// parseReplayTime accepts an RFC3339 timestamp or a duration relative to
+// now; "-1h" and "1h" both mean an hour ago. Empty means unbounded.
+func parseReplayTime(spec string, now time.Time) (time.Time, error) {
+	if spec == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, spec); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(strings.TrimPrefix(spec, "-"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: want RFC3339 or a duration like -1h", spec)
+	}
+	return now.Add(-d), nil
+}
+
+// readAuditRecords calls fn for each record in an audit log file.
+func readAuditRecords(path string, fn func(AuditRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	for {
+		var record AuditRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		fn(record)
+	}
+}
+
+// Tail: "tail" follows an audit log and prints decisions as they are
+// written, optionally filtered by event type, tool, or decision:
+//
+//	go run . tail -audit-log audit.log -decision block
+//
+// The file is polled rather than watched so it works everywhere; when the
+// log is rotated (renamed or truncated) tail reopens the path and carries
+// on from the start of the new file.
+func runTail(args []string) int {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	path := fs.String("audit-log", os.Getenv("CCHD_AUDIT_LOG"), "audit log to follow")
+	eventType := fs.String("type", "", "only show this event type (e.g. PreToolUse)")
+	tool := fs.String("tool", "", "only show this tool")
+	decision := fs.String("decision", "", "only show this decision (e.g. block)")
+	fromStart := fs.Bool("from-start", false, "print existing records before following")
+	interval := fs.Duration("interval", 250*time.Millisecond, "how often to poll for new records")
+	fs.Parse(args)
+	if *path == "" {
+		fmt.Fprintln(os.Stderr, "usage: tail -audit-log FILE [flags]")
+		return 2
+	}
+
+	show := func(record AuditRecord) {
+		if (*eventType != "" && record.EventType != *eventType && record.EventType != "com.claudecode.hook."+*eventType) ||
+			(*tool != "" && record.ToolName != *tool) || (*decision != "" && record.Decision != *decision) {
+			return
+		}
+		line := fmt.Sprintf("%s %-18s %-8s %-10s %s", record.Time,
+			strings.TrimPrefix(record.EventType, "com.claudecode.hook."), record.Decision, record.ToolName, record.SessionID)
+		if record.Reason != "" {
+			line += "\n    " + record.Reason
+		}
+		fmt.Println(SanitizeText(line))
+	}
+
+	var f *os.File
+	var info os.FileInfo
+	var pending []byte
+	var offset int64
+	open := func(seekEnd bool) {
+		var err error
+		if f, err = os.Open(*path); err != nil {
+			f = nil
+			return
+		}
+		info, offset, pending = nil, 0, nil
+		if fi, err := f.Stat(); err == nil {
+			info = fi
+		}
+		if seekEnd {
+			offset, _ = f.Seek(0, io.SeekEnd)
+		}
+	}
+	open(!*fromStart)
+	if f == nil {
+		fmt.Fprintf(os.Stderr, "waiting for %s to appear\n", *path)
+	}
+
+	buf := make([]byte, 64<<10)
+	for {
+		if f == nil {
+			time.Sleep(*interval)
+			open(false)
+			continue
+		}
+		n, err := f.Read(buf)
+		if n > 0 {
+			offset += int64(n)
+			pending = append(pending, buf[:n]...)
+			for {
+				i := bytes.IndexByte(pending, '\n')
+				if i < 0 {
+					break
+				}
+				var record AuditRecord
+				if json.Unmarshal(pending[:i], &record) == nil {
+					show(record)
+				}
+				pending = pending[i+1:]
+			}
+		}
+		if err != nil && err != io.EOF {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if n > 0 {
+			continue
+		}
+
+		// At EOF: reopen if the path now names a different file (rotated by
+		// rename) or the file shrank (truncated in place). Without a good
+		// FileInfo for the open file the comparison would always report a
+		// rotation and reread the file from the start, so it is skipped until
+		// fstat succeeds.
+		time.Sleep(*interval)
+		if info == nil {
+			if info, err = f.Stat(); err != nil {
+				info = nil
+				continue
+			}
+		}
+		current, err := os.Stat(*path)
+		if err != nil {
+			continue // mid-rotation; the new file will appear shortly
+		}
+		if !os.SameFile(info, current) || current.Size() < offset {
+			f.Close()
+			open(false)
+		}
+	}
+}
+
+// Conformance: "conformance" sends a fixed set of test vectors to a hook
+// server and checks each response against the protocol, so the author of a
+// third-party server can verify it before anyone points cchd at it:
+//
+//	go run . conformance -server http://localhost:9000/hook
+//
+// The vectors cover every event type, both response formats (the legacy
+// decision field and hookSpecificOutput), CloudEvents-wrapped decisions, and
+// malformed requests. They constrain the shape of a response, not the
+// policy: a server may allow or block any vector.
+//
+// A server that commits to one format can be held to it with
+// -response-format: "modern" fails PreToolUse decisions given in the
+// legacy decision field, "legacy" fails any permissionDecision, and "auto"
+// (the default) accepts both. This matches the format a dispatcher pinned
+// with --response-format will accept, so a regression shows up here first.
+type conformanceVector struct {
+	Name   string
+	Body   string
+	Accept string
+	// Check validates the status code and body against the -response-format
+	// in use; nil means the default shape check for the vector's event type.
+	Check func(format string, status int, body []byte) error
+}
+
+func conformanceEvent(eventType string, data string) string {
+	return fmt.Sprintf(`{"specversion":"1.0","type":"com.claudecode.hook.%s","source":"/claude-code/hooks","id":"conformance-%s","time":%q,"datacontenttype":"application/json","sessionid":"conformance-session","data":%s}`,
+		eventType, strings.ToLower(eventType), time.Now().UTC().Format(time.RFC3339), data)
+}
+
+var conformanceVectors = []conformanceVector{
+	{Name: "PreToolUse Bash", Body: conformanceEvent("PreToolUse", `{"hook_event_name":"PreToolUse","tool_name":"Bash","tool_input":{"command":"ls -la"}}`)},
+	{Name: "PreToolUse dangerous Bash", Body: conformanceEvent("PreToolUse", `{"hook_event_name":"PreToolUse","tool_name":"Bash","tool_input":{"command":"rm -rf /"}}`)},
+	{Name: "PreToolUse Write", Body: conformanceEvent("PreToolUse", `{"hook_event_name":"PreToolUse","tool_name":"Write","tool_input":{"file_path":"/tmp/conformance.txt","content":"hello"}}`)},
+	{Name: "PreToolUse large integer", Body: conformanceEvent("PreToolUse", `{"hook_event_name":"PreToolUse","tool_name":"Read","tool_input":{"file_path":"/tmp/conformance.txt","offset":9007199254740993}}`)},
+	{Name: "PostToolUse", Body: conformanceEvent("PostToolUse", `{"hook_event_name":"PostToolUse","tool_name":"Bash","tool_input":{"command":"ls"},"tool_response":{"stdout":"file.txt"}}`)},
+	{Name: "UserPromptSubmit", Body: conformanceEvent("UserPromptSubmit", `{"hook_event_name":"UserPromptSubmit","prompt":"Write a hello world program"}`)},
+	{Name: "Notification", Body: conformanceEvent("Notification", `{"hook_event_name":"Notification","title":"Claude Code","message":"Claude needs your permission to use Bash"}`)},
+	{Name: "Stop", Body: conformanceEvent("Stop", `{"hook_event_name":"Stop","stop_hook_active":false}`)},
+	{Name: "SubagentStop", Body: conformanceEvent("SubagentStop", `{"hook_event_name":"SubagentStop","stop_hook_active":false}`)},
+	{Name: "PreCompact", Body: conformanceEvent("PreCompact", `{"hook_event_name":"PreCompact","trigger":"manual","custom_instructions":""}`)},
+	{Name: "SessionStart", Body: conformanceEvent("SessionStart", `{"hook_event_name":"SessionStart","source":"startup"}`)},
+	{Name: "SessionEnd", Body: conformanceEvent("SessionEnd", `{"hook_event_name":"SessionEnd","reason":"prompt_input_exit"}`)},
+	{
+		Name:   "CloudEvents-wrapped decision",
+		Body:   conformanceEvent("PreToolUse", `{"hook_event_name":"PreToolUse","tool_name":"Bash","tool_input":{"command":"ls"}}`),
+		Accept: "application/cloudevents+json",
+	},
+	{Name: "PreToolUse Edit modify", Body: modifyVectorBody, Check: func(format string, status int, body []byte) error {
+		return checkModifyResponse(modifyVectorBody, format, status, body)
+	}},
+	{Name: "malformed JSON", Body: `{"specversion":"1.0",`, Check: expectClientError},
+	{Name: "empty body", Body: ``, Check: expectClientError},
+}
+
+// modifyVectorBody is an Edit a server might rewrite rather than block, the
+// case suggestEdit exists for. Servers are free to allow or block it too;
+// the vector only holds a "modify" answer to what the dispatcher needs.
+var modifyVectorBody = conformanceEvent("PreToolUse", `{"hook_event_name":"PreToolUse","tool_name":"Edit","tool_input":{"file_path":"/tmp/conformance.go","old_string":"h := sha256.New()","new_string":"h := md5.New()"}}`)
+
+// checkModifyResponse runs the shape check and, when the server answers
+// "modify", checks that modified_data is still the request's event data: the
+// dispatcher hands it to Claude in place of the original, so it must keep
+// the hook event and tool name and carry tool_input as an object.
+func checkModifyResponse(request, format string, status int, body []byte) error {
+	var event CloudEvent
+	if err := json.Unmarshal([]byte(request), &event); err != nil {
+		return fmt.Errorf("vector is not a CloudEvent: %v", err)
+	}
+	if err := checkResponseShape(strings.TrimPrefix(event.Type, "com.claudecode.hook."), format, status, body); err != nil {
+		return err
+	}
+	var response map[string]interface{}
+	json.Unmarshal(body, &response)
+	if response["type"] == decisionEventType {
+		response, _ = response["data"].(map[string]interface{})
+	}
+	if response["decision"] != "modify" {
+		return nil
+	}
+	modified := response["modified_data"].(map[string]interface{})
+	for _, field := range []string{"hook_event_name", "tool_name"} {
+		if modified[field] != event.Data[field] {
+			return fmt.Errorf("modified_data.%s is %v, want %v", field, modified[field], event.Data[field])
+		}
+	}
+	if _, ok := modified["tool_input"].(map[string]interface{}); !ok {
+		return fmt.Errorf("modified_data.tool_input is %T, want an object", modified["tool_input"])
+	}
+	return nil
+}
+
+// expectClientError requires a 4xx: the dispatcher treats those as the
+// server rejecting the request, and anything else as a decision or outage.
+func expectClientError(format string, status int, body []byte) error {
+	if status < 400 || status >= 500 {
+		return fmt.Errorf("got HTTP %d, want a 4xx for an invalid request", status)
+	}
+	return nil
+}
+
+// checkResponseShape validates a decision the way the dispatcher reads it.
+func checkResponseShape(eventType, format string, status int, body []byte) error {
+	if status != http.StatusOK {
+		return fmt.Errorf("got HTTP %d, want 200", status)
+	}
+	// An empty 200 carries no decision at all; the dispatcher can only
+	// apply its --on-empty-response policy, so call it out by name.
+	if len(bytes.TrimSpace(body)) == 0 {
+		return fmt.Errorf("response body is empty")
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("response is not a JSON object: %v", err)
+	}
+	if response["type"] == decisionEventType {
+		data, ok := response["data"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("decision event has no data object")
+		}
+		response = data
+	}
+
+	if value, ok := response["decision"]; ok {
+		decision, isString := value.(string)
+		switch {
+		case !isString:
+			return fmt.Errorf("decision is %T, want a string", value)
+		case decision == "modify":
+			if _, ok := response["modified_data"].(map[string]interface{}); !ok {
+				return fmt.Errorf(`decision "modify" without a modified_data object`)
+			}
+		case decision != "allow" && decision != "approve" && decision != "block":
+			return fmt.Errorf("unknown decision %q", decision)
+		case format == "modern" && eventType == "PreToolUse":
+			return fmt.Errorf("legacy decision %q, want hookSpecificOutput.permissionDecision", decision)
+		}
+	}
+	for _, field := range []string{"reason", "status"} {
+		if value, ok := response[field]; ok {
+			if _, isString := value.(string); !isString {
+				return fmt.Errorf("%s is %T, want a string", field, value)
+			}
+		}
+	}
+	if value, ok := response["hookSpecificOutput"]; ok {
+		output, isObject := value.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("hookSpecificOutput is %T, want an object", value)
+		}
+		if name, _ := output["hookEventName"].(string); name != eventType {
+			return fmt.Errorf("hookSpecificOutput.hookEventName is %q, want %q", name, eventType)
+		}
+		if permission, ok := output["permissionDecision"]; ok {
+			if format == "legacy" {
+				return fmt.Errorf("permissionDecision in a legacy-format response")
+			}
+			if eventType != "PreToolUse" {
+				return fmt.Errorf("permissionDecision is only valid for PreToolUse")
+			}
+			switch permission {
+			case "allow", "deny", "ask":
+			default:
+				return fmt.Errorf("unknown permissionDecision %v", permission)
+			}
+		}
+	}
+	return nil
+}
+
+func runConformance(args []string) int {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	server := fs.String("server", fmt.Sprintf("http://localhost:%d/hook", PORT), "hook endpoint to test")
+	timeout := fs.Duration("timeout", 5*time.Second, "per-request timeout")
+	format := fs.String("response-format", "auto", "response format the server must use: modern, legacy, or auto")
+	fs.Parse(args)
+	switch *format {
+	case "modern", "legacy", "auto":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -response-format %q: want modern, legacy, or auto\n", *format)
+		return 2
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	failed := 0
+	for _, v := range conformanceVectors {
+		err := func() error {
+			req, err := http.NewRequest(http.MethodPost, *server, strings.NewReader(v.Body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			signRequest(req, []byte(v.Body))
+			if v.Accept != "" {
+				req.Header.Set("Accept", v.Accept)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			if err != nil {
+				return err
+			}
+			if v.Check != nil {
+				return v.Check(*format, resp.StatusCode, body)
+			}
+			var event CloudEvent
+			json.Unmarshal([]byte(v.Body), &event)
+			return checkResponseShape(strings.TrimPrefix(event.Type, "com.claudecode.hook."), *format, resp.StatusCode, body)
+		}()
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %-30s %v\n", v.Name, err)
+		} else {
+			fmt.Printf("PASS  %s\n", v.Name)
+		}
+	}
+	fmt.Printf("\n%d/%d vectors passed\n", len(conformanceVectors)-failed, len(conformanceVectors))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Bench: "bench" measures a hook server under load before anyone relies on
+// it during a busy session. It sends -events events from -concurrency
+// workers and reports throughput, latency percentiles and the error rate:
+//
+//	go run . bench -server http://localhost:9000/hook -events 5000 -concurrency 16
+//
+// Workers start one by one over -ramp rather than all at once, so a cold
+// server isn't judged on its first second. Events are synthetic unless
+// -sample names an audit log, whose recorded events (up to -sample-size)
+// are sent instead for realistic payloads. Every event gets a fresh id and
+// time, so replay protection doesn't reject the repeats. Non-200 responses
+// and transport failures count as errors, and any error makes bench exit 1.
+var benchEvents = []struct{ eventType, data string }{
+	{"PreToolUse", `{"hook_event_name":"PreToolUse","tool_name":"Bash","tool_input":{"command":"ls -la"}}`},
+	{"PreToolUse", `{"hook_event_name":"PreToolUse","tool_name":"Read","tool_input":{"file_path":"/tmp/bench.txt"}}`},
+	{"PreToolUse", `{"hook_event_name":"PreToolUse","tool_name":"Write","tool_input":{"file_path":"/tmp/bench.txt","content":"hello"}}`},
+	{"PostToolUse", `{"hook_event_name":"PostToolUse","tool_name":"Bash","tool_input":{"command":"ls"},"tool_response":{"stdout":"file.txt"}}`},
+	{"UserPromptSubmit", `{"hook_event_name":"UserPromptSubmit","prompt":"Write a hello world program"}`},
+}
+
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := fs.String("server", fmt.Sprintf("http://localhost:%d/hook", PORT), "hook endpoint to load")
+	events := fs.Int("events", 1000, "number of events to send")
+	concurrency := fs.Int("concurrency", 8, "events in flight at once")
+	ramp := fs.Duration("ramp", 2*time.Second, "time over which workers are started")
+	sample := fs.String("sample", "", "audit log whose events to send instead of synthetic ones")
+	sampleSize := fs.Int("sample-size", 1000, "most events to take from -sample")
+	timeout := fs.Duration("timeout", 5*time.Second, "per-request timeout")
+	fs.Parse(args)
+	if *events < 1 || *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "-events and -concurrency must be at least 1")
+		return 2
+	}
+
+	var payloads []CloudEvent
+	if *sample != "" {
+		err := readAuditRecords(*sample, func(record AuditRecord) {
+			if len(payloads) < *sampleSize {
+				payloads = append(payloads, record.Event)
+			}
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	} else {
+		for _, e := range benchEvents {
+			event, err := decodeCloudEvent([]byte(conformanceEvent(e.eventType, e.data)))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+			payloads = append(payloads, event)
+		}
+	}
+	if len(payloads) == 0 {
+		fmt.Fprintf(os.Stderr, "%s has no events\n", *sample)
+		return 2
+	}
+
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+	send := func(i int) error {
+		event := payloads[i%len(payloads)]
+		event.ID = fmt.Sprintf("bench-%d", i)
+		event.Time = time.Now().UTC().Format(time.RFC3339)
+		event.Nonce = ""
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodPost, *server, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/cloudevents+json")
+		signRequest(req, body)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		closeBody(resp)
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	latencies := make([]time.Duration, *events)
+	var failures atomic.Int64
+	var firstErr atomic.Value
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	go func() {
+		for i := 0; i < *events; i++ {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			time.Sleep(*ramp * time.Duration(w) / time.Duration(*concurrency))
+			for i := range jobs {
+				began := time.Now()
+				if err := send(i); err != nil {
+					failures.Add(1)
+					firstErr.CompareAndSwap(nil, err.Error())
+				}
+				latencies[i] = time.Since(began)
+			}
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(math.Ceil(p*float64(len(latencies))))-1].Round(time.Microsecond)
+	}
+	failed := failures.Load()
+	fmt.Printf("Events:      %d from %d workers\n", *events, *concurrency)
+	fmt.Printf("Errors:      %d (%.2f%%)\n", failed, 100*float64(failed)/float64(*events))
+	fmt.Printf("Duration:    %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput:  %.1f events/s\n", float64(*events)/elapsed.Seconds())
+	fmt.Printf("Latency:     p50 %v  p90 %v  p99 %v  max %v\n",
+		percentile(0.50), percentile(0.90), percentile(0.99), latencies[len(latencies)-1].Round(time.Microsecond))
+	if failed > 0 {
+		fmt.Printf("First error: %v\n", firstErr.Load())
+		return 1
+	}
+	return 0
+}
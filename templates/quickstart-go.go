@@ -1,10 +1,14 @@
 // Quick-start template for a Claude Code hooks server using Go.
-// Save as quickstart-go.go and run with: go run quickstart-go.go.
 //
-// This template provides placeholder functions for each hook event type.
-// Customize the logic in each handler function for your specific needs.
-// The template is designed for rapid prototyping - production deployments
-// should add authentication, rate limiting, and proper error handling.
+// The server is a single package main split across files. This one holds
+// the event types, a handler for each hook event type, and main; it is the
+// file you customize. The quickstart-go-*.go files beside it hold the
+// supporting machinery (HTTP serving, the audit log, the decision cache,
+// security checks, and the subcommands), each described at its top.
+//
+// "cchd init go" downloads all of them into one directory. Run the server
+// with: go run quickstart-go.go quickstart-go-*.go
+// or with "go run ." inside a Go module, as in the cchd repository.
 //
 // Events are sent in CloudEvents JSON format (v1.0):
 // {
@@ -15,25 +19,55 @@
 //   "time": "2024-01-15T10:30:00Z",
 //   "datacontenttype": "application/json",
 //   "sessionid": "session-123",
+//   "parentsessionid": "session-100", // Optional: set for subagent events.
+//   "rawdata": "eyJzZXNzaW9uX2lkIjoi...", // Optional: base64 of the original stdin.
+//   "userid": "alice", // Optional: who is running Claude, possibly hashed.
+//   "nonce": "9c1f...", // Optional: unique per event, for replay protection.
+//   "forwardedenv": "{\"PATH\":\"/usr/bin:/bin\"}", // Optional: see forwardedEnv.
+//   "encrypteddata": "q83vEjRW...", // Optional: replaces data; see decryptEventData.
+//   "packagerisk": "[{\"ecosystem\":\"npm\",...}]", // Optional: see PackageRef.
 //   "data": {
 //     // Complete unmodified stdin input from Claude.
 //   }
 // }
 //
-// For production use with full security features, see examples/go_server.go.
+// When the dispatcher knows how long Claude will wait, it sends the remaining
+// time in a Cchd-Timeout header using the grpc-timeout format: an integer of
+// at most 8 digits followed by a unit, H (hours), M (minutes), S (seconds),
+// m (milliseconds), u (microseconds), or n (nanoseconds), e.g. "1500m".
+//
+// When CCHD_WEBHOOK_SECRET is set, every request must carry an
+// X-CCHD-Signature header: the hex HMAC-SHA256 of the raw body keyed with
+// the secret, optionally prefixed with "sha256=". See verifySignature.
 
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 const PORT = 8080
@@ -42,15 +76,83 @@ const PORT = 8080
 // follows the CloudEvents v1.0 specification, providing a standard way to
 // describe event data across different systems and protocols.
 type CloudEvent struct {
-	SpecVersion      string                 `json:"specversion"`
-	Type             string                 `json:"type"`
-	Source           string                 `json:"source"`
-	ID               string                 `json:"id"`
-	Time             string                 `json:"time,omitempty"`
-	DataContentType  string                 `json:"datacontenttype,omitempty"`
-	SessionID        string                 `json:"sessionid,omitempty"`
-	CorrelationID    string                 `json:"correlationid,omitempty"`
-	Data             map[string]interface{} `json:"data"`
+	SpecVersion     string                 `json:"specversion"`
+	Type            string                 `json:"type"`
+	Source          string                 `json:"source"`
+	ID              string                 `json:"id"`
+	Time            string                 `json:"time,omitempty"`
+	DataContentType string                 `json:"datacontenttype,omitempty"`
+	SessionID       string                 `json:"sessionid,omitempty"`
+	CorrelationID   string                 `json:"correlationid,omitempty"`
+	ParentSessionID string                 `json:"parentsessionid,omitempty"`
+	RawData         string                 `json:"rawdata,omitempty"`
+	UserID          string                 `json:"userid,omitempty"`
+	Nonce           string                 `json:"nonce,omitempty"`
+	ForwardedEnv    string                 `json:"forwardedenv,omitempty"`
+	EncryptedData   string                 `json:"encrypteddata,omitempty"`
+	PackageRisk     string                 `json:"packagerisk,omitempty"`
+	Data            map[string]interface{} `json:"data"`
+
+	// Deadline is when Claude stops waiting for a decision, from the
+	// Cchd-Timeout request header; zero if the dispatcher sent none.
+	Deadline time.Time `json:"-"`
+	// Languages are the preferred languages for reasons, from the
+	// Accept-Language request header.
+	Languages []string `json:"-"`
+}
+
+// timeLeft reports how long a handler has before its deadline, and false if
+// the event has no deadline. Handlers can use it to skip expensive checks
+// that won't finish in time:
+//
+//	if left, ok := timeLeft(event); ok && left < 200*time.Millisecond {
+//		// fall back to the cheap checks only
+//	}
+func timeLeft(event CloudEvent) (time.Duration, bool) {
+	if event.Deadline.IsZero() {
+		return 0, false
+	}
+	return time.Until(event.Deadline), true
+}
+
+var timeoutUnits = map[byte]time.Duration{
+	'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+	'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+}
+
+// parseTimeoutHeader parses a grpc-timeout style value such as "1500m".
+func parseTimeoutHeader(value string) (time.Duration, error) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("invalid timeout %q", value)
+	}
+	unit, ok := timeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid timeout unit in %q", value)
+	}
+	n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q", value)
+	}
+	if unit == time.Hour && n > uint64(math.MaxInt64/int64(time.Hour)) {
+		return 0, fmt.Errorf("timeout %q out of range", value)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// rawInput returns the exact stdin bytes Claude sent, if the dispatcher
+// forwarded them: The optional "rawdata" extension attribute carries the
+// original input base64-encoded, because the reconstructed data field may
+// differ in key order and whitespace. Use it for signature verification or
+// archival; it roughly doubles the payload size, so it is opt-in upstream.
+func rawInput(event CloudEvent) ([]byte, bool, error) {
+	if event.RawData == "" {
+		return nil, false, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(event.RawData)
+	if err != nil {
+		return nil, false, fmt.Errorf("decoding rawdata attribute: %w", err)
+	}
+	return raw, true, nil
 }
 
 // Response represents the webhook response: This structure defines how
@@ -62,7 +164,46 @@ type Response struct {
 	Reason             string                 `json:"reason,omitempty"`
 	ModifiedData       map[string]interface{} `json:"modified_data,omitempty"`
 	HookSpecificOutput *HookSpecificOutput    `json:"hookSpecificOutput,omitempty"`
-	Timestamp          string                 `json:"timestamp"`
+	Defer              *DeferAnnotation       `json:"defer,omitempty"`
+	Delay              *DelayAnnotation       `json:"delay,omitempty"`
+	PostActions        []PostAction           `json:"post_actions,omitempty"`
+	PolicyURL          string                 `json:"policy_url,omitempty"`
+	Status             string                 `json:"status,omitempty"`
+	// Metadata carries details for logs and audit trails, such as redacted
+	// secret findings. The dispatcher ignores it.
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Timestamp string                 `json:"timestamp"`
+}
+
+// Status lines: A decision that allows an event but is worth noting (a
+// low-risk command, a file under review) can carry a brief status, which
+// the dispatcher shows as Claude's unobtrusive system message where the
+// event type supports one and drops elsewhere. Statuses are one line of at
+// most maxStatusLength characters; longer ones are cut with an ellipsis.
+const maxStatusLength = 60
+
+func sanitizeStatus(status string) string {
+	status = strings.Join(strings.Fields(SanitizeText(status)), " ")
+	if utf8.RuneCountInString(status) > maxStatusLength {
+		status = string([]rune(status)[:maxStatusLength-1]) + "…"
+	}
+	return status
+}
+
+// Policy links: A block is easier to accept when the user can read the
+// policy behind it. A response may carry a policy_url, which the dispatcher
+// shows next to the reason and which is audited with the decision. Only
+// absolute http and https URLs are sent; anything else, like a javascript:
+// or file: link that a terminal might open, is dropped with a log line.
+func validPolicyURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid policy_url: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("policy_url %q must be an absolute http or https URL", raw)
+	}
+	return nil
 }
 
 // HookSpecificOutput for modern hook responses (v1.0.59+): This provides
@@ -75,6 +216,248 @@ type HookSpecificOutput struct {
 	AdditionalContext        string `json:"additionalContext,omitempty"`
 }
 
+// DeferAnnotation lets a PreToolUse handler postpone its decision: The tool
+// is allowed to run, but the session is flagged so the matching follow-up
+// event (PostToolUse by default) is evaluated with extra scrutiny. A defer
+// never blocks on its own and is ignored when the decision is "block".
+type DeferAnnotation struct {
+	Until  string `json:"until,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// decodeCloudEvent parses a request body into a CloudEvent. We decode with
+// UseNumber so numbers in data stay json.Number rather than float64: large
+// integer ids in tool inputs would otherwise lose precision and re-encode in
+// scientific notation when a modify decision echoes the data back. Anything
+// after the event is rejected rather than ignored, so a body can't carry a
+// second payload that a different parser might read instead.
+func decodeCloudEvent(body []byte) (CloudEvent, error) {
+	var event CloudEvent
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		return CloudEvent{}, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return CloudEvent{}, fmt.Errorf("unexpected data after event")
+	}
+	return event, nil
+}
+
+// validateCloudEvent enforces the CloudEvents v1.0 required attributes
+// before an event is dispatched: specversion must be "1.0", type, source
+// and id must be present, and time, when set, must be RFC3339. The type
+// must also be in the com.claudecode.hook. namespace (or be a registered
+// custom type), so a typo fails loudly instead of slipping through as an
+// unknown event.
+func validateCloudEvent(e CloudEvent) error {
+	switch {
+	case e.SpecVersion == "":
+		return errors.New("missing required attribute specversion")
+	case e.SpecVersion != "1.0":
+		return fmt.Errorf("unsupported specversion %q: expected 1.0", e.SpecVersion)
+	case e.Type == "":
+		return errors.New("missing required attribute type")
+	case e.Source == "":
+		return errors.New("missing required attribute source")
+	case e.ID == "":
+		return errors.New("missing required attribute id")
+	}
+	if !strings.HasPrefix(e.Type, "com.claudecode.hook.") && customEventHandlers[e.Type] == nil {
+		return fmt.Errorf("event type %q is not in the com.claudecode.hook. namespace", e.Type)
+	}
+	if e.Time != "" {
+		if _, err := time.Parse(time.RFC3339, e.Time); err != nil {
+			return fmt.Errorf("time %q is not an RFC3339 timestamp", e.Time)
+		}
+	}
+	return nil
+}
+
+// Field name normalization: Claude Code has sent some hook fields in both
+// snake_case and camelCase across versions (tool_input vs toolInput), which
+// leaves handlers reading empty fields. We rename the camelCase spelling of
+// each known field to snake_case; if both are present, snake_case wins.
+// Only top-level fields are renamed, since tool inputs belong to the tool.
+var hookFieldNames = []string{
+	"session_id", "transcript_path", "hook_event_name", "cwd",
+	"current_working_directory", "tool_name", "tool_input", "tool_response",
+	"tool_use_id", "parent_session_id", "stop_hook_active", "prompt",
+	"message", "title", "trigger", "custom_instructions",
+}
+
+var camelFieldNames = func() map[string]string {
+	names := make(map[string]string, len(hookFieldNames)*2)
+	for _, snake := range hookFieldNames {
+		parts := strings.Split(snake, "_")
+		camel := parts[0]
+		for _, part := range parts[1:] {
+			camel += strings.ToUpper(part[:1]) + part[1:]
+		}
+		if camel == snake {
+			continue
+		}
+		names[camel] = snake
+		// Accept the initialism spelling Go encoders produce, e.g. sessionID.
+		if strings.HasSuffix(camel, "Id") {
+			names[strings.TrimSuffix(camel, "Id")+"ID"] = snake
+		}
+	}
+	return names
+}()
+
+func normalizeFieldNames(data map[string]interface{}) {
+	for camel, snake := range camelFieldNames {
+		value, ok := data[camel]
+		if !ok {
+			continue
+		}
+		if _, exists := data[snake]; !exists {
+			data[snake] = value
+		}
+		delete(data, camel)
+	}
+}
+
+// Tool name normalization: Tool names and their casing have shifted between
+// Claude Code versions (e.g. "bash", "BashTool"), so we map every incoming
+// name onto one canonical spelling before routing and matching. Policies can
+// then compare against "Bash" without caring which version sent the event.
+var canonicalToolNames = []string{
+	"Bash", "Read", "Write", "Edit", "MultiEdit", "Glob", "Grep", "LS",
+	"WebFetch", "WebSearch", "Task", "TodoWrite", "NotebookRead", "NotebookEdit",
+}
+
+// toolAliases maps a lowercased tool name onto its canonical form. It is
+// populated once at startup from the built-in defaults plus any aliases
+// supplied via -tool-aliases or CCHD_TOOL_ALIASES, and is read-only afterward.
+var toolAliases = defaultToolAliases()
+
+func defaultToolAliases() map[string]string {
+	aliases := make(map[string]string, len(canonicalToolNames)*2)
+	for _, name := range canonicalToolNames {
+		lower := strings.ToLower(name)
+		aliases[lower] = name
+		aliases[lower+"tool"] = name
+	}
+	return aliases
+}
+
+// loadToolAliases merges a comma-separated list of "From=To" pairs into the
+// alias map. We reject malformed entries rather than skipping them so a typo
+// in the configuration is noticed at startup instead of silently ignored.
+func loadToolAliases(spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(entry, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("invalid tool alias %q: expected From=To", entry)
+		}
+		toolAliases[strings.ToLower(from)] = to
+	}
+	return nil
+}
+
+// NormalizeToolName returns the canonical spelling of a tool name. Unknown
+// names (including MCP tools like "mcp__server__tool") are returned unchanged
+// so new tools still reach handlers under the name Claude sent.
+func NormalizeToolName(name string) string {
+	trimmed := strings.TrimSpace(name)
+	if canonical, ok := toolAliases[strings.ToLower(trimmed)]; ok {
+		return canonical
+	}
+	return trimmed
+}
+
+// DelayAnnotation asks the dispatcher to hold an allow decision for a
+// cool-down period, showing Message and a countdown on the TTY so a human
+// can abort a risky operation. Without a TTY there is nobody to abort, so
+// NonInteractive chooses between just waiting ("wait") and refusing the
+// operation outright ("block", the default).
+type DelayAnnotation struct {
+	Seconds        int    `json:"seconds"`
+	Message        string `json:"message,omitempty"`
+	NonInteractive string `json:"non_interactive,omitempty"`
+}
+
+// PostAction is a follow-up a handler wants after its decision, such as
+// reminding Claude not to commit a change it was just allowed to write.
+// Actions are translated into Claude-facing output only where the event
+// type supports it, and dropped with a log line elsewhere:
+//
+//	inject_context    PostToolUse, UserPromptSubmit, SessionStart: appended
+//	                  to hookSpecificOutput.additionalContext.
+//	request_followup  Stop, SubagentStop: becomes a "block" whose reason
+//	                  tells Claude what to do before stopping.
+type PostAction struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// contextEvents lists the hook events whose additionalContext Claude reads.
+var contextEvents = map[string]bool{
+	"PostToolUse":      true,
+	"UserPromptSubmit": true,
+	"SessionStart":     true,
+}
+
+// applyPostActions translates a response's post actions into the output
+// Claude understands for this event type. The actions stay in the response
+// so a dispatcher or audit trail can still see what was requested.
+func applyPostActions(event CloudEvent, response Response) Response {
+	hookEvent := strings.TrimPrefix(event.Type, "com.claudecode.hook.")
+	for _, action := range response.PostActions {
+		switch {
+		case action.Type == "inject_context" && contextEvents[hookEvent]:
+			if response.HookSpecificOutput == nil {
+				response.HookSpecificOutput = &HookSpecificOutput{HookEventName: hookEvent}
+			}
+			output := response.HookSpecificOutput
+			output.AdditionalContext = mergeAdditionalContext(
+				[]string{output.AdditionalContext, action.Message}, maxContextLength)
+		case action.Type == "request_followup" && (hookEvent == "Stop" || hookEvent == "SubagentStop"):
+			if response.Decision == "" {
+				response.Decision = "block"
+				response.Reason = action.Message
+			}
+		default:
+			slog.Warn("Dropping unsupported post action", "action", action.Type, "event_type", hookEvent)
+		}
+	}
+	return response
+}
+
+// resolvedToolPath returns the tool input's file_path (or path, for search
+// tools) as a clean absolute path. Relative paths are resolved against the
+// event's working directory rather than this server's, which is what Claude
+// will use; they can't be resolved, and false is returned, if the event
+// doesn't say where Claude is running.
+func resolvedToolPath(event CloudEvent) (string, bool) {
+	toolInput, _ := event.Data["tool_input"].(map[string]interface{})
+	path, _ := toolInput["file_path"].(string)
+	if path == "" {
+		path, _ = toolInput["path"].(string)
+	}
+	if path == "" {
+		return "", false
+	}
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path), true
+	}
+	cwd, _ := event.Data["cwd"].(string)
+	if cwd == "" {
+		cwd, _ = event.Data["current_working_directory"].(string)
+	}
+	if !filepath.IsAbs(cwd) {
+		return "", false
+	}
+	return filepath.Join(cwd, path), true
+}
+
 // Handler functions for each event type: These functions contain the core
 // business logic for processing hook events. Customize these functions to
 // implement your specific security policies, logging, or modifications.
@@ -86,16 +469,144 @@ func handlePreToolUse(event CloudEvent) Response {
 	toolInput, _ := event.Data["tool_input"].(map[string]interface{})
 	sessionID := event.SessionID
 
-	fmt.Printf("[PreToolUse] Tool: %s, Session: %s\n", toolName, sessionID)
-	fmt.Printf("  Input: %+v\n", toolInput)
+	slog.Debug("PreToolUse", "tool_name", SanitizeText(toolName), "session_id", SanitizeText(sessionID),
+		"tool_input", SanitizeText(fmt.Sprintf("%+v", toolInput)))
+
+	// Example: Per-user policy. When the dispatcher attaches the "userid"
+	// attribute, policies can vary by who is running Claude. The value may be
+	// a hash rather than a name, so compare it against hashed values too.
+	//
+	//	if event.UserID == "contractor" && toolName == "WebFetch" {
+	//		return Response{Version: "1.0", Decision: "block", Reason: "..."}
+	//	}
+
+	// Example: Judge Bash commands by their environment. With the dispatcher
+	// forwarding PATH, a PATH that searches the working directory means "ls"
+	// may run a binary the agent just wrote:
+	//
+	//	if env, _ := forwardedEnv(event); toolName == "Bash" {
+	//		for _, dir := range filepath.SplitList(env["PATH"]) {
+	//			if dir == "" || dir == "." {
+	//				return Response{Version: "1.0", Decision: "block", Reason: "PATH includes the working directory"}
+	//			}
+	//		}
+	//	}
+
+	// Example: Read before write. Overwriting an existing file is allowed
+	// only if this session read it first and that Read was allowed. A
+	// policy like this depends on session state, so leave the decision
+	// cache off or key it on session_id with -cache-key-fields.
+	//
+	//	if path, ok := resolvedToolPath(event); ok && toolName == "Write" {
+	//		if _, err := os.Stat(path); err == nil {
+	//			_, read := sessions.lastOutcome(sessionID, func(o Outcome) bool {
+	//				return o.EventType == "PreToolUse" && o.ToolName == "Read" && o.Path == path && o.Decision == "allow"
+	//			})
+	//			if !read {
+	//				return Response{Version: "1.0", Decision: "block", Reason: "Read " + path + " before overwriting it"}
+	//			}
+	//		}
+	//	}
+
+	// Example: Supply-chain policy. With -advisory-source set, install
+	// commands carry the advisories known for each package:
+	//
+	//	risks, _ := packageRisks(event)
+	//	for _, risk := range risks {
+	//		if len(risk.Advisories) > 0 {
+	//			return Response{Version: "1.0", Decision: "block",
+	//				Reason: fmt.Sprintf("%s has known advisories (%s)", risk.Name, risk.Advisories[0].ID)}
+	//		}
+	//	}
+
+	// Example: Defer web fetches to PostToolUse. Whether fetched content is
+	// safe can only be judged once it exists, so we let the fetch run and
+	// flag it for a prompt-injection scan when the response comes back
+	// (see handlePostToolUse). Put it after your own checks, since
+	// returning here skips them:
+	//
+	//	if toolName == "WebFetch" {
+	//		return Response{
+	//			Version: "1.0",
+	//			Defer: &DeferAnnotation{
+	//				Until:  "PostToolUse",
+	//				Reason: "scan fetched content for prompt injection",
+	//			},
+	//			Timestamp: time.Now().Format(time.RFC3339),
+	//		}
+	//	}
 
 	// Example: Block dangerous commands. This demonstrates how to inspect tool
 	// inputs and make security decisions based on their content.
 	if toolName == "Bash" {
 		if command, ok := toolInput["command"].(string); ok {
 			// Add your security logic here: Consider checking against allowlists,
-	// validating paths, or scanning for sensitive data exposure.
-			fmt.Printf("  Command: %s\n", command)
+			// validating paths, or scanning for sensitive data exposure.
+			slog.Debug("Bash command", "session_id", SanitizeText(sessionID), "command", SanitizeText(command))
+
+			// Block whole command categories: Checked first because a
+			// category block is a deliberate operator decision.
+			for _, category := range CategoryOf(command) {
+				if blockedCategories[category] {
+					return Response{
+						Version:   "1.0",
+						Decision:  "block",
+						Reason:    renderReason("blocked-category", event, category),
+						Timestamp: time.Now().Format(time.RFC3339),
+					}
+				}
+			}
+
+			// Check the configured security patterns: The first pattern
+			// that doesn't simply allow decides the outcome.
+			for _, p := range matchSecurityPatterns(securityPatterns, "command", command) {
+				if p.Decision != "allow" {
+					return patternResponse(event, p)
+				}
+			}
+
+			// Catch payloads hidden behind encoding: A literal command
+			// list never sees what "base64 -d | sh" will actually run.
+			if findings := DetectEncodedExecution(command); len(findings) > 0 {
+				return Response{
+					Version:   "1.0",
+					Decision:  "block",
+					Reason:    renderReason(findings[0].Rule, event, findings[0].Message),
+					Timestamp: time.Now().Format(time.RFC3339),
+				}
+			}
+
+			// Impose a cool-down on destructive commands: Rather than a hard
+			// block, give the human a window to cancel.
+			if destructiveDelay > 0 && destructivePattern.MatchString(command) {
+				return Response{
+					Version: "1.0",
+					Delay: &DelayAnnotation{
+						Seconds:        int(destructiveDelay / time.Second),
+						Message:        "Destructive command: " + truncateMatch(command),
+						NonInteractive: "block",
+					},
+					Timestamp: time.Now().Format(time.RFC3339),
+				}
+			}
+		}
+	}
+
+	// Check file paths against the same patterns: Traversal sequences in a
+	// file_path are as suspicious as in a shell command. Patterns see both
+	// the path as written, where traversal is visible, and the resolved
+	// path, so a rule for /etc also catches "../../etc/passwd".
+	if filePath, ok := toolInput["file_path"].(string); ok {
+		candidates := []string{filePath}
+		if resolved, ok := resolvedToolPath(event); ok && resolved != filePath {
+			candidates = append(candidates, resolved)
+		}
+		for _, candidate := range candidates {
+			for _, p := range matchSecurityPatterns(securityPatterns, "path", candidate) {
+				if p.Decision != "allow" {
+					return patternResponse(event, p)
+				}
+			}
 		}
 	}
 
@@ -112,10 +623,184 @@ func handlePreToolUse(event CloudEvent) Response {
 		// Option 2: Legacy format
 		// Decision: "block",
 		// Reason: "Dangerous command detected",
+		// Optional: A short note shown without blocking
+		// Status: "policy: low-risk",
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+}
+
+// suggestEdit builds a modify decision that replaces an Edit call's
+// new_string, e.g. to swap an insecure pattern for a safe one instead of
+// blocking the edit. The modified data is the full event data with only
+// tool_input.new_string changed. It fails if the file no longer contains
+// old_string the way Edit requires (exactly once unless replace_all), since
+// Claude's edit would then fail or touch the wrong text anyway.
+//
+//	if fixed := strings.ReplaceAll(newString, "md5.New()", "sha256.New()"); fixed != newString {
+//		if response, err := suggestEdit(event, fixed, "use SHA-256 instead of MD5"); err == nil {
+//			return response
+//		}
+//	}
+func suggestEdit(event CloudEvent, newString, reason string) (Response, error) {
+	toolInput, _ := event.Data["tool_input"].(map[string]interface{})
+	filePath, _ := toolInput["file_path"].(string)
+	oldString, _ := toolInput["old_string"].(string)
+	replaceAll, _ := toolInput["replace_all"].(bool)
+	if filePath == "" || oldString == "" {
+		return Response{}, fmt.Errorf("not an Edit call with file_path and old_string")
+	}
+	if oldString == newString {
+		return Response{}, fmt.Errorf("suggested new_string is identical to old_string")
+	}
+	resolved, ok := resolvedToolPath(event)
+	if !ok {
+		return Response{}, fmt.Errorf("can't resolve %s without the working directory", filePath)
+	}
+	content, err := os.ReadFile(resolved)
+	if err != nil {
+		return Response{}, fmt.Errorf("reading %s: %w", filePath, err)
+	}
+	switch n := strings.Count(string(content), oldString); {
+	case n == 0:
+		return Response{}, fmt.Errorf("old_string no longer matches %s", filePath)
+	case n > 1 && !replaceAll:
+		return Response{}, fmt.Errorf("old_string matches %s %d times", filePath, n)
+	}
+
+	input := make(map[string]interface{}, len(toolInput))
+	for key, value := range toolInput {
+		input[key] = value
+	}
+	input["new_string"] = newString
+	data := make(map[string]interface{}, len(event.Data))
+	for key, value := range event.Data {
+		data[key] = value
+	}
+	data["tool_input"] = input
+	return Response{
+		Version:      "1.0",
+		Decision:     "modify",
+		Reason:       reason,
+		ModifiedData: data,
+		Timestamp:    time.Now().Format(time.RFC3339),
+	}, nil
+}
+
+// patternResponse turns a matched security pattern into a decision. "ask"
+// uses the modern permission format since legacy responses can't express it.
+func patternResponse(event CloudEvent, p SecurityPattern) Response {
+	reason := renderReason(p.ID, event, p.Reason)
+	if p.Decision == "ask" {
+		return Response{
+			Version: "1.0",
+			HookSpecificOutput: &HookSpecificOutput{
+				HookEventName:            "PreToolUse",
+				PermissionDecision:       "ask",
+				PermissionDecisionReason: reason,
+			},
+			PolicyURL: p.PolicyURL,
+			Timestamp: time.Now().Format(time.RFC3339),
+		}
+	}
+	return Response{
+		Version:   "1.0",
+		Decision:  "block",
+		Reason:    reason,
+		PolicyURL: p.PolicyURL,
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
 }
 
+// ToolOutcome is what a PostToolUse tool_response says about how the call
+// went. Tools report failure in different shapes: Bash has an exit code
+// and stderr, MCP tools set isError and put the text in content, others
+// set success to false or an error field, and some report an error as a
+// plain string. ParseToolOutcome folds these into one value so policies
+// can react to outcomes, not just inputs.
+type ToolOutcome struct {
+	Failed      bool
+	ExitCode    int
+	HasExitCode bool
+	Interrupted bool
+	// Error is the failure's text, or stderr for a failed command.
+	Error string
+}
+
+// ParseToolOutcome reads the outcome out of a tool_response value.
+func ParseToolOutcome(toolResponse interface{}) ToolOutcome {
+	var outcome ToolOutcome
+	switch resp := toolResponse.(type) {
+	case string:
+		// A bare string is output unless it reads as an error report.
+		if lower := strings.ToLower(strings.TrimSpace(resp)); strings.HasPrefix(lower, "error") {
+			outcome.Failed, outcome.Error = true, resp
+		}
+	case map[string]interface{}:
+		for _, key := range []string{"exit_code", "exitCode", "returncode", "return_code"} {
+			if code, ok := toolResponseInt(resp[key]); ok {
+				outcome.ExitCode, outcome.HasExitCode = code, true
+				outcome.Failed = code != 0
+				break
+			}
+		}
+		if interrupted, _ := resp["interrupted"].(bool); interrupted {
+			outcome.Interrupted, outcome.Failed = true, true
+		}
+		if success, ok := resp["success"].(bool); ok && !success {
+			outcome.Failed = true
+		}
+		for _, key := range []string{"is_error", "isError"} {
+			if isError, _ := resp[key].(bool); isError {
+				outcome.Failed = true
+				outcome.Error = contentText(resp["content"])
+			}
+		}
+		switch e := resp["error"].(type) {
+		case string:
+			if e != "" {
+				outcome.Failed, outcome.Error = true, e
+			}
+		case map[string]interface{}:
+			outcome.Failed = true
+			outcome.Error, _ = e["message"].(string)
+		}
+		if outcome.Failed && outcome.Error == "" {
+			outcome.Error, _ = resp["stderr"].(string)
+		}
+	}
+	return outcome
+}
+
+// ToolFailed reports whether a tool_response describes a failed call.
+func ToolFailed(toolResponse interface{}) bool {
+	return ParseToolOutcome(toolResponse).Failed
+}
+
+func toolResponseInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		n, err := v.Int64()
+		return int(n), err == nil
+	case float64:
+		return int(v), true
+	}
+	return 0, false
+}
+
+// contentText joins the text blocks of an MCP result's content.
+func contentText(content interface{}) string {
+	blocks, _ := content.([]interface{})
+	var texts []string
+	for _, block := range blocks {
+		if b, ok := block.(map[string]interface{}); ok {
+			if text, ok := b["text"].(string); ok {
+				texts = append(texts, text)
+			}
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
 func handlePostToolUse(event CloudEvent) Response {
 	// Extract tool information and response: PostToolUse events include both
 	// the original input and the tool's response, allowing for output validation.
@@ -124,15 +809,76 @@ func handlePostToolUse(event CloudEvent) Response {
 	toolResponse, _ := event.Data["tool_response"].(map[string]interface{})
 	sessionID := event.SessionID
 
-	fmt.Printf("[PostToolUse] Tool: %s, Session: %s\n", toolName, sessionID)
-	fmt.Printf("  Input: %+v\n", toolInput)
-	fmt.Printf("  Response: %+v\n", toolResponse)
+	slog.Debug("PostToolUse", "tool_name", SanitizeText(toolName), "session_id", SanitizeText(sessionID),
+		"tool_input", SanitizeText(fmt.Sprintf("%+v", toolInput)),
+		"tool_response", SanitizeText(fmt.Sprintf("%+v", toolResponse)))
+	if outcome := ParseToolOutcome(event.Data["tool_response"]); outcome.Failed {
+		slog.Debug("Tool failed", "tool_name", SanitizeText(toolName), "session_id", SanitizeText(sessionID),
+			"error", SanitizeText(truncateMatch(outcome.Error)))
+	}
+
+	// Apply deferred scrutiny: If PreToolUse deferred this call, we now have
+	// the tool's output and can enforce the decision it postponed.
+	if deferral, ok := sessions.takeDeferral(sessionID, toolInvocationKey(event)); ok {
+		slog.Debug("Applying deferred scrutiny", "session_id", SanitizeText(sessionID), "reason", SanitizeText(deferral.Reason))
+		output, _ := json.Marshal(event.Data["tool_response"])
+		if strings.Contains(strings.ToLower(string(output)), "ignore previous instructions") {
+			return Response{
+				Version:   "1.0",
+				Decision:  "block",
+				Reason:    renderReason("prompt-injection", event, "fetched content contains a likely prompt injection"),
+				Timestamp: time.Now().Format(time.RFC3339),
+			}
+		}
+	}
+
+	// Flag leaked credentials: The output is already in Claude's context
+	// once it is returned, so by default this reports rather than blocks.
+	if findings := scanForSecrets([]byte(strings.Join(responseStrings(event.Data["tool_response"], nil), "\n"))); len(findings) > 0 {
+		rules := make([]string, len(findings))
+		for i, finding := range findings {
+			rules[i] = finding.Rule
+		}
+		slog.Warn("Possible secret in tool output", "tool_name", SanitizeText(toolName), "session_id", SanitizeText(sessionID),
+			"findings", len(findings), "rules", rules)
+		metadata := map[string]interface{}{"secret_findings": findings}
+		if secretStrict {
+			return Response{
+				Version:   "1.0",
+				Decision:  "block",
+				Reason:    renderReason("secret-in-output", event, fmt.Sprintf("%d possible secret(s) found: %s", len(findings), strings.Join(rules, ", "))),
+				Metadata:  metadata,
+				Timestamp: time.Now().Format(time.RFC3339),
+			}
+		}
+		return Response{
+			Version:   "1.0",
+			Status:    sanitizeStatus("Possible secret in tool output"),
+			Metadata:  metadata,
+			Timestamp: time.Now().Format(time.RFC3339),
+		}
+	}
 
 	// Add your post-execution logic here: Common uses include logging tool
-	// outputs, scanning for sensitive data leaks, or triggering follow-up actions.
+	// outputs or triggering follow-up actions.
+	//
+	// Example: Stop Claude from hammering a failing command. Tracking
+	// failures per session is left to the policy:
+	//
+	//	if toolName == "Bash" && ToolFailed(event.Data["tool_response"]) {
+	//		if failures := countFailure(sessionID, toolInput["command"]); failures >= 3 {
+	//			return Response{Version: "1.0", Decision: "block",
+	//				Reason: "This command has failed three times; try a different approach"}
+	//		}
+	//	}
 
 	return Response{
-		Version:   "1.0",
+		Version: "1.0",
+		// Example: Remind Claude about a follow-up after a write
+		// PostActions: []PostAction{{
+		//     Type:    "inject_context",
+		//     Message: "Do not commit this change until it has been reviewed",
+		// }},
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
 }
@@ -144,9 +890,7 @@ func handleUserPromptSubmit(event CloudEvent) Response {
 	cwd, _ := event.Data["current_working_directory"].(string)
 	sessionID := event.SessionID
 
-	fmt.Printf("[UserPromptSubmit] Session: %s\n", sessionID)
-	fmt.Printf("  Prompt: %s\n", prompt)
-	fmt.Printf("  CWD: %s\n", cwd)
+	slog.Debug("UserPromptSubmit", "session_id", SanitizeText(sessionID), "prompt", SanitizeText(prompt), "cwd", SanitizeText(cwd))
 
 	// Add your prompt validation logic here: Consider checking for prompt
 	// injection attempts, PII exposure, or policy violations.
@@ -165,19 +909,111 @@ func handleUserPromptSubmit(event CloudEvent) Response {
 	}
 }
 
+// Notification severity: Claude may send a level with a notification; when
+// it doesn't, the first -notify-rule whose pattern matches the message
+// assigns one. Notifications at or above -notify-min-severity are forwarded
+// to -notify-webhook so important ones can page someone while routine ones
+// are only logged.
+type Notification struct {
+	SessionID string `json:"session_id,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Message   string `json:"message"`
+	Severity  string `json:"severity"`
+}
+
+type severityRule struct {
+	pattern  *regexp.Regexp
+	severity string
+}
+
+var severityRanks = map[string]int{"info": 0, "warning": 1, "critical": 2}
+
+var (
+	severityRules = []severityRule{
+		{regexp.MustCompile(`(?i)\b(error|failed|failure|crash(ed)?)\b`), "critical"},
+		{regexp.MustCompile(`(?i)\b(permission|approve|waiting for your input)\b`), "warning"},
+	}
+	notifyWebhook     string
+	notifyMinSeverity = "critical"
+	notifyClient      = &http.Client{Timeout: 5 * time.Second}
+)
+
+// addSeverityRule parses a regex=severity -notify-rule. User rules are
+// checked before the built-in ones.
+func addSeverityRule(spec string) error {
+	i := strings.LastIndex(spec, "=")
+	if i <= 0 {
+		return fmt.Errorf("invalid notification rule %q: expected regex=severity", spec)
+	}
+	severity := strings.ToLower(strings.TrimSpace(spec[i+1:]))
+	if _, ok := severityRanks[severity]; !ok {
+		return fmt.Errorf("invalid notification severity %q: expected info, warning, or critical", spec[i+1:])
+	}
+	re, err := regexp.Compile(spec[:i])
+	if err != nil {
+		return fmt.Errorf("invalid notification rule %q: %w", spec, err)
+	}
+	severityRules = append([]severityRule{{re, severity}}, severityRules...)
+	return nil
+}
+
+func parseNotification(event CloudEvent) Notification {
+	n := Notification{SessionID: event.SessionID}
+	n.Message, _ = event.Data["message"].(string)
+	n.Title, _ = event.Data["title"].(string)
+	for _, key := range []string{"severity", "level"} {
+		if level, ok := event.Data[key].(string); ok {
+			if _, known := severityRanks[strings.ToLower(level)]; known {
+				n.Severity = strings.ToLower(level)
+				return n
+			}
+		}
+	}
+	n.Severity = "info"
+	for _, rule := range severityRules {
+		if rule.pattern.MatchString(n.Message) {
+			n.Severity = rule.severity
+			break
+		}
+	}
+	return n
+}
+
+// routeNotification forwards a notification to -notify-webhook in the
+// background when it is severe enough; delivery failures are only logged
+// since notifications never affect decisions.
+func routeNotification(n Notification) {
+	if notifyWebhook == "" || severityRanks[n.Severity] < severityRanks[notifyMinSeverity] {
+		return
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		return
+	}
+	go func() {
+		resp, err := notifyClient.Post(notifyWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Warn("Notification webhook failed", "error", err)
+			return
+		}
+		closeBody(resp)
+		if resp.StatusCode >= 300 {
+			slog.Warn("Notification webhook failed", "status", resp.Status)
+		}
+	}()
+}
+
 func handleNotification(event CloudEvent) Response {
 	// Extract notification details: Notifications are informational events
 	// that don't require decisions but can be logged or forwarded.
-	message, _ := event.Data["message"].(string)
-	title, _ := event.Data["title"].(string)
-	sessionID := event.SessionID
+	n := parseNotification(event)
 
-	fmt.Printf("[Notification] Session: %s\n", sessionID)
-	fmt.Printf("  Title: %s\n", title)
-	fmt.Printf("  Message: %s\n", message)
+	slog.Debug("Notification", "session_id", SanitizeText(n.SessionID), "severity", SanitizeText(n.Severity),
+		"title", SanitizeText(n.Title), "message", SanitizeText(n.Message))
 
 	// Process notification (no decision needed): These events are useful for
 	// audit trails, monitoring, or triggering external workflows.
+	routeNotification(n)
 
 	return Response{
 		Version:   "1.0",
@@ -191,8 +1027,7 @@ func handleStop(event CloudEvent) Response {
 	stopHookActive, _ := event.Data["stop_hook_active"].(bool)
 	sessionID := event.SessionID
 
-	fmt.Printf("[Stop] Session: %s\n", sessionID)
-	fmt.Printf("  Stop Hook Active: %v\n", stopHookActive)
+	slog.Debug("Stop", "session_id", SanitizeText(sessionID), "stop_hook_active", stopHookActive)
 
 	// Add cleanup logic here: Consider saving session state, closing
 	// connections, or notifying external systems of the shutdown.
@@ -211,8 +1046,12 @@ func handleSubagentStop(event CloudEvent) Response {
 	stopHookActive, _ := event.Data["stop_hook_active"].(bool)
 	sessionID := event.SessionID
 
-	fmt.Printf("[SubagentStop] Session: %s\n", sessionID)
-	fmt.Printf("  Stop Hook Active: %v\n", stopHookActive)
+	attrs := []interface{}{"session_id", SanitizeText(sessionID), "stop_hook_active", stopHookActive}
+	if event.ParentSessionID != "" {
+		attrs = append(attrs, "parent_session_id", SanitizeText(event.ParentSessionID),
+			"root_session_id", SanitizeText(sessions.rootSession(sessionID)))
+	}
+	slog.Debug("SubagentStop", attrs...)
 
 	// Add subagent cleanup logic here: Subagents are separate Claude instances
 	// spawned for specific tasks that may need different cleanup procedures.
@@ -230,11 +1069,8 @@ func handlePreCompact(event CloudEvent) Response {
 	customInstructions, _ := event.Data["custom_instructions"].(string)
 	sessionID := event.SessionID
 
-	fmt.Printf("[PreCompact] Session: %s\n", sessionID)
-	fmt.Printf("  Trigger: %s\n", trigger)
-	if customInstructions != "" {
-		fmt.Printf("  Instructions: %s\n", customInstructions)
-	}
+	slog.Debug("PreCompact", "session_id", SanitizeText(sessionID), "trigger", SanitizeText(trigger),
+		"custom_instructions", SanitizeText(customInstructions))
 
 	// Process pre-compaction event (no decision needed): Use this to log
 	// what content is being compressed or to preserve important context.
@@ -245,59 +1081,625 @@ func handlePreCompact(event CloudEvent) Response {
 	}
 }
 
-func webhookHandler(w http.ResponseWriter, r *http.Request) {
-	// Read request body: We read the entire body at once since hook payloads
-	// are typically small and this simplifies error handling.
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
+// Session start context: -session-context adds text to every new or
+// resumed session before the first prompt, which suits environment notes
+// like which branch is deployable or which directories are off limits.
+// Contributions merge like prompt reminders and share -max-context-length.
+var sessionStartContext []string
+
+func handleSessionStart(event CloudEvent) Response {
+	// Extract session details: SessionStart fires when Claude Code starts a
+	// new session or resumes one. The source says which: "startup",
+	// "resume", "clear", or "compact".
+	source, _ := event.Data["source"].(string)
+	sessionID := event.SessionID
+
+	slog.Debug("SessionStart", "session_id", SanitizeText(sessionID), "source", SanitizeText(source))
+
+	response := Response{
+		Version:   "1.0",
+		Timestamp: time.Now().Format(time.RFC3339),
 	}
+	if context := mergeAdditionalContext(sessionStartContext, maxContextLength); context != "" {
+		response.HookSpecificOutput = &HookSpecificOutput{
+			HookEventName:     "SessionStart",
+			AdditionalContext: context,
+		}
+	}
+	return response
+}
 
-	// Parse JSON (CloudEvents format): The incoming data follows the CloudEvents
-	// specification, providing a consistent envelope for all event types.
-	var event CloudEvent
-	if err := json.Unmarshal(body, &event); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+func handleSessionEnd(event CloudEvent) Response {
+	// Extract end details: SessionEnd fires once a session is over, with a
+	// reason such as "clear", "logout", "prompt_input_exit", or "other".
+	// The session can no longer be influenced, so no decision is made.
+	reason, _ := event.Data["reason"].(string)
+	sessionID := event.SessionID
+
+	slog.Debug("SessionEnd", "session_id", SanitizeText(sessionID), "reason", SanitizeText(reason))
+
+	// Flush per-session state: The session won't send another event, so
+	// its deferrals, outcomes and parent links would otherwise sit in memory
+	// until the idle sweep.
+	sessions.clear(sessionID)
+
+	return Response{
+		Version:   "1.0",
+		Timestamp: time.Now().Format(time.RFC3339),
 	}
+}
+
+// Unknown event policy: An event type this server doesn't recognize may mean
+// Claude Code added a hook we haven't accounted for. Permissive deployments
+// allow it, strict ones block it, and "warn" allows it but logs loudly so the
+// new type gets noticed. Set with -unknown-events or CCHD_UNKNOWN_EVENTS.
+// This only covers the com.claudecode.hook. namespace: validateCloudEvent
+// rejects other types before dispatch.
+var unknownEventPolicy = "allow"
 
-	// Route to appropriate handler based on CloudEvents type: This dispatcher
-	// pattern makes it easy to add new event types as Claude Code evolves.
-	var response Response
-	switch event.Type {
-	case "com.claudecode.hook.PreToolUse":
-		response = handlePreToolUse(event)
-	case "com.claudecode.hook.PostToolUse":
-		response = handlePostToolUse(event)
-	case "com.claudecode.hook.UserPromptSubmit":
-		response = handleUserPromptSubmit(event)
-	case "com.claudecode.hook.Notification":
-		response = handleNotification(event)
-	case "com.claudecode.hook.Stop":
-		response = handleStop(event)
-	case "com.claudecode.hook.SubagentStop":
-		response = handleSubagentStop(event)
-	case "com.claudecode.hook.PreCompact":
-		response = handlePreCompact(event)
+func parseUnknownEventPolicy(value string) (string, error) {
+	return parseEventPolicy("unknown event", value)
+}
+
+// parseEventPolicy parses an allow|block|warn policy flag, defaulting to allow.
+func parseEventPolicy(kind, value string) (string, error) {
+	switch value {
+	case "", "allow":
+		return "allow", nil
+	case "block", "warn":
+		return value, nil
 	default:
-		fmt.Printf("[Unknown Event] Type: %s, Session: %s\n", event.Type, event.SessionID)
-		response = Response{
+		return "", fmt.Errorf("invalid %s policy %q: expected allow, block, or warn", kind, value)
+	}
+}
+
+// Malformed data policy: An event whose data lacks a field its type always
+// carries (a PreToolUse without tool_name) usually means the protocol has
+// drifted, and policies reading that field would quietly see "". With
+// -on-malformed-data block such events fail closed; "warn" logs the field
+// and carries on, and "allow" (the default) carries on silently.
+var malformedDataPolicy = "allow"
+
+type dataField struct {
+	name string
+	kind string // JSON type, as reported by jsonType
+}
+
+var requiredDataFields = map[string][]dataField{
+	"com.claudecode.hook.PreToolUse":       {{"tool_name", "string"}, {"tool_input", "object"}},
+	"com.claudecode.hook.PostToolUse":      {{"tool_name", "string"}, {"tool_input", "object"}},
+	"com.claudecode.hook.UserPromptSubmit": {{"prompt", "string"}},
+	"com.claudecode.hook.Notification":     {{"message", "string"}},
+	"com.claudecode.hook.Stop":             {},
+	"com.claudecode.hook.SubagentStop":     {},
+	"com.claudecode.hook.PreCompact":       {},
+	"com.claudecode.hook.SessionStart":     {},
+	"com.claudecode.hook.SessionEnd":       {},
+}
+
+// checkEventData reports the first required field that is missing or has
+// the wrong type for the event's type. Unknown types have their own policy.
+func checkEventData(event CloudEvent) error {
+	for _, field := range requiredDataFields[event.Type] {
+		value, ok := event.Data[field.name]
+		if !ok {
+			return fmt.Errorf("missing %s", field.name)
+		}
+		if kind := jsonType(value); kind != field.kind {
+			return fmt.Errorf("%s is %s, want %s", field.name, kind, field.kind)
+		}
+	}
+	return nil
+}
+
+func handleUnknownEvent(event CloudEvent) Response {
+	switch unknownEventPolicy {
+	case "block":
+		slog.Debug("Blocking unrecognized event type", "event_type", SanitizeText(event.Type), "session_id", SanitizeText(event.SessionID))
+		return Response{
 			Version:   "1.0",
+			Decision:  "block",
+			Reason:    renderReason("unknown-event", event, ""),
 			Timestamp: time.Now().Format(time.RFC3339),
 		}
+	case "warn":
+		slog.Warn("Allowing unrecognized event type; update this server to handle it",
+			"event_type", SanitizeText(event.Type), "session_id", SanitizeText(event.SessionID))
+	default:
+		slog.Debug("Unknown event", "event_type", SanitizeText(event.Type), "session_id", SanitizeText(event.SessionID))
+	}
+	return Response{
+		Version:   "1.0",
+		Timestamp: time.Now().Format(time.RFC3339),
 	}
+}
+
+// Custom event types: New hook events can be handled before this template
+// knows about them. Register a type at build time with the data fields it
+// must carry and its handler:
+//
+//	func init() {
+//		RegisterEventType("ConfigChange", map[string]string{"setting": "string"}, func(e CloudEvent) Response {
+//			return Response{Version: "1.0", Timestamp: time.Now().Format(time.RFC3339)}
+//		})
+//	}
+//
+// or declare types in a JSON file given with -event-types, mapping each
+// type to its required fields:
+//
+//	{"ConfigChange": {"setting": "string"}}
+//
+// Names without a dot get the "com.claudecode.hook." prefix. Field kinds
+// are JSON types: string, number, boolean, object, array or null.
+// Registered types are checked like the built-in ones (-on-malformed-data)
+// instead of falling under -unknown-events; a type declared only in the
+// file has no handler and is allowed.
+type EventHandler func(event CloudEvent) Response
 
-	// Send response: All responses use JSON format to maintain consistency
-	// with the CloudEvents input format.
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+var customEventHandlers = map[string]EventHandler{}
+
+var jsonKinds = map[string]bool{"string": true, "number": true, "boolean": true, "object": true, "array": true, "null": true}
+
+// RegisterEventType adds a custom event type. It panics on an invalid
+// registration, like http.Handle, since it runs at startup.
+func RegisterEventType(name string, fields map[string]string, handler EventHandler) {
+	if err := registerEventType(name, fields, handler); err != nil {
+		panic(err)
+	}
+}
+
+func registerEventType(name string, fields map[string]string, handler EventHandler) error {
+	if name == "" {
+		return fmt.Errorf("event type has no name")
+	}
+	if !strings.Contains(name, ".") {
+		name = "com.claudecode.hook." + name
+	}
+	if _, builtin := requiredDataFields[name]; builtin && customEventHandlers[name] == nil {
+		return fmt.Errorf("event type %s is built in", name)
+	}
+	required := make([]dataField, 0, len(fields))
+	for field, kind := range fields {
+		if !jsonKinds[kind] {
+			return fmt.Errorf("event type %s: field %s has invalid kind %q", name, field, kind)
+		}
+		required = append(required, dataField{field, kind})
+	}
+	sort.Slice(required, func(i, j int) bool { return required[i].name < required[j].name })
+	if handler == nil {
+		handler = customHandlerPlaceholder
+	}
+	requiredDataFields[name] = required
+	customEventHandlers[name] = handler
+	return nil
+}
+
+// loadEventTypes registers the types declared in an -event-types file. A
+// type that code already registered keeps its handler.
+func loadEventTypes(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading event types: %w", err)
+	}
+	var types map[string]map[string]string
+	if err := json.Unmarshal(data, &types); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for name, fields := range types {
+		full := name
+		if !strings.Contains(full, ".") {
+			full = "com.claudecode.hook." + full
+		}
+		if err := registerEventType(name, fields, customEventHandlers[full]); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func customHandlerPlaceholder(event CloudEvent) Response {
+	slog.Debug(SanitizeText(strings.TrimPrefix(event.Type, "com.claudecode.hook.")), "session_id", SanitizeText(event.SessionID))
+	return Response{
+		Version:   "1.0",
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+}
+
+// Additional context merging: Several sources may want to inject context
+// into the same event (local reminders configured on this server plus
+// whatever a handler returns). Contributions are trimmed, deduplicated in
+// order of appearance, and joined with blank lines so each stays readable.
+// maxContextLength caps the merged result in bytes (0 disables the cap).
+var (
+	promptReminders  []string
+	maxContextLength = 0
+)
+
+const contextSeparator = "\n\n"
+
+func mergeAdditionalContext(contributions []string, limit int) string {
+	seen := make(map[string]bool, len(contributions))
+	var parts []string
+	for _, c := range contributions {
+		c = strings.TrimSpace(c)
+		if c == "" || seen[c] {
+			continue
+		}
+		seen[c] = true
+		parts = append(parts, c)
+	}
+	merged := strings.Join(parts, contextSeparator)
+	if limit > 0 && len(merged) > limit {
+		// Cut on a rune boundary so we never emit a broken UTF-8 sequence.
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(merged[cut]) {
+			cut--
+		}
+		merged = merged[:cut]
+	}
+	return merged
+}
+
+// applyPromptReminders folds the configured local reminders into a
+// UserPromptSubmit response. Local reminders come first so they survive the
+// length cap even when a handler contributes a large block of context.
+func applyPromptReminders(response Response) Response {
+	if response.Decision == "block" || (len(promptReminders) == 0 && maxContextLength == 0) {
+		return response
+	}
+	contributions := append([]string{}, promptReminders...)
+	if response.HookSpecificOutput != nil {
+		contributions = append(contributions, response.HookSpecificOutput.AdditionalContext)
+	}
+	merged := mergeAdditionalContext(contributions, maxContextLength)
+	if merged == "" {
+		return response
+	}
+	if response.HookSpecificOutput == nil {
+		response.HookSpecificOutput = &HookSpecificOutput{HookEventName: "UserPromptSubmit"}
+	}
+	response.HookSpecificOutput.AdditionalContext = merged
+	return response
+}
+
+// subcommands are alternative entry points that run instead of the server.
+var subcommands = map[string]func(args []string) int{
+	"test-patterns": runTestPatterns,
+	"replay":        runReplay,
+	"conformance":   runConformance,
+	"tail":          runTail,
+	"keygen":        runKeygen,
+	"slo-check":     runSLOCheck,
+	"bench":         runBench,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
+	// Parse configuration: Flags default to their CCHD_* environment variables
+	// so the server can be configured either way without code changes.
+	toolAliasSpec := flag.String("tool-aliases", os.Getenv("CCHD_TOOL_ALIASES"),
+		"comma-separated From=To tool name aliases (e.g. BashTool=Bash)")
+	repeatableFlag("prompt-reminder", "context to add to every UserPromptSubmit (repeatable)",
+		func(value string) error {
+			promptReminders = append(promptReminders, value)
+			return nil
+		})
+	repeatableFlag("session-context", "context to add when a session starts or resumes (repeatable)",
+		func(value string) error {
+			sessionStartContext = append(sessionStartContext, value)
+			return nil
+		})
+	flag.IntVar(&maxContextLength, "max-context-length", envInt("CCHD_MAX_CONTEXT_LENGTH", 0),
+		"maximum bytes of merged additional context (0 for no limit)")
+	var reasonOverrides []string
+	repeatableFlag("reason-template", "rule=template override for a block reason (repeatable)",
+		func(value string) error {
+			reasonOverrides = append(reasonOverrides, value)
+			return nil
+		})
+	eventTypes := flag.String("event-types", os.Getenv("CCHD_EVENT_TYPES"),
+		"JSON file declaring custom event types and their required data fields")
+	reasonCatalog := flag.String("reason-catalog", os.Getenv("CCHD_REASON_CATALOG"),
+		"JSON file of translated reason templates keyed by language and rule")
+	maxEventRate := flag.Float64("max-event-rate", envFloat("CCHD_MAX_EVENT_RATE", 0),
+		"global events per second before shedding load (0 disables)")
+	maxEventBurst := flag.Int("max-event-burst", envInt("CCHD_MAX_EVENT_BURST", 0),
+		"burst size for -max-event-rate (defaults to the rate)")
+	sessionRate := flag.Float64("session-rate", envFloat("CCHD_SESSION_RATE", 0),
+		"events per second allowed per session before answering 429 (0 disables)")
+	sessionBurst := flag.Int("session-burst", envInt("CCHD_SESSION_BURST", 0),
+		"burst size for -session-rate (defaults to the rate)")
+	sessionIdle := flag.Duration("session-idle", envDuration("CCHD_SESSION_IDLE", 5*time.Minute),
+		"forget a session's rate limit bucket after this long without events")
+	shedMode := flag.String("shed-decision", os.Getenv("CCHD_SHED_DECISION"),
+		"response for shed events: fail (503), allow, or block")
+	flag.IntVar(&encodedMinBase64Length, "encoded-min-base64", envInt("CCHD_ENCODED_MIN_BASE64", encodedMinBase64Length),
+		"minimum base64 blob length flagged when sent to an interpreter")
+	flag.IntVar(&encodedMinHexLength, "encoded-min-hex", envInt("CCHD_ENCODED_MIN_HEX", encodedMinHexLength),
+		"minimum hex blob length flagged when sent to an interpreter")
+	flag.BoolVar(&cloudEventsResponses, "cloudevents-response", os.Getenv("CCHD_CLOUDEVENTS_RESPONSE") == "true",
+		"wrap every decision in a com.claudecode.hook.Decision CloudEvent")
+	flag.BoolVar(&validateToolInputs, "validate-tool-input", os.Getenv("CCHD_VALIDATE_TOOL_INPUT") == "true",
+		"block tool calls whose input doesn't match the schema served at /schemas")
+	auditPath := flag.String("audit-log", os.Getenv("CCHD_AUDIT_LOG"),
+		"append every decision as JSON lines to this file")
+	auditMaxSize := flag.Int("audit-max-size", envInt("CCHD_AUDIT_MAX_SIZE", 0),
+		"rotate the audit log after this many megabytes (0 disables)")
+	auditMaxAge := flag.Duration("audit-max-age", envDuration("CCHD_AUDIT_MAX_AGE", 0),
+		"rotate the audit log after this long (0 disables)")
+	auditCompress := flag.Bool("audit-compress", os.Getenv("CCHD_AUDIT_COMPRESS") == "true",
+		"gzip rotated audit log segments")
+	auditHTTP := flag.String("audit-http", os.Getenv("CCHD_AUDIT_HTTP"),
+		"also POST every audit record to this collector URL")
+	auditSyslog := flag.String("audit-syslog", os.Getenv("CCHD_AUDIT_SYSLOG"),
+		"also send every audit record to syslog: udp://host:port, tcp://host:port, or unix:///dev/log")
+	auditBuffer := flag.Int("audit-buffer", envInt("CCHD_AUDIT_BUFFER", 1024),
+		"records buffered per audit sink before new ones are dropped")
+	flag.StringVar(&advisorySource, "advisory-source", os.Getenv("CCHD_ADVISORY_SOURCE"),
+		"annotate package installs from an OSV-compatible query URL or a local advisory JSON file")
+	flag.DurationVar(&advisoryClient.Timeout, "advisory-timeout", envDuration("CCHD_ADVISORY_TIMEOUT", 2*time.Second),
+		"how long to wait for the advisory source before failing open")
+	flag.DurationVar(&advisoryTTL, "advisory-cache-ttl", envDuration("CCHD_ADVISORY_CACHE_TTL", time.Hour),
+		"how long advisory lookups are cached")
+	shadowURL := flag.String("shadow", os.Getenv("CCHD_SHADOW"),
+		"also send every event to this candidate server and log where it disagrees")
+	shadowLog := flag.String("shadow-log", os.Getenv("CCHD_SHADOW_LOG"),
+		"file to append shadow disagreements to (default stderr)")
+	shadowConcurrency := flag.Int("shadow-concurrency", envInt("CCHD_SHADOW_CONCURRENCY", 16),
+		"shadow requests in flight before events are skipped")
+	shadowTimeout := flag.Duration("shadow-timeout", envDuration("CCHD_SHADOW_TIMEOUT", 10*time.Second),
+		"how long to wait for the shadow server")
+	sloTarget := flag.Duration("slo-target", envDuration("CCHD_SLO_TARGET", 0),
+		"track how often decisions take longer than this (0 disables)")
+	sloObjective := flag.Float64("slo-objective", envFloat("CCHD_SLO_OBJECTIVE", 0.99),
+		"fraction of decisions that must meet -slo-target")
+	sloWindow := flag.Duration("slo-window", envDuration("CCHD_SLO_WINDOW", time.Hour),
+		"sliding window the error budget covers, in whole minutes")
+	tlsCert := flag.String("tls-cert", os.Getenv("CCHD_TLS_CERT"),
+		"PEM certificate file; serve HTTPS when set with -tls-key")
+	tlsKey := flag.String("tls-key", os.Getenv("CCHD_TLS_KEY"),
+		"PEM private key file for -tls-cert")
+	tlsMinVersion := flag.String("tls-min-version", os.Getenv("CCHD_TLS_MIN_VERSION"),
+		"minimum TLS version: 1.0, 1.1, 1.2 (default), or 1.3")
+	listenAddr := flag.String("listen", envString("CCHD_LISTEN", fmt.Sprintf("127.0.0.1:%d", PORT)),
+		"address to listen on; use :PORT to accept connections from other hosts")
+	shutdownTimeout := flag.Duration("shutdown-timeout", envDuration("CCHD_SHUTDOWN_TIMEOUT", 5*time.Second),
+		"how long shutdown waits for in-flight requests, and then for audit sinks to flush")
+	flag.DurationVar(&destructiveDelay, "destructive-delay", envDuration("CCHD_DESTRUCTIVE_DELAY", 0),
+		"cool-down before destructive Bash commands run, rounded to seconds (0 disables)")
+	flag.BoolVar(&coalesceEvents, "coalesce", os.Getenv("CCHD_COALESCE") == "true",
+		"share one evaluation between identical concurrent events in a session")
+	blockCategories := flag.String("block-categories", os.Getenv("CCHD_BLOCK_CATEGORIES"),
+		"comma-separated command categories to block (e.g. network,package-install)")
+	repeatableFlag("command-category", "name=prog1,prog2 command category definition (repeatable)", addCommandCategory)
+	flag.BoolVar(&secretStrict, "secret-strict", os.Getenv("CCHD_SECRET_STRICT") == "true",
+		"block tool output that contains a likely secret instead of only reporting it")
+	flag.IntVar(&secretMinLength, "secret-min-length", envInt("CCHD_SECRET_MIN_LENGTH", secretMinLength),
+		"shortest string, in characters, checked for secret-like entropy")
+	flag.Float64Var(&secretMinEntropy, "secret-min-entropy", envFloat("CCHD_SECRET_MIN_ENTROPY", secretMinEntropy),
+		"lowest entropy, in bits per character, reported as a likely secret")
+	flag.StringVar(&notifyWebhook, "notify-webhook", os.Getenv("CCHD_NOTIFY_WEBHOOK"),
+		"URL to POST severe notifications to")
+	notifySeverity := flag.String("notify-min-severity", os.Getenv("CCHD_NOTIFY_MIN_SEVERITY"),
+		"lowest severity forwarded to -notify-webhook: info, warning, or critical (default critical)")
+	repeatableFlag("notify-rule", "regex=severity rule for notifications without a level (repeatable)", addSeverityRule)
+	flag.Int64Var(&maxBodySize, "max-body-size", int64(envInt("CCHD_MAX_BODY_SIZE", int(maxBodySize))),
+		"largest accepted request body in bytes")
+	flag.IntVar(&stats.ByTool.limit, "stats-max-tools", envInt("CCHD_STATS_MAX_TOOLS", stats.ByTool.limit),
+		"distinct tool names counted in /stats before bucketing into \"other\" (0 for no limit)")
+	flag.IntVar(&stats.BySession.limit, "stats-max-sessions", envInt("CCHD_STATS_MAX_SESSIONS", stats.BySession.limit),
+		"distinct session ids counted in /stats before bucketing into \"other\" (0 for no limit)")
+	replayWindow := flag.Duration("replay-window", envDuration("CCHD_REPLAY_WINDOW", 0),
+		"reject events older than this or with a nonce seen within it (0 disables)")
+	replayMaxNonces := flag.Int("replay-max-nonces", envInt("CCHD_REPLAY_MAX_NONCES", 100000),
+		"most nonces remembered for -replay-window")
+	cacheSize := flag.Int("cache-size", envInt("CCHD_CACHE_SIZE", 0),
+		"number of PreToolUse decisions to cache (0 disables caching)")
+	cacheTTL := flag.Duration("cache-ttl", envDuration("CCHD_CACHE_TTL", 5*time.Minute),
+		"how long a cached decision stays valid")
+	flag.BoolVar(&cacheContentHash, "cache-content-hash", os.Getenv("CCHD_CACHE_CONTENT_HASH") == "true",
+		"key cached Read/Write/Edit decisions on file content as well as path")
+	flag.Int64Var(&cacheContentMaxSize, "cache-content-max-size", int64(envInt("CCHD_CACHE_CONTENT_MAX_SIZE", int(cacheContentMaxSize))),
+		"largest file in bytes hashed for -cache-content-hash")
+	cacheKeyFields := flag.String("cache-key-fields", os.Getenv("CCHD_CACHE_KEY_FIELDS"),
+		"comma-separated data fields that make up the decision cache key (default: built-in key)")
+	warmCache := flag.String("warm-cache", os.Getenv("CCHD_WARM_CACHE"),
+		"file of common calls to evaluate into the decision cache at startup")
+	patternFile := flag.String("patterns", os.Getenv("CCHD_PATTERNS"),
+		"JSON or YAML file of additional security patterns")
+	unknownEvents := flag.String("unknown-events", os.Getenv("CCHD_UNKNOWN_EVENTS"),
+		"handling for unrecognized event types: allow, block, or warn")
+	decryptKeyPath := flag.String("decrypt-key", os.Getenv("CCHD_DECRYPT_KEY"),
+		"X25519 private key file; require and decrypt encrypted event data")
+	malformedData := flag.String("on-malformed-data", os.Getenv("CCHD_ON_MALFORMED_DATA"),
+		"handling for events missing required data fields: allow, block, or warn")
+	configPath := flag.String("config", os.Getenv("CCHD_SERVER_CONFIG"),
+		"JSON configuration file with named profiles")
+	profileName := flag.String("profile", os.Getenv("CCHD_PROFILE"),
+		"profile from the configuration file to apply")
+	logFormat := flag.String("log-format", os.Getenv("CCHD_LOG_FORMAT"),
+		"server log format on stderr: json (default) or text")
+	logLevel := flag.String("log-level", os.Getenv("CCHD_LOG_LEVEL"),
+		"lowest log level written: debug, info (default), warn, or error")
+	dumpConfig := flag.Bool("dump-config", false,
+		"print the effective configuration and where each value came from, then exit")
+	flag.Parse()
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	var settings map[string]json.RawMessage
+	if *profileName != "" {
+		if *configPath == "" {
+			log.Fatalf("profile %q requested but no -config file given", *profileName)
+		}
+		cfg, err := readConfigFile(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		settings, err = resolveProfile(cfg, *profileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := applyProfile(settings); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *dumpConfig {
+		if err := writeEffectiveConfig(os.Stdout, explicit, settings); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if err := configureLogging(*logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadToolAliases(*toolAliasSpec); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadReasonTemplates(reasonOverrides); err != nil {
+		log.Fatal(err)
+	}
+	if *reasonCatalog != "" {
+		if err := loadReasonCatalog(*reasonCatalog); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *eventTypes != "" {
+		if err := loadEventTypes(*eventTypes); err != nil {
+			log.Fatal(err)
+		}
+	}
+	policy, err := parseUnknownEventPolicy(*unknownEvents)
+	if err != nil {
+		log.Fatal(err)
+	}
+	unknownEventPolicy = policy
+	if malformedDataPolicy, err = parseEventPolicy("malformed data", *malformedData); err != nil {
+		log.Fatal(err)
+	}
+	if shedDecision, err = parseShedDecision(*shedMode); err != nil {
+		log.Fatal(err)
+	}
+	serverTLS, err := tlsConfig(*tlsCert, *tlsKey, *tlsMinVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, category := range strings.Split(*blockCategories, ",") {
+		if category = strings.TrimSpace(category); category != "" {
+			if _, ok := commandCategories[category]; !ok {
+				log.Fatalf("unknown command category %q", category)
+			}
+			blockedCategories[category] = true
+		}
+	}
+	if securityPatterns, err = loadSecurityPatterns(*patternFile); err != nil {
+		log.Fatal(err)
+	}
+	if *notifySeverity != "" {
+		if _, ok := severityRanks[*notifySeverity]; !ok {
+			log.Fatalf("unknown notification severity %q", *notifySeverity)
+		}
+		notifyMinSeverity = *notifySeverity
+	}
+	if advisorySource != "" && !strings.HasPrefix(advisorySource, "http://") && !strings.HasPrefix(advisorySource, "https://") {
+		if advisoryDB, err = loadAdvisoryDB(advisorySource); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *sloTarget > 0 {
+		if *sloObjective <= 0 || *sloObjective >= 1 {
+			log.Fatalf("-slo-objective must be between 0 and 1, got %v", *sloObjective)
+		}
+		slo = newSLOTracker(*sloTarget, *sloObjective, *sloWindow)
+	}
+	if *shadowURL != "" {
+		var out io.Writer = os.Stderr
+		if *shadowLog != "" {
+			file, err := os.OpenFile(*shadowLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer file.Close()
+			out = file
+		}
+		shadow = newShadowServer(*shadowURL, *shadowConcurrency, *shadowTimeout, out)
+	}
+	if *decryptKeyPath != "" {
+		if decryptKey, err = loadDecryptKey(*decryptKeyPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *replayWindow > 0 {
+		// A cap below one would evict every nonce before it is stored,
+		// silently turning replay detection off.
+		if *replayMaxNonces < 1 {
+			log.Fatalf("-replay-max-nonces must be at least 1, got %d", *replayMaxNonces)
+		}
+		replayGuard = NewReplayGuard(*replayWindow, *replayMaxNonces)
+	}
+	if *cacheSize > 0 {
+		decisions = newDecisionCache(*cacheSize, *cacheTTL)
+	}
+	if *cacheKeyFields != "" {
+		var fields []string
+		for _, field := range strings.Split(*cacheKeyFields, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, field)
+			}
+		}
+		SetCacheKeyFunc(fieldsCacheKey(fields))
+	}
+	if *warmCache != "" {
+		if decisions == nil {
+			log.Fatal("-warm-cache requires -cache-size")
+		}
+		warmed, err := warmDecisionCache(*warmCache)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("Warmed decision cache", "entries", warmed)
+	}
+	if *maxEventRate > 0 {
+		eventLimiter = newTokenBucket(*maxEventRate, *maxEventBurst)
+	}
+	if *sessionRate > 0 {
+		sessionLimits = newSessionLimiter(*sessionRate, *sessionBurst, *sessionIdle)
+	}
+	if *auditPath != "" || *auditHTTP != "" || *auditSyslog != "" {
+		audit = &auditFanout{}
+	}
+	if *auditPath != "" {
+		file, err := openAuditLog(*auditPath, int64(*auditMaxSize)<<20, *auditMaxAge, *auditCompress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		audit.add("file", file, *auditBuffer)
+	}
+	if *auditHTTP != "" {
+		audit.add("http", &httpAuditSink{url: *auditHTTP, client: &http.Client{Timeout: 10 * time.Second}}, *auditBuffer)
+	}
+	if *auditSyslog != "" {
+		sink, err := newSyslogAuditSink(*auditSyslog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		audit.add("syslog", sink, *auditBuffer)
+	}
+	registerReadinessChecks()
+
 	// Set up routes: We expose /hook as the main webhook endpoint and provide
 	// a helpful error message for requests to other paths.
-	http.HandleFunc("/hook", webhookHandler)
+	http.Handle("/hook", hooks)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/stats", statsHandler)
+	http.HandleFunc("/schemas", schemasHandler)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
@@ -307,23 +1709,61 @@ func main() {
 		})
 	})
 
-	// Start server: The server listens on localhost by default for security.
-	// In production, use proper TLS certificates and authentication.
-	fmt.Printf("🚀 Claude Hooks server listening on http://localhost:%d\n", PORT)
-	fmt.Printf("📮 Send webhooks to: http://localhost:%d/hook\n", PORT)
-	fmt.Println("\nPress Ctrl+C to stop the server")
+	if len(webhookSecret) == 0 {
+		slog.Warn("CCHD_WEBHOOK_SECRET is not set; requests are accepted without a signature")
+	}
 
 	// Handle graceful shutdown: This ensures the server can be stopped cleanly
 	// with Ctrl+C, allowing any in-flight requests to complete.
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	// Listen before reporting ready: Binding the port first means /readyz
+	// can never claim readiness for a server that failed to start. The
+	// server listens on loopback only unless -listen says otherwise; in
+	// production, add -tls-cert, -tls-key and a webhook secret before
+	// widening it.
+	listener, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scheme := "http"
+	if serverTLS != nil {
+		listener = tls.NewListener(listener, serverTLS)
+		scheme = "https"
+	}
+	ready.Store(true)
+
+	fmt.Printf("🚀 Claude Hooks server listening on %s://%s\n", scheme, listener.Addr())
+	fmt.Printf("📮 Send webhooks to: %s://%s/hook\n", scheme, listener.Addr())
+	fmt.Println("\nPress Ctrl+C to stop the server")
+
+	// Bound header reads: A client that trickles its headers would otherwise
+	// hold a connection open forever.
+	server := &http.Server{ReadHeaderTimeout: 10 * time.Second}
 	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", PORT), nil); err != nil {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
 
 	<-sigChan
+	ready.Store(false)
 	fmt.Println("\n👋 Shutting down server...")
+	shutdown(server, audit, *shutdownTimeout)
+}
+
+// shutdown stops accepting connections and waits up to timeout for
+// in-flight requests to finish, then up to timeout again for the audit sinks
+// to flush. Requests go first so the records they write are in the buffers
+// before the sinks close; a record arriving after that would be dropped.
+func shutdown(server *http.Server, audit *auditFanout, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("In-flight requests still running", "timeout", timeout, "error", err)
+	}
+	if audit != nil {
+		audit.closeWithin(timeout)
+	}
 }
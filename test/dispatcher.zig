@@ -0,0 +1,1773 @@
+const std = @import("std");
+const testing = std.testing;
+const builtin = @import("builtin");
+
+// Capture server for dispatcher option tests. Each test needs to see exactly
+// what the dispatcher put on the wire (headers and CloudEvent body) and to
+// control the answer it gets back, which the template servers can't offer.
+// The server handles a single request on an ephemeral port, so tests run in
+// parallel without fighting over 8080. It stops listening once that request
+// arrives, so any later connection is refused instead of hanging.
+const CaptureServer = struct {
+    server: std.net.Server,
+    thread: std.Thread = undefined,
+    response: []const u8,
+    request: [256 * 1024]u8 = undefined,
+    request_len: usize = 0,
+    url_buffer: [64]u8 = undefined,
+    url_len: usize = 0,
+
+    fn init(response: []const u8) !CaptureServer {
+        const address = try std.net.Address.parseIp("127.0.0.1", 0);
+        var capture: CaptureServer = .{
+            .server = try address.listen(.{ .reuse_address = true }),
+            .response = response,
+        };
+        capture.url_len = (std.fmt.bufPrint(&capture.url_buffer, "http://127.0.0.1:{d}/hook", .{capture.server.listen_address.getPort()}) catch unreachable).len;
+        return capture;
+    }
+
+    fn start(self: *CaptureServer) !void {
+        self.thread = try std.Thread.spawn(.{}, serve, .{self});
+    }
+
+    // Waits for the captured request. Call only after the dispatcher exits,
+    // so the single accepted connection has been served.
+    fn finish(self: *CaptureServer) void {
+        self.thread.join();
+    }
+
+    fn url(self: *CaptureServer) []const u8 {
+        return self.url_buffer[0..self.url_len];
+    }
+
+    fn serve(self: *CaptureServer) void {
+        const connection = self.server.accept() catch {
+            self.server.deinit();
+            return;
+        };
+        self.server.deinit();
+        defer connection.stream.close();
+
+        // Read until the headers and the full Content-Length body arrived.
+        while (self.request_len < self.request.len) {
+            const n = connection.stream.read(self.request[self.request_len..]) catch return;
+            if (n == 0) break;
+            self.request_len += n;
+            if (requestComplete(self.request[0..self.request_len])) break;
+        }
+        connection.stream.writeAll(self.response) catch {};
+    }
+
+    fn requestComplete(request: []const u8) bool {
+        const header_end = std.mem.indexOf(u8, request, "\r\n\r\n") orelse return false;
+        const length = headerValue(request[0..header_end], "Content-Length") orelse return true;
+        const body_len = std.fmt.parseInt(usize, length, 10) catch return true;
+        return request.len >= header_end + 4 + body_len;
+    }
+
+    fn headerValue(headers: []const u8, name: []const u8) ?[]const u8 {
+        var lines = std.mem.splitSequence(u8, headers, "\r\n");
+        while (lines.next()) |line| {
+            const colon = std.mem.indexOfScalar(u8, line, ':') orelse continue;
+            if (std.ascii.eqlIgnoreCase(line[0..colon], name)) {
+                return std.mem.trim(u8, line[colon + 1 ..], " ");
+            }
+        }
+        return null;
+    }
+
+    fn header(self: *CaptureServer, name: []const u8) ?[]const u8 {
+        const request = self.request[0..self.request_len];
+        const header_end = std.mem.indexOf(u8, request, "\r\n\r\n") orelse return null;
+        return headerValue(request[0..header_end], name);
+    }
+
+    fn body(self: *CaptureServer) []const u8 {
+        const request = self.request[0..self.request_len];
+        const header_end = std.mem.indexOf(u8, request, "\r\n\r\n") orelse return "";
+        return request[header_end + 4 ..];
+    }
+};
+
+// Builds a complete HTTP/1.1 200 response around a JSON body at compile time.
+fn okResponse(comptime json_body: []const u8) []const u8 {
+    return std.fmt.comptimePrint("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: {d}\r\nConnection: close\r\n\r\n{s}", .{ json_body.len, json_body });
+}
+
+const allow_response = okResponse("{\"decision\":\"allow\"}");
+
+const pre_tool_use_input =
+    \\{"session_id":"test123","hook_event_name":"PreToolUse","tool_name":"Bash","tool_input":{"command":"echo hello"}}
+;
+
+fn runDispatcher(allocator: std.mem.Allocator, input: []const u8, options: []const []const u8, env_map: ?*const std.process.EnvMap) !std.process.Child.RunResult {
+    var argv_list = std.ArrayList([]const u8).init(allocator);
+    defer argv_list.deinit();
+    try argv_list.append("./zig-out/bin/cchd");
+    try argv_list.append("--no-color");
+    try argv_list.appendSlice(options);
+
+    var child = std.process.Child.init(argv_list.items, allocator);
+    child.stdin_behavior = .Pipe;
+    child.stdout_behavior = .Pipe;
+    child.stderr_behavior = .Pipe;
+    child.env_map = env_map;
+
+    try child.spawn();
+    try child.stdin.?.writeAll(input);
+    child.stdin.?.close();
+    child.stdin = null;
+
+    const stdout = try child.stdout.?.readToEndAlloc(allocator, 1024 * 1024);
+    errdefer allocator.free(stdout);
+    const stderr = try child.stderr.?.readToEndAlloc(allocator, 1024 * 1024);
+    errdefer allocator.free(stderr);
+
+    return .{ .term = try child.wait(), .stdout = stdout, .stderr = stderr };
+}
+
+// Sends input through the dispatcher to a capture server answering with
+// response, and returns the parsed CloudEvent the server received.
+fn captureEvent(allocator: std.mem.Allocator, server: *CaptureServer, input: []const u8, options: []const []const u8, env_map: ?*const std.process.EnvMap) !std.json.Parsed(std.json.Value) {
+    try server.start();
+
+    var argv = std.ArrayList([]const u8).init(allocator);
+    defer argv.deinit();
+    try argv.appendSlice(&.{ "--server", server.url() });
+    try argv.appendSlice(options);
+
+    const result = try runDispatcher(allocator, input, argv.items, env_map);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    return std.json.parseFromSlice(std.json.Value, allocator, server.body(), .{});
+}
+
+test "--include-raw forwards the original stdin as rawdata" {
+    const allocator = testing.allocator;
+
+    // Extra whitespace and key order are what the reconstructed data field
+    // loses, so the raw attribute must preserve them byte for byte.
+    const input = "{ \"tool_name\":\"Bash\",  \"session_id\":\"test123\",\"hook_event_name\":\"PreToolUse\",\"tool_input\":{\"command\":\"ls\"} }";
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, input, &.{"--include-raw"}, null);
+    defer event.deinit();
+
+    const encoded = event.value.object.get("rawdata").?.string;
+    const decoder = std.base64.standard.Decoder;
+    const decoded = try allocator.alloc(u8, try decoder.calcSizeForSlice(encoded));
+    defer allocator.free(decoded);
+    try decoder.decode(decoded, encoded);
+    try testing.expectEqualStrings(input, decoded);
+}
+
+test "rawdata is omitted without --include-raw" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{}, null);
+    defer event.deinit();
+
+    try testing.expect(event.value.object.get("rawdata") == null);
+}
+
+test "--user-id takes the first source that yields a value" {
+    const allocator = testing.allocator;
+
+    var env_map = try std.process.getEnvMap(allocator);
+    defer env_map.deinit();
+    env_map.remove("CCHD_TEST_MISSING");
+    try env_map.put("CCHD_TEST_USER", "alice");
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{ "--user-id", "env:CCHD_TEST_MISSING,env:CCHD_TEST_USER,os" }, &env_map);
+    defer event.deinit();
+
+    try testing.expectEqualStrings("alice", event.value.object.get("userid").?.string);
+}
+
+test "--user-id exec source reads a credential helper" {
+    const allocator = testing.allocator;
+
+    // The command runs to the end of the list, commas included.
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{ "--user-id", "env:CCHD_TEST_MISSING,exec:printf 'bob,smith\\nsecond line\\n'" }, null);
+    defer event.deinit();
+
+    try testing.expectEqualStrings("bob,smith", event.value.object.get("userid").?.string);
+}
+
+test "--hash-user-id sends the SHA-256 hex of the identity" {
+    const allocator = testing.allocator;
+
+    var env_map = try std.process.getEnvMap(allocator);
+    defer env_map.deinit();
+    try env_map.put("CCHD_TEST_USER", "alice");
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{ "--user-id", "env:CCHD_TEST_USER", "--hash-user-id" }, &env_map);
+    defer event.deinit();
+
+    var digest: [std.crypto.hash.sha2.Sha256.digest_length]u8 = undefined;
+    std.crypto.hash.sha2.Sha256.hash("alice", &digest, .{});
+    const expected = std.fmt.bytesToHex(digest, .lower);
+    try testing.expectEqualStrings(&expected, event.value.object.get("userid").?.string);
+}
+
+test "userid is omitted when no source yields a value" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{ "--user-id", "env:CCHD_TEST_MISSING,exec:false" }, null);
+    defer event.deinit();
+
+    try testing.expect(event.value.object.get("userid") == null);
+}
+
+test "requests carry the request timeout in Cchd-Timeout" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{ "--timeout", "2500" }, null);
+    defer event.deinit();
+
+    try testing.expectEqualStrings("2500m", server.header("Cchd-Timeout").?);
+}
+
+// Parses a grpc-timeout value the dispatcher sent in milliseconds.
+fn timeoutMillis(value: []const u8) !u64 {
+    try testing.expect(std.mem.endsWith(u8, value, "m"));
+    try testing.expect(value.len <= 9);
+    return std.fmt.parseInt(u64, value[0 .. value.len - 1], 10);
+}
+
+test "--deadline caps Cchd-Timeout at the time left" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{ "--deadline", "1500" }, null);
+    defer event.deinit();
+
+    // Some of the deadline is spent before the request goes out.
+    const timeout = try timeoutMillis(server.header("Cchd-Timeout").?);
+    try testing.expect(timeout <= 1500);
+    try testing.expect(timeout > 500);
+}
+
+test "CCHD_DEADLINE_MS sets the deadline from the environment" {
+    const allocator = testing.allocator;
+
+    var env_map = try std.process.getEnvMap(allocator);
+    defer env_map.deinit();
+    try env_map.put("CCHD_DEADLINE_MS", "1200");
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{}, &env_map);
+    defer event.deinit();
+
+    try testing.expect(try timeoutMillis(server.header("Cchd-Timeout").?) <= 1200);
+}
+
+test "--deadline stops retries that can't fit" {
+    const allocator = testing.allocator;
+
+    // A server that accepts but never answers: without the deadline, three
+    // attempts at the 5s default timeout would take 15s plus backoff.
+    const address = try std.net.Address.parseIp("127.0.0.1", 0);
+    var silent = try address.listen(.{ .reuse_address = true });
+    defer silent.deinit();
+
+    var url_buffer: [64]u8 = undefined;
+    const url = try std.fmt.bufPrint(&url_buffer, "http://127.0.0.1:{d}/hook", .{silent.listen_address.getPort()});
+
+    const start = std.time.milliTimestamp();
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", url, "--deadline", "800" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    const elapsed = std.time.milliTimestamp() - start;
+
+    // Fail-closed by default, so the timeout blocks the operation.
+    try testing.expect(result.term.Exited != 0);
+    try testing.expect(elapsed < 3000);
+}
+
+test "--lang is forwarded as Accept-Language in preference order" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{ "--lang", "de-CH,fr" }, null);
+    defer event.deinit();
+
+    try testing.expectEqualStrings("de-CH, fr;q=0.9", server.header("Accept-Language").?);
+}
+
+test "CCHD_LANG accepts a POSIX locale name" {
+    const allocator = testing.allocator;
+
+    var env_map = try std.process.getEnvMap(allocator);
+    defer env_map.deinit();
+    try env_map.put("CCHD_LANG", "de_CH.UTF-8");
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{}, &env_map);
+    defer event.deinit();
+
+    try testing.expectEqualStrings("de-CH", server.header("Accept-Language").?);
+}
+
+test "Accept-Language is omitted for the C locale" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{ "--lang", "C" }, null);
+    defer event.deinit();
+
+    try testing.expect(server.header("Accept-Language") == null);
+}
+
+test "every event carries a fresh random nonce" {
+    const allocator = testing.allocator;
+
+    var nonces: [2][]u8 = undefined;
+    for (&nonces) |*nonce| {
+        var server = try CaptureServer.init(allow_response);
+        const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{}, null);
+        defer event.deinit();
+
+        const value = event.value.object.get("nonce").?.string;
+        try testing.expectEqual(@as(usize, 32), value.len);
+        for (value) |c| try testing.expect(std.ascii.isHex(c));
+        nonce.* = try allocator.dupe(u8, value);
+    }
+    defer for (nonces) |nonce| allocator.free(nonce);
+
+    try testing.expect(!std.mem.eql(u8, nonces[0], nonces[1]));
+}
+
+test "--forward-env sends only the named variables that are set" {
+    const allocator = testing.allocator;
+
+    var env_map = try std.process.getEnvMap(allocator);
+    defer env_map.deinit();
+    try env_map.put("CCHD_TEST_PATH", "/usr/bin:/bin");
+    try env_map.put("CCHD_TEST_QUOTED", "say \"hi\"");
+    try env_map.put("CCHD_TEST_SECRET", "hunter2");
+    env_map.remove("CCHD_TEST_MISSING");
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{ "--forward-env", "CCHD_TEST_PATH,CCHD_TEST_QUOTED,CCHD_TEST_MISSING,not-a-name" }, &env_map);
+    defer event.deinit();
+
+    const forwarded = try std.json.parseFromSlice(std.json.Value, allocator, event.value.object.get("forwardedenv").?.string, .{});
+    defer forwarded.deinit();
+
+    const env = forwarded.value.object;
+    try testing.expectEqual(@as(usize, 2), env.count());
+    try testing.expectEqualStrings("/usr/bin:/bin", env.get("CCHD_TEST_PATH").?.string);
+    try testing.expectEqualStrings("say \"hi\"", env.get("CCHD_TEST_QUOTED").?.string);
+}
+
+test "no environment is forwarded by default" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{}, null);
+    defer event.deinit();
+
+    try testing.expect(event.value.object.get("forwardedenv") == null);
+}
+
+const empty_response = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n";
+
+// Runs the dispatcher against a server answering 200 with an empty body.
+fn runWithEmptyResponse(allocator: std.mem.Allocator, options: []const []const u8) !std.process.Child.RunResult {
+    var server = try CaptureServer.init(empty_response);
+    try server.start();
+
+    var argv = std.ArrayList([]const u8).init(allocator);
+    defer argv.deinit();
+    try argv.appendSlice(&.{ "--server", server.url() });
+    try argv.appendSlice(options);
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, argv.items, null);
+    server.finish();
+    return result;
+}
+
+test "an empty 200 blocks by default" {
+    const allocator = testing.allocator;
+
+    const result = try runWithEmptyResponse(allocator, &.{});
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expectEqual(@as(u8, 1), result.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "empty response") != null);
+}
+
+test "an empty 200 follows --fail-open" {
+    const allocator = testing.allocator;
+
+    const result = try runWithEmptyResponse(allocator, &.{"--fail-open"});
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+}
+
+test "--on-empty-response block wins over --fail-open" {
+    const allocator = testing.allocator;
+
+    const result = try runWithEmptyResponse(allocator, &.{ "--fail-open", "--on-empty-response", "block" });
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expectEqual(@as(u8, 1), result.term.Exited);
+}
+
+test "--on-empty-response allow lets the operation through" {
+    const allocator = testing.allocator;
+
+    const result = try runWithEmptyResponse(allocator, &.{ "--on-empty-response", "allow" });
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, result.stdout, "echo hello") != null);
+}
+
+test "--on-empty-response rejects unknown policies" {
+    const allocator = testing.allocator;
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--on-empty-response", "maybe" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expect(result.term.Exited != 0);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "--on-empty-response") != null);
+}
+
+const legacy_allow_response = allow_response;
+const modern_allow_response = okResponse("{\"hookSpecificOutput\":{\"hookEventName\":\"PreToolUse\",\"permissionDecision\":\"allow\"}}");
+
+// Runs the dispatcher against a server answering with response and returns
+// its exit code.
+fn exitCodeFor(allocator: std.mem.Allocator, response: []const u8, input: []const u8, options: []const []const u8, env_map: ?*const std.process.EnvMap) !u8 {
+    var server = try CaptureServer.init(response);
+    try server.start();
+
+    var argv = std.ArrayList([]const u8).init(allocator);
+    defer argv.deinit();
+    try argv.appendSlice(&.{ "--server", server.url() });
+    try argv.appendSlice(options);
+
+    const result = try runDispatcher(allocator, input, argv.items, env_map);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+    return result.term.Exited;
+}
+
+test "--response-format auto accepts both formats" {
+    const allocator = testing.allocator;
+
+    try testing.expectEqual(@as(u8, 0), try exitCodeFor(allocator, legacy_allow_response, pre_tool_use_input, &.{}, null));
+    try testing.expectEqual(@as(u8, 0), try exitCodeFor(allocator, modern_allow_response, pre_tool_use_input, &.{}, null));
+}
+
+test "--response-format modern rejects a legacy PreToolUse decision" {
+    const allocator = testing.allocator;
+
+    try testing.expectEqual(@as(u8, 1), try exitCodeFor(allocator, legacy_allow_response, pre_tool_use_input, &.{ "--response-format", "modern" }, null));
+    try testing.expectEqual(@as(u8, 0), try exitCodeFor(allocator, modern_allow_response, pre_tool_use_input, &.{ "--response-format", "modern" }, null));
+
+    // Other events keep the top-level decision in the modern format.
+    const stop_input =
+        \\{"session_id":"test123","hook_event_name":"Stop","stop_hook_active":false}
+    ;
+    try testing.expectEqual(@as(u8, 0), try exitCodeFor(allocator, legacy_allow_response, stop_input, &.{ "--response-format", "modern" }, null));
+}
+
+test "--response-format legacy rejects permissionDecision" {
+    const allocator = testing.allocator;
+
+    try testing.expectEqual(@as(u8, 1), try exitCodeFor(allocator, modern_allow_response, pre_tool_use_input, &.{ "--response-format", "legacy" }, null));
+    try testing.expectEqual(@as(u8, 0), try exitCodeFor(allocator, legacy_allow_response, pre_tool_use_input, &.{ "--response-format", "legacy" }, null));
+}
+
+test "a wrong-format response follows the fail mode" {
+    const allocator = testing.allocator;
+
+    try testing.expectEqual(@as(u8, 0), try exitCodeFor(allocator, legacy_allow_response, pre_tool_use_input, &.{ "--response-format", "modern", "--fail-open" }, null));
+}
+
+test "a server_urls entry pins its own response format" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(legacy_allow_response);
+    try server.start();
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const config_json = try std.fmt.allocPrint(allocator, "{{\"server_urls\":[{{\"url\":\"{s}\",\"response_format\":\"modern\"}}],\"response_format\":\"legacy\"}}", .{server.url()});
+    defer allocator.free(config_json);
+    try tmp.dir.writeFile(.{ .sub_path = "config.json", .data = config_json });
+    const config_path = try tmp.dir.realpathAlloc(allocator, "config.json");
+    defer allocator.free(config_path);
+
+    var env_map = try std.process.getEnvMap(allocator);
+    defer env_map.deinit();
+    try env_map.put("CCHD_CONFIG_PATH", config_path);
+    env_map.remove("HOOK_SERVER_URL");
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{}, &env_map);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+
+    try testing.expectEqual(@as(u8, 1), result.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "pinned modern format") != null);
+}
+
+test "--response-format rejects unknown formats" {
+    const allocator = testing.allocator;
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--response-format", "newest" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expect(result.term.Exited != 0);
+}
+
+// Returns a server URL nothing listens on, so connections are refused.
+fn unreachableUrl(buffer: []u8) ![]const u8 {
+    const address = try std.net.Address.parseIp("127.0.0.1", 0);
+    var listener = try address.listen(.{ .reuse_address = true });
+    const port = listener.listen_address.getPort();
+    listener.deinit();
+    return std.fmt.bufPrint(buffer, "http://127.0.0.1:{d}/hook", .{port});
+}
+
+fn countSpooled(dir: std.fs.Dir) !usize {
+    var count: usize = 0;
+    var it = dir.iterate();
+    while (try it.next()) |entry| {
+        if (std.mem.endsWith(u8, entry.name, ".event.json")) count += 1;
+    }
+    return count;
+}
+
+fn notificationInput(comptime message: []const u8) []const u8 {
+    return "{\"session_id\":\"test123\",\"hook_event_name\":\"Notification\",\"message\":\"" ++ message ++ "\"}";
+}
+
+test "--spool-dir keeps audit events while the server is down" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{ .iterate = true });
+    defer tmp.cleanup();
+    const spool_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(spool_path);
+
+    var url_buffer: [64]u8 = undefined;
+    const url = try unreachableUrl(&url_buffer);
+
+    const result = try runDispatcher(allocator, notificationInput("first"), &.{ "--server", url, "--spool-dir", spool_path }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    // Spooled rather than failed closed.
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    try testing.expectEqual(@as(usize, 1), try countSpooled(tmp.dir));
+}
+
+test "--spool-dir never holds decision events" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{ .iterate = true });
+    defer tmp.cleanup();
+    const spool_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(spool_path);
+
+    var url_buffer: [64]u8 = undefined;
+    const url = try unreachableUrl(&url_buffer);
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", url, "--spool-dir", spool_path }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expect(result.term.Exited != 0);
+    try testing.expectEqual(@as(usize, 0), try countSpooled(tmp.dir));
+}
+
+test "spooled events are delivered before newer ones" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{ .iterate = true });
+    defer tmp.cleanup();
+    const spool_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(spool_path);
+
+    var url_buffer: [64]u8 = undefined;
+    const down_url = try unreachableUrl(&url_buffer);
+    const spooled = try runDispatcher(allocator, notificationInput("older"), &.{ "--server", down_url, "--spool-dir", spool_path }, null);
+    allocator.free(spooled.stdout);
+    allocator.free(spooled.stderr);
+    try testing.expectEqual(@as(usize, 1), try countSpooled(tmp.dir));
+
+    // The capture server takes one request, which must be the older event.
+    // The newer one then finds the server gone and waits in the spool.
+    var server = try CaptureServer.init(allow_response);
+    try server.start();
+    const result = try runDispatcher(allocator, notificationInput("newer"), &.{ "--server", server.url(), "--spool-dir", spool_path }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, server.body(), "older") != null);
+    try testing.expectEqual(@as(usize, 1), try countSpooled(tmp.dir));
+}
+
+// Runs input with the server list unreachable and one route pointing at a
+// capture server, so a zero exit means the route was taken.
+fn runRouted(allocator: std.mem.Allocator, input: []const u8, route_key: []const u8) !u8 {
+    var server = try CaptureServer.init(allow_response);
+    try server.start();
+
+    var url_buffer: [64]u8 = undefined;
+    const down_url = try unreachableUrl(&url_buffer);
+    const route = try std.fmt.allocPrint(allocator, "{s}={s}", .{ route_key, server.url() });
+    defer allocator.free(route);
+
+    const result = try runDispatcher(allocator, input, &.{ "--server", down_url, "--route", route }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+    return result.term.Exited;
+}
+
+test "--route sends a tool to its own server" {
+    try testing.expectEqual(@as(u8, 0), try runRouted(testing.allocator, pre_tool_use_input, "Bash"));
+}
+
+test "--route sends an event type to its own server" {
+    const input =
+        \\{"session_id":"test123","hook_event_name":"UserPromptSubmit","prompt":"hello"}
+    ;
+    try testing.expectEqual(@as(u8, 0), try runRouted(testing.allocator, input, "UserPromptSubmit"));
+}
+
+test "events with no route use the default route" {
+    try testing.expectEqual(@as(u8, 0), try runRouted(testing.allocator, pre_tool_use_input, "default"));
+}
+
+test "--route rejects entries without a URL" {
+    const allocator = testing.allocator;
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--route", "Bash" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expect(result.term.Exited != 0);
+}
+
+// Environment whose retry budgets live in dir, so tests don't share them.
+fn stateEnv(allocator: std.mem.Allocator, dir: []const u8) !std.process.EnvMap {
+    var env_map = try std.process.getEnvMap(allocator);
+    errdefer env_map.deinit();
+    try env_map.put("XDG_RUNTIME_DIR", dir);
+    return env_map;
+}
+
+test "--retry-budget stops retries once the session has spent it" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const budget_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(budget_path);
+    var env_map = try stateEnv(allocator, budget_path);
+    defer env_map.deinit();
+
+    var url_buffer: [64]u8 = undefined;
+    const url = try unreachableUrl(&url_buffer);
+
+    // The first event's two retries spend the whole budget.
+    const first = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", url, "--retry-budget", "2" }, &env_map);
+    defer allocator.free(first.stdout);
+    defer allocator.free(first.stderr);
+    try testing.expect(std.mem.indexOf(u8, first.stderr, "Retry budget exhausted") == null);
+
+    const second = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", url, "--retry-budget", "2" }, &env_map);
+    defer allocator.free(second.stdout);
+    defer allocator.free(second.stderr);
+    try testing.expect(second.term.Exited != 0);
+    try testing.expect(std.mem.indexOf(u8, second.stderr, "Retry budget exhausted") != null);
+}
+
+test "events report the retries left in retrybudget" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const budget_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(budget_path);
+    var env_map = try stateEnv(allocator, budget_path);
+    defer env_map.deinit();
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{ "--retry-budget", "5" }, &env_map);
+    defer event.deinit();
+
+    try testing.expectEqual(@as(i64, 5), event.value.object.get("retrybudget").?.integer);
+}
+
+test "retrybudget is omitted without --retry-budget" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    const event = try captureEvent(allocator, &server, pre_tool_use_input, &.{}, null);
+    defer event.deinit();
+
+    try testing.expect(event.value.object.get("retrybudget") == null);
+}
+
+test "--retry-budget rejects non-numbers" {
+    const allocator = testing.allocator;
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--retry-budget", "lots" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expect(result.term.Exited != 0);
+}
+
+const exec_allow = "cat >/dev/null; echo '{\"decision\":\"allow\"}'";
+
+test "--exec asks a local policy program instead of a server" {
+    const allocator = testing.allocator;
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--exec", "cat >/dev/null; echo '{\"decision\":\"block\",\"reason\":\"no shell today\"}'" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expect(result.term.Exited != 0);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "no shell today") != null);
+}
+
+test "--exec sends the CloudEvent on stdin" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+    const command = try std.fmt.allocPrint(allocator, "cat > '{s}/event.json'; echo '{{\"decision\":\"allow\"}}'", .{dir_path});
+    defer allocator.free(command);
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--exec", command }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+
+    const event_json = try tmp.dir.readFileAlloc(allocator, "event.json", 1024 * 1024);
+    defer allocator.free(event_json);
+    const event = try std.json.parseFromSlice(std.json.Value, allocator, event_json, .{});
+    defer event.deinit();
+    try testing.expectEqualStrings("1.0", event.value.object.get("specversion").?.string);
+}
+
+test "a failing policy program follows the fail mode" {
+    const allocator = testing.allocator;
+
+    const closed = try runDispatcher(allocator, pre_tool_use_input, &.{ "--exec", "exit 3" }, null);
+    defer allocator.free(closed.stdout);
+    defer allocator.free(closed.stderr);
+    try testing.expect(closed.term.Exited != 0);
+
+    const open = try runDispatcher(allocator, pre_tool_use_input, &.{ "--exec", "exit 3", "--fail-open" }, null);
+    defer allocator.free(open.stdout);
+    defer allocator.free(open.stderr);
+    try testing.expectEqual(@as(u8, 0), open.term.Exited);
+}
+
+test "--exec-sandbox still runs an ordinary policy program" {
+    if (builtin.os.tag != .linux) return error.SkipZigTest;
+    const allocator = testing.allocator;
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--exec-sandbox", "--exec", exec_allow }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+}
+
+test "--exec-sandbox-profile denies the listed syscalls" {
+    if (builtin.os.tag != .linux) return error.SkipZigTest;
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    // Denying execve keeps the policy program from starting at all.
+    try tmp.dir.writeFile(.{ .sub_path = "profile", .data = "# no programs\nexecve\n" });
+    const profile_path = try tmp.dir.realpathAlloc(allocator, "profile");
+    defer allocator.free(profile_path);
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--exec-sandbox-profile", profile_path, "--exec", exec_allow }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expect(result.term.Exited != 0);
+}
+
+test "--exec-sandbox-profile rejects unknown syscalls" {
+    if (builtin.os.tag != .linux) return error.SkipZigTest;
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.writeFile(.{ .sub_path = "profile", .data = "not_a_syscall\n" });
+    const profile_path = try tmp.dir.realpathAlloc(allocator, "profile");
+    defer allocator.free(profile_path);
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--exec-sandbox-profile", profile_path, "--exec", exec_allow }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expect(result.term.Exited != 0);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "Unknown syscall") != null);
+}
+
+test "--output-fd writes the decision output to another descriptor" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    try server.start();
+
+    // The child only has stdio, so stderr stands in for a spare descriptor.
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", server.url(), "--output-fd", "2" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    try testing.expectEqualStrings("", result.stdout);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "\"session_id\":\"test123\"") != null);
+}
+
+test "--output-fd rejects a descriptor that is not open" {
+    const allocator = testing.allocator;
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--output-fd", "99" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expect(result.term.Exited != 0);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "not open for writing") != null);
+}
+
+// Runs one event against the capture server and an unreachable one with the
+// given weights, returning the run result. The weights are lopsided enough
+// that the heavier server is picked first for all practical purposes.
+fn runWeighted(allocator: std.mem.Allocator, server: *CaptureServer, capture_weight: []const u8, down_weight: []const u8, options: []const []const u8) !std.process.Child.RunResult {
+    try server.start();
+    var url_buffer: [64]u8 = undefined;
+    const down_url = try unreachableUrl(&url_buffer);
+    const servers = try std.fmt.allocPrint(allocator, "{s}={s},{s}={s}", .{ server.url(), capture_weight, down_url, down_weight });
+    defer allocator.free(servers);
+
+    var argv = std.ArrayList([]const u8).init(allocator);
+    defer argv.deinit();
+    try argv.appendSlice(&.{ "--server", servers });
+    try argv.appendSlice(options);
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, argv.items, null);
+    server.finish();
+    return result;
+}
+
+test "--server weights send an event to the server its weight picks" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    const result = try runWeighted(allocator, &server, "1", "0.000000001", &.{});
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "Trying fallback server") == null);
+}
+
+test "a weighted pick that fails falls back to the other servers" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    const result = try runWeighted(allocator, &server, "0.000000001", "1", &.{});
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "Trying fallback server") != null);
+}
+
+test "--json reports which server decided" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    const result = try runWeighted(allocator, &server, "1", "0.000000001", &.{"--json"});
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    const output = try std.json.parseFromSlice(std.json.Value, allocator, result.stdout, .{});
+    defer output.deinit();
+    try testing.expectEqualStrings(server.url(), output.value.object.get("server").?.string);
+}
+
+test "--server weights must be given for every server" {
+    const allocator = testing.allocator;
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", "http://localhost:8080/hook=0.9,http://localhost:8081/hook" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expect(result.term.Exited != 0);
+}
+
+test "a closed output pipe exits cleanly" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    try server.start();
+
+    var child = std.process.Child.init(&.{ "./zig-out/bin/cchd", "--no-color", "--server", server.url() }, allocator);
+    child.stdin_behavior = .Pipe;
+    child.stdout_behavior = .Pipe;
+    child.stderr_behavior = .Pipe;
+    try child.spawn();
+
+    // Claude going away mid-hook: the read end closes before cchd writes.
+    child.stdout.?.close();
+    child.stdout = null;
+    try child.stdin.?.writeAll(pre_tool_use_input);
+    child.stdin.?.close();
+    child.stdin = null;
+
+    const stderr = try child.stderr.?.readToEndAlloc(allocator, 1024 * 1024);
+    defer allocator.free(stderr);
+    const term = try child.wait();
+    server.finish();
+
+    // Exited normally with the decision, rather than killed by SIGPIPE.
+    try testing.expectEqual(std.process.Child.Term{ .Exited = 0 }, term);
+    try testing.expect(std.mem.indexOf(u8, stderr, "Error") == null);
+}
+
+// One server answering PreToolUse in the modern format and every other event
+// in the legacy one, the way servers migrate one event type at a time.
+const MixedFormatServer = struct {
+    server: std.net.Server,
+    thread: std.Thread = undefined,
+    requests: usize,
+    url_buffer: [64]u8 = undefined,
+    url_len: usize = 0,
+
+    const modern_deny = okResponse("{\"hookSpecificOutput\":{\"hookEventName\":\"PreToolUse\",\"permissionDecision\":\"deny\",\"permissionDecisionReason\":\"modern deny\"}}");
+    const legacy_block = okResponse("{\"decision\":\"block\",\"reason\":\"legacy block\"}");
+
+    fn init(requests: usize) !MixedFormatServer {
+        const address = try std.net.Address.parseIp("127.0.0.1", 0);
+        var mixed: MixedFormatServer = .{
+            .server = try address.listen(.{ .reuse_address = true }),
+            .requests = requests,
+        };
+        mixed.url_len = (std.fmt.bufPrint(&mixed.url_buffer, "http://127.0.0.1:{d}/hook", .{mixed.server.listen_address.getPort()}) catch unreachable).len;
+        return mixed;
+    }
+
+    fn url(self: *MixedFormatServer) []const u8 {
+        return self.url_buffer[0..self.url_len];
+    }
+
+    fn start(self: *MixedFormatServer) !void {
+        self.thread = try std.Thread.spawn(.{}, serve, .{self});
+    }
+
+    fn finish(self: *MixedFormatServer) void {
+        self.thread.join();
+    }
+
+    fn serve(self: *MixedFormatServer) void {
+        defer self.server.deinit();
+        for (0..self.requests) |_| {
+            const connection = self.server.accept() catch return;
+            defer connection.stream.close();
+
+            var request: [64 * 1024]u8 = undefined;
+            var len: usize = 0;
+            while (len < request.len) {
+                const n = connection.stream.read(request[len..]) catch return;
+                if (n == 0) break;
+                len += n;
+                if (CaptureServer.requestComplete(request[0..len])) break;
+            }
+            const pre_tool_use = std.mem.indexOf(u8, request[0..len], "\"hook_event_name\":\"PreToolUse\"") != null;
+            connection.stream.writeAll(if (pre_tool_use) modern_deny else legacy_block) catch {};
+        }
+    }
+};
+
+test "one server may answer each event type in its own format" {
+    const allocator = testing.allocator;
+
+    var server = try MixedFormatServer.init(2);
+    try server.start();
+
+    const modern = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", server.url() }, null);
+    defer allocator.free(modern.stdout);
+    defer allocator.free(modern.stderr);
+
+    const legacy = try runDispatcher(allocator, prompt_input, &.{ "--server", server.url() }, null);
+    defer allocator.free(legacy.stdout);
+    defer allocator.free(legacy.stderr);
+    server.finish();
+
+    try testing.expectEqual(@as(u8, 1), modern.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, modern.stderr, "modern deny") != null);
+    try testing.expectEqual(@as(u8, 1), legacy.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, legacy.stderr, "legacy block") != null);
+}
+
+test "permissionDecision only counts for PreToolUse events" {
+    const allocator = testing.allocator;
+
+    // The response claims PreToolUse, but it answers a PostToolUse event.
+    const response = okResponse("{\"hookSpecificOutput\":{\"hookEventName\":\"PreToolUse\",\"permissionDecision\":\"deny\"}}");
+    const input =
+        \\{"session_id":"test123","hook_event_name":"PostToolUse","tool_name":"Bash","tool_input":{},"tool_response":{}}
+    ;
+    try testing.expectEqual(@as(u8, 0), try exitCodeFor(allocator, response, input, &.{}, null));
+}
+
+test "a modern PreToolUse decision doesn't need hookEventName" {
+    const allocator = testing.allocator;
+
+    const response = okResponse("{\"hookSpecificOutput\":{\"permissionDecision\":\"ask\"}}");
+    try testing.expectEqual(@as(u8, 2), try exitCodeFor(allocator, response, pre_tool_use_input, &.{}, null));
+}
+
+test "legacy responses may say deny and ask" {
+    const allocator = testing.allocator;
+
+    try testing.expectEqual(@as(u8, 1), try exitCodeFor(allocator, okResponse("{\"decision\":\"deny\"}"), pre_tool_use_input, &.{}, null));
+    try testing.expectEqual(@as(u8, 2), try exitCodeFor(allocator, okResponse("{\"decision\":\"ask\"}"), pre_tool_use_input, &.{}, null));
+}
+
+test "an unknown decision follows the fail mode" {
+    const allocator = testing.allocator;
+
+    const response = okResponse("{\"decision\":\"maybe\"}");
+    try testing.expectEqual(@as(u8, 1), try exitCodeFor(allocator, response, pre_tool_use_input, &.{}, null));
+    try testing.expectEqual(@as(u8, 0), try exitCodeFor(allocator, response, pre_tool_use_input, &.{"--fail-open"}, null));
+}
+
+const read_input =
+    \\{"session_id":"test123","hook_event_name":"PreToolUse","tool_name":"Read","tool_input":{"file_path":"README.md"}}
+;
+
+test "--safe-start blocks mutating tools until the server answers" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const state_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(state_path);
+    var env_map = try stateEnv(allocator, state_path);
+    defer env_map.deinit();
+
+    var url_buffer: [64]u8 = undefined;
+    const url = try unreachableUrl(&url_buffer);
+
+    // --fail-open would allow Bash, but the server has never answered.
+    const bash = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", url, "--fail-open", "--safe-start" }, &env_map);
+    defer allocator.free(bash.stdout);
+    defer allocator.free(bash.stderr);
+    try testing.expectEqual(@as(u8, 1), bash.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, bash.stderr, "safe start") != null);
+
+    // Read-only tools follow the fail mode.
+    const read = try runDispatcher(allocator, read_input, &.{ "--server", url, "--fail-open", "--safe-start" }, &env_map);
+    defer allocator.free(read.stdout);
+    defer allocator.free(read.stderr);
+    try testing.expectEqual(@as(u8, 0), read.term.Exited);
+}
+
+test "--safe-start ends once the session's server has answered" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const state_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(state_path);
+    var env_map = try stateEnv(allocator, state_path);
+    defer env_map.deinit();
+    try env_map.put("CCHD_LOG_LEVEL", "INFO");
+
+    var server = try CaptureServer.init(allow_response);
+    try server.start();
+    const confirmed = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", server.url(), "--fail-open", "--safe-start" }, &env_map);
+    defer allocator.free(confirmed.stdout);
+    defer allocator.free(confirmed.stderr);
+    server.finish();
+    try testing.expectEqual(@as(u8, 0), confirmed.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, confirmed.stderr, "leaving safe start mode") != null);
+
+    // From now on a failure follows the fail mode as usual.
+    var url_buffer: [64]u8 = undefined;
+    const url = try unreachableUrl(&url_buffer);
+    const later = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", url, "--fail-open", "--safe-start" }, &env_map);
+    defer allocator.free(later.stdout);
+    defer allocator.free(later.stderr);
+    try testing.expectEqual(@as(u8, 0), later.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, later.stderr, "leaving safe start mode") == null);
+
+    // Other sessions still wait for their own first answer.
+    const other_input =
+        \\{"session_id":"other","hook_event_name":"PreToolUse","tool_name":"Bash","tool_input":{"command":"ls"}}
+    ;
+    const other = try runDispatcher(allocator, other_input, &.{ "--server", url, "--fail-open", "--safe-start" }, &env_map);
+    defer allocator.free(other.stdout);
+    defer allocator.free(other.stderr);
+    try testing.expectEqual(@as(u8, 1), other.term.Exited);
+}
+
+test "--fail-cache-ttl repeats a failure's outcome for identical events" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const state_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(state_path);
+    var env_map = try stateEnv(allocator, state_path);
+    defer env_map.deinit();
+
+    var url_buffer: [64]u8 = undefined;
+    const url = try unreachableUrl(&url_buffer);
+
+    const blocked = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", url, "--fail-cache-ttl", "5000" }, &env_map);
+    defer allocator.free(blocked.stdout);
+    defer allocator.free(blocked.stderr);
+    try testing.expect(blocked.term.Exited != 0);
+
+    // --fail-open would allow it, but the same event was just blocked.
+    const repeated = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", url, "--fail-open", "--fail-cache-ttl", "5000" }, &env_map);
+    defer allocator.free(repeated.stdout);
+    defer allocator.free(repeated.stderr);
+    try testing.expectEqual(blocked.term.Exited, repeated.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, repeated.stderr, "fail cache") != null);
+
+    // Other events aren't affected.
+    const other = try runDispatcher(allocator, read_input, &.{ "--server", url, "--fail-open", "--fail-cache-ttl", "5000" }, &env_map);
+    defer allocator.free(other.stdout);
+    defer allocator.free(other.stderr);
+    try testing.expectEqual(@as(u8, 0), other.term.Exited);
+}
+
+test "--fail-cache-ttl asks the server again once the entry expires" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const state_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(state_path);
+    var env_map = try stateEnv(allocator, state_path);
+    defer env_map.deinit();
+
+    var url_buffer: [64]u8 = undefined;
+    const url = try unreachableUrl(&url_buffer);
+    const blocked = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", url, "--fail-cache-ttl", "200" }, &env_map);
+    defer allocator.free(blocked.stdout);
+    defer allocator.free(blocked.stderr);
+    try testing.expect(blocked.term.Exited != 0);
+
+    std.Thread.sleep(300 * std.time.ns_per_ms);
+
+    var server = try CaptureServer.init(allow_response);
+    try server.start();
+    const allowed = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", server.url(), "--fail-cache-ttl", "200" }, &env_map);
+    defer allocator.free(allowed.stdout);
+    defer allocator.free(allowed.stderr);
+    server.finish();
+    try testing.expectEqual(@as(u8, 0), allowed.term.Exited);
+}
+
+test "--fail-cache-ttl rejects a TTL longer than a flap" {
+    const allocator = testing.allocator;
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--fail-cache-ttl", "60000" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    try testing.expect(result.term.Exited != 0);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "between 0 and 10000 ms") != null);
+}
+
+test "--proxy sends the request through the proxy" {
+    const allocator = testing.allocator;
+
+    var proxy = try CaptureServer.init(allow_response);
+    try proxy.start();
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--proxy", proxy.url(), "--server", "http://policy.invalid/hook" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    proxy.finish();
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    try testing.expect(std.mem.startsWith(u8, proxy.request[0..proxy.request_len], "POST http://policy.invalid/hook "));
+}
+
+test "HTTP_PROXY is honored unless NO_PROXY exempts the server" {
+    const allocator = testing.allocator;
+
+    var proxy = try CaptureServer.init(allow_response);
+    try proxy.start();
+    var env_map = try std.process.getEnvMap(allocator);
+    defer env_map.deinit();
+    env_map.remove("http_proxy");
+    env_map.remove("no_proxy");
+    env_map.remove("NO_PROXY");
+    try env_map.put("HTTP_PROXY", proxy.url());
+
+    const proxied = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", "http://policy.invalid/hook" }, &env_map);
+    defer allocator.free(proxied.stdout);
+    defer allocator.free(proxied.stderr);
+    proxy.finish();
+    try testing.expectEqual(@as(u8, 0), proxied.term.Exited);
+    try testing.expect(std.mem.startsWith(u8, proxy.request[0..proxy.request_len], "POST http://policy.invalid/hook "));
+
+    // Exempted, the server is contacted directly, and it doesn't resolve.
+    try env_map.put("NO_PROXY", "policy.invalid");
+    const direct = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", "http://policy.invalid/hook" }, &env_map);
+    defer allocator.free(direct.stdout);
+    defer allocator.free(direct.stderr);
+    try testing.expect(direct.term.Exited != 0);
+    try testing.expect(std.mem.indexOf(u8, direct.stderr, "proxy") == null);
+}
+
+test "proxy failures are reported apart from server failures" {
+    const allocator = testing.allocator;
+
+    var url_buffer: [64]u8 = undefined;
+    const url = try unreachableUrl(&url_buffer);
+    const down = try runDispatcher(allocator, pre_tool_use_input, &.{ "--proxy", url, "--server", "http://policy.invalid/hook" }, null);
+    defer allocator.free(down.stdout);
+    defer allocator.free(down.stderr);
+    try testing.expectEqual(@as(u8, 19), down.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, down.stderr, "Could not connect to proxy") != null);
+
+    var proxy = try CaptureServer.init("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\nConnection: close\r\n\r\n");
+    try proxy.start();
+    const refused = try runDispatcher(allocator, pre_tool_use_input, &.{ "--proxy", proxy.url(), "--server", "http://policy.invalid/hook" }, null);
+    defer allocator.free(refused.stdout);
+    defer allocator.free(refused.stderr);
+    proxy.finish();
+    try testing.expectEqual(@as(u8, 19), refused.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, refused.stderr, "HTTP 407") != null);
+}
+
+const ask_response = okResponse("{\"decision\":\"ask\"}");
+const block_response = okResponse("{\"decision\":\"block\",\"reason\":\"no\"}");
+
+// Runs one event fanned out to two capture servers, returning its exit code.
+fn fanOutExitCode(allocator: std.mem.Allocator, first: *CaptureServer, second: *CaptureServer, extra: []const []const u8) !u8 {
+    const servers = try std.fmt.allocPrint(allocator, "{s},{s}", .{ first.url(), second.url() });
+    defer allocator.free(servers);
+    var options = std.ArrayList([]const u8).init(allocator);
+    defer options.deinit();
+    try options.appendSlice(&.{ "--fan-out", "--server", servers });
+    try options.appendSlice(extra);
+
+    try first.start();
+    try second.start();
+    const result = try runDispatcher(allocator, pre_tool_use_input, options.items, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    first.finish();
+    second.finish();
+    return result.term.Exited;
+}
+
+test "--fan-out asks every server and a block from any of them wins" {
+    const allocator = testing.allocator;
+
+    var first = try CaptureServer.init(allow_response);
+    var second = try CaptureServer.init(block_response);
+    try testing.expectEqual(@as(u8, 1), try fanOutExitCode(allocator, &first, &second, &.{}));
+    try testing.expect(std.mem.indexOf(u8, first.body(), "\"tool_name\":\"Bash\"") != null);
+    try testing.expect(std.mem.indexOf(u8, second.body(), "\"tool_name\":\"Bash\"") != null);
+}
+
+test "--fan-out takes the strictest answer when servers disagree" {
+    const allocator = testing.allocator;
+
+    var first = try CaptureServer.init(allow_response);
+    var second = try CaptureServer.init(ask_response);
+    try testing.expectEqual(@as(u8, 2), try fanOutExitCode(allocator, &first, &second, &.{}));
+}
+
+test "--arbiter settles a fan-out conflict from all the answers" {
+    const allocator = testing.allocator;
+
+    var arbiter = try CaptureServer.init(block_response);
+    try arbiter.start();
+    var first = try CaptureServer.init(allow_response);
+    var second = try CaptureServer.init(ask_response);
+    const exit_code = try fanOutExitCode(allocator, &first, &second, &.{ "--arbiter", arbiter.url() });
+    arbiter.finish();
+
+    try testing.expectEqual(@as(u8, 1), exit_code);
+    const request = arbiter.body();
+    try testing.expect(std.mem.indexOf(u8, request, "\"event\":{") != null);
+    try testing.expect(std.mem.indexOf(u8, request, first.url()) != null);
+    try testing.expect(std.mem.indexOf(u8, request, second.url()) != null);
+    try testing.expect(std.mem.indexOf(u8, request, "\"verdict\":\"allow\"") != null);
+    try testing.expect(std.mem.indexOf(u8, request, "\"verdict\":\"ask\"") != null);
+}
+
+test "--fan-out fails the event when a server fails, unless --fail-open" {
+    const allocator = testing.allocator;
+
+    var url_buffer: [64]u8 = undefined;
+    const url = try unreachableUrl(&url_buffer);
+
+    inline for (.{ false, true }) |fail_open| {
+        var server = try CaptureServer.init(allow_response);
+        try server.start();
+        const servers = try std.fmt.allocPrint(allocator, "{s},{s}", .{ server.url(), url });
+        defer allocator.free(servers);
+        const options: []const []const u8 = if (fail_open) &.{ "--fan-out", "--fail-open", "--server", servers } else &.{ "--fan-out", "--server", servers };
+        const result = try runDispatcher(allocator, pre_tool_use_input, options, null);
+        defer allocator.free(result.stdout);
+        defer allocator.free(result.stderr);
+        server.finish();
+        if (fail_open) {
+            try testing.expectEqual(@as(u8, 0), result.term.Exited);
+        } else {
+            try testing.expect(result.term.Exited != 0);
+        }
+    }
+}
+
+const prompt_input =
+    \\{"session_id":"test123","hook_event_name":"UserPromptSubmit","prompt":"fix it"}
+;
+
+test "a return decision sends a prompt back to the user" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(okResponse("{\"decision\":\"return\",\"message\":\"Say which file you mean\"}"));
+    try server.start();
+    const result = try runDispatcher(allocator, prompt_input, &.{ "--server", server.url() }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+
+    // Claude reads the UserPromptSubmit block output only on exit 0.
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    const output = try std.json.parseFromSlice(std.json.Value, allocator, std.mem.trim(u8, result.stdout, "\n"), .{});
+    defer output.deinit();
+    try testing.expectEqualStrings("block", output.value.object.get("decision").?.string);
+    try testing.expectEqualStrings("Say which file you mean", output.value.object.get("reason").?.string);
+}
+
+test "a return decision blocks events other than UserPromptSubmit" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(okResponse("{\"decision\":\"return\",\"message\":\"Not now\"}"));
+    try server.start();
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", server.url() }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+
+    try testing.expectEqual(@as(u8, 1), result.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "Blocked: Not now") != null);
+}
+
+const notification_input =
+    \\{"session_id":"test123","hook_event_name":"Notification","message":"Claude needs your permission"}
+;
+
+// Runs one event against a capture server answering server_response, with
+// the given --output-convention. The caller frees stdout and stderr.
+fn runWithConvention(allocator: std.mem.Allocator, input: []const u8, server_response: []const u8, convention: []const u8) !std.process.Child.RunResult {
+    var server = try CaptureServer.init(server_response);
+    try server.start();
+    const result = try runDispatcher(allocator, input, &.{ "--server", server.url(), "--output-convention", convention }, null);
+    server.finish();
+    return result;
+}
+
+test "--output-convention json gives PreToolUse decisions as permissionDecision" {
+    const allocator = testing.allocator;
+
+    inline for (.{ .{ block_response, "deny", "no" }, .{ ask_response, "ask", "Approval required by policy" } }) |case| {
+        const result = try runWithConvention(allocator, pre_tool_use_input, case[0], "json");
+        defer allocator.free(result.stdout);
+        defer allocator.free(result.stderr);
+
+        // Claude only reads the JSON on exit 0.
+        try testing.expectEqual(@as(u8, 0), result.term.Exited);
+        const output = try std.json.parseFromSlice(std.json.Value, allocator, std.mem.trim(u8, result.stdout, "\n"), .{});
+        defer output.deinit();
+        const hook_output = output.value.object.get("hookSpecificOutput").?.object;
+        try testing.expectEqualStrings("PreToolUse", hook_output.get("hookEventName").?.string);
+        try testing.expectEqualStrings(case[1], hook_output.get("permissionDecision").?.string);
+        try testing.expectEqualStrings(case[2], hook_output.get("permissionDecisionReason").?.string);
+    }
+}
+
+test "--output-convention json blocks other events with a top-level decision" {
+    const allocator = testing.allocator;
+
+    const result = try runWithConvention(allocator, prompt_input, block_response, "json");
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    const output = try std.json.parseFromSlice(std.json.Value, allocator, std.mem.trim(u8, result.stdout, "\n"), .{});
+    defer output.deinit();
+    try testing.expectEqualStrings("block", output.value.object.get("decision").?.string);
+    try testing.expectEqualStrings("no", output.value.object.get("reason").?.string);
+}
+
+test "--output-convention json prints nothing for an allow" {
+    const allocator = testing.allocator;
+
+    const result = try runWithConvention(allocator, pre_tool_use_input, allow_response, "json");
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    try testing.expectEqualStrings("", result.stdout);
+}
+
+test "--output-convention exit blocks with exit code 2 and no stdout" {
+    const allocator = testing.allocator;
+
+    inline for (.{ .{ block_response, 2 }, .{ ask_response, 2 }, .{ allow_response, 0 } }) |case| {
+        const result = try runWithConvention(allocator, pre_tool_use_input, case[0], "exit");
+        defer allocator.free(result.stdout);
+        defer allocator.free(result.stderr);
+
+        try testing.expectEqual(@as(u8, case[1]), result.term.Exited);
+        try testing.expectEqualStrings("", result.stdout);
+    }
+}
+
+test "--output-convention json falls back to exit 2 for events without a decision" {
+    const allocator = testing.allocator;
+
+    const result = try runWithConvention(allocator, notification_input, block_response, "json");
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expectEqual(@as(u8, 2), result.term.Exited);
+    try testing.expectEqualStrings("", result.stdout);
+}
+
+test "--output-convention maps each event type to its convention" {
+    const allocator = testing.allocator;
+
+    const convention = "exit,PreToolUse=json";
+    const pre_tool_use = try runWithConvention(allocator, pre_tool_use_input, block_response, convention);
+    defer allocator.free(pre_tool_use.stdout);
+    defer allocator.free(pre_tool_use.stderr);
+    try testing.expectEqual(@as(u8, 0), pre_tool_use.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, pre_tool_use.stdout, "\"permissionDecision\":\"deny\"") != null);
+
+    const prompt = try runWithConvention(allocator, prompt_input, block_response, convention);
+    defer allocator.free(prompt.stdout);
+    defer allocator.free(prompt.stderr);
+    try testing.expectEqual(@as(u8, 2), prompt.term.Exited);
+    try testing.expectEqualStrings("", prompt.stdout);
+}
+
+test "--output-convention exit blocks with exit code 2 in fail-closed mode" {
+    const allocator = testing.allocator;
+
+    var url_buffer: [64]u8 = undefined;
+    const url = try unreachableUrl(&url_buffer);
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", url, "--output-convention", "exit" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    // Claude would let any other nonzero exit code through.
+    try testing.expectEqual(@as(u8, 2), result.term.Exited);
+}
+
+test "--output-convention rejects an unknown convention" {
+    const allocator = testing.allocator;
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--output-convention", "PreToolUse=stdout" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expect(result.term.Exited != 0);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "--output-convention") != null);
+}
+
+// Side effects run detached, so their output is waited for by polling.
+fn waitForFile(allocator: std.mem.Allocator, dir: std.fs.Dir, name: []const u8) ![]u8 {
+    var attempts: usize = 0;
+    while (true) : (attempts += 1) {
+        if (dir.readFileAlloc(allocator, name, 64 * 1024)) |data| {
+            return data;
+        } else |err| {
+            if (err != error.FileNotFound or attempts >= 50) return err;
+        }
+        std.Thread.sleep(100 * std.time.ns_per_ms);
+    }
+}
+
+test "side effects a response asks for run with the decision" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const tmp_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(tmp_path);
+    const side_effect = try std.fmt.allocPrint(allocator, "log=exec:cat > {s}/effect.json.tmp && mv {s}/effect.json.tmp {s}/effect.json", .{ tmp_path, tmp_path, tmp_path });
+    defer allocator.free(side_effect);
+
+    var server = try CaptureServer.init(okResponse("{\"decision\":\"block\",\"reason\":\"no\",\"side_effects\":[\"log\",\"unknown\"]}"));
+    try server.start();
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", server.url(), "--side-effect", side_effect }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+    try testing.expectEqual(@as(u8, 1), result.term.Exited);
+
+    const payload = try waitForFile(allocator, tmp.dir, "effect.json");
+    defer allocator.free(payload);
+    const parsed = try std.json.parseFromSlice(std.json.Value, allocator, payload, .{});
+    defer parsed.deinit();
+    try testing.expectEqualStrings("block", parsed.value.object.get("decision").?.string);
+    try testing.expectEqualStrings("no", parsed.value.object.get("reason").?.string);
+    try testing.expectEqualStrings("Bash", parsed.value.object.get("event").?.object.get("tool_name").?.string);
+}
+
+test "--on-block posts to a webhook when the server is down in fail-closed mode" {
+    const allocator = testing.allocator;
+
+    var url_buffer: [64]u8 = undefined;
+    const url = try unreachableUrl(&url_buffer);
+    var webhook = try CaptureServer.init(okResponse("{}"));
+    try webhook.start();
+    const side_effect = try std.fmt.allocPrint(allocator, "siem=webhook:{s}", .{webhook.url()});
+    defer allocator.free(side_effect);
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", url, "--side-effect", side_effect, "--on-block", "siem" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    webhook.finish();
+
+    try testing.expect(result.term.Exited != 0);
+    try testing.expect(std.mem.indexOf(u8, webhook.body(), "\"decision\":\"block\"") != null);
+    try testing.expect(std.mem.indexOf(u8, webhook.body(), "\"hook_event_name\":\"PreToolUse\"") != null);
+}
+
+test "a slow side effect doesn't delay the decision" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(okResponse("{\"decision\":\"allow\",\"side_effects\":[\"slow\"]}"));
+    try server.start();
+    var timer = try std.time.Timer.start();
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", server.url(), "--side-effect", "slow=exec:sleep 5" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+
+    // runDispatcher reads stdout and stderr to the end, so a side effect
+    // holding either open would show up here as well.
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    try testing.expect(timer.read() < 3 * std.time.ns_per_s);
+}
+
+test "--side-effect rejects an unknown type" {
+    const allocator = testing.allocator;
+
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--side-effect", "notify=ftp:host" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+
+    try testing.expect(result.term.Exited != 0);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "--side-effect") != null);
+}
+
+test "--max-forward-prompt truncates the forwarded prompt and says so" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    try server.start();
+    const result = try runDispatcher(allocator, prompt_input, &.{ "--server", server.url(), "--max-forward-prompt", "3" }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    const event = try std.json.parseFromSlice(std.json.Value, allocator, server.body(), .{});
+    defer event.deinit();
+    try testing.expectEqualStrings("fix", event.value.object.get("data").?.object.get("prompt").?.string);
+    try testing.expect(event.value.object.get("prompttruncated").?.bool);
+    try testing.expectEqual(@as(i64, 6), event.value.object.get("promptlength").?.integer);
+    // Claude gets its own input back with the prompt intact.
+    try testing.expect(std.mem.indexOf(u8, result.stdout, "\"prompt\":\"fix it\"") != null);
+}
+
+test "--max-forward-prompt leaves short prompts alone and is off by default" {
+    const allocator = testing.allocator;
+
+    const cases = [_][]const []const u8{ &.{ "--max-forward-prompt", "6" }, &.{} };
+    for (cases) |extra| {
+        var server = try CaptureServer.init(allow_response);
+        try server.start();
+        var options = std.ArrayList([]const u8).init(allocator);
+        defer options.deinit();
+        try options.appendSlice(&.{ "--server", server.url() });
+        try options.appendSlice(extra);
+        const result = try runDispatcher(allocator, prompt_input, options.items, null);
+        defer allocator.free(result.stdout);
+        defer allocator.free(result.stderr);
+        server.finish();
+
+        try testing.expect(std.mem.indexOf(u8, server.body(), "\"prompt\":\"fix it\"") != null);
+        try testing.expect(std.mem.indexOf(u8, server.body(), "prompttruncated") == null);
+    }
+}
+
+test "identical modifications produce byte-identical output" {
+    const allocator = testing.allocator;
+
+    const responses = [_][]const u8{
+        okResponse("{\"decision\":\"modify\",\"modified_data\":{\"z\":1,\"a\":{\"y\":[{\"b\":2,\"a\":1}],\"x\":\"s\"}}}"),
+        okResponse("{\"decision\":\"modify\",\"modified_data\":{\"z\":1,\"a\":{\"y\":[{\"b\":2,\"a\":1}],\"x\":\"s\"}}}"),
+        okResponse("{\"decision\":\"modify\",\"modified_data\":{\"a\":{\"x\":\"s\",\"y\":[{\"a\":1,\"b\":2}]},\"z\":1}}"),
+    };
+    for (responses) |response| {
+        var server = try CaptureServer.init(response);
+        try server.start();
+        const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", server.url() }, null);
+        defer allocator.free(result.stdout);
+        defer allocator.free(result.stderr);
+        server.finish();
+
+        try testing.expectEqual(@as(u8, 0), result.term.Exited);
+        try testing.expectEqualStrings("{\"a\":{\"x\":\"s\",\"y\":[{\"a\":1,\"b\":2}]},\"z\":1}\n", result.stdout);
+    }
+}
+
+// pre_tool_use_input gzipped, and a megabyte of spaces gzipped, which is
+// twice the input limit once decompressed.
+const gzip_pre_tool_use_input = "\x1f\x8b\x08\x00\x00\x00\x00\x00\x02\x03\x35\xcc\x31\x0a\x80\x30\x10\x44\xd1\xab\xc8\xd6\x36\x6a\x67\xe9\x09\x2c\xb4\x0e\x41\x07\x12\x4c\x76\xc5\x5d\x6d\xc4\xbb\x1b\x0b\xbb\xe1\x3f\x98\x9b\x14\xaa\x51\xd8\xc5\x95\x7a\x32\xa8\x35\x6d\x47\x35\x05\x91\xcd\xe1\x02\x9b\x63\x9f\x51\x6c\x3c\x30\x89\xa4\x59\x51\xd8\xca\xfa\x61\xf0\x1a\xfe\x14\x79\x3f\x8d\xfa\x9b\x16\xc9\xd9\xf3\xf7\x89\x25\x48\x15\x90\x92\xd0\xf3\xbc\x39\xa9\x29\x9e\x70\x00\x00\x00";
+const gzip_bomb_input = "\x1f\x8b\x08\x00\x00\x00\x00\x00\x02\x03\xed\xc1\x31\x01\x00\x00\x00\xc2\xa0\x2a\xeb\x9f\xd2\x10\xbe\x40\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7c\x06\xa7\x02\x03\xf1\x00\x00\x10\x00";
+
+test "gzip-compressed input is decompressed before it is forwarded" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    try server.start();
+    const result = try runDispatcher(allocator, gzip_pre_tool_use_input, &.{ "--server", server.url() }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, server.body(), "\"tool_name\":\"Bash\"") != null);
+    // The decompressed event is what Claude gets back.
+    try testing.expectEqualStrings(pre_tool_use_input ++ "\n", result.stdout);
+}
+
+test "plain input is read as before alongside gzip support" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    try server.start();
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", server.url() }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    try testing.expectEqualStrings(pre_tool_use_input ++ "\n", result.stdout);
+}
+
+test "gzip input that is corrupt or decompresses past the limit is rejected" {
+    const allocator = testing.allocator;
+
+    const inputs = [_][]const u8{ gzip_pre_tool_use_input[0 .. gzip_pre_tool_use_input.len / 2], gzip_bomb_input };
+    for (inputs) |input| {
+        const result = try runDispatcher(allocator, input, &.{}, null);
+        defer allocator.free(result.stdout);
+        defer allocator.free(result.stderr);
+
+        try testing.expectEqual(@as(u8, 21), result.term.Exited);
+        try testing.expectEqualStrings("", result.stdout);
+    }
+}
+
+// .invalid never resolves, so the SRV name stays in the server list.
+const unresolvable_srv_url = "srv+http://_hook._tcp.policy.invalid/hook";
+
+test "an SRV server that doesn't resolve goes to the fail mode" {
+    const allocator = testing.allocator;
+
+    const closed = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", unresolvable_srv_url }, null);
+    defer allocator.free(closed.stdout);
+    defer allocator.free(closed.stderr);
+    try testing.expect(closed.term.Exited != 0);
+    try testing.expect(std.mem.indexOf(u8, closed.stderr, "No targets for SRV server") != null);
+
+    const open = try runDispatcher(allocator, pre_tool_use_input, &.{ "--fail-open", "--server", unresolvable_srv_url }, null);
+    defer allocator.free(open.stdout);
+    defer allocator.free(open.stderr);
+    try testing.expectEqual(@as(u8, 0), open.term.Exited);
+}
+
+test "an SRV server that doesn't resolve falls back to the next server" {
+    const allocator = testing.allocator;
+
+    var server = try CaptureServer.init(allow_response);
+    try server.start();
+    const servers = try std.fmt.allocPrint(allocator, "{s},{s}", .{ unresolvable_srv_url, server.url() });
+    defer allocator.free(servers);
+    const result = try runDispatcher(allocator, pre_tool_use_input, &.{ "--server", servers }, null);
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    server.finish();
+
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, server.body(), "\"tool_name\":\"Bash\"") != null);
+}
+
+test "SRV URLs with a port, and SRV routes, are rejected at startup" {
+    const allocator = testing.allocator;
+
+    const options = [_][]const []const u8{
+        &.{ "--server", "srv+https://_hook._tcp.policy.example.com:8443/hook" },
+        &.{ "--server", "srv+ftp://_hook._tcp.policy.example.com/hook" },
+        &.{ "--route", "Bash=" ++ unresolvable_srv_url },
+    };
+    for (options) |option| {
+        const result = try runDispatcher(allocator, pre_tool_use_input, option, null);
+        defer allocator.free(result.stdout);
+        defer allocator.free(result.stderr);
+
+        // Rejected as an invalid URL before any request is made.
+        try testing.expectEqual(@as(u8, 4), result.term.Exited);
+        try testing.expectEqualStrings("", result.stdout);
+    }
+}
@@ -57,6 +57,9 @@ const MockServer = struct {
             } else if (std.mem.indexOf(u8, request, "GET /quickstart-go.go")) |_| {
                 const response = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\npackage main\n// Mock Go template\n";
                 _ = connection.stream.write(response) catch break;
+            } else if (std.mem.indexOf(u8, request, "GET /quickstart-go-")) |_| {
+                const response = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\npackage main\n// Mock Go template support file\n";
+                _ = connection.stream.write(response) catch break;
             } else {
                 const response = "HTTP/1.1 404 Not Found\r\n\r\n";
                 _ = connection.stream.write(response) catch break;
@@ -282,6 +285,37 @@ test "template filename constants" {
     try testing.expect(std.mem.indexOf(u8, result.stdout, expected_filenames.go) != null);
 }
 
+test "go template support files match the repository" {
+    // The Go template is split across files, and init downloads the extra
+    // ones by name. Every non-test quickstart-go-*.go file in templates/ must
+    // be listed in src/cli/init.c, or "cchd init go" would produce a server
+    // that doesn't build.
+    const allocator = testing.allocator;
+
+    const init_source = try std.fs.cwd().readFileAlloc(allocator, "src/cli/init.c", 1 << 20);
+    defer allocator.free(init_source);
+
+    var dir = try std.fs.cwd().openDir("templates", .{ .iterate = true });
+    defer dir.close();
+
+    var found: usize = 0;
+    var it = dir.iterate();
+    while (try it.next()) |entry| {
+        if (!std.mem.startsWith(u8, entry.name, "quickstart-go-")) continue;
+        if (!std.mem.endsWith(u8, entry.name, ".go")) continue;
+        if (std.mem.endsWith(u8, entry.name, "_test.go")) continue;
+
+        const quoted = try std.fmt.allocPrint(allocator, "\"{s}\"", .{entry.name});
+        defer allocator.free(quoted);
+        if (std.mem.indexOf(u8, init_source, quoted) == null) {
+            std.debug.print("{s} is missing from go_support_files\n", .{entry.name});
+            return error.TestUnexpectedResult;
+        }
+        found += 1;
+    }
+    try testing.expect(found > 0);
+}
+
 test "main help mentions init command" {
     const allocator = testing.allocator;
 
@@ -0,0 +1,221 @@
+const std = @import("std");
+const testing = std.testing;
+
+// Tests for 'cchd install'. Each one works on a settings file in its own
+// temporary directory, so the real ~/.claude is never touched.
+
+const existing_settings =
+    \\{
+    \\  "model": "opus",
+    \\  "hooks": {
+    \\    "PreToolUse": [
+    \\      {
+    \\        "matcher": "Bash",
+    \\        "hooks": [
+    \\          {"type": "command", "command": "/usr/local/bin/cchd --server http://old.example/hook"},
+    \\          {"type": "command", "command": "my-linter"}
+    \\        ]
+    \\      }
+    \\    ],
+    \\    "SessionStart": [{"hooks": [{"type": "command", "command": "echo hi"}]}]
+    \\  }
+    \\}
+;
+
+const event_names = [_][]const u8{ "PreToolUse", "PostToolUse", "Notification", "UserPromptSubmit", "Stop", "SubagentStop", "PreCompact" };
+
+fn runInstall(allocator: std.mem.Allocator, settings_path: []const u8, options: []const []const u8) !std.process.Child.RunResult {
+    var argv = std.ArrayList([]const u8).init(allocator);
+    defer argv.deinit();
+    try argv.appendSlice(&.{ "./zig-out/bin/cchd", "install", "--settings", settings_path });
+    try argv.appendSlice(options);
+    return std.process.Child.run(.{ .allocator = allocator, .argv = argv.items, .env_map = null });
+}
+
+// Returns the commands of every hook installed for event_name.
+fn hookCommands(allocator: std.mem.Allocator, settings: std.json.Value, event_name: []const u8) ![]const []const u8 {
+    var commands = std.ArrayList([]const u8).init(allocator);
+    const groups = settings.object.get("hooks").?.object.get(event_name) orelse return commands.toOwnedSlice();
+    for (groups.array.items) |group| {
+        for (group.object.get("hooks").?.array.items) |hook| {
+            try commands.append(hook.object.get("command").?.string);
+        }
+    }
+    return commands.toOwnedSlice();
+}
+
+test "install adds a cchd hook for every event" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+    const settings_path = try std.fs.path.join(allocator, &.{ dir_path, "settings.json" });
+    defer allocator.free(settings_path);
+
+    const result = try runInstall(allocator, settings_path, &.{ "--server", "https://policy.example.com/hook", "--", "--fail-open" });
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+
+    const content = try tmp.dir.readFileAlloc(allocator, "settings.json", 1024 * 1024);
+    defer allocator.free(content);
+    const parsed = try std.json.parseFromSlice(std.json.Value, allocator, content, .{});
+    defer parsed.deinit();
+
+    for (event_names) |event_name| {
+        const commands = try hookCommands(allocator, parsed.value, event_name);
+        defer allocator.free(commands);
+        try testing.expectEqual(@as(usize, 1), commands.len);
+        try testing.expectEqualStrings("cchd --server https://policy.example.com/hook --fail-open", commands[0]);
+    }
+
+    // Only the tool events take a matcher.
+    const pre_tool_use = parsed.value.object.get("hooks").?.object.get("PreToolUse").?.array.items[0];
+    try testing.expectEqualStrings("*", pre_tool_use.object.get("matcher").?.string);
+    const stop = parsed.value.object.get("hooks").?.object.get("Stop").?.array.items[0];
+    try testing.expect(stop.object.get("matcher") == null);
+}
+
+test "install replaces old cchd hooks and keeps everything else" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.writeFile(.{ .sub_path = "settings.json", .data = existing_settings });
+    const settings_path = try tmp.dir.realpathAlloc(allocator, "settings.json");
+    defer allocator.free(settings_path);
+
+    const result = try runInstall(allocator, settings_path, &.{});
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+
+    const content = try tmp.dir.readFileAlloc(allocator, "settings.json", 1024 * 1024);
+    defer allocator.free(content);
+    const parsed = try std.json.parseFromSlice(std.json.Value, allocator, content, .{});
+    defer parsed.deinit();
+
+    try testing.expectEqualStrings("opus", parsed.value.object.get("model").?.string);
+
+    const pre_tool_use = try hookCommands(allocator, parsed.value, "PreToolUse");
+    defer allocator.free(pre_tool_use);
+    try testing.expectEqual(@as(usize, 2), pre_tool_use.len);
+    try testing.expectEqualStrings("my-linter", pre_tool_use[0]);
+    try testing.expectEqualStrings("cchd --server http://localhost:8080/hook", pre_tool_use[1]);
+
+    const session_start = try hookCommands(allocator, parsed.value, "SessionStart");
+    defer allocator.free(session_start);
+    try testing.expectEqual(@as(usize, 1), session_start.len);
+    try testing.expectEqualStrings("echo hi", session_start[0]);
+
+    // The original is kept byte for byte.
+    const backup = try tmp.dir.readFileAlloc(allocator, "settings.json.bak", 1024 * 1024);
+    defer allocator.free(backup);
+    try testing.expectEqualStrings(existing_settings, backup);
+}
+
+test "install is idempotent" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.writeFile(.{ .sub_path = "settings.json", .data = existing_settings });
+    const settings_path = try tmp.dir.realpathAlloc(allocator, "settings.json");
+    defer allocator.free(settings_path);
+
+    const first = try runInstall(allocator, settings_path, &.{});
+    defer allocator.free(first.stdout);
+    defer allocator.free(first.stderr);
+    const after_first = try tmp.dir.readFileAlloc(allocator, "settings.json", 1024 * 1024);
+    defer allocator.free(after_first);
+
+    const second = try runInstall(allocator, settings_path, &.{});
+    defer allocator.free(second.stdout);
+    defer allocator.free(second.stderr);
+    try testing.expectEqual(@as(u8, 0), second.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, second.stdout, "already runs") != null);
+
+    const after_second = try tmp.dir.readFileAlloc(allocator, "settings.json", 1024 * 1024);
+    defer allocator.free(after_second);
+    try testing.expectEqualStrings(after_first, after_second);
+
+    // An unchanged file doesn't overwrite the backup of the original.
+    const backup = try tmp.dir.readFileAlloc(allocator, "settings.json.bak", 1024 * 1024);
+    defer allocator.free(backup);
+    try testing.expectEqualStrings(existing_settings, backup);
+}
+
+test "install --dry-run prints a diff and writes nothing" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{ .iterate = true });
+    defer tmp.cleanup();
+    try tmp.dir.writeFile(.{ .sub_path = "settings.json", .data = existing_settings });
+    const settings_path = try tmp.dir.realpathAlloc(allocator, "settings.json");
+    defer allocator.free(settings_path);
+
+    const result = try runInstall(allocator, settings_path, &.{"--dry-run"});
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+
+    try testing.expect(std.mem.startsWith(u8, result.stdout, "--- "));
+    try testing.expect(std.mem.indexOf(u8, result.stdout, "\n@@ -") != null);
+    try testing.expect(std.mem.indexOf(u8, result.stdout, "\n-          {\"type\": \"command\", \"command\": \"/usr/local/bin/cchd") != null);
+    try testing.expect(std.mem.indexOf(u8, result.stdout, "\n+            \"command\": \"cchd --server http://localhost:8080/hook\"") != null);
+
+    const content = try tmp.dir.readFileAlloc(allocator, "settings.json", 1024 * 1024);
+    defer allocator.free(content);
+    try testing.expectEqualStrings(existing_settings, content);
+
+    var entries: usize = 0;
+    var it = tmp.dir.iterate();
+    while (try it.next()) |_| entries += 1;
+    try testing.expectEqual(@as(usize, 1), entries);
+}
+
+test "install refuses to rewrite a settings file it can't parse" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.writeFile(.{ .sub_path = "settings.json", .data = "{\"model\": " });
+    const settings_path = try tmp.dir.realpathAlloc(allocator, "settings.json");
+    defer allocator.free(settings_path);
+
+    const result = try runInstall(allocator, settings_path, &.{});
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    try testing.expectEqual(@as(u8, 1), result.term.Exited);
+    try testing.expect(std.mem.indexOf(u8, result.stderr, "is not valid JSON") != null);
+
+    const content = try tmp.dir.readFileAlloc(allocator, "settings.json", 1024 * 1024);
+    defer allocator.free(content);
+    try testing.expectEqualStrings("{\"model\": ", content);
+}
+
+test "install quotes flags the shell would split" {
+    const allocator = testing.allocator;
+
+    var tmp = testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+    const settings_path = try std.fs.path.join(allocator, &.{ dir_path, "settings.json" });
+    defer allocator.free(settings_path);
+
+    const result = try runInstall(allocator, settings_path, &.{ "--", "--user-id", "it's me" });
+    defer allocator.free(result.stdout);
+    defer allocator.free(result.stderr);
+    try testing.expectEqual(@as(u8, 0), result.term.Exited);
+
+    const content = try tmp.dir.readFileAlloc(allocator, "settings.json", 1024 * 1024);
+    defer allocator.free(content);
+    const parsed = try std.json.parseFromSlice(std.json.Value, allocator, content, .{});
+    defer parsed.deinit();
+    const commands = try hookCommands(allocator, parsed.value, "Stop");
+    defer allocator.free(commands);
+    try testing.expectEqualStrings("cchd --server http://localhost:8080/hook --user-id 'it'\\''s me'", commands[0]);
+}
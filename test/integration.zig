@@ -257,7 +257,7 @@ fn testGoTemplate(allocator: std.mem.Allocator) !void {
     allocator.free(go_check.stdout);
     allocator.free(go_check.stderr);
 
-    var server = try startServer(allocator, &[_][]const u8{ "go", "run", "templates/quickstart-go.go" }, 8080, "Go Template");
+    var server = try startServer(allocator, &[_][]const u8{ "go", "-C", "templates", "run", "." }, 8080, "Go Template");
     defer stopServer(&server);
 
     try runTemplateTests(allocator, "Go Template");
@@ -9,6 +9,8 @@ const testing = std.testing;
 pub const integration = @import("integration.zig");
 pub const init = @import("init.zig");
 pub const init_unit = @import("init_unit.zig");
+pub const install = @import("install.zig");
+pub const dispatcher = @import("dispatcher.zig");
 
 test "cchd test suite" {
     std.debug.print("\n🧪 CCHD Complete Test Suite\n", .{});